@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"fmt"
 	"monkey/token"
+	"strconv"
 	"strings"
 )
 
@@ -36,13 +37,43 @@ func (p *Program) TokenLiteral() string {
 	}
 }
 func (p *Program) String() string {
+	return joinStatements(p.Statements)
+}
+
+// String() 输出合法的 Monkey 源码, 重新解析得到等价的语法树;
+// 表达式语句后面还有语句时补上 `;`, 避免与下一条语句连在一起被解析
+func joinStatements(stmts []Statement) string {
 	var out bytes.Buffer
-	for _, s := range p.Statements {
+	for i, s := range stmts {
 		out.WriteString(s.String())
+		if _, ok := s.(*ExpressionStatement); ok && i < len(stmts)-1 {
+			out.WriteString(";")
+		}
 	}
 	return out.String()
 }
 
+// if/while 等的条件需要括号; 前缀、中缀和索引表达式自带括号
+func parenthesize(exp Expression) string {
+	switch exp := exp.(type) {
+	case *PrefixExpression, *IndexExpression, *SliceExpression:
+		return exp.String()
+	case *InfixExpression:
+		if exp.Operator != token.DOT {
+			return exp.String()
+		}
+	}
+	return "(" + exp.String() + ")"
+}
+
+// { stmt; stmt }
+func blockString(block *BlockStatement) string {
+	if block == nil || len(block.Statements) == 0 {
+		return "{ }"
+	}
+	return "{ " + block.String() + " }"
+}
+
 // let语句
 type LetStatement struct {
 	Token token.Token
@@ -54,9 +85,18 @@ func (let *LetStatement) statementNode() {}
 func (let *LetStatement) TokenLiteral() string {
 	return let.Token.Literal
 }
+
+// const NAME = expr;
+func (let *LetStatement) IsConst() bool {
+	return let.Token.Type == token.CONST
+}
 func (let *LetStatement) String() string {
 	var out bytes.Buffer
-	out.WriteString(let.TokenLiteral() + " ")
+	if let.IsConst() {
+		out.WriteString("const ")
+	} else {
+		out.WriteString("let ")
+	}
 	out.WriteString(let.Name.String())
 	out.WriteString(" = ")
 
@@ -93,9 +133,9 @@ func (rs *ReturnStatement) TokenLiteral() string {
 }
 func (rs *ReturnStatement) String() string {
 	var out bytes.Buffer
-	out.WriteString(rs.TokenLiteral() + " ")
+	out.WriteString("return")
 	if rs.ReturnValue != nil {
-		out.WriteString(rs.ReturnValue.String())
+		out.WriteString(" " + rs.ReturnValue.String())
 	}
 	out.WriteString(";")
 	return out.String()
@@ -112,20 +152,14 @@ func (w *WhileStatement) TokenLiteral() string {
 	return w.Token.Literal
 }
 func (w *WhileStatement) String() string {
-	var out bytes.Buffer
-	out.WriteString(w.TokenLiteral() + " ")
-	out.WriteString("(")
-	out.WriteString(w.Condition.String())
-	out.WriteString(") {\n")
-	out.WriteString(w.Body.String())
-	out.WriteString("\n}")
-	return out.String()
+	return "while " + parenthesize(w.Condition) + " " + blockString(w.Body)
 }
 
 type AssignExpression struct {
-	Token token.Token
-	Left  Expression
-	Value Expression
+	Token    token.Token
+	Left     Expression
+	Operator string // = += -= *= /=
+	Value    Expression
 }
 
 // func (assign *AssignExpression) statementNode()  {}
@@ -133,18 +167,46 @@ func (assign *AssignExpression) expressionNode() {}
 func (assign *AssignExpression) TokenLiteral() string {
 	return assign.Left.TokenLiteral()
 }
+
+// 赋值只能作为语句出现, 不需要括号
 func (assign *AssignExpression) String() string {
 	var out bytes.Buffer
+	operator := assign.Operator
+	if operator == "" {
+		operator = token.ASSIGN
+	}
 	out.WriteString(assign.Left.String())
-	out.WriteString(" = ")
+	out.WriteString(" " + operator + " ")
 
 	if assign.Value != nil {
 		out.WriteString(assign.Value.String())
 	}
-	out.WriteString(";")
 	return out.String()
 }
 
+// a += b 中的 +, 普通赋值返回空字符串
+func (assign *AssignExpression) CompoundOperator() string {
+	if assign.Operator == "" || assign.Operator == token.ASSIGN {
+		return ""
+	}
+	return strings.TrimSuffix(assign.Operator, token.ASSIGN)
+}
+
+// a += b 展开为 a = a + b, 返回实际要写入的值表达式;
+// 只适用于变量, a[f()] += 1 展开后会把 a 和 f() 求值两次
+func (assign *AssignExpression) ExpandedValue() Expression {
+	operator := assign.CompoundOperator()
+	if operator == "" {
+		return assign.Value
+	}
+	return &InfixExpression{
+		Token:    assign.Token,
+		Left:     assign.Left,
+		Operator: operator,
+		Right:    assign.Value,
+	}
+}
+
 type ThisLiteral struct {
 	Token token.Token
 	Value string
@@ -172,16 +234,14 @@ func (f *ForStatement) TokenLiteral() string {
 }
 func (f *ForStatement) String() string {
 	var out bytes.Buffer
-	out.WriteString(f.TokenLiteral() + " ")
-	out.WriteString("(")
+	out.WriteString("for (")
 	out.WriteString(f.LetStmt.String())
-	out.WriteString(";")
+	out.WriteString(" ")
 	out.WriteString(f.Condition.String())
-	out.WriteString(";")
+	out.WriteString("; ")
 	out.WriteString(f.Inc.String())
-	out.WriteString(") {\n")
-	out.WriteString(f.Body.String())
-	out.WriteString("\n}")
+	out.WriteString(") ")
+	out.WriteString(blockString(f.Body))
 	return out.String()
 }
 
@@ -216,7 +276,7 @@ func (il *IntegerLiteral) TokenLiteral() string {
 	return il.Token.Literal
 }
 func (il *IntegerLiteral) String() string {
-	return il.Token.Literal
+	return strconv.FormatInt(il.Value, 10)
 }
 
 // prefix expression
@@ -252,6 +312,10 @@ func (ie *InfixExpression) TokenLiteral() string {
 	return ie.Token.Literal
 }
 func (ie *InfixExpression) String() string {
+	// obj.name 的优先级最高, 不需要括号
+	if ie.Operator == token.DOT {
+		return ie.Left.String() + "." + ie.Right.String()
+	}
 	var out bytes.Buffer
 	out.WriteString("(")
 	out.WriteString(ie.Left.String())
@@ -272,7 +336,7 @@ func (b *Boolean) TokenLiteral() string {
 	return b.Token.Literal
 }
 func (b *Boolean) String() string {
-	return b.Token.Literal
+	return strconv.FormatBool(b.Value)
 }
 
 // if expression
@@ -289,15 +353,13 @@ func (ife *IfExpression) TokenLiteral() string {
 }
 func (ife *IfExpression) String() string {
 	var out bytes.Buffer
-	out.WriteString("  if")
-	out.WriteString(ife.Condition.String())
-	out.WriteString(" {\n  ")
-	out.WriteString(ife.Consequence.String())
-	out.WriteString("\n  }")
+	out.WriteString("if ")
+	out.WriteString(parenthesize(ife.Condition))
+	out.WriteString(" ")
+	out.WriteString(blockString(ife.Consequence))
 	if ife.Alternative != nil {
-		out.WriteString("else {\n  ")
-		out.WriteString(ife.Alternative.String())
-		out.WriteString(" \n  }")
+		out.WriteString(" else ")
+		out.WriteString(blockString(ife.Alternative))
 	}
 	return out.String()
 }
@@ -305,14 +367,12 @@ func (ife *IfExpression) String() string {
 type BlockStatement struct {
 	Token      token.Token
 	Statements []Statement
+	Rbrace     token.Position // }
 }
 
+// 只输出块内的语句, 花括号由所在的 if/fn/while 等输出
 func (bs *BlockStatement) String() string {
-	var out bytes.Buffer
-	for _, s := range bs.Statements {
-		out.WriteString(s.String())
-	}
-	return out.String()
+	return joinStatements(bs.Statements)
 }
 func (bs *BlockStatement) statementNode() {}
 func (bs *BlockStatement) TokenLiteral() string {
@@ -337,17 +397,11 @@ func (fl *FunctionLiteral) String() string {
 	for _, p := range fl.Parameters {
 		params = append(params, p.String())
 	}
-	// out.WriteString(" ")
-	out.WriteString(fl.TokenLiteral())
-	if fl.Name != "" {
-		out.WriteString(fmt.Sprintf("<%s>", fl.Name))
-	}
-	out.WriteString("(")
+	// Name 由 let 绑定得到, 不出现在源码中
+	out.WriteString("fn(")
 	out.WriteString(strings.Join(params, ", "))
-	out.WriteString(")")
-	out.WriteString("{ ")
-	out.WriteString(fl.Body.String())
-	out.WriteString(" }")
+	out.WriteString(") ")
+	out.WriteString(blockString(fl.Body))
 	return out.String()
 }
 
@@ -369,14 +423,10 @@ func (class *ClassStmt) TokenLiteral() string {
 func (class *ClassStmt) String() string {
 	var out bytes.Buffer
 
+	out.WriteString("class ")
+	out.WriteString(class.Name.String())
 	out.WriteString(" ")
-	out.WriteString(class.TokenLiteral())
-	if class.Name.Value != "" {
-		out.WriteString(fmt.Sprintf("<%s>", class.Name))
-	}
-	out.WriteString("{ ")
-	out.WriteString(class.Body.String())
-	out.WriteString(" }")
+	out.WriteString(blockString(class.Body))
 	return out.String()
 }
 
@@ -385,6 +435,7 @@ type CallExpression struct {
 	Token     token.Token
 	Function  Expression //ident or function literal
 	Arguments []Expression
+	Rparen    token.Position // )
 }
 
 func (call *CallExpression) expressionNode() {}
@@ -415,13 +466,16 @@ func (sl *StringLiteral) expressionNode() {}
 func (sl *StringLiteral) TokenLiteral() string {
 	return sl.Token.Literal
 }
+
+// Value 保存引号之间的原始内容 (包括转义), 直接加上引号即可还原
 func (sl *StringLiteral) String() string {
-	return sl.Token.Literal
+	return `"` + sl.Value + `"`
 }
 
 type ArrayLiteral struct {
 	Token    token.Token
 	Elements []Expression
+	Rbracket token.Position // ]
 }
 
 func (al *ArrayLiteral) expressionNode() {}
@@ -444,9 +498,10 @@ func (al *ArrayLiteral) String() string {
 }
 
 type IndexExpression struct {
-	Token token.Token
-	Left  Expression
-	Index Expression
+	Token    token.Token
+	Left     Expression
+	Index    Expression
+	Rbracket token.Position // ]
 }
 
 func (ie *IndexExpression) expressionNode() {}
@@ -465,9 +520,46 @@ func (ie *IndexExpression) String() string {
 	return out.String()
 }
 
+// left[start:end:step], 省略的部分为 nil
+type SliceExpression struct {
+	Token    token.Token // [
+	Left     Expression
+	Start    Expression
+	End      Expression
+	Step     Expression
+	Rbracket token.Position // ]
+}
+
+func (se *SliceExpression) expressionNode() {}
+func (se *SliceExpression) TokenLiteral() string {
+	return se.Token.Literal
+}
+func (se *SliceExpression) String() string {
+	var out bytes.Buffer
+
+	out.WriteString("(")
+	out.WriteString(se.Left.String())
+	out.WriteString("[")
+	if se.Start != nil {
+		out.WriteString(se.Start.String())
+	}
+	out.WriteString(":")
+	if se.End != nil {
+		out.WriteString(se.End.String())
+	}
+	if se.Step != nil {
+		out.WriteString(":")
+		out.WriteString(se.Step.String())
+	}
+	out.WriteString("])")
+
+	return out.String()
+}
+
 type HashLiteral struct {
-	Token token.Token
-	Pairs map[Expression]Expression
+	Token  token.Token
+	Pairs  map[Expression]Expression
+	Rbrace token.Position // }
 }
 
 func (hl *HashLiteral) expressionNode() {}
@@ -477,12 +569,12 @@ func (hl *HashLiteral) TokenLiteral() string {
 func (hl *HashLiteral) String() string {
 	var out bytes.Buffer
 
-	paris := []string{}
-	for key, value := range hl.Pairs {
-		paris = append(paris, key.String()+":"+value.String())
+	pairs := []string{}
+	for _, key := range SortedHashKeys(hl) {
+		pairs = append(pairs, key.String()+": "+hl.Pairs[key].String())
 	}
 	out.WriteString("{")
-	out.WriteString(strings.Join(paris, ","))
+	out.WriteString(strings.Join(pairs, ", "))
 	out.WriteString("}")
 
 	return out.String()
@@ -505,13 +597,10 @@ func (m *MacroLiteral) String() string {
 	for _, p := range m.Parameters {
 		params = append(params, p.String())
 	}
-	out.WriteString(m.TokenLiteral())
-	out.WriteString("(")
+	out.WriteString("macro(")
 	out.WriteString(strings.Join(params, ", "))
-	out.WriteString(")")
-	// out.WriteString("{")
-	out.WriteString(m.Body.String())
-	// out.WriteString("}")
+	out.WriteString(") ")
+	out.WriteString(blockString(m.Body))
 
 	return out.String()
 }
@@ -45,7 +45,7 @@ func TestAssignStatement(t *testing.T) {
 			},
 		},
 	}
-	if program.String() != "foo = 6;" {
+	if program.String() != "foo = 6" {
 		t.Errorf("program.String() wrong: got='%s'", program.String())
 	}
 }
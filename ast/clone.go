@@ -0,0 +1,196 @@
+package ast
+
+// 深拷贝节点及其全部子节点, 拷贝与原树不共享任何节点,
+// 修改其中一棵 (例如 Modify) 不会影响另一棵; Token 和位置信息原样保留
+func Clone(node Node) Node {
+	if isNilNode(node) {
+		return nil
+	}
+
+	switch node := node.(type) {
+	case *Program:
+		return &Program{Statements: cloneStatements(node.Statements)}
+	case *LetStatement:
+		return cloneLetStatement(node)
+	case *ReturnStatement:
+		c := *node
+		c.ReturnValue = cloneExpression(node.ReturnValue)
+		return &c
+	case *ExpressionStatement:
+		return cloneExpressionStatement(node)
+	case *BlockStatement:
+		return cloneBlock(node)
+	case *WhileStatement:
+		c := *node
+		c.Condition = cloneExpression(node.Condition)
+		c.Body = cloneBlock(node.Body)
+		return &c
+	case *ForStatement:
+		c := *node
+		c.LetStmt = cloneLetStatement(node.LetStmt)
+		c.Condition = cloneExpression(node.Condition)
+		c.Inc = cloneExpressionStatement(node.Inc)
+		c.Body = cloneBlock(node.Body)
+		return &c
+	case *ClassStmt:
+		c := *node
+		c.Name = cloneIdentifier(node.Name)
+		c.Body = cloneBlock(node.Body)
+		return &c
+	case *AssignExpression:
+		c := *node
+		c.Left = cloneExpression(node.Left)
+		c.Value = cloneExpression(node.Value)
+		return &c
+	case *PrefixExpression:
+		c := *node
+		c.Right = cloneExpression(node.Right)
+		return &c
+	case *InfixExpression:
+		c := *node
+		c.Left = cloneExpression(node.Left)
+		c.Right = cloneExpression(node.Right)
+		return &c
+	case *IfExpression:
+		c := *node
+		c.Condition = cloneExpression(node.Condition)
+		c.Consequence = cloneBlock(node.Consequence)
+		c.Alternative = cloneBlock(node.Alternative)
+		return &c
+	case *FunctionLiteral:
+		c := *node
+		c.Parameters = cloneIdentifiers(node.Parameters)
+		c.Body = cloneBlock(node.Body)
+		return &c
+	case *MacroLiteral:
+		c := *node
+		c.Parameters = cloneIdentifiers(node.Parameters)
+		c.Body = cloneBlock(node.Body)
+		return &c
+	case *CallExpression:
+		c := *node
+		c.Function = cloneExpression(node.Function)
+		c.Arguments = cloneExpressions(node.Arguments)
+		return &c
+	case *ArrayLiteral:
+		c := *node
+		c.Elements = cloneExpressions(node.Elements)
+		return &c
+	case *IndexExpression:
+		c := *node
+		c.Left = cloneExpression(node.Left)
+		c.Index = cloneExpression(node.Index)
+		return &c
+	case *SliceExpression:
+		c := *node
+		c.Left = cloneExpression(node.Left)
+		c.Start = cloneExpression(node.Start)
+		c.End = cloneExpression(node.End)
+		c.Step = cloneExpression(node.Step)
+		return &c
+	case *HashLiteral:
+		c := *node
+		// 键是指针, 拷贝后的键必须是新节点, 否则两个 map 会共享同一个键
+		if node.Pairs != nil {
+			c.Pairs = make(map[Expression]Expression, len(node.Pairs))
+			for key, value := range node.Pairs {
+				c.Pairs[cloneExpression(key)] = cloneExpression(value)
+			}
+		}
+		return &c
+	case *Identifier:
+		return cloneIdentifier(node)
+	case *IntegerLiteral:
+		c := *node
+		return &c
+	case *StringLiteral:
+		c := *node
+		return &c
+	case *Boolean:
+		c := *node
+		return &c
+	case *ThisLiteral:
+		c := *node
+		return &c
+	default:
+		return node
+	}
+}
+
+func cloneExpression(exp Expression) Expression {
+	if isNilNode(exp) {
+		return nil
+	}
+	return Clone(exp).(Expression)
+}
+
+func cloneExpressions(exps []Expression) []Expression {
+	if exps == nil {
+		return nil
+	}
+	result := make([]Expression, len(exps))
+	for i, exp := range exps {
+		result[i] = cloneExpression(exp)
+	}
+	return result
+}
+
+func cloneStatements(stmts []Statement) []Statement {
+	if stmts == nil {
+		return nil
+	}
+	result := make([]Statement, len(stmts))
+	for i, stmt := range stmts {
+		if !isNilNode(stmt) {
+			result[i] = Clone(stmt).(Statement)
+		}
+	}
+	return result
+}
+
+func cloneBlock(block *BlockStatement) *BlockStatement {
+	if block == nil {
+		return nil
+	}
+	c := *block
+	c.Statements = cloneStatements(block.Statements)
+	return &c
+}
+
+func cloneIdentifier(ident *Identifier) *Identifier {
+	if ident == nil {
+		return nil
+	}
+	c := *ident
+	return &c
+}
+
+func cloneIdentifiers(idents []*Identifier) []*Identifier {
+	if idents == nil {
+		return nil
+	}
+	result := make([]*Identifier, len(idents))
+	for i, ident := range idents {
+		result[i] = cloneIdentifier(ident)
+	}
+	return result
+}
+
+func cloneLetStatement(let *LetStatement) *LetStatement {
+	if let == nil {
+		return nil
+	}
+	c := *let
+	c.Name = cloneIdentifier(let.Name)
+	c.Value = cloneExpression(let.Value)
+	return &c
+}
+
+func cloneExpressionStatement(stmt *ExpressionStatement) *ExpressionStatement {
+	if stmt == nil {
+		return nil
+	}
+	c := *stmt
+	c.Expression = cloneExpression(stmt.Expression)
+	return &c
+}
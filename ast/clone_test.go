@@ -0,0 +1,107 @@
+package ast_test
+
+import (
+	"bytes"
+	"monkey/ast"
+	"monkey/token"
+	"testing"
+)
+
+func TestCloneIsDeepAndEqual(t *testing.T) {
+	input := `
+let add = fn(a, b) { return a + b; };
+const limit = 10;
+let items = [1, "two", true, -3][1:3];
+let h = {"a": 1, "b": [2]};
+h.a += items[0];
+while (limit > 0) { limit = limit - 1; }
+for (let i = 0; i < 3; i = i + 1) { puts(i); }
+class Point { let init = fn(x) { this.x = x; }; }
+if (!false) { add(1, 2) } else { h["b"][::-1] }
+let m = macro(x) { quote(unquote(x)); };
+`
+	program := parseProgram(t, input)
+	clone := ast.Clone(program).(*ast.Program)
+
+	if clone.String() != program.String() {
+		t.Errorf("clone differs.\nwant=%q\ngot=%q", program.String(), clone.String())
+	}
+
+	// 位置信息也要保留
+	want, err := ast.MarshalJSON(program)
+	if err != nil {
+		t.Fatalf("marshal failed: %s", err)
+	}
+	got, err := ast.MarshalJSON(clone)
+	if err != nil {
+		t.Fatalf("marshal failed: %s", err)
+	}
+	if !bytes.Equal(want, got) {
+		t.Errorf("clone json differs from original")
+	}
+
+	original := map[ast.Node]bool{}
+	ast.Inspect(program, func(node ast.Node) bool {
+		original[node] = true
+		return true
+	})
+	count := 0
+	ast.Inspect(clone, func(node ast.Node) bool {
+		count++
+		if original[node] {
+			t.Errorf("clone shares node %T %q with original", node, node.String())
+		}
+		return true
+	})
+	if count != len(original) {
+		t.Errorf("wrong number of nodes in clone. want=%d, got=%d", len(original), count)
+	}
+}
+
+func TestModifyCloneLeavesOriginal(t *testing.T) {
+	program := parseProgram(t, `let f = fn(x) { [x, {x: x}][0] + 1 };`)
+	before := program.String()
+
+	turnOneIntoTwo := func(node ast.Node) ast.Node {
+		if integer, ok := node.(*ast.IntegerLiteral); ok && integer.Value == 1 {
+			integer.Value = 2
+		}
+		if ident, ok := node.(*ast.Identifier); ok && ident.Value == "x" {
+			ident.Value = "y"
+		}
+		return node
+	}
+
+	first := ast.Modify(ast.Clone(program), turnOneIntoTwo)
+	second := ast.Modify(ast.Clone(program), turnOneIntoTwo)
+
+	if program.String() != before {
+		t.Errorf("original was modified. got=%q", program.String())
+	}
+	want := "let f = fn(y) { (([y, {y: y}][0]) + 2) };"
+	for _, modified := range []ast.Node{first, second} {
+		if modified.String() != want {
+			t.Errorf("wrong modified program. want=%q, got=%q", want, modified.String())
+		}
+	}
+}
+
+func TestCloneNil(t *testing.T) {
+	if ast.Clone(nil) != nil {
+		t.Errorf("Clone(nil) should be nil")
+	}
+	var ident *ast.Identifier
+	if ast.Clone(ident) != nil {
+		t.Errorf("Clone of nil pointer should be nil")
+	}
+
+	// 可选的子节点保持为 nil
+	slice := &ast.SliceExpression{
+		Token: token.Token{Type: token.LBRACKET, Literal: "["},
+		Left:  &ast.Identifier{Value: "a"},
+	}
+	clone := ast.Clone(slice).(*ast.SliceExpression)
+	if clone.Start != nil || clone.End != nil || clone.Step != nil {
+		t.Errorf("omitted slice bounds should stay nil. got=%q", clone.String())
+	}
+}
@@ -0,0 +1,537 @@
+package ast
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"monkey/token"
+	"sort"
+	"strings"
+)
+
+// JSON 中的一个节点:
+//
+//	{
+//	  "kind": "InfixExpression",
+//	  "span": {"start": {...}, "end": {...}},
+//	  "token": {"type": "+", "literal": "+", "start": {...}, "end": {...}},
+//	  "operator": "+",
+//	  "children": {"left": {...}, "right": {...}}
+//	}
+//
+// span 由 token 位置推导, 反序列化时忽略; close 是 } ) ] 的位置
+type jsonNode struct {
+	Kind     string                 `json:"kind"`
+	Span     *jsonSpan              `json:"span,omitempty"`
+	Token    *jsonToken             `json:"token,omitempty"`
+	Value    json.RawMessage        `json:"value,omitempty"`
+	Operator string                 `json:"operator,omitempty"`
+	Name     string                 `json:"name,omitempty"`
+	Close    *token.Position        `json:"close,omitempty"`
+	Children map[string]interface{} `json:"children,omitempty"`
+}
+
+type jsonSpan struct {
+	Start token.Position `json:"start"`
+	End   token.Position `json:"end"`
+}
+
+type jsonToken struct {
+	Type    token.TokenType `json:"type"`
+	Literal string          `json:"literal"`
+	Start   token.Position  `json:"start"`
+	End     token.Position  `json:"end"`
+}
+
+type jsonPair struct {
+	Key   *jsonNode `json:"key"`
+	Value *jsonNode `json:"value"`
+}
+
+// 序列化整个程序
+func MarshalJSON(program *Program) ([]byte, error) {
+	node, err := encodeNode(program)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(node)
+}
+
+func encodeNode(node Node) (*jsonNode, error) {
+	if isNilNode(node) {
+		return nil, nil
+	}
+
+	out := &jsonNode{Kind: strings.TrimPrefix(fmt.Sprintf("%T", node), "*ast."), Children: map[string]interface{}{}}
+	// 与 Span 的结果相同, 但由子节点的范围合并得到, 不必为每个节点重新遍历子树
+	extend := func(start, end token.Position) {
+		if !start.IsValid() {
+			return
+		}
+		if out.Span == nil {
+			out.Span = &jsonSpan{Start: start, End: end}
+			return
+		}
+		if start.Offset < out.Span.Start.Offset {
+			out.Span.Start = start
+		}
+		if end.Offset > out.Span.End.Offset {
+			out.Span.End = end
+		}
+	}
+	if tok, ok := nodeToken(node); ok {
+		out.Token = &jsonToken{Type: tok.Type, Literal: tok.Literal, Start: tok.Pos, End: tok.End}
+		extend(tok.Pos, tok.End)
+	}
+	if pos := closingPosition(node); pos.IsValid() {
+		out.Close = &pos
+		extend(pos, token.Position{Offset: pos.Offset + 1, Line: pos.Line, Column: pos.Column + 1})
+	}
+
+	var err error
+	encode := func(n Node) *jsonNode {
+		var encoded *jsonNode
+		encoded, err = encodeNode(n)
+		if encoded != nil && encoded.Span != nil {
+			extend(encoded.Span.Start, encoded.Span.End)
+		}
+		return encoded
+	}
+	value := func(v interface{}) {
+		out.Value, err = json.Marshal(v)
+	}
+	child := func(key string, n Node) {
+		if err != nil {
+			return
+		}
+		out.Children[key] = encode(n)
+	}
+	list := func(key string, length int, at func(int) Node) {
+		items := []*jsonNode{}
+		for i := 0; i < length && err == nil; i++ {
+			items = append(items, encode(at(i)))
+		}
+		out.Children[key] = items
+	}
+
+	switch node := node.(type) {
+	case *Program:
+		list("statements", len(node.Statements), func(i int) Node { return node.Statements[i] })
+	case *LetStatement:
+		child("name", node.Name)
+		child("value", node.Value)
+	case *Identifier:
+		value(node.Value)
+	case *ReturnStatement:
+		child("returnValue", node.ReturnValue)
+	case *WhileStatement:
+		child("condition", node.Condition)
+		child("body", node.Body)
+	case *AssignExpression:
+		out.Operator = node.Operator
+		child("left", node.Left)
+		child("value", node.Value)
+	case *ThisLiteral:
+		value(node.Value)
+	case *ForStatement:
+		child("let", node.LetStmt)
+		child("condition", node.Condition)
+		child("inc", node.Inc)
+		child("body", node.Body)
+	case *ExpressionStatement:
+		child("expression", node.Expression)
+	case *IntegerLiteral:
+		value(node.Value)
+	case *PrefixExpression:
+		out.Operator = node.Operator
+		child("right", node.Right)
+	case *InfixExpression:
+		out.Operator = node.Operator
+		child("left", node.Left)
+		child("right", node.Right)
+	case *Boolean:
+		value(node.Value)
+	case *IfExpression:
+		child("condition", node.Condition)
+		child("consequence", node.Consequence)
+		child("alternative", node.Alternative)
+	case *BlockStatement:
+		list("statements", len(node.Statements), func(i int) Node { return node.Statements[i] })
+	case *FunctionLiteral:
+		out.Name = node.Name
+		list("parameters", len(node.Parameters), func(i int) Node { return node.Parameters[i] })
+		child("body", node.Body)
+	case *ClassStmt:
+		child("name", node.Name)
+		child("body", node.Body)
+	case *CallExpression:
+		child("function", node.Function)
+		list("arguments", len(node.Arguments), func(i int) Node { return node.Arguments[i] })
+	case *StringLiteral:
+		value(node.Value)
+	case *ArrayLiteral:
+		list("elements", len(node.Elements), func(i int) Node { return node.Elements[i] })
+	case *IndexExpression:
+		child("left", node.Left)
+		child("index", node.Index)
+	case *SliceExpression:
+		child("left", node.Left)
+		child("start", node.Start)
+		child("end", node.End)
+		child("step", node.Step)
+	case *HashLiteral:
+		pairs := []jsonPair{}
+		for _, key := range SortedHashKeys(node) {
+			if err != nil {
+				break
+			}
+			var pair jsonPair
+			if pair.Key = encode(key); err != nil {
+				break
+			}
+			pair.Value = encode(node.Pairs[key])
+			pairs = append(pairs, pair)
+		}
+		out.Children["pairs"] = pairs
+	case *MacroLiteral:
+		list("parameters", len(node.Parameters), func(i int) Node { return node.Parameters[i] })
+		child("body", node.Body)
+	default:
+		return nil, fmt.Errorf("ast json: unsupported node %T", node)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+	if len(out.Children) == 0 {
+		out.Children = nil
+	}
+	return out, nil
+}
+
+// 哈希字面量的键按源码位置排序, 没有位置时按 String() 排序
+func SortedHashKeys(hash *HashLiteral) []Expression {
+	// 排序前算好每个键的位置和字符串, 比较时不再遍历键的子树
+	type sortKey struct {
+		key    Expression
+		offset int
+		text   string
+	}
+	sorted := make([]sortKey, 0, len(hash.Pairs))
+	for key := range hash.Pairs {
+		start, _ := Span(key)
+		sorted = append(sorted, sortKey{key: key, offset: start.Offset, text: key.String()})
+	}
+	sort.SliceStable(sorted, func(i, j int) bool {
+		if sorted[i].offset != sorted[j].offset {
+			return sorted[i].offset < sorted[j].offset
+		}
+		return sorted[i].text < sorted[j].text
+	})
+
+	keys := make([]Expression, len(sorted))
+	for i, k := range sorted {
+		keys[i] = k.key
+	}
+	return keys
+}
+
+// 反序列化时读取的节点
+type rawNode struct {
+	Kind     string                     `json:"kind"`
+	Token    *jsonToken                 `json:"token"`
+	Value    json.RawMessage            `json:"value"`
+	Operator string                     `json:"operator"`
+	Name     string                     `json:"name"`
+	Close    *token.Position            `json:"close"`
+	Children map[string]json.RawMessage `json:"children"`
+}
+
+type rawPair struct {
+	Key   json.RawMessage `json:"key"`
+	Value json.RawMessage `json:"value"`
+}
+
+// 从 MarshalJSON 的输出重建程序
+func UnmarshalJSON(data []byte) (*Program, error) {
+	d := &jsonDecoder{}
+	node := d.node(data)
+	if d.err != nil {
+		return nil, d.err
+	}
+	program, ok := node.(*Program)
+	if !ok {
+		return nil, fmt.Errorf("ast json: expected Program, got %T", node)
+	}
+	return program, nil
+}
+
+// 第一个错误之后的解码都被跳过
+type jsonDecoder struct {
+	err error
+}
+
+func (d *jsonDecoder) fail(format string, a ...interface{}) {
+	if d.err == nil {
+		d.err = fmt.Errorf("ast json: "+format, a...)
+	}
+}
+
+// 解析器总会填上的子节点, 缺少时后续的编译和求值会解引用 nil
+var requiredChildren = map[string][]string{
+	"LetStatement":        {"name", "value"},
+	"ReturnStatement":     {"returnValue"},
+	"WhileStatement":      {"condition", "body"},
+	"AssignExpression":    {"left", "value"},
+	"ForStatement":        {"let", "condition", "inc", "body"},
+	"ExpressionStatement": {"expression"},
+	"PrefixExpression":    {"right"},
+	"InfixExpression":     {"left", "right"},
+	"IfExpression":        {"condition", "consequence"},
+	"FunctionLiteral":     {"body"},
+	"ClassStmt":           {"name", "body"},
+	"CallExpression":      {"function"},
+	"IndexExpression":     {"left", "index"},
+	"SliceExpression":     {"left"},
+	"MacroLiteral":        {"body"},
+}
+
+func isJSONNull(data []byte) bool {
+	data = bytes.TrimSpace(data)
+	return len(data) == 0 || string(data) == "null"
+}
+
+func (d *jsonDecoder) node(data []byte) Node {
+	if d.err != nil || isJSONNull(data) {
+		return nil
+	}
+
+	var raw rawNode
+	if err := json.Unmarshal(data, &raw); err != nil {
+		d.fail("%s", err)
+		return nil
+	}
+
+	var tok token.Token
+	if raw.Token != nil {
+		tok = token.Token{Type: raw.Token.Type, Literal: raw.Token.Literal, Pos: raw.Token.Start, End: raw.Token.End}
+	}
+	var closing token.Position
+	if raw.Close != nil {
+		closing = *raw.Close
+	}
+	children := raw.Children
+	for _, key := range requiredChildren[raw.Kind] {
+		if isJSONNull(children[key]) {
+			d.fail("%s: missing %s", raw.Kind, key)
+			return nil
+		}
+	}
+
+	switch raw.Kind {
+	case "Program":
+		return &Program{Statements: d.statements(children, "statements")}
+	case "LetStatement":
+		return &LetStatement{Token: tok, Name: d.identifier(children, "name"), Value: d.expression(children, "value")}
+	case "Identifier":
+		node := &Identifier{Token: tok}
+		d.value(raw, &node.Value)
+		return node
+	case "ReturnStatement":
+		return &ReturnStatement{Token: tok, ReturnValue: d.expression(children, "returnValue")}
+	case "WhileStatement":
+		return &WhileStatement{Token: tok, Condition: d.expression(children, "condition"), Body: d.block(children, "body")}
+	case "AssignExpression":
+		return &AssignExpression{Token: tok, Operator: raw.Operator, Left: d.expression(children, "left"), Value: d.expression(children, "value")}
+	case "ThisLiteral":
+		node := &ThisLiteral{Token: tok}
+		d.value(raw, &node.Value)
+		return node
+	case "ForStatement":
+		node := &ForStatement{Token: tok, Condition: d.expression(children, "condition"), Body: d.block(children, "body")}
+		if let := d.child(children, "let"); let != nil {
+			var ok bool
+			if node.LetStmt, ok = let.(*LetStatement); !ok {
+				d.fail("let: expected LetStatement, got %T", let)
+			}
+		}
+		if inc := d.child(children, "inc"); inc != nil {
+			var ok bool
+			if node.Inc, ok = inc.(*ExpressionStatement); !ok {
+				d.fail("inc: expected ExpressionStatement, got %T", inc)
+			}
+		}
+		return node
+	case "ExpressionStatement":
+		return &ExpressionStatement{Token: tok, Expression: d.expression(children, "expression")}
+	case "IntegerLiteral":
+		node := &IntegerLiteral{Token: tok}
+		d.value(raw, &node.Value)
+		return node
+	case "PrefixExpression":
+		return &PrefixExpression{Token: tok, Operator: raw.Operator, Right: d.expression(children, "right")}
+	case "InfixExpression":
+		return &InfixExpression{Token: tok, Operator: raw.Operator, Left: d.expression(children, "left"), Right: d.expression(children, "right")}
+	case "Boolean":
+		node := &Boolean{Token: tok}
+		d.value(raw, &node.Value)
+		return node
+	case "IfExpression":
+		return &IfExpression{
+			Token:       tok,
+			Condition:   d.expression(children, "condition"),
+			Consequence: d.block(children, "consequence"),
+			Alternative: d.block(children, "alternative"),
+		}
+	case "BlockStatement":
+		return &BlockStatement{Token: tok, Statements: d.statements(children, "statements"), Rbrace: closing}
+	case "FunctionLiteral":
+		return &FunctionLiteral{Token: tok, Name: raw.Name, Parameters: d.identifiers(children, "parameters"), Body: d.block(children, "body")}
+	case "ClassStmt":
+		return &ClassStmt{Token: tok, Name: d.identifier(children, "name"), Body: d.block(children, "body")}
+	case "CallExpression":
+		return &CallExpression{Token: tok, Function: d.expression(children, "function"), Arguments: d.expressions(children, "arguments"), Rparen: closing}
+	case "StringLiteral":
+		node := &StringLiteral{Token: tok}
+		d.value(raw, &node.Value)
+		return node
+	case "ArrayLiteral":
+		return &ArrayLiteral{Token: tok, Elements: d.expressions(children, "elements"), Rbracket: closing}
+	case "IndexExpression":
+		return &IndexExpression{Token: tok, Left: d.expression(children, "left"), Index: d.expression(children, "index"), Rbracket: closing}
+	case "SliceExpression":
+		return &SliceExpression{
+			Token:    tok,
+			Left:     d.expression(children, "left"),
+			Start:    d.expression(children, "start"),
+			End:      d.expression(children, "end"),
+			Step:     d.expression(children, "step"),
+			Rbracket: closing,
+		}
+	case "HashLiteral":
+		node := &HashLiteral{Token: tok, Pairs: map[Expression]Expression{}, Rbrace: closing}
+		var pairs []rawPair
+		d.unmarshal(children["pairs"], &pairs)
+		for _, pair := range pairs {
+			if isJSONNull(pair.Key) || isJSONNull(pair.Value) {
+				d.fail("HashLiteral.pairs: missing key or value")
+				return nil
+			}
+			key := d.asExpression(d.node(pair.Key), "HashLiteral.pairs")
+			node.Pairs[key] = d.asExpression(d.node(pair.Value), "HashLiteral.pairs")
+		}
+		return node
+	case "MacroLiteral":
+		return &MacroLiteral{Token: tok, Parameters: d.identifiers(children, "parameters"), Body: d.block(children, "body")}
+	default:
+		d.fail("unknown node kind %q", raw.Kind)
+		return nil
+	}
+}
+
+func (d *jsonDecoder) unmarshal(data []byte, v interface{}) {
+	if d.err != nil || isJSONNull(data) {
+		return
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		d.fail("%s", err)
+	}
+}
+
+func (d *jsonDecoder) value(raw rawNode, v interface{}) {
+	if len(raw.Value) == 0 {
+		return
+	}
+	d.unmarshal(raw.Value, v)
+}
+
+func (d *jsonDecoder) child(children map[string]json.RawMessage, key string) Node {
+	return d.node(children[key])
+}
+
+func (d *jsonDecoder) list(children map[string]json.RawMessage, key string) []Node {
+	var items []json.RawMessage
+	d.unmarshal(children[key], &items)
+	nodes := []Node{}
+	for _, item := range items {
+		if isJSONNull(item) {
+			d.fail("%s: null element", key)
+			return nil
+		}
+		nodes = append(nodes, d.node(item))
+	}
+	return nodes
+}
+
+func (d *jsonDecoder) asExpression(node Node, key string) Expression {
+	if node == nil {
+		return nil
+	}
+	exp, ok := node.(Expression)
+	if !ok {
+		d.fail("%s: expected expression, got %T", key, node)
+	}
+	return exp
+}
+
+func (d *jsonDecoder) expression(children map[string]json.RawMessage, key string) Expression {
+	return d.asExpression(d.child(children, key), key)
+}
+
+func (d *jsonDecoder) expressions(children map[string]json.RawMessage, key string) []Expression {
+	exps := []Expression{}
+	for _, node := range d.list(children, key) {
+		exps = append(exps, d.asExpression(node, key))
+	}
+	return exps
+}
+
+func (d *jsonDecoder) statements(children map[string]json.RawMessage, key string) []Statement {
+	stmts := []Statement{}
+	for _, node := range d.list(children, key) {
+		stmt, ok := node.(Statement)
+		if !ok {
+			d.fail("%s: expected statement, got %T", key, node)
+			continue
+		}
+		stmts = append(stmts, stmt)
+	}
+	return stmts
+}
+
+func (d *jsonDecoder) block(children map[string]json.RawMessage, key string) *BlockStatement {
+	node := d.child(children, key)
+	if node == nil {
+		return nil
+	}
+	block, ok := node.(*BlockStatement)
+	if !ok {
+		d.fail("%s: expected BlockStatement, got %T", key, node)
+	}
+	return block
+}
+
+func (d *jsonDecoder) identifier(children map[string]json.RawMessage, key string) *Identifier {
+	node := d.child(children, key)
+	if node == nil {
+		return nil
+	}
+	ident, ok := node.(*Identifier)
+	if !ok {
+		d.fail("%s: expected Identifier, got %T", key, node)
+	}
+	return ident
+}
+
+func (d *jsonDecoder) identifiers(children map[string]json.RawMessage, key string) []*Identifier {
+	idents := []*Identifier{}
+	for _, node := range d.list(children, key) {
+		ident, ok := node.(*Identifier)
+		if !ok {
+			d.fail("%s: expected Identifier, got %T", key, node)
+			continue
+		}
+		idents = append(idents, ident)
+	}
+	return idents
+}
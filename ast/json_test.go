@@ -0,0 +1,190 @@
+package ast_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"monkey/ast"
+	"monkey/lexer"
+	"monkey/parser"
+	"testing"
+)
+
+func parseProgram(t *testing.T, input string) *ast.Program {
+	t.Helper()
+	p := parser.New(lexer.New(input))
+	program := p.ParserProgram()
+	if len(p.Errors()) != 0 {
+		t.Fatalf("parser errors: %v", p.Errors())
+	}
+	return program
+}
+
+func TestJSONRoundTrip(t *testing.T) {
+	input := `
+let add = fn(a, b) { return a + b; };
+const limit = 10;
+let items = [1, "two", true, -3][1:3];
+let h = {"a": 1, "b": [2]};
+h.a += items[0];
+while (limit > 0) { limit = limit - 1; }
+for (let i = 0; i < 3; i = i + 1) { puts(i); }
+class Point { let init = fn(x) { this.x = x; }; }
+if (!false) { add(1, 2) } else { h["b"][::-1] }
+let m = macro(x) { quote(unquote(x)); };
+`
+	program := parseProgram(t, input)
+
+	data, err := ast.MarshalJSON(program)
+	if err != nil {
+		t.Fatalf("marshal failed: %s", err)
+	}
+
+	decoded, err := ast.UnmarshalJSON(data)
+	if err != nil {
+		t.Fatalf("unmarshal failed: %s", err)
+	}
+	if decoded.String() != program.String() {
+		t.Errorf("decoded program differs.\nwant=%q\ngot=%q", program.String(), decoded.String())
+	}
+
+	again, err := ast.MarshalJSON(decoded)
+	if err != nil {
+		t.Fatalf("marshal failed: %s", err)
+	}
+	if !bytes.Equal(data, again) {
+		t.Errorf("json is not stable across a round trip")
+	}
+}
+
+func TestJSONKindAndSpan(t *testing.T) {
+	program := parseProgram(t, "let x = 1;\nf(x, [2])")
+
+	data, err := ast.MarshalJSON(program)
+	if err != nil {
+		t.Fatalf("marshal failed: %s", err)
+	}
+
+	var root struct {
+		Kind     string `json:"kind"`
+		Children struct {
+			Statements []struct {
+				Kind string `json:"kind"`
+				Span struct {
+					Start struct{ Line, Column int }
+					End   struct{ Line, Column int }
+				} `json:"span"`
+			} `json:"statements"`
+		} `json:"children"`
+	}
+	if err := json.Unmarshal(data, &root); err != nil {
+		t.Fatalf("invalid json: %s", err)
+	}
+
+	if root.Kind != "Program" {
+		t.Fatalf("wrong root kind. got=%q", root.Kind)
+	}
+	if len(root.Children.Statements) != 2 {
+		t.Fatalf("wrong number of statements. got=%d", len(root.Children.Statements))
+	}
+
+	tests := []struct {
+		kind                string
+		startLine, startCol int
+		endLine, endCol     int
+	}{
+		{"LetStatement", 1, 1, 1, 10},
+		{"ExpressionStatement", 2, 1, 2, 10},
+	}
+	for i, tt := range tests {
+		stmt := root.Children.Statements[i]
+		if stmt.Kind != tt.kind {
+			t.Errorf("wrong kind. want=%q, got=%q", tt.kind, stmt.Kind)
+		}
+		span := stmt.Span
+		if span.Start.Line != tt.startLine || span.Start.Column != tt.startCol ||
+			span.End.Line != tt.endLine || span.End.Column != tt.endCol {
+			t.Errorf("wrong span for %s. got=%+v", tt.kind, span)
+		}
+	}
+}
+
+// 序列化时合并子节点得到的范围与 ast.Span 一致
+func TestJSONSpanMatchesSpan(t *testing.T) {
+	program := parseProgram(t, `
+let h = {"b": [2, {"c": f(1)}], "a": fn(x) { x }};
+if (h) { h["a"](1) } else { [1, 2][0:1] }
+for (let i = 0; i < 3; i += 1) { puts(i); }
+`)
+
+	data, err := ast.MarshalJSON(program)
+	if err != nil {
+		t.Fatalf("marshal failed: %s", err)
+	}
+	var root struct {
+		Children struct {
+			Statements []struct {
+				Span struct {
+					Start struct{ Offset int }
+					End   struct{ Offset int }
+				} `json:"span"`
+			} `json:"statements"`
+		} `json:"children"`
+	}
+	if err := json.Unmarshal(data, &root); err != nil {
+		t.Fatalf("invalid json: %s", err)
+	}
+
+	for i, stmt := range program.Statements {
+		start, end := ast.Span(stmt)
+		got := root.Children.Statements[i].Span
+		if got.Start.Offset != start.Offset || got.End.Offset != end.Offset {
+			t.Errorf("wrong span for statement %d. want=%d-%d, got=%d-%d",
+				i, start.Offset, end.Offset, got.Start.Offset, got.End.Offset)
+		}
+	}
+}
+
+func TestUnmarshalJSONErrors(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{`{"kind": "Nope"}`, `ast json: unknown node kind "Nope"`},
+		{`{"kind": "IntegerLiteral", "value": 1}`, "ast json: expected Program, got *ast.IntegerLiteral"},
+		{
+			`{"kind": "Program", "children": {"statements": [{"kind": "IntegerLiteral"}]}}`,
+			"ast json: statements: expected statement, got *ast.IntegerLiteral",
+		},
+		// 缺少必需的子节点
+		{`{"kind": "LetStatement", "children": {}}`, "ast json: LetStatement: missing name"},
+		{`{"kind": "FunctionLiteral"}`, "ast json: FunctionLiteral: missing body"},
+		{`{"kind": "ClassStmt"}`, "ast json: ClassStmt: missing name"},
+		{`{"kind": "ForStatement"}`, "ast json: ForStatement: missing let"},
+		{
+			`{"kind": "WhileStatement", "children": {"body": {"kind": "BlockStatement"}}}`,
+			"ast json: WhileStatement: missing condition",
+		},
+		{
+			`{"kind": "Program", "children": {"statements": [{"kind": "ExpressionStatement", "children": {"expression": ` +
+				`{"kind": "CallExpression", "children": {"function": {"kind": "Identifier", "value": "f"}, "arguments": [null]}}}}]}}`,
+			"ast json: arguments: null element",
+		},
+		{`{"kind": "Program", "children": {"statements": [null]}}`, "ast json: statements: null element"},
+		{`{"kind": "HashLiteral", "children": {"pairs": [{}]}}`, "ast json: HashLiteral.pairs: missing key or value"},
+		{
+			`{"kind": "HashLiteral", "children": {"pairs": [{"key": {"kind": "IntegerLiteral", "value": 1}}]}}`,
+			"ast json: HashLiteral.pairs: missing key or value",
+		},
+	}
+
+	for _, tt := range tests {
+		_, err := ast.UnmarshalJSON([]byte(tt.input))
+		if err == nil {
+			t.Errorf("expected error for %s", tt.input)
+			continue
+		}
+		if err.Error() != tt.expected {
+			t.Errorf("wrong error. want=%q, got=%q", tt.expected, err)
+		}
+	}
+}
@@ -1,56 +1,261 @@
 package ast
 
+import "fmt"
+
 type ModifierFunc func(Node) Node
 
-func Modify(node Node, modifier ModifierFunc) Node {
+// 后序遍历所有节点, 用 modifier 的返回值替换原节点;
+// 替换结果与所在位置的类型不符时 (例如语句位置返回了表达式) 返回错误
+func Rewrite(node Node, modifier ModifierFunc) (Node, error) {
+	var err error
+
 	switch node := node.(type) {
 	case *Program:
-		for i, statement := range node.Statements {
-			node.Statements[i] = Modify(statement, modifier).(Statement)
+		for i := range node.Statements {
+			if node.Statements[i], err = rewriteStatement(node.Statements[i], modifier); err != nil {
+				return nil, err
+			}
+		}
+	case *LetStatement:
+		if node.Name, err = rewriteIdentifier(node.Name, modifier); err != nil {
+			return nil, err
+		}
+		if node.Value, err = rewriteExpression(node.Value, modifier); err != nil {
+			return nil, err
+		}
+	case *ReturnStatement:
+		if node.ReturnValue, err = rewriteExpression(node.ReturnValue, modifier); err != nil {
+			return nil, err
 		}
 	case *ExpressionStatement:
-		node.Expression = Modify(node.Expression, modifier).(Expression)
-	case *InfixExpression:
-		node.Left = Modify(node.Left, modifier).(Expression)
-		node.Right = Modify(node.Right, modifier).(Expression)
-	case *PrefixExpression:
-		node.Right = Modify(node.Right, modifier).(Expression)
-	case *IndexExpression:
-		node.Left = Modify(node.Left, modifier).(Expression)
-		node.Index = Modify(node.Index, modifier).(Expression)
-	case *IfExpression:
-		node.Condition = Modify(node.Condition, modifier).(Expression)
-		node.Consequence = Modify(node.Consequence, modifier).(*BlockStatement)
-		if node.Alternative != nil {
-			node.Alternative = Modify(node.Alternative, modifier).(*BlockStatement)
+		if node.Expression, err = rewriteExpression(node.Expression, modifier); err != nil {
+			return nil, err
 		}
 	case *BlockStatement:
 		for i := range node.Statements {
-			node.Statements[i] = Modify(node.Statements[i], modifier).(Statement)
+			if node.Statements[i], err = rewriteStatement(node.Statements[i], modifier); err != nil {
+				return nil, err
+			}
+		}
+	case *WhileStatement:
+		if node.Condition, err = rewriteExpression(node.Condition, modifier); err != nil {
+			return nil, err
+		}
+		if node.Body, err = rewriteBlock(node.Body, modifier); err != nil {
+			return nil, err
+		}
+	case *ForStatement:
+		if node.LetStmt != nil {
+			let, err := rewriteStatement(node.LetStmt, modifier)
+			if err != nil {
+				return nil, err
+			}
+			if node.LetStmt, err = asLetStatement(let); err != nil {
+				return nil, err
+			}
+		}
+		if node.Condition, err = rewriteExpression(node.Condition, modifier); err != nil {
+			return nil, err
+		}
+		if node.Inc != nil {
+			inc, err := rewriteStatement(node.Inc, modifier)
+			if err != nil {
+				return nil, err
+			}
+			if node.Inc, err = asExpressionStatement(inc); err != nil {
+				return nil, err
+			}
+		}
+		if node.Body, err = rewriteBlock(node.Body, modifier); err != nil {
+			return nil, err
+		}
+	case *ClassStmt:
+		if node.Name, err = rewriteIdentifier(node.Name, modifier); err != nil {
+			return nil, err
+		}
+		if node.Body, err = rewriteBlock(node.Body, modifier); err != nil {
+			return nil, err
+		}
+	case *AssignExpression:
+		if node.Left, err = rewriteExpression(node.Left, modifier); err != nil {
+			return nil, err
+		}
+		if node.Value, err = rewriteExpression(node.Value, modifier); err != nil {
+			return nil, err
+		}
+	case *PrefixExpression:
+		if node.Right, err = rewriteExpression(node.Right, modifier); err != nil {
+			return nil, err
+		}
+	case *InfixExpression:
+		if node.Left, err = rewriteExpression(node.Left, modifier); err != nil {
+			return nil, err
+		}
+		if node.Right, err = rewriteExpression(node.Right, modifier); err != nil {
+			return nil, err
+		}
+	case *IfExpression:
+		if node.Condition, err = rewriteExpression(node.Condition, modifier); err != nil {
+			return nil, err
+		}
+		if node.Consequence, err = rewriteBlock(node.Consequence, modifier); err != nil {
+			return nil, err
+		}
+		if node.Alternative, err = rewriteBlock(node.Alternative, modifier); err != nil {
+			return nil, err
 		}
-	case *ReturnStatement:
-		node.ReturnValue = Modify(node.ReturnValue, modifier).(Expression)
-	case *LetStatement:
-		node.Value = Modify(node.Value, modifier).(Expression)
 	case *FunctionLiteral:
 		for i := range node.Parameters {
-			node.Parameters[i] = Modify(node.Parameters[i], modifier).(*Identifier)
+			if node.Parameters[i], err = rewriteIdentifier(node.Parameters[i], modifier); err != nil {
+				return nil, err
+			}
+		}
+		if node.Body, err = rewriteBlock(node.Body, modifier); err != nil {
+			return nil, err
+		}
+	case *MacroLiteral:
+		for i := range node.Parameters {
+			if node.Parameters[i], err = rewriteIdentifier(node.Parameters[i], modifier); err != nil {
+				return nil, err
+			}
+		}
+		if node.Body, err = rewriteBlock(node.Body, modifier); err != nil {
+			return nil, err
+		}
+	case *CallExpression:
+		if node.Function, err = rewriteExpression(node.Function, modifier); err != nil {
+			return nil, err
+		}
+		for i := range node.Arguments {
+			if node.Arguments[i], err = rewriteExpression(node.Arguments[i], modifier); err != nil {
+				return nil, err
+			}
 		}
-		node.Body = Modify(node.Body, modifier).(*BlockStatement)
 	case *ArrayLiteral:
 		for i := range node.Elements {
-			node.Elements[i] = Modify(node.Elements[i], modifier).(Expression)
+			if node.Elements[i], err = rewriteExpression(node.Elements[i], modifier); err != nil {
+				return nil, err
+			}
+		}
+	case *IndexExpression:
+		if node.Left, err = rewriteExpression(node.Left, modifier); err != nil {
+			return nil, err
+		}
+		if node.Index, err = rewriteExpression(node.Index, modifier); err != nil {
+			return nil, err
+		}
+	case *SliceExpression:
+		if node.Left, err = rewriteExpression(node.Left, modifier); err != nil {
+			return nil, err
+		}
+		if node.Start, err = rewriteExpression(node.Start, modifier); err != nil {
+			return nil, err
+		}
+		if node.End, err = rewriteExpression(node.End, modifier); err != nil {
+			return nil, err
+		}
+		if node.Step, err = rewriteExpression(node.Step, modifier); err != nil {
+			return nil, err
 		}
 	case *HashLiteral:
 		newPairs := make(map[Expression]Expression)
-		for key, val := range node.Pairs {
-			// _ 未处理错误
-			newKey, _ := Modify(key, modifier).(Expression)
-			newVal, _ := Modify(val, modifier).(Expression)
+		// 与 Walk 一样按源码顺序改写, 修改函数有副作用 (如 gensym 计数) 时结果确定
+		for _, key := range SortedHashKeys(node) {
+			val := node.Pairs[key]
+			newKey, err := rewriteExpression(key, modifier)
+			if err != nil {
+				return nil, err
+			}
+			newVal, err := rewriteExpression(val, modifier)
+			if err != nil {
+				return nil, err
+			}
 			newPairs[newKey] = newVal
 		}
 		node.Pairs = newPairs
 	}
 
-	return modifier(node)
+	return modifier(node), nil
+}
+
+// 与 Rewrite 相同, 替换结果类型不符时 panic
+func Modify(node Node, modifier ModifierFunc) Node {
+	modified, err := Rewrite(node, modifier)
+	if err != nil {
+		panic(err)
+	}
+	return modified
+}
+
+func rewriteExpression(exp Expression, modifier ModifierFunc) (Expression, error) {
+	if exp == nil {
+		return nil, nil
+	}
+	node, err := Rewrite(exp, modifier)
+	if err != nil {
+		return nil, err
+	}
+	result, ok := node.(Expression)
+	if !ok {
+		return nil, fmt.Errorf("cannot replace expression %s with %T", exp.String(), node)
+	}
+	return result, nil
+}
+
+func rewriteStatement(stmt Statement, modifier ModifierFunc) (Statement, error) {
+	node, err := Rewrite(stmt, modifier)
+	if err != nil {
+		return nil, err
+	}
+	result, ok := node.(Statement)
+	if !ok {
+		return nil, fmt.Errorf("cannot replace statement %s with %T", stmt.String(), node)
+	}
+	return result, nil
+}
+
+func rewriteBlock(block *BlockStatement, modifier ModifierFunc) (*BlockStatement, error) {
+	if block == nil {
+		return nil, nil
+	}
+	node, err := Rewrite(block, modifier)
+	if err != nil {
+		return nil, err
+	}
+	result, ok := node.(*BlockStatement)
+	if !ok {
+		return nil, fmt.Errorf("cannot replace block statement with %T", node)
+	}
+	return result, nil
+}
+
+func rewriteIdentifier(ident *Identifier, modifier ModifierFunc) (*Identifier, error) {
+	if ident == nil {
+		return nil, nil
+	}
+	node, err := Rewrite(ident, modifier)
+	if err != nil {
+		return nil, err
+	}
+	result, ok := node.(*Identifier)
+	if !ok {
+		return nil, fmt.Errorf("cannot replace identifier %s with %T", ident.Value, node)
+	}
+	return result, nil
+}
+
+func asLetStatement(stmt Statement) (*LetStatement, error) {
+	let, ok := stmt.(*LetStatement)
+	if !ok {
+		return nil, fmt.Errorf("cannot replace for-loop initializer with %T", stmt)
+	}
+	return let, nil
+}
+
+func asExpressionStatement(stmt Statement) (*ExpressionStatement, error) {
+	exp, ok := stmt.(*ExpressionStatement)
+	if !ok {
+		return nil, fmt.Errorf("cannot replace for-loop increment with %T", stmt)
+	}
+	return exp, nil
 }
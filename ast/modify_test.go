@@ -2,6 +2,7 @@ package ast
 
 import (
 	"reflect"
+	"strings"
 	"testing"
 )
 
@@ -124,6 +125,60 @@ func TestModify(t *testing.T) {
 			&ArrayLiteral{Elements: []Expression{one(), two()}},
 			&ArrayLiteral{Elements: []Expression{two(), two()}},
 		},
+		{
+			&WhileStatement{
+				Condition: one(),
+				Body:      &BlockStatement{Statements: []Statement{&ExpressionStatement{Expression: one()}}},
+			},
+			&WhileStatement{
+				Condition: two(),
+				Body:      &BlockStatement{Statements: []Statement{&ExpressionStatement{Expression: two()}}},
+			},
+		},
+		{
+			&ForStatement{
+				LetStmt:   &LetStatement{Value: one()},
+				Condition: one(),
+				Inc:       &ExpressionStatement{Expression: one()},
+				Body:      &BlockStatement{Statements: []Statement{&ExpressionStatement{Expression: one()}}},
+			},
+			&ForStatement{
+				LetStmt:   &LetStatement{Value: two()},
+				Condition: two(),
+				Inc:       &ExpressionStatement{Expression: two()},
+				Body:      &BlockStatement{Statements: []Statement{&ExpressionStatement{Expression: two()}}},
+			},
+		},
+		{
+			&AssignExpression{Left: &IndexExpression{Left: one(), Index: one()}, Value: one()},
+			&AssignExpression{Left: &IndexExpression{Left: two(), Index: two()}, Value: two()},
+		},
+		{
+			&CallExpression{Function: one(), Arguments: []Expression{one(), two()}},
+			&CallExpression{Function: two(), Arguments: []Expression{two(), two()}},
+		},
+		{
+			&ClassStmt{Body: &BlockStatement{Statements: []Statement{&ExpressionStatement{Expression: one()}}}},
+			&ClassStmt{Body: &BlockStatement{Statements: []Statement{&ExpressionStatement{Expression: two()}}}},
+		},
+		{
+			&MacroLiteral{
+				Parameters: []*Identifier{},
+				Body:       &BlockStatement{Statements: []Statement{&ExpressionStatement{Expression: one()}}},
+			},
+			&MacroLiteral{
+				Parameters: []*Identifier{},
+				Body:       &BlockStatement{Statements: []Statement{&ExpressionStatement{Expression: two()}}},
+			},
+		},
+		{
+			&SliceExpression{Left: one(), Start: one(), Step: one()},
+			&SliceExpression{Left: two(), Start: two(), Step: two()},
+		},
+		{
+			&InfixExpression{Left: &ThisLiteral{}, Operator: ".", Right: one()},
+			&InfixExpression{Left: &ThisLiteral{}, Operator: ".", Right: two()},
+		},
 	}
 
 	for _, tt := range tests {
@@ -153,3 +208,49 @@ func TestModify(t *testing.T) {
 		}
 	}
 }
+
+func TestRewriteHashLiteralOrder(t *testing.T) {
+	hashLiteral := &HashLiteral{Pairs: map[Expression]Expression{}}
+	for _, key := range []string{"c", "a", "d", "b"} {
+		hashLiteral.Pairs[&StringLiteral{Value: key}] = &IntegerLiteral{Value: 1}
+	}
+
+	for i := 0; i < 10; i++ {
+		visited := ""
+		Modify(hashLiteral, func(node Node) Node {
+			if str, ok := node.(*StringLiteral); ok {
+				visited += str.Value
+			}
+			return node
+		})
+		if visited != "abcd" {
+			t.Fatalf("wrong rewrite order. want=%q, got=%q", "abcd", visited)
+		}
+	}
+}
+
+func TestRewriteTypeMismatch(t *testing.T) {
+	toStatement := func(node Node) Node {
+		if _, ok := node.(*IntegerLiteral); ok {
+			return &ExpressionStatement{}
+		}
+		return node
+	}
+
+	tests := []Node{
+		&HashLiteral{Pairs: map[Expression]Expression{&StringLiteral{Value: "a"}: &IntegerLiteral{Value: 1}}},
+		&CallExpression{Function: &Identifier{Value: "f"}, Arguments: []Expression{&IntegerLiteral{Value: 1}}},
+		&WhileStatement{Condition: &IntegerLiteral{Value: 1}, Body: &BlockStatement{}},
+	}
+
+	for _, input := range tests {
+		_, err := Rewrite(input, toStatement)
+		if err == nil {
+			t.Errorf("expected error rewriting %T", input)
+			continue
+		}
+		if !strings.HasSuffix(err.Error(), "with *ast.ExpressionStatement") {
+			t.Errorf("wrong error. got=%q", err)
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package ast
+
+import "monkey/token"
+
+// 节点在源码中的范围 [start, end), 由子树中所有 token 和结束括号的位置得到;
+// 没有位置信息的节点 (例如宏展开生成的节点) 返回无效的位置
+func Span(node Node) (start, end token.Position) {
+	extend := func(from, to token.Position) {
+		if !from.IsValid() {
+			return
+		}
+		if !start.IsValid() || from.Offset < start.Offset {
+			start = from
+		}
+		if !end.IsValid() || to.Offset > end.Offset {
+			end = to
+		}
+	}
+
+	Inspect(node, func(n Node) bool {
+		if tok, ok := nodeToken(n); ok {
+			extend(tok.Pos, tok.End)
+		}
+		if pos := closingPosition(n); pos.IsValid() {
+			extend(pos, token.Position{Offset: pos.Offset + 1, Line: pos.Line, Column: pos.Column + 1})
+		}
+		return true
+	})
+	return start, end
+}
+
+func nodeToken(node Node) (token.Token, bool) {
+	switch node := node.(type) {
+	case *LetStatement:
+		return node.Token, true
+	case *Identifier:
+		return node.Token, true
+	case *ReturnStatement:
+		return node.Token, true
+	case *WhileStatement:
+		return node.Token, true
+	case *AssignExpression:
+		return node.Token, true
+	case *ThisLiteral:
+		return node.Token, true
+	case *ForStatement:
+		return node.Token, true
+	case *ExpressionStatement:
+		return node.Token, true
+	case *IntegerLiteral:
+		return node.Token, true
+	case *PrefixExpression:
+		return node.Token, true
+	case *InfixExpression:
+		return node.Token, true
+	case *Boolean:
+		return node.Token, true
+	case *IfExpression:
+		return node.Token, true
+	case *BlockStatement:
+		return node.Token, true
+	case *FunctionLiteral:
+		return node.Token, true
+	case *ClassStmt:
+		return node.Token, true
+	case *CallExpression:
+		return node.Token, true
+	case *StringLiteral:
+		return node.Token, true
+	case *ArrayLiteral:
+		return node.Token, true
+	case *IndexExpression:
+		return node.Token, true
+	case *SliceExpression:
+		return node.Token, true
+	case *HashLiteral:
+		return node.Token, true
+	case *MacroLiteral:
+		return node.Token, true
+	}
+	return token.Token{}, false
+}
+
+// } ) ] 的位置
+func closingPosition(node Node) token.Position {
+	switch node := node.(type) {
+	case *BlockStatement:
+		return node.Rbrace
+	case *CallExpression:
+		return node.Rparen
+	case *ArrayLiteral:
+		return node.Rbracket
+	case *IndexExpression:
+		return node.Rbracket
+	case *SliceExpression:
+		return node.Rbracket
+	case *HashLiteral:
+		return node.Rbrace
+	}
+	return token.Position{}
+}
+
+// 节点自身 token 的位置, 例如中缀表达式的运算符、调用表达式的 (
+func Position(node Node) token.Position {
+	if tok, ok := nodeToken(node); ok {
+		return tok.Pos
+	}
+	return token.Position{}
+}
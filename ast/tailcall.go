@@ -0,0 +1,38 @@
+package ast
+
+// 函数体中处于尾部位置的调用: return 的值、函数体的最后一条表达式语句,
+// 以及尾部位置上 if 各分支的最后一条表达式语句; 不包括嵌套的函数和类中的调用
+func TailCalls(fn *FunctionLiteral) map[*CallExpression]bool {
+	calls := map[*CallExpression]bool{}
+
+	var tailExpression func(exp Expression)
+	tailBlock := func(block *BlockStatement) {
+		if block == nil || len(block.Statements) == 0 {
+			return
+		}
+		if stmt, ok := block.Statements[len(block.Statements)-1].(*ExpressionStatement); ok {
+			tailExpression(stmt.Expression)
+		}
+	}
+	tailExpression = func(exp Expression) {
+		switch exp := exp.(type) {
+		case *CallExpression:
+			calls[exp] = true
+		case *IfExpression:
+			tailBlock(exp.Consequence)
+			tailBlock(exp.Alternative)
+		}
+	}
+
+	tailBlock(fn.Body)
+	Inspect(fn.Body, func(node Node) bool {
+		switch node := node.(type) {
+		case *FunctionLiteral, *MacroLiteral, *ClassStmt:
+			return false
+		case *ReturnStatement:
+			tailExpression(node.ReturnValue)
+		}
+		return true
+	})
+	return calls
+}
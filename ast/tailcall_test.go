@@ -0,0 +1,34 @@
+package ast_test
+
+import (
+	"monkey/ast"
+	"sort"
+	"testing"
+)
+
+func TestTailCalls(t *testing.T) {
+	program := parseProgram(t, `fn(x) {
+		a(b(1));
+		if (x) { return c(d(2)); }
+		while (x) { return e(); }
+		let g = fn() { f() };
+		if (x) { h() } else { if (x) { i() } else { j() + 1 } }
+	}`)
+	fn := program.Statements[0].(*ast.ExpressionStatement).Expression.(*ast.FunctionLiteral)
+
+	got := []string{}
+	for call := range ast.TailCalls(fn) {
+		got = append(got, call.Function.String())
+	}
+	sort.Strings(got)
+
+	expected := []string{"c", "e", "h", "i"}
+	if len(got) != len(expected) {
+		t.Fatalf("wrong tail calls. want=%v, got=%v", expected, got)
+	}
+	for i := range expected {
+		if got[i] != expected[i] {
+			t.Errorf("wrong tail calls. want=%v, got=%v", expected, got)
+		}
+	}
+}
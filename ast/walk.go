@@ -0,0 +1,114 @@
+package ast
+
+import "reflect"
+
+// Visitor 在进入节点时调用 Enter, 返回 false 跳过该节点的子节点 (也不调用 Exit);
+// 子节点全部访问完后调用 Exit
+type Visitor interface {
+	Enter(node Node) bool
+	Exit(node Node)
+}
+
+// 按源码顺序深度优先遍历节点, 覆盖所有节点类型
+func Walk(v Visitor, node Node) {
+	if isNilNode(node) || !v.Enter(node) {
+		return
+	}
+
+	switch node := node.(type) {
+	case *Program:
+		for _, stmt := range node.Statements {
+			Walk(v, stmt)
+		}
+	case *LetStatement:
+		Walk(v, node.Name)
+		Walk(v, node.Value)
+	case *ReturnStatement:
+		Walk(v, node.ReturnValue)
+	case *ExpressionStatement:
+		Walk(v, node.Expression)
+	case *BlockStatement:
+		for _, stmt := range node.Statements {
+			Walk(v, stmt)
+		}
+	case *WhileStatement:
+		Walk(v, node.Condition)
+		Walk(v, node.Body)
+	case *ForStatement:
+		Walk(v, node.LetStmt)
+		Walk(v, node.Condition)
+		Walk(v, node.Inc)
+		Walk(v, node.Body)
+	case *ClassStmt:
+		Walk(v, node.Name)
+		Walk(v, node.Body)
+	case *AssignExpression:
+		Walk(v, node.Left)
+		Walk(v, node.Value)
+	case *PrefixExpression:
+		Walk(v, node.Right)
+	case *InfixExpression:
+		Walk(v, node.Left)
+		Walk(v, node.Right)
+	case *IfExpression:
+		Walk(v, node.Condition)
+		Walk(v, node.Consequence)
+		Walk(v, node.Alternative)
+	case *FunctionLiteral:
+		for _, param := range node.Parameters {
+			Walk(v, param)
+		}
+		Walk(v, node.Body)
+	case *MacroLiteral:
+		for _, param := range node.Parameters {
+			Walk(v, param)
+		}
+		Walk(v, node.Body)
+	case *CallExpression:
+		Walk(v, node.Function)
+		for _, arg := range node.Arguments {
+			Walk(v, arg)
+		}
+	case *ArrayLiteral:
+		for _, el := range node.Elements {
+			Walk(v, el)
+		}
+	case *IndexExpression:
+		Walk(v, node.Left)
+		Walk(v, node.Index)
+	case *SliceExpression:
+		Walk(v, node.Left)
+		Walk(v, node.Start)
+		Walk(v, node.End)
+		Walk(v, node.Step)
+	case *HashLiteral:
+		// 按源码顺序遍历, 结果不受 map 遍历顺序影响
+		for _, key := range SortedHashKeys(node) {
+			Walk(v, key)
+			Walk(v, node.Pairs[key])
+		}
+	case *Identifier, *IntegerLiteral, *StringLiteral, *Boolean, *ThisLiteral:
+		// 叶子节点
+	}
+
+	v.Exit(node)
+}
+
+type inspector func(Node) bool
+
+func (f inspector) Enter(node Node) bool { return f(node) }
+func (f inspector) Exit(node Node)       {}
+
+// 只需要进入节点的回调时使用, f 返回 false 跳过子节点
+func Inspect(node Node, f func(Node) bool) {
+	Walk(inspector(f), node)
+}
+
+// 可选的子节点可能是 nil 接口, 也可能是装着 nil 指针的接口
+func isNilNode(node Node) bool {
+	if node == nil {
+		return true
+	}
+	value := reflect.ValueOf(node)
+	return value.Kind() == reflect.Ptr && value.IsNil()
+}
@@ -0,0 +1,140 @@
+package ast
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+type recordingVisitor struct {
+	events []string
+	skip   func(Node) bool
+}
+
+func (r *recordingVisitor) Enter(node Node) bool {
+	r.events = append(r.events, fmt.Sprintf("enter %T", node))
+	return r.skip == nil || !r.skip(node)
+}
+
+func (r *recordingVisitor) Exit(node Node) {
+	r.events = append(r.events, fmt.Sprintf("exit %T", node))
+}
+
+func TestWalk(t *testing.T) {
+	// while (x) { f(1); }
+	program := &Program{
+		Statements: []Statement{
+			&WhileStatement{
+				Condition: &Identifier{Value: "x"},
+				Body: &BlockStatement{
+					Statements: []Statement{
+						&ExpressionStatement{
+							Expression: &CallExpression{
+								Function:  &Identifier{Value: "f"},
+								Arguments: []Expression{&IntegerLiteral{Value: 1}},
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+
+	visitor := &recordingVisitor{}
+	Walk(visitor, program)
+
+	expected := []string{
+		"enter *ast.Program",
+		"enter *ast.WhileStatement",
+		"enter *ast.Identifier",
+		"exit *ast.Identifier",
+		"enter *ast.BlockStatement",
+		"enter *ast.ExpressionStatement",
+		"enter *ast.CallExpression",
+		"enter *ast.Identifier",
+		"exit *ast.Identifier",
+		"enter *ast.IntegerLiteral",
+		"exit *ast.IntegerLiteral",
+		"exit *ast.CallExpression",
+		"exit *ast.ExpressionStatement",
+		"exit *ast.BlockStatement",
+		"exit *ast.WhileStatement",
+		"exit *ast.Program",
+	}
+	if !reflect.DeepEqual(visitor.events, expected) {
+		t.Errorf("wrong events.\nwant=%q\ngot=%q", expected, visitor.events)
+	}
+
+	// Enter 返回 false 时不访问子节点, 也不调用 Exit
+	visitor = &recordingVisitor{skip: func(node Node) bool {
+		_, ok := node.(*BlockStatement)
+		return ok
+	}}
+	Walk(visitor, program)
+	expected = []string{
+		"enter *ast.Program",
+		"enter *ast.WhileStatement",
+		"enter *ast.Identifier",
+		"exit *ast.Identifier",
+		"enter *ast.BlockStatement",
+		"exit *ast.WhileStatement",
+		"exit *ast.Program",
+	}
+	if !reflect.DeepEqual(visitor.events, expected) {
+		t.Errorf("wrong events.\nwant=%q\ngot=%q", expected, visitor.events)
+	}
+}
+
+func TestInspectReachesEveryNode(t *testing.T) {
+	integer := func(v int64) Expression { return &IntegerLiteral{Value: v} }
+	body := func(exp Expression) *BlockStatement {
+		return &BlockStatement{Statements: []Statement{&ExpressionStatement{Expression: exp}}}
+	}
+
+	program := &Program{
+		Statements: []Statement{
+			&LetStatement{Name: &Identifier{Value: "a"}, Value: integer(1)},
+			&ReturnStatement{ReturnValue: integer(2)},
+			&WhileStatement{Condition: integer(3), Body: body(integer(4))},
+			&ForStatement{
+				LetStmt:   &LetStatement{Name: &Identifier{Value: "i"}, Value: integer(5)},
+				Condition: integer(6),
+				Inc:       &ExpressionStatement{Expression: integer(7)},
+				Body:      body(integer(8)),
+			},
+			&ClassStmt{Name: &Identifier{Value: "C"}, Body: body(&AssignExpression{
+				Left:  &InfixExpression{Left: &ThisLiteral{}, Operator: ".", Right: &Identifier{Value: "x"}},
+				Value: integer(9),
+			})},
+			&ExpressionStatement{Expression: &CallExpression{
+				Function:  &Identifier{Value: "f"},
+				Arguments: []Expression{integer(10), &PrefixExpression{Operator: "-", Right: integer(11)}},
+			}},
+			&ExpressionStatement{Expression: &IfExpression{Condition: integer(12), Consequence: body(integer(13))}},
+			&ExpressionStatement{Expression: &MacroLiteral{Parameters: []*Identifier{}, Body: body(integer(14))}},
+			&ExpressionStatement{Expression: &FunctionLiteral{Parameters: []*Identifier{}, Body: body(integer(15))}},
+			&ExpressionStatement{Expression: &SliceExpression{
+				Left:  &ArrayLiteral{Elements: []Expression{integer(16)}},
+				Start: integer(17),
+			}},
+			&ExpressionStatement{Expression: &IndexExpression{
+				Left:  &HashLiteral{Pairs: map[Expression]Expression{&StringLiteral{Value: "k"}: integer(18)}},
+				Index: &StringLiteral{Value: "k"},
+			}},
+		},
+	}
+
+	seen := map[int64]bool{}
+	Inspect(program, func(node Node) bool {
+		if integer, ok := node.(*IntegerLiteral); ok {
+			seen[integer.Value] = true
+		}
+		return true
+	})
+
+	for i := int64(1); i <= 18; i++ {
+		if !seen[i] {
+			t.Errorf("integer literal %d not visited", i)
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"monkey/ast"
+	"monkey/compiler"
+	"monkey/evaluator"
+	"monkey/object"
+	"os"
+)
+
+// monkey ast [--json] file.mon     打印语法树
+// monkey ast --from-json file.json  读取 JSON 语法树, 编译检查后打印源码
+func astCommand(args []string) int {
+	flags := flag.NewFlagSet("ast", flag.ContinueOnError)
+	asJSON := flags.Bool("json", false, "print the AST as JSON")
+	fromJSON := flags.Bool("from-json", false, "read a JSON AST and print it as source")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "usage: monkey ast [--json | --from-json] <file>")
+		return 2
+	}
+
+	input, err := readSource(flags.Arg(0))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	var program *ast.Program
+	if *fromJSON {
+		program, err = ast.UnmarshalJSON([]byte(input))
+		if err == nil {
+			// 确认得到的语法树能被编译器接受; 与 run 一样先展开宏, 展开会修改语法树, 打印的仍是原来的程序
+			var expanded *ast.Program
+			expanded, err = evaluator.ExpandProgram(ast.Clone(program).(*ast.Program), object.NewEnvironment())
+			if err == nil {
+				err = compiler.New().Compile(expanded)
+			}
+		}
+	} else {
+		program, err = parseSource(input)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	if !*asJSON {
+		fmt.Println(program.String())
+		return 0
+	}
+
+	data, err := ast.MarshalJSON(program)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	var out bytes.Buffer
+	json.Indent(&out, data, "", "  ")
+	fmt.Println(out.String())
+	return 0
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"monkey/compiler"
+	"monkey/evaluator"
+	"monkey/lexer"
+	"monkey/object"
+	"monkey/parser"
+	"monkey/vm"
+	"os"
+	"strings"
+)
+
+// monkey build [-O level] [-s] [--diagnostics=json] file.mon [-o file.monc]  编译为字节码文件
+func buildCommand(args []string) int {
+	flags := flag.NewFlagSet("build", flag.ContinueOnError)
+	output := flags.String("o", "", "output file, default is the source file with a .monc extension")
+	level := flags.Int("O", 0, "optimization level: 0 none, 1 constant folding, 2 peephole")
+	strip := flags.Bool("s", false, "omit debug information")
+	diagnostics := diagnosticsFlag(flags)
+	files, err := parseInterspersed(flags, args)
+	if err != nil {
+		return 2
+	}
+	if len(files) != 1 {
+		fmt.Fprintln(os.Stderr, "usage: monkey build [-O level] [-s] [--diagnostics=json] <file> [-o output]")
+		return 2
+	}
+	if !checkDiagnosticsFormat(*diagnostics, os.Stderr) {
+		return 2
+	}
+
+	path := files[0]
+	byteCode, err := compileFile(path, *level)
+	writeDiagnostics(os.Stderr, *diagnostics, path, err)
+	if err != nil {
+		return 1
+	}
+	if *strip {
+		byteCode.Debug = nil
+	}
+	data, err := compiler.MarshalByteCode(byteCode)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	if *output == "" {
+		*output = strings.TrimSuffix(path, ".mon") + ".monc"
+	}
+	if err := ioutil.WriteFile(*output, data, 0644); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
+
+// monkey run [-O level] [--diagnostics=json] file  执行 .monc 文件, 源文件先编译再执行
+func runCommand(args []string) int {
+	flags := flag.NewFlagSet("run", flag.ContinueOnError)
+	level := flags.Int("O", 0, "optimization level for source files")
+	diagnostics := diagnosticsFlag(flags)
+	files, err := parseInterspersed(flags, args)
+	if err != nil {
+		return 2
+	}
+	if len(files) != 1 {
+		fmt.Fprintln(os.Stderr, "usage: monkey run [-O level] [--diagnostics=json] <file>")
+		return 2
+	}
+	if !checkDiagnosticsFormat(*diagnostics, os.Stderr) {
+		return 2
+	}
+
+	byteCode, err := loadByteCode(files[0], *level)
+	writeDiagnostics(os.Stderr, *diagnostics, files[0], err)
+	if err != nil {
+		return 1
+	}
+	machine := vm.New(byteCode)
+	if err := machine.Run(); err != nil {
+		if runtimeErr, ok := err.(*vm.RuntimeError); ok {
+			fmt.Fprintf(os.Stderr, "vm run failed: %s\n", runtimeErr.Report(readByteCodeSource(files[0], byteCode)))
+		} else {
+			fmt.Fprintf(os.Stderr, "vm run failed: %s\n", err)
+		}
+		return 1
+	}
+	return 0
+}
+
+// 以 magic 开头的是字节码文件, 否则当作源文件编译
+func loadByteCode(path string, level int) (*compiler.ByteCode, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if bytes.HasPrefix(data, []byte(compiler.ByteCodeMagic)) {
+		byteCode, err := compiler.UnmarshalByteCode(data)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", path, err)
+		}
+		return byteCode, nil
+	}
+	return compileSource(path, string(data), level)
+}
+
+// 字节码对应的源文件名和源码; 字节码文件按调试信息中的文件名读取源码, 读不到时源码为空
+func readByteCodeSource(path string, byteCode *compiler.ByteCode) (string, string) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return path, ""
+	}
+	if !bytes.HasPrefix(data, []byte(compiler.ByteCodeMagic)) {
+		return path, string(data)
+	}
+	if byteCode.Debug == nil {
+		return path, ""
+	}
+	data, err = ioutil.ReadFile(byteCode.Debug.Source)
+	if err != nil {
+		return byteCode.Debug.Source, ""
+	}
+	return byteCode.Debug.Source, string(data)
+}
+
+func compileFile(path string, level int) (*compiler.ByteCode, error) {
+	input, err := readSource(path)
+	if err != nil {
+		return nil, err
+	}
+	return compileSource(path, input, level)
+}
+
+// 解析、展开宏并编译, 调试信息中记录源文件名; 源码中的错误返回 *compileError
+func compileSource(path, input string, level int) (*compiler.ByteCode, error) {
+	if level < int(compiler.OptimizeNone) || level > int(compiler.OptimizePeephole) {
+		return nil, fmt.Errorf("unknown optimization level %d", level)
+	}
+	p := parser.New(lexer.New(input))
+	program := p.ParserProgram()
+	if len(p.Errors()) != 0 {
+		return nil, &compileError{path: path, source: input, diagnostics: syntaxDiagnostics(p.SyntaxErrors())}
+	}
+	program, err := evaluator.ExpandProgram(program, object.NewEnvironment())
+	if err != nil {
+		return nil, &compileError{path: path, source: input, diagnostics: compiler.Diagnostics{macroDiagnostic(err)}}
+	}
+
+	comp := compiler.New()
+	comp.SetOptimizationLevel(compiler.OptimizationLevel(level))
+	if err := comp.Compile(program); err != nil {
+		if diagnostics, ok := compiler.AsDiagnostics(err); ok {
+			return nil, &compileError{path: path, source: input, diagnostics: diagnostics}
+		}
+		return nil, fmt.Errorf("%s: compiler error: %s", path, err)
+	}
+	byteCode := comp.ByteCode()
+	byteCode.Debug = &compiler.DebugInfo{Source: path}
+	return byteCode, nil
+}
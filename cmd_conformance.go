@@ -0,0 +1,55 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"monkey/conformance"
+	"os"
+)
+
+// monkey conformance [--update] [-v] [file|dir ...]  用解释器和虚拟机分别运行程序并比较结果
+// 默认运行 conformance/testdata 下的程序
+func conformanceCommand(args []string) int {
+	flags := flag.NewFlagSet("conformance", flag.ContinueOnError)
+	update := flags.Bool("update", false, "write the .out files when both engines agree")
+	verbose := flags.Bool("v", false, "also list programs that pass")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	paths := flags.Args()
+	if len(paths) == 0 {
+		paths = []string{"conformance/testdata"}
+	}
+	files, err := collectSourceFiles(paths)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	status := 0
+	failed := 0
+	for _, path := range files {
+		if *update {
+			if err := conformance.Update(path); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				status = 1
+			}
+		}
+		report, err := conformance.CheckFile(path)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			status = 1
+			continue
+		}
+		if report.Failed() {
+			failed++
+			status = 1
+		}
+		if report.Failed() || *verbose {
+			fmt.Println(report)
+		}
+	}
+	fmt.Printf("%d programs, %d failed\n", len(files), failed)
+	return status
+}
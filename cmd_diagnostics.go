@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"monkey/compiler"
+	"monkey/evaluator"
+	"monkey/parser"
+	"monkey/token"
+	"strings"
+)
+
+// 源文件编译失败; 语法错误、宏展开错误和编译错误都转换为诊断
+type compileError struct {
+	path        string
+	source      string
+	diagnostics compiler.Diagnostics
+}
+
+func (e *compileError) Error() string {
+	reports := make([]string, len(e.diagnostics))
+	for i, d := range e.diagnostics {
+		reports[i] = d.Report(e.path, e.source)
+	}
+	return strings.Join(reports, "\n")
+}
+
+// 语法错误标在出错的 token 上
+func syntaxDiagnostics(errs []parser.Error) compiler.Diagnostics {
+	diagnostics := compiler.Diagnostics{}
+	for _, err := range errs {
+		diagnostics = append(diagnostics, &compiler.Diagnostic{
+			Severity: compiler.SeverityError,
+			Code:     compiler.CodeSyntax,
+			Span:     compiler.Span{Start: err.Token.Pos, End: err.Token.End},
+			Message:  err.Message,
+		})
+	}
+	return diagnostics
+}
+
+func macroDiagnostic(err error) *compiler.Diagnostic {
+	d := &compiler.Diagnostic{
+		Severity: compiler.SeverityError,
+		Code:     compiler.CodeMacroExpansion,
+		Message:  err.Error(),
+	}
+	var macroErr *evaluator.MacroError
+	if errors.As(err, &macroErr) {
+		d.Message = fmt.Sprintf("macro `%s`: %s", macroErr.Macro, macroErr.Message)
+		d.Span = compiler.Span{Start: macroErr.Pos, End: token.Position{
+			Offset: macroErr.Pos.Offset + len(macroErr.Macro),
+			Line:   macroErr.Pos.Line,
+			Column: macroErr.Pos.Column + len(macroErr.Macro),
+		}}
+	}
+	return d
+}
+
+// --diagnostics=text|json
+func diagnosticsFlag(flags *flag.FlagSet) *string {
+	return flags.String("diagnostics", "text", "format of compiler diagnostics: text or json")
+}
+
+func checkDiagnosticsFormat(format string, w io.Writer) bool {
+	if format != "text" && format != "json" {
+		fmt.Fprintf(w, "unknown diagnostics format %q, want text or json\n", format)
+		return false
+	}
+	return true
+}
+
+// 编译的结果: text 格式只输出错误; json 格式总是输出一个对象, 编译成功时诊断列表为空
+//
+//	{"file": "a.mon", "diagnostics": [{"severity": "error", "code": "E0001", "span": {...}, "message": "...", "notes": [...]}]}
+//
+// 不是诊断的错误 (例如读不到文件) 按文本输出
+func writeDiagnostics(w io.Writer, format, path string, err error) {
+	var compileErr *compileError
+	isCompileErr := errors.As(err, &compileErr)
+	if format != "json" || (err != nil && !isCompileErr) {
+		if err != nil {
+			fmt.Fprintln(w, err)
+		}
+		return
+	}
+
+	result := struct {
+		File        string               `json:"file"`
+		Diagnostics compiler.Diagnostics `json:"diagnostics"`
+	}{File: path, Diagnostics: compiler.Diagnostics{}}
+	if isCompileErr {
+		result.Diagnostics = compileErr.diagnostics
+	}
+	data, _ := json.Marshal(result)
+	fmt.Fprintln(w, string(data))
+}
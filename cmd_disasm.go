@@ -0,0 +1,33 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"monkey/disasm"
+	"os"
+)
+
+// monkey disasm [-O level] file  反汇编源文件或 .monc 文件
+func disasmCommand(args []string) int {
+	flags := flag.NewFlagSet("disasm", flag.ContinueOnError)
+	level := flags.Int("O", 0, "optimization level for source files")
+	files, err := parseInterspersed(flags, args)
+	if err != nil {
+		return 2
+	}
+	if len(files) != 1 {
+		fmt.Fprintln(os.Stderr, "usage: monkey disasm [-O level] <file>")
+		return 2
+	}
+
+	path := files[0]
+	byteCode, err := loadByteCode(path, *level)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	_, source := readByteCodeSource(path, byteCode)
+	fmt.Print(disasm.Disassemble(byteCode, source))
+	return 0
+}
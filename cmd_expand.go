@@ -0,0 +1,44 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"monkey/evaluator"
+	"monkey/formatter"
+	"monkey/object"
+	"os"
+)
+
+// monkey expand [--width n] file.mon  展开宏, 打印展开后的源码
+func expandCommand(args []string) int {
+	flags := flag.NewFlagSet("expand", flag.ContinueOnError)
+	width := flags.Uint("width", 80, "maximum line width")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "usage: monkey expand [--width n] <file>")
+		return 2
+	}
+
+	input, err := readSource(flags.Arg(0))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	program, err := parseSource(input)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	program, err = evaluator.ExpandProgram(program, object.NewEnvironment())
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	config := formatter.DefaultConfig()
+	config.SetMaxLineLength(uint32(*width))
+	fmt.Print(formatter.FormatProgram(program, nil, config))
+	return 0
+}
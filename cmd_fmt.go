@@ -0,0 +1,117 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"monkey/formatter"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// monkey fmt [-w] [--check] [-d] [--width n] [file|dir ...]  格式化源码
+// 目录下的 .mon 文件都会被格式化, 没有参数时读取标准输入
+func fmtCommand(args []string) int {
+	flags := flag.NewFlagSet("fmt", flag.ContinueOnError)
+	write := flags.Bool("w", false, "write the result back to the source file")
+	check := flags.Bool("check", false, "list files that are not formatted and exit with status 1")
+	var diff bool
+	flags.BoolVar(&diff, "d", false, "print a diff instead of the formatted source")
+	flags.BoolVar(&diff, "diff", false, "same as -d")
+	width := flags.Uint("width", 80, "maximum line width")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	paths := flags.Args()
+	if len(paths) == 0 {
+		paths = []string{"-"}
+	}
+	files, err := collectSourceFiles(paths)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	config := formatter.DefaultConfig()
+	config.SetMaxLineLength(uint32(*width))
+
+	status := 0
+	for _, path := range files {
+		input, err := readSource(path)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			status = 1
+			continue
+		}
+		formatted, err := formatter.Format(input, config)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", path, err)
+			status = 1
+			continue
+		}
+
+		changed := formatted != input
+		if *check && changed {
+			fmt.Println(path)
+			status = 1
+		}
+		if diff && changed {
+			fmt.Print(formatter.Diff(path+".orig", path, input, formatted))
+		}
+		if *write && changed && path != "-" {
+			if err := writeSource(path, formatted); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				status = 1
+			}
+		}
+		if !*write && !*check && !diff {
+			fmt.Print(formatted)
+		}
+	}
+	return status
+}
+
+// 展开目录, 返回其中所有的 .mon 文件
+func collectSourceFiles(paths []string) ([]string, error) {
+	files := []string{}
+	for _, path := range paths {
+		if path == "-" {
+			files = append(files, path)
+			continue
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		if !info.IsDir() {
+			files = append(files, path)
+			continue
+		}
+		err = filepath.Walk(path, func(p string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if info.IsDir() && p != path && strings.HasPrefix(info.Name(), ".") {
+				return filepath.SkipDir
+			}
+			if !info.IsDir() && filepath.Ext(p) == ".mon" {
+				files = append(files, p)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return files, nil
+}
+
+func writeSource(path, content string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, []byte(content), info.Mode().Perm())
+}
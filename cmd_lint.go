@@ -0,0 +1,63 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"monkey/lint"
+	"os"
+)
+
+// monkey lint [--rules rule=off|warning|error,...] [--diagnostics=json] [file|dir ...]
+// 检查目录下所有 .mon 文件, 没有参数时读取标准输入; 有任何诊断时返回 1
+func lintCommand(args []string) int {
+	flags := flag.NewFlagSet("lint", flag.ContinueOnError)
+	rules := flags.String("rules", "", "comma separated rule settings, for example shadow=off,unreachable=error")
+	list := flags.Bool("list", false, "list all rules with their default severity")
+	diagnostics := diagnosticsFlag(flags)
+	paths, err := parseInterspersed(flags, args)
+	if err != nil {
+		return 2
+	}
+	if !checkDiagnosticsFormat(*diagnostics, os.Stderr) {
+		return 2
+	}
+	if *list {
+		for _, rule := range lint.Rules {
+			fmt.Printf("%-22s %-8s %s\n", rule.Name, rule.Severity, rule.Doc)
+		}
+		return 0
+	}
+
+	config := lint.DefaultConfig()
+	if err := config.Set(*rules); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	if len(paths) == 0 {
+		paths = []string{"-"}
+	}
+	files, err := collectSourceFiles(paths)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	status := 0
+	for _, path := range files {
+		input, err := readSource(path)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			status = 1
+			continue
+		}
+		found := lint.Lint(input, config)
+		var lintErr error
+		if len(found) > 0 {
+			lintErr = &compileError{path: path, source: input, diagnostics: found}
+			status = 1
+		}
+		writeDiagnostics(os.Stdout, *diagnostics, path, lintErr)
+	}
+	return status
+}
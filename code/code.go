@@ -15,9 +15,15 @@ func (ins Instruction) String() string {
 	for i < len(ins) {
 		def, err := Lookup(ins[i])
 		if err != nil {
-			fmt.Fprintf(&out, "Error: %s\n", err)
+			// 跳过无法识别的字节, 继续输出后面的指令
+			fmt.Fprintf(&out, "%04d Error: %s\n\t", i, err)
+			i++
 			continue
 		}
+		if i+1+def.Width() > len(ins) {
+			fmt.Fprintf(&out, "%04d Error: %s is missing operands\n\t", i, def.Name)
+			break
+		}
 
 		operands, readByteLength := ReadOperands(def, ins[i+1:])
 		fmt.Fprintf(&out, "%04d %s\n\t", i, ins.fmtInstruction(def, operands))
@@ -81,13 +87,22 @@ const (
 	OpGetFreeVar
 	OpCurrnetClosure
 	OpLoop
-	OpAnd // &&
-	OpOr  // ||
-	OpClass
-	OpMethod
-	OpDefineClass
-	OpSetProperty
-	OpGetProperty
+	OpAnd         // &&
+	OpOr          // ||
+	OpClass       // 类体闭包 -> 类
+	OpSetProperty // obj.name = value
+	OpGetProperty // obj.name
+	OpSetFreeVar
+	OpSetIndex         // left[index] = value
+	OpSlice            // left[start:end:step]
+	OpTailCall         // 尾调用, 复用当前的 Frame
+	OpLessEqual        // <=
+	OpGreaterEqual     // >=
+	OpAddLocalConstant // 超指令: OpGetLocal; OpConstant; OpAdd
+	OpCell             // 把值放入新的 cell
+	OpGetCell          // cell -> 值
+	OpSetCell          // 值, cell -> 修改 cell 中的值
+	OpDup              // 复制栈顶的 n 个值
 )
 
 type Definition struct {
@@ -95,6 +110,15 @@ type Definition struct {
 	OperandWidths []int  //每个操作数占用的字节数
 }
 
+// 所有操作数占用的字节数
+func (def *Definition) Width() int {
+	width := 0
+	for _, w := range def.OperandWidths {
+		width += w
+	}
+	return width
+}
+
 // ! 不要漏OpCode
 var definitions = map[Opcode]*Definition{
 	OpConstant:       {"OpConstant", []int{2}},
@@ -131,17 +155,26 @@ var definitions = map[Opcode]*Definition{
 	OpLessThan:       {"OpLessThan", []int{}},
 	OpAnd:            {"OpAnd", []int{2}},
 	OpOr:             {"OpOr", []int{2}},
-	OpClass:          {"OpClass", []int{}},
-	OpMethod:         {"OpMethod", []int{2, 1}},
-	OpDefineClass:    {"OpDefineClass", []int{2}},
-	OpSetProperty:    {"OpSetProperty", []int{2}},
+	OpClass:          {"OpClass", []int{2}},       // 类名在常量池中的 index
+	OpSetProperty:    {"OpSetProperty", []int{2}}, // 属性名在常量池中的 index
 	OpGetProperty:    {"OpGetProperty", []int{2}},
+	OpSetFreeVar:     {"OpSetFreeVar", []int{1}},
+	OpSetIndex:       {"OpSetIndex", []int{}},
+	OpSlice:          {"OpSlice", []int{}},
+	OpTailCall:       {"OpTailCall", []int{1}}, // u8
+	OpLessEqual:      {"OpLessEqual", []int{}},
+	OpGreaterEqual:   {"OpGreaterEqual", []int{}},
+	// 局部变量 index 和常量 index
+	OpAddLocalConstant: {"OpAddLocalConstant", []int{1, 2}},
+	OpCell:             {"OpCell", []int{}},
+	OpGetCell:          {"OpGetCell", []int{}},
+	OpSetCell:          {"OpSetCell", []int{}},
+	OpDup:              {"OpDup", []int{1}}, // u8
 }
 
+// OpSetGlobal 的第一个操作数; 数组/哈希元素赋值使用 OpSetIndex
 const (
 	SetTypeVar byte = iota
-	SetTypeArray
-	SetTypeHash
 )
 
 func Lookup(op byte) (*Definition, error) {
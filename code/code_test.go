@@ -63,6 +63,7 @@ func TestReadOperands(t *testing.T) {
 		{OpConstant, []int{65535}, 2},
 		{OpGetLocal, []int{255}, 1},
 		{OpClosure, []int{65535, 255}, 3},
+		{OpAddLocalConstant, []int{255, 65535}, 3},
 	}
 
 	for _, tt := range tests {
@@ -84,3 +85,55 @@ func TestReadOperands(t *testing.T) {
 		}
 	}
 }
+
+// 无法识别的操作码和不完整的操作数不能让输出陷入死循环或越界
+func TestInvalidInstructionToString(t *testing.T) {
+	ins := Instruction{255}
+	ins = append(ins, Make(OpAdd)...)
+	ins = append(ins, Make(OpConstant, 1)[:2]...)
+
+	expected := `0000 Error: opcode 255 undefined
+	0001 OpAdd
+	0002 Error: OpConstant is missing operands
+	`
+	if got := ins.String(); got != expected {
+		t.Errorf("instructions wrong formatted. \nwant=%q, \ngot=%q", expected, got)
+	}
+}
+
+func TestLineTable(t *testing.T) {
+	var lines LineTable
+	lines = lines.Add(0, 1, 1)
+	lines = lines.Add(3, 1, 1) // 与上一个条目相同
+	lines = lines.Add(5, 2, 4)
+	lines = lines.Add(9, 3, 1)
+
+	if len(lines) != 3 {
+		t.Fatalf("wrong number of entries: %v", lines)
+	}
+	tests := []struct {
+		offset int
+		line   int
+		column int
+	}{
+		{0, 1, 1},
+		{4, 1, 1},
+		{5, 2, 4},
+		{8, 2, 4},
+		{100, 3, 1},
+	}
+	for _, tt := range tests {
+		entry, ok := lines.Lookup(tt.offset)
+		if !ok || entry.Line != tt.line || entry.Column != tt.column {
+			t.Errorf("Lookup(%d) wrong. want=%d:%d, got=%+v (%t)", tt.offset, tt.line, tt.column, entry, ok)
+		}
+	}
+
+	first := LineTable{{Offset: 2, Line: 1, Column: 1}}
+	if _, ok := first.Lookup(1); ok {
+		t.Errorf("expected no entry before the first offset")
+	}
+	if truncated := lines.Truncate(5); len(truncated) != 1 {
+		t.Errorf("Truncate(5) wrong: %v", truncated)
+	}
+}
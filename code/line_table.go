@@ -0,0 +1,39 @@
+package code
+
+// 指令位置到源码位置的对应表, 每个条目从 Offset 开始生效, 直到下一个条目; 按 Offset 递增
+type LineTable []LineEntry
+
+type LineEntry struct {
+	Offset int
+	Line   int
+	Column int
+}
+
+// offset 处的指令对应的源码位置, 没有位置信息时 ok 为 false
+func (t LineTable) Lookup(offset int) (entry LineEntry, ok bool) {
+	for _, e := range t {
+		if e.Offset > offset {
+			break
+		}
+		entry, ok = e, true
+	}
+	return entry, ok
+}
+
+// 追加 offset 处的位置, 与上一个条目相同时不追加
+func (t LineTable) Add(offset, line, column int) LineTable {
+	if n := len(t); n > 0 && t[n-1].Line == line && t[n-1].Column == column {
+		return t
+	}
+	return append(t, LineEntry{Offset: offset, Line: line, Column: column})
+}
+
+// 删除 offset 及之后的条目, 用于删除末尾的指令
+func (t LineTable) Truncate(offset int) LineTable {
+	for i, e := range t {
+		if e.Offset >= offset {
+			return t[:i]
+		}
+	}
+	return t
+}
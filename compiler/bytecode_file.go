@@ -0,0 +1,476 @@
+package compiler
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"monkey/code"
+	"monkey/object"
+)
+
+// .monc 文件格式, 整数都是大端序:
+//
+//	magic     "MONC"
+//	version   u16
+//	flags     u8, flagDebugInfo 表示带有调试信息
+//	main      主程序的指令: u32 长度 + 字节
+//	constants u32 个数, 每个常量是 u8 类型标记 + 内容
+//	debug     有 flagDebugInfo 时才有: 源文件名, 主程序的位置表, 按常量顺序每个函数的位置表;
+//	          位置表是 u32 条目数 + 每个条目的 u32 offset, line, column
+//	checksum  u32, 之前所有字节的 CRC-32
+//
+// 类编译为类体函数和类名字符串两个常量, 不需要单独的类型标记
+const (
+	ByteCodeMagic   = "MONC"
+	ByteCodeVersion = 3 // 2: 调试信息中加入位置表; 3: 加入 OpCell、OpDup 等指令
+)
+
+const flagDebugInfo byte = 1 << 0
+
+// 常量的类型标记
+const (
+	tagInteger  byte = 'i' // i64
+	tagString   byte = 's' // u32 长度 + 字节
+	tagFunction byte = 'f' // 名字, u16 局部变量数, u8 参数个数, 指令
+)
+
+// 调试信息, 运行时不需要
+type DebugInfo struct {
+	Source string // 源文件名
+}
+
+// 序列化为 .monc 文件的内容
+func MarshalByteCode(bc *ByteCode) ([]byte, error) {
+	var out bytes.Buffer
+	out.WriteString(ByteCodeMagic)
+	binary.Write(&out, binary.BigEndian, uint16(ByteCodeVersion))
+
+	var flags byte
+	if bc.Debug != nil {
+		flags |= flagDebugInfo
+	}
+	out.WriteByte(flags)
+
+	writeBytes(&out, bc.Instruction)
+	binary.Write(&out, binary.BigEndian, uint32(len(bc.Constants)))
+	for i, constant := range bc.Constants {
+		if err := writeConstant(&out, constant); err != nil {
+			return nil, fmt.Errorf("bytecode: constant %d: %s", i, err)
+		}
+	}
+	if bc.Debug != nil {
+		writeBytes(&out, []byte(bc.Debug.Source))
+		writeLineTable(&out, bc.Lines)
+		for _, constant := range bc.Constants {
+			if fn, ok := constant.(*object.CompiledFunction); ok {
+				writeLineTable(&out, fn.Lines)
+			}
+		}
+	}
+
+	binary.Write(&out, binary.BigEndian, crc32.ChecksumIEEE(out.Bytes()))
+	return out.Bytes(), nil
+}
+
+func writeBytes(out *bytes.Buffer, data []byte) {
+	binary.Write(out, binary.BigEndian, uint32(len(data)))
+	out.Write(data)
+}
+
+func writeLineTable(out *bytes.Buffer, lines code.LineTable) {
+	binary.Write(out, binary.BigEndian, uint32(len(lines)))
+	for _, e := range lines {
+		binary.Write(out, binary.BigEndian, [3]uint32{uint32(e.Offset), uint32(e.Line), uint32(e.Column)})
+	}
+}
+
+func writeConstant(out *bytes.Buffer, constant object.Object) error {
+	switch constant := constant.(type) {
+	case *object.Integer:
+		out.WriteByte(tagInteger)
+		binary.Write(out, binary.BigEndian, constant.Value)
+	case *object.String:
+		out.WriteByte(tagString)
+		writeBytes(out, []byte(constant.Value))
+	case *object.CompiledFunction:
+		if constant.NumLocals > 0xffff || constant.NumParameters > 0xff {
+			return fmt.Errorf("function %q has too many locals", constant.Name)
+		}
+		out.WriteByte(tagFunction)
+		writeBytes(out, []byte(constant.Name))
+		binary.Write(out, binary.BigEndian, uint16(constant.NumLocals))
+		out.WriteByte(byte(constant.NumParameters))
+		writeBytes(out, constant.Instructions)
+	default:
+		return fmt.Errorf("cannot serialize %s", constant.Type())
+	}
+	return nil
+}
+
+// 读取 .monc 文件; 版本不符、内容损坏或指令不合法时返回错误
+func UnmarshalByteCode(data []byte) (*ByteCode, error) {
+	header := len(ByteCodeMagic)
+	if len(data) < header || string(data[:header]) != ByteCodeMagic {
+		return nil, fmt.Errorf("bytecode: not a monkey bytecode file")
+	}
+	// 先检查版本, 新版本的文件不会被当作损坏的文件
+	if len(data) < header+2 {
+		return nil, fmt.Errorf("bytecode: unexpected end of file")
+	}
+	if version := binary.BigEndian.Uint16(data[header:]); version != ByteCodeVersion {
+		return nil, fmt.Errorf("bytecode: unsupported version %d, want %d", version, ByteCodeVersion)
+	}
+	if len(data) < header+2+4 {
+		return nil, fmt.Errorf("bytecode: unexpected end of file")
+	}
+	body := data[:len(data)-4]
+	if crc32.ChecksumIEEE(body) != binary.BigEndian.Uint32(data[len(body):]) {
+		return nil, fmt.Errorf("bytecode: checksum mismatch, file is corrupt")
+	}
+
+	d := &byteCodeDecoder{data: body[header+2:]}
+	flags := d.byte()
+	if flags&^flagDebugInfo != 0 {
+		d.fail("unknown flags %#x", flags)
+	}
+	bc := &ByteCode{Instruction: d.bytes(), Constants: []object.Object{}}
+	count := d.uint32()
+	for i := uint32(0); i < count && d.err == nil; i++ {
+		bc.Constants = append(bc.Constants, d.constant())
+	}
+	if flags&flagDebugInfo != 0 {
+		bc.Debug = &DebugInfo{Source: string(d.bytes())}
+		bc.Lines = d.lineTable()
+		for _, constant := range bc.Constants {
+			if fn, ok := constant.(*object.CompiledFunction); ok {
+				fn.Lines = d.lineTable()
+			}
+		}
+	}
+	if d.err == nil && len(d.data) != 0 {
+		d.fail("%d unexpected bytes at end of file", len(d.data))
+	}
+	if d.err != nil {
+		return nil, d.err
+	}
+
+	if err := VerifyByteCode(bc); err != nil {
+		return nil, err
+	}
+	return bc, nil
+}
+
+// 第一个错误之后的读取都返回零值
+type byteCodeDecoder struct {
+	data []byte
+	err  error
+}
+
+func (d *byteCodeDecoder) fail(format string, a ...interface{}) {
+	if d.err == nil {
+		d.err = fmt.Errorf("bytecode: "+format, a...)
+	}
+}
+
+func (d *byteCodeDecoder) next(n int) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if n > len(d.data) {
+		d.fail("unexpected end of file")
+		return nil
+	}
+	data := d.data[:n]
+	d.data = d.data[n:]
+	return data
+}
+
+func (d *byteCodeDecoder) byte() byte {
+	if data := d.next(1); data != nil {
+		return data[0]
+	}
+	return 0
+}
+
+func (d *byteCodeDecoder) uint16() uint16 {
+	if data := d.next(2); data != nil {
+		return binary.BigEndian.Uint16(data)
+	}
+	return 0
+}
+
+func (d *byteCodeDecoder) uint32() uint32 {
+	if data := d.next(4); data != nil {
+		return binary.BigEndian.Uint32(data)
+	}
+	return 0
+}
+
+// 长度在前的字节串, 返回拷贝
+func (d *byteCodeDecoder) bytes() []byte {
+	n := d.uint32()
+	if uint64(n) > uint64(len(d.data)) {
+		d.fail("unexpected end of file")
+		return nil
+	}
+	return append([]byte{}, d.next(int(n))...)
+}
+
+func (d *byteCodeDecoder) lineTable() code.LineTable {
+	n := d.uint32()
+	if uint64(n)*12 > uint64(len(d.data)) {
+		d.fail("unexpected end of file")
+		return nil
+	}
+	var lines code.LineTable
+	for i := uint32(0); i < n; i++ {
+		lines = append(lines, code.LineEntry{Offset: int(d.uint32()), Line: int(d.uint32()), Column: int(d.uint32())})
+	}
+	return lines
+}
+
+func (d *byteCodeDecoder) constant() object.Object {
+	switch tag := d.byte(); tag {
+	case tagInteger:
+		value := d.next(8)
+		if value == nil {
+			return nil
+		}
+		return &object.Integer{Value: int64(binary.BigEndian.Uint64(value))}
+	case tagString:
+		return &object.String{Value: string(d.bytes())}
+	case tagFunction:
+		fn := &object.CompiledFunction{Name: string(d.bytes())}
+		fn.NumLocals = int(d.uint16())
+		fn.NumParameters = int(d.byte())
+		fn.Instructions = d.bytes()
+		return fn
+	default:
+		d.fail("unknown constant tag %q", tag)
+		return nil
+	}
+}
+
+// 检查指令能否安全执行: 操作码已定义, 操作数完整,
+// 引用的常量、局部变量、自由变量、内置函数存在, 跳转目标是某条指令的开头,
+// 栈上的值足够每条指令使用, 并且从不同路径到达同一条指令时栈的深度相同
+func VerifyByteCode(bc *ByteCode) error {
+	numFree := map[int]int{} // 函数常量 -> 创建闭包时捕获的自由变量个数, 取最小值
+	if err := verifyInstructions("main", bc.Instruction, 0, bc.Constants, numFree); err != nil {
+		return err
+	}
+	for i, constant := range bc.Constants {
+		fn, ok := constant.(*object.CompiledFunction)
+		if !ok {
+			continue
+		}
+		name := fmt.Sprintf("constant %d", i)
+		if fn.NumParameters > fn.NumLocals || fn.NumLocals > 256 {
+			return fmt.Errorf("bytecode: %s: %d parameters and %d locals", name, fn.NumParameters, fn.NumLocals)
+		}
+		if err := verifyInstructions(name, fn.Instructions, fn.NumLocals, bc.Constants, numFree); err != nil {
+			return err
+		}
+	}
+
+	if err := verifyStack("main", bc.Instruction, 0); err != nil {
+		return err
+	}
+	for i, constant := range bc.Constants {
+		fn, ok := constant.(*object.CompiledFunction)
+		if !ok {
+			continue
+		}
+		// 没有被 OpClosure 引用的函数不会执行, 不检查自由变量
+		free, ok := numFree[i]
+		if !ok {
+			free = -1
+		}
+		if err := verifyStack(fmt.Sprintf("constant %d", i), fn.Instructions, free); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func verifyInstructions(name string, ins code.Instruction, numLocals int, constants []object.Object, numFree map[int]int) error {
+	fail := func(offset int, format string, a ...interface{}) error {
+		return fmt.Errorf("bytecode: %s at %04d: %s", name, offset, fmt.Sprintf(format, a...))
+	}
+	constantOf := func(index int) object.Object {
+		if index < len(constants) {
+			return constants[index]
+		}
+		return nil
+	}
+
+	starts := map[int]bool{len(ins): true}
+	jumps := [][2]int{} // 跳转指令的位置和目标
+	for i := 0; i < len(ins); {
+		starts[i] = true
+		def, err := code.Lookup(ins[i])
+		if err != nil {
+			return fail(i, "%s", err)
+		}
+		width := def.Width()
+		if i+1+width > len(ins) {
+			return fail(i, "%s is missing operands", def.Name)
+		}
+		operands, _ := code.ReadOperands(def, ins[i+1:])
+
+		switch code.Opcode(ins[i]) {
+		case code.OpConstant:
+			if constantOf(operands[0]) == nil {
+				return fail(i, "constant %d does not exist", operands[0])
+			}
+		case code.OpAddLocalConstant:
+			if operands[0] >= numLocals {
+				return fail(i, "local %d does not exist", operands[0])
+			}
+			if constantOf(operands[1]) == nil {
+				return fail(i, "constant %d does not exist", operands[1])
+			}
+		case code.OpGetLocal, code.OpSetLocal:
+			if operands[0] >= numLocals {
+				return fail(i, "local %d does not exist", operands[0])
+			}
+		case code.OpClosure:
+			if _, ok := constantOf(operands[0]).(*object.CompiledFunction); !ok {
+				return fail(i, "constant %d is not a function", operands[0])
+			}
+			if free, ok := numFree[operands[0]]; !ok || operands[1] < free {
+				numFree[operands[0]] = operands[1]
+			}
+		case code.OpClass, code.OpGetProperty, code.OpSetProperty:
+			if _, ok := constantOf(operands[0]).(*object.String); !ok {
+				return fail(i, "constant %d is not a string", operands[0])
+			}
+		case code.OpGetBuiltin:
+			if operands[0] >= len(object.Builtins) {
+				return fail(i, "builtin %d does not exist", operands[0])
+			}
+		case code.OpJump, code.OpJumpNotTruthy, code.OpAnd, code.OpOr, code.OpLoop:
+			jumps = append(jumps, [2]int{i, operands[0]})
+		}
+		i += 1 + width
+	}
+
+	for _, jump := range jumps {
+		if !starts[jump[1]] {
+			return fail(jump[0], "jump target %d is not an instruction", jump[1])
+		}
+	}
+	return nil
+}
+
+// 按控制流模拟栈的深度 (相对于 Frame 的起点); numFree 为 -1 时不检查自由变量的下标
+func verifyStack(name string, ins code.Instruction, numFree int) error {
+	fail := func(offset int, format string, a ...interface{}) error {
+		return fmt.Errorf("bytecode: %s at %04d: %s", name, offset, fmt.Sprintf(format, a...))
+	}
+
+	depths := map[int]int{}
+	pending := []int{0}
+	reach := func(from, target, depth int) error {
+		if target >= len(ins) {
+			return nil
+		}
+		if seen, ok := depths[target]; ok {
+			if seen != depth {
+				return fail(from, "stack depth %d at %04d, reached before with depth %d", depth, target, seen)
+			}
+			return nil
+		}
+		depths[target] = depth
+		pending = append(pending, target)
+		return nil
+	}
+	if len(ins) > 0 {
+		depths[0] = 0
+	} else {
+		pending = nil
+	}
+
+	for len(pending) > 0 {
+		i := pending[len(pending)-1]
+		pending = pending[:len(pending)-1]
+		depth := depths[i]
+
+		op := code.Opcode(ins[i])
+		def, _ := code.Lookup(ins[i])
+		operands, width := code.ReadOperands(def, ins[i+1:])
+		next := i + 1 + width
+
+		pop, push := 0, 0
+		switch op {
+		case code.OpConstant, code.OpTrue, code.OpFalse, code.OpNull, code.OpGetGlobal, code.OpGetLocal,
+			code.OpGetBuiltin, code.OpGetFreeVar, code.OpCurrnetClosure, code.OpAddLocalConstant:
+			push = 1
+		case code.OpAdd, code.OpSub, code.OpMul, code.OpDiv, code.OpEqual, code.OpNotEqual, code.OpGreaterThan,
+			code.OpLessThan, code.OpGreaterEqual, code.OpLessEqual, code.OpIndex:
+			pop, push = 2, 1
+		case code.OpMinus, code.OpBang, code.OpClass, code.OpGetProperty, code.OpCell, code.OpGetCell:
+			pop, push = 1, 1
+		case code.OpPop, code.OpSetLocal, code.OpSetFreeVar, code.OpJumpNotTruthy, code.OpReturnValue:
+			pop = 1
+		case code.OpSetGlobal:
+			if byte(operands[0]) == code.SetTypeVar {
+				pop = 1
+			}
+		case code.OpSetProperty, code.OpSetCell:
+			pop = 2
+		case code.OpSetIndex:
+			pop = 3
+		case code.OpSlice:
+			pop, push = 4, 1
+		case code.OpArray, code.OpHash:
+			pop, push = operands[0], 1
+		case code.OpCall, code.OpTailCall:
+			pop, push = operands[0]+1, 1
+		case code.OpClosure:
+			pop, push = operands[1], 1
+		case code.OpDup:
+			pop, push = operands[0], 2*operands[0]
+		case code.OpAnd, code.OpOr:
+			pop = 1
+		case code.OpJump, code.OpLoop, code.OpReturn:
+		default:
+			return fail(i, "%s has no known stack effect", def.Name)
+		}
+		if depth < pop {
+			return fail(i, "%s needs %d values on the stack, has %d", def.Name, pop, depth)
+		}
+		if (op == code.OpGetFreeVar || op == code.OpSetFreeVar) && numFree >= 0 && operands[0] >= numFree {
+			return fail(i, "free variable %d does not exist", operands[0])
+		}
+		after := depth - pop + push
+
+		var err error
+		switch op {
+		case code.OpJump, code.OpLoop:
+			err = reach(i, operands[0], after)
+		case code.OpJumpNotTruthy:
+			if err = reach(i, operands[0], after); err == nil {
+				err = reach(i, next, after)
+			}
+		case code.OpAnd:
+			// 值为假时保留在栈上并跳转, 否则弹出后继续
+			if err = reach(i, operands[0], depth); err == nil {
+				err = reach(i, next, after)
+			}
+		case code.OpOr:
+			// 值为假时弹出并跳转, 否则保留在栈上继续
+			if err = reach(i, operands[0], after); err == nil {
+				err = reach(i, next, depth)
+			}
+		case code.OpReturnValue, code.OpReturn:
+		default:
+			err = reach(i, next, after)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
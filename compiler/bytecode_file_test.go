@@ -0,0 +1,238 @@
+package compiler
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"io/ioutil"
+	"monkey/code"
+	"monkey/evaluator"
+	"monkey/object"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func compileForFile(t *testing.T, input string) *ByteCode {
+	t.Helper()
+	comp := New()
+	if err := comp.Compile(parse(input)); err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+	return comp.ByteCode()
+}
+
+func TestByteCodeRoundTrip(t *testing.T) {
+	inputs := []string{
+		"",
+		`let a = -9223372036854775807 - 1; puts(a, "", "字符串");`,
+		"let add = fn(a, b) { let c = a + b; fn() { c } }; add(1, 2)();",
+		"class P { let init = fn(x) { this.x = x; }; } P(1).x;",
+		"for (let i = 0; i < 3; i += 1) { if (i >= 1 && i != 2) { puts(i); } }",
+	}
+
+	for _, input := range inputs {
+		want := compileForFile(t, input)
+		want.Debug = &DebugInfo{Source: "test.mon"}
+
+		data, err := MarshalByteCode(want)
+		if err != nil {
+			t.Fatalf("MarshalByteCode(%q) failed: %s", input, err)
+		}
+		got, err := UnmarshalByteCode(data)
+		if err != nil {
+			t.Fatalf("UnmarshalByteCode(%q) failed: %s", input, err)
+		}
+
+		if got.Instruction.String() != want.Instruction.String() {
+			t.Errorf("%q: wrong instructions.\nwant=%s\ngot= %s", input, want.Instruction, got.Instruction)
+		}
+		if !reflect.DeepEqual(got.Constants, want.Constants) {
+			t.Errorf("%q: wrong constants.\nwant=%#v\ngot= %#v", input, want.Constants, got.Constants)
+		}
+		if !reflect.DeepEqual(got.Lines, want.Lines) {
+			t.Errorf("%q: wrong line table.\nwant=%v\ngot= %v", input, want.Lines, got.Lines)
+		}
+		if got.Debug == nil || got.Debug.Source != "test.mon" {
+			t.Errorf("%q: wrong debug info %+v", input, got.Debug)
+		}
+	}
+}
+
+func TestByteCodeWithoutDebugInfo(t *testing.T) {
+	data, err := MarshalByteCode(compileForFile(t, "1 + 2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := UnmarshalByteCode(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Debug != nil || got.Lines != nil {
+		t.Errorf("expected no debug info, got %+v %v", got.Debug, got.Lines)
+	}
+}
+
+// 修改内容后重新计算校验和, 用来构造通过校验和但内容不合法的文件
+func withChecksum(data []byte) []byte {
+	body := data[:len(data)-4]
+	out := append(append([]byte{}, body...), 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(out[len(body):], crc32.ChecksumIEEE(body))
+	return out
+}
+
+// 编译器生成的字节码都能通过检查
+func TestCompiledProgramsVerify(t *testing.T) {
+	files, err := filepath.Glob("../conformance/testdata/*.mon")
+	if err != nil || len(files) == 0 {
+		t.Fatalf("no programs found: %v", err)
+	}
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, level := range []OptimizationLevel{OptimizeNone, OptimizeBasic, OptimizePeephole} {
+			program, err := evaluator.ExpandProgram(parse(string(data)), object.NewEnvironment())
+			if err != nil {
+				continue
+			}
+			comp := New()
+			comp.SetOptimizationLevel(level)
+			if err := comp.Compile(program); err != nil {
+				continue
+			}
+			if err := VerifyByteCode(comp.ByteCode()); err != nil {
+				t.Errorf("%s at level %d: %s", file, level, err)
+			}
+		}
+	}
+}
+
+func TestUnmarshalByteCodeErrors(t *testing.T) {
+	valid, err := MarshalByteCode(compileForFile(t, `let f = fn(x) { x + 1 }; f(1); "s"`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	modified := func(f func(data []byte) []byte) []byte {
+		return f(append([]byte{}, valid...))
+	}
+	encode := func(bc *ByteCode) []byte {
+		data, err := MarshalByteCode(bc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return data
+	}
+
+	tests := []struct {
+		data     []byte
+		expected string
+	}{
+		{[]byte{}, "bytecode: not a monkey bytecode file"},
+		{[]byte("MONKEY"), "bytecode: not a monkey bytecode file"},
+		{[]byte("MONC"), "bytecode: unexpected end of file"},
+		{modified(func(d []byte) []byte { d[5] = 9; return d }), "bytecode: unsupported version 9, want 3"},
+		{modified(func(d []byte) []byte { d[len(d)/2] ^= 0xff; return d }), "bytecode: checksum mismatch, file is corrupt"},
+		{valid[:len(valid)-1], "bytecode: checksum mismatch, file is corrupt"},
+		{withChecksum(valid[:20]), "bytecode: unexpected end of file"},
+		{modified(func(d []byte) []byte { d[6] = 0x80; return withChecksum(d) }), "bytecode: unknown flags 0x80"},
+		{modified(func(d []byte) []byte { return withChecksum(append(d[:len(d)-4], 0, 0, 0, 0, 0)) }), "bytecode: 1 unexpected bytes at end of file"},
+		{
+			encode(&ByteCode{Instruction: code.Instruction{255}}),
+			"bytecode: main at 0000: opcode 255 undefined",
+		},
+		{
+			encode(&ByteCode{Instruction: code.Make(code.OpConstant, 0)[:2]}),
+			"bytecode: main at 0000: OpConstant is missing operands",
+		},
+		{
+			encode(&ByteCode{Instruction: code.Make(code.OpConstant, 1), Constants: []object.Object{&object.Integer{Value: 1}}}),
+			"bytecode: main at 0000: constant 1 does not exist",
+		},
+		{
+			encode(&ByteCode{Instruction: code.Make(code.OpClosure, 0, 0), Constants: []object.Object{&object.Integer{Value: 1}}}),
+			"bytecode: main at 0000: constant 0 is not a function",
+		},
+		{
+			encode(&ByteCode{Instruction: code.Make(code.OpGetBuiltin, 200)}),
+			"bytecode: main at 0000: builtin 200 does not exist",
+		},
+		{
+			encode(&ByteCode{Instruction: append(code.Make(code.OpTrue), code.Make(code.OpJump, 2)...)}),
+			"bytecode: main at 0001: jump target 2 is not an instruction",
+		},
+		{
+			encode(&ByteCode{Instruction: code.Make(code.OpPop)}),
+			"bytecode: main at 0000: OpPop needs 1 values on the stack, has 0",
+		},
+		{
+			encode(&ByteCode{Instruction: concatInstructions([]code.Instruction{code.Make(code.OpTrue), code.Make(code.OpJumpNotTruthy, 5),
+				code.Make(code.OpTrue), code.Make(code.OpNull), code.Make(code.OpPop)})}),
+			"bytecode: main at 0004: stack depth 1 at 0005, reached before with depth 0",
+		},
+		{
+			encode(&ByteCode{Instruction: concatInstructions([]code.Instruction{code.Make(code.OpNull), code.Make(code.OpDup, 2)})}),
+			"bytecode: main at 0001: OpDup needs 2 values on the stack, has 1",
+		},
+		{
+			encode(&ByteCode{Instruction: code.Make(code.OpGetFreeVar, 0)}),
+			"bytecode: main at 0000: free variable 0 does not exist",
+		},
+		{
+			encode(&ByteCode{
+				Instruction: concatInstructions([]code.Instruction{code.Make(code.OpNull), code.Make(code.OpClosure, 0, 1), code.Make(code.OpPop)}),
+				Constants: []object.Object{&object.CompiledFunction{
+					Instructions: concatInstructions([]code.Instruction{code.Make(code.OpGetFreeVar, 1), code.Make(code.OpReturnValue)}),
+				}},
+			}),
+			"bytecode: constant 0 at 0000: free variable 1 does not exist",
+		},
+		{
+			encode(&ByteCode{Constants: []object.Object{&object.CompiledFunction{
+				Instructions:  append(code.Make(code.OpGetLocal, 1), code.Make(code.OpReturnValue)...),
+				NumLocals:     1,
+				NumParameters: 1,
+			}}}),
+			"bytecode: constant 0 at 0000: local 1 does not exist",
+		},
+	}
+
+	for i, tt := range tests {
+		_, err := UnmarshalByteCode(tt.data)
+		if err == nil {
+			t.Errorf("test %d: expected error %q", i, tt.expected)
+			continue
+		}
+		if err.Error() != tt.expected {
+			t.Errorf("test %d: wrong error.\nwant=%q\ngot= %q", i, tt.expected, err)
+		}
+	}
+}
+
+// 截断在任意位置都只能得到错误, 不能 panic
+func TestUnmarshalTruncatedByteCode(t *testing.T) {
+	data, err := MarshalByteCode(compileForFile(t, "let f = fn(a) { a * 2 }; puts(f(21));"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for n := 0; n < len(data); n++ {
+		if _, err := UnmarshalByteCode(withChecksumIfLong(data[:n])); err == nil {
+			t.Errorf("expected error for %d of %d bytes", n, len(data))
+		}
+	}
+}
+
+func withChecksumIfLong(data []byte) []byte {
+	if len(data) < 4 {
+		return data
+	}
+	return withChecksum(data)
+}
+
+func TestMarshalUnsupportedConstant(t *testing.T) {
+	_, err := MarshalByteCode(&ByteCode{Constants: []object.Object{&object.Boolean{Value: true}}})
+	if err == nil || !strings.Contains(err.Error(), "cannot serialize BOOLEAN") {
+		t.Errorf("expected serialization error, got %v", err)
+	}
+}
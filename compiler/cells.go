@@ -0,0 +1,221 @@
+package compiler
+
+import (
+	"monkey/ast"
+	"monkey/token"
+)
+
+// 被闭包捕获、又被赋值的变量放在 cell 中, 闭包和定义它的作用域共享同一个 cell,
+// 与求值器中闭包引用外层环境的行为一致:
+//
+//	let f = fn() { let c = 0; let inc = fn() { c = c + 1; }; inc(); inc(); c }; // 2
+//
+// 只读的捕获仍然按值复制; 顶层的全局变量直接访问, 不需要 cell.
+// 同一作用域中重新 let 也算赋值
+
+// 与符号表相同的作用域划分, 名字对应声明它的标识符; nil 表示不能赋值的名字 (函数名、this)
+type cellScope struct {
+	outer    *cellScope
+	function bool
+	decls    map[string]*ast.Identifier
+}
+
+type cellAnalysis struct {
+	scope    *cellScope
+	captured map[*ast.Identifier]bool
+	assigned map[*ast.Identifier]bool
+	// for 循环递增部分修改的是下一次迭代的新绑定, 不影响本次迭代中创建的闭包
+	loopVariable *ast.Identifier
+}
+
+// 需要 cell 的变量, 按声明的标识符 (let/class 的名字、参数、给未声明变量赋值的目标) 记录
+func findCells(program *ast.Program) map[*ast.Identifier]bool {
+	a := &cellAnalysis{
+		scope:    &cellScope{function: true, decls: map[string]*ast.Identifier{}},
+		captured: map[*ast.Identifier]bool{},
+		assigned: map[*ast.Identifier]bool{},
+	}
+	a.statements(program.Statements)
+
+	cells := map[*ast.Identifier]bool{}
+	for decl := range a.captured {
+		if a.assigned[decl] {
+			cells[decl] = true
+		}
+	}
+	return cells
+}
+
+func (a *cellAnalysis) enter(function bool) {
+	a.scope = &cellScope{outer: a.scope, function: function, decls: map[string]*ast.Identifier{}}
+}
+
+func (a *cellAnalysis) leave() {
+	a.scope = a.scope.outer
+}
+
+// 找到名字的声明; 跨过函数边界找到的非顶层声明是被捕获的
+func (a *cellAnalysis) resolve(name string) (decl *ast.Identifier, captured bool, ok bool) {
+	crossed := false
+	for scope := a.scope; scope != nil; scope = scope.outer {
+		if decl, ok := scope.decls[name]; ok {
+			return decl, crossed && scope.outer != nil, true
+		}
+		if scope.function {
+			crossed = true
+		}
+	}
+	return nil, false, false
+}
+
+func (a *cellAnalysis) use(name string) {
+	decl, captured, _ := a.resolve(name)
+	if decl != nil && captured {
+		a.captured[decl] = true
+	}
+}
+
+// let 和 class: 同一作用域中已经声明过时是对原来变量的赋值
+func (a *cellAnalysis) declare(name *ast.Identifier) {
+	if decl := a.scope.decls[name.Value]; decl != nil {
+		a.assigned[decl] = true
+		return
+	}
+	a.scope.decls[name.Value] = name
+}
+
+func (a *cellAnalysis) assign(name *ast.Identifier) {
+	decl, captured, ok := a.resolve(name.Value)
+	if !ok {
+		// 与编译器一样, 给未声明的变量赋值在当前作用域定义它
+		a.scope.decls[name.Value] = name
+		decl = name
+	}
+	if decl == nil || decl == a.loopVariable {
+		return
+	}
+	a.assigned[decl] = true
+	if captured {
+		a.captured[decl] = true
+	}
+}
+
+func (a *cellAnalysis) statements(stmts []ast.Statement) {
+	for _, stmt := range stmts {
+		a.node(stmt)
+	}
+}
+
+func (a *cellAnalysis) block(block *ast.BlockStatement) {
+	if block == nil {
+		return
+	}
+	a.enter(false)
+	a.statements(block.Statements)
+	a.leave()
+}
+
+func (a *cellAnalysis) node(node ast.Node) {
+	switch node := node.(type) {
+	case *ast.ExpressionStatement:
+		a.node(node.Expression)
+	case *ast.ReturnStatement:
+		a.node(node.ReturnValue)
+	case *ast.BlockStatement:
+		a.block(node)
+	case *ast.LetStatement:
+		if node == nil {
+			return
+		}
+		a.declare(node.Name)
+		if _, ok := node.Value.(*ast.MacroLiteral); !ok {
+			a.node(node.Value)
+		}
+	case *ast.ClassStmt:
+		a.declare(node.Name)
+		a.enter(true)
+		a.scope.decls["this"] = nil
+		a.statements(node.Body.Statements)
+		a.leave()
+	case *ast.WhileStatement:
+		a.node(node.Condition)
+		a.block(node.Body)
+	case *ast.ForStatement:
+		a.enter(false)
+		a.node(node.LetStmt)
+		a.node(node.Condition)
+		if node.Inc != nil {
+			saved := a.loopVariable
+			if node.LetStmt != nil {
+				a.loopVariable = a.scope.decls[node.LetStmt.Name.Value]
+			}
+			a.node(node.Inc)
+			a.loopVariable = saved
+		}
+		a.block(node.Body)
+		a.leave()
+	case *ast.IfExpression:
+		a.node(node.Condition)
+		a.block(node.Consequence)
+		a.block(node.Alternative)
+	case *ast.FunctionLiteral:
+		a.enter(true)
+		if node.Name != "" {
+			a.scope.decls[node.Name] = nil
+		}
+		for _, param := range node.Parameters {
+			a.scope.decls[param.Value] = param
+		}
+		a.block(node.Body)
+		a.leave()
+	case *ast.Identifier:
+		a.use(node.Value)
+	case *ast.PrefixExpression:
+		a.node(node.Right)
+	case *ast.InfixExpression:
+		a.node(node.Left)
+		if node.Operator != token.DOT {
+			a.node(node.Right)
+		}
+	case *ast.CallExpression:
+		a.node(node.Function)
+		for _, arg := range node.Arguments {
+			a.node(arg)
+		}
+	case *ast.ArrayLiteral:
+		for _, element := range node.Elements {
+			a.node(element)
+		}
+	case *ast.HashLiteral:
+		for key, value := range node.Pairs {
+			a.node(key)
+			a.node(value)
+		}
+	case *ast.IndexExpression:
+		a.node(node.Left)
+		a.node(node.Index)
+	case *ast.SliceExpression:
+		a.node(node.Left)
+		for _, bound := range []ast.Expression{node.Start, node.End, node.Step} {
+			if bound != nil {
+				a.node(bound)
+			}
+		}
+	case *ast.AssignExpression:
+		switch left := node.Left.(type) {
+		case *ast.Identifier:
+			a.assign(left)
+		case *ast.IndexExpression:
+			a.node(left.Left)
+			a.node(left.Index)
+		case *ast.InfixExpression:
+			a.node(left.Left)
+		}
+		a.node(node.Value)
+		if node.Operator != "" && node.Operator != token.ASSIGN {
+			if ident, ok := node.Left.(*ast.Identifier); ok {
+				a.use(ident.Value)
+			}
+		}
+	}
+}
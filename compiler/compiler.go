@@ -1,7 +1,6 @@
 package compiler
 
 import (
-	"fmt"
 	"monkey/ast"
 	"monkey/code"
 	"monkey/object"
@@ -22,14 +21,7 @@ type CompilationScope struct {
 	instruction         code.Instruction
 	lastInstruction     EmittedInstruction // 最后一条指令
 	previousInstruction EmittedInstruction // 倒数第二条
-}
-
-type CompilerCtx struct {
-	isCompClass bool
-	infixAssign bool
-	infixDot    bool
-	index       int
-	// hasExtends  bool
+	lines               code.LineTable     // 指令对应的源码位置
 }
 
 type Compiler struct {
@@ -37,12 +29,19 @@ type Compiler struct {
 	symbolTable *SymbolTable //符号表, 保存、处理变量
 	scopes      []CompilationScope
 	scopeIndex  int
-	compilerCtx *CompilerCtx
+	tailCalls   map[*ast.CallExpression]bool // 处于尾部位置的调用, 编译为 OpTailCall
+	cells       map[*ast.Identifier]bool     // 需要 cell 的变量声明, 见 cells.go
+	position    token.Position               // 正在编译的节点的位置, 记录到生成的指令上
+	undefined   Diagnostics                  // 未定义的名字, 用 OpNull 占位继续编译, 编译完程序时一起报告
+
+	optimization OptimizationLevel
 }
 
 type ByteCode struct {
 	Instruction code.Instruction
 	Constants   []object.Object
+	Lines       code.LineTable // 主程序指令对应的源码位置
+	Debug       *DebugInfo     // 可选, 从 .monc 文件读取时可能没有
 }
 
 func New() *Compiler {
@@ -61,7 +60,7 @@ func New() *Compiler {
 		symbolTable: symbolTable,
 		scopes:      []CompilationScope{mainScope},
 		scopeIndex:  0,
-		compilerCtx: &CompilerCtx{isCompClass: false, index: -1, infixAssign: false},
+		tailCalls:   map[*ast.CallExpression]bool{},
 	}
 }
 
@@ -77,14 +76,24 @@ func (c *Compiler) currentInstructions() code.Instruction {
 }
 
 func (c *Compiler) Compile(node ast.Node) error {
+	// 没有位置的节点 (宏和优化生成的节点) 沿用外层节点的位置
+	if pos := ast.Position(node); pos.IsValid() {
+		saved := c.position
+		c.position = pos
+		defer func() { c.position = saved }()
+	}
+
 	switch node := node.(type) {
 	case *ast.Program:
-		for _, stmt := range node.Statements {
-			err := c.Compile(stmt)
+		if c.optimization >= OptimizeBasic {
+			optimized, err := optimize(node)
 			if err != nil {
 				return err
 			}
+			node = optimized
 		}
+		c.cells = findCells(node)
+		return c.withUndefined(c.compileStatements(node.Statements))
 
 	case *ast.ExpressionStatement:
 		err := c.Compile(node.Expression)
@@ -131,59 +140,26 @@ func (c *Compiler) Compile(node ast.Node) error {
 			return nil
 		}
 
-		if node.Operator == token.ASSIGN {
-			c.compilerCtx.infixAssign = true
-		}
-
 		err := c.Compile(node.Left)
 		if err != nil {
 			return err
 		}
 
+		// foo.bar
 		if node.Operator == token.DOT {
-			c.compilerCtx.infixDot = true
+			name, err := c.propertyName(node)
+			if err != nil {
+				return err
+			}
+			c.emit(code.OpGetProperty, c.addConstant(name))
+			return nil
 		}
+
 		err = c.Compile(node.Right)
 		if err != nil {
 			return err
 		}
-
-		switch node.Operator {
-		case "+":
-			c.emit(code.OpAdd)
-		case "-":
-			c.emit(code.OpSub)
-		case "*":
-			c.emit(code.OpMul)
-		case "/":
-			c.emit(code.OpDiv)
-		case "<":
-			c.emit(code.OpLessThan)
-		case ">":
-			c.emit(code.OpGreaterThan)
-		case "==":
-			c.emit(code.OpEqual)
-		case "!=":
-			c.emit(code.OpNotEqual)
-		case "<=":
-			c.emit(code.OpGreaterThan)
-			c.emit(code.OpBang)
-		case ">=":
-			c.emit(code.OpLessThan)
-			c.emit(code.OpBang)
-		// case "=":
-		// 	// this.foo = 1;
-		// 	if c.compilerCtx.index >= 0 && c.compilerCtx.infixDot {
-		// 		c.emit(code.OpSetProperty, c.compilerCtx.index)
-		// 	}
-		// 	c.compilerCtx.infixAssign = false
-		// 	c.compilerCtx.index = -1
-		// case ".":
-		// 	// foo.a
-		// 	c.compilerCtx.infixDot = false
-		default:
-			return fmt.Errorf("unknown operator %s", node.Operator)
-		}
+		return c.emitInfixOperator(node, node.Operator)
 
 	case *ast.IntegerLiteral:
 		integer := &object.Integer{Value: node.Value}
@@ -194,8 +170,12 @@ func (c *Compiler) Compile(node ast.Node) error {
 		} else {
 			c.emit(code.OpFalse)
 		}
-	// case *ast.ThisLiteral:
-	// c.compilerCtx.infixDot = true
+	case *ast.ThisLiteral:
+		symbol, ok := c.symbolTable.Resolve(node.Value)
+		if !ok {
+			return c.errorf(node, CodeThisOutsideClass, "`this` outside of class")
+		}
+		c.loadSymbol(symbol)
 	case *ast.PrefixExpression:
 		err := c.Compile(node.Right)
 		if err != nil {
@@ -208,10 +188,21 @@ func (c *Compiler) Compile(node ast.Node) error {
 		case "-":
 			c.emit(code.OpMinus)
 		default:
-			return fmt.Errorf("unknown operator: %s", node.Operator)
+			return c.errorf(node, CodeUnknownOperator, "unknown operator: %s", node.Operator)
 		}
 	case *ast.IfExpression:
-		err := c.Compile(node.Condition)
+		if truthy, ok := c.constantCondition(node.Condition); ok {
+			consequence := func() error { return c.compileBranch(node.Consequence) }
+			alternative := func() error { return c.compileBranch(node.Alternative) }
+			if truthy {
+				return c.compileEach(consequence, func() error { return c.compileDiscarded(alternative) })
+			}
+			return c.compileEach(func() error { return c.compileDiscarded(consequence) }, alternative)
+		}
+
+		// 条件和两个分支中的错误都报告, 一处出错时继续编译其他部分
+		var diagnostics Diagnostics
+		err := c.compileRecovering(&diagnostics, func() error { return c.Compile(node.Condition) })
 		if err != nil {
 			return err
 		}
@@ -219,16 +210,11 @@ func (c *Compiler) Compile(node ast.Node) error {
 		//虚假的偏移量9999 jump not truthy
 		jumpNotTPos := c.emit(code.OpJumpNotTruthy, 9999)
 
-		err = c.Compile(node.Consequence)
+		err = c.compileRecovering(&diagnostics, func() error { return c.Compile(node.Consequence) })
 		if err != nil {
 			return err
 		}
-		if c.lastInstructionIs(code.OpPop) {
-			c.removeLastOpPop()
-		}
-		// else {
-		// 	return fmt.Errorf("syntax error: if(true){ _ }")
-		// }
+		c.branchValue()
 
 		jumpPos := c.emit(code.OpJump, 9999)
 		//回填操作,修正偏移量
@@ -244,44 +230,56 @@ func (c *Compiler) Compile(node ast.Node) error {
 			// c.changeOperand(jumpNotTPos,afterConsequencePos)
 
 			//else {}
-			err := c.Compile(node.Alternative)
+			err := c.compileRecovering(&diagnostics, func() error { return c.Compile(node.Alternative) })
 			if err != nil {
 				return err
 			}
 
-			if c.lastInstructionIs(code.OpPop) {
-				c.removeLastOpPop()
-			}
+			c.branchValue()
 		}
 		//修正跳出备选位置 9999 -> len(c.instructions)
 		// afterAlternativePos := len(c.instructions)
 		afterAlternativePos := len(c.currentInstructions())
 		c.changeOperand(jumpPos, afterAlternativePos)
+		if len(diagnostics) > 0 {
+			return diagnostics
+		}
 
 	case *ast.BlockStatement:
-		for _, stmt := range node.Statements {
-			err := c.Compile(stmt)
-			if err != nil {
-				return err
-			}
+		c.enterBlockScope()
+		err := c.compileStatements(node.Statements)
+		if err != nil {
+			return err
 		}
+		c.leaveBlockScope()
 	case *ast.LetStatement:
-		symbol := c.symbolTable.Define(node.Name.Value)
+		if s, ok := c.symbolTable.Lookup(node.Name.Value); ok && s.Const {
+			d := c.errorf(node.Name, CodeConstRedeclared, "constant `%s` already declared", node.Name.Value)
+			d.Notes = declaredHere(s, "was declared as a constant")
+			return d
+		}
+
+		if node.IsConst() {
+			return c.compileConst(node)
+		}
+
+		symbol, fresh := c.defineVariable(node.Name)
 
 		err := c.Compile(node.Value)
 		if err != nil {
 			return err
 		}
 
-		if symbol.Scope == GlobalScope {
-			c.emit(code.OpSetGlobal, int(code.SetTypeVar), symbol.Index)
-		} else {
-			c.emit(code.OpSetLocal, symbol.Index)
-		}
+		c.initSymbol(symbol, fresh)
 	case *ast.Identifier:
 		symbol, ok := c.symbolTable.Resolve(node.Value)
 		if !ok {
-			return fmt.Errorf("undefined variable `%s`", node.Value)
+			// 只记录诊断, 表达式的其余部分继续编译, 一次报告其中所有未定义的名字
+			d := c.errorf(node, CodeUndefinedVariable, "undefined variable `%s`", node.Value)
+			d.Notes = didYouMean(d.Span, node.Value, c.symbolTable.visibleNames())
+			c.undefined = append(c.undefined, d)
+			c.emit(code.OpNull)
+			return nil
 		}
 
 		c.loadSymbol(symbol)
@@ -331,7 +329,29 @@ func (c *Compiler) Compile(node ast.Node) error {
 
 		c.emit(code.OpIndex)
 
+	case *ast.SliceExpression:
+		err := c.Compile(node.Left)
+		if err != nil {
+			return err
+		}
+		// 省略的边界压入 null
+		for _, bound := range []ast.Expression{node.Start, node.End, node.Step} {
+			if bound == nil {
+				c.emit(code.OpNull)
+				continue
+			}
+			err = c.Compile(bound)
+			if err != nil {
+				return err
+			}
+		}
+
+		c.emit(code.OpSlice)
+
 	case *ast.FunctionLiteral:
+		for call := range ast.TailCalls(node) {
+			c.tailCalls[call] = true
+		}
 		c.enterScope()
 
 		if node.Name != "" {
@@ -341,6 +361,15 @@ func (c *Compiler) Compile(node ast.Node) error {
 		for _, param := range node.Parameters {
 			c.symbolTable.Define(param.Value)
 		}
+		// 参数在函数开始时放入 cell
+		for _, param := range node.Parameters {
+			if c.cells[param] {
+				symbol := c.symbolTable.markCell(param.Value)
+				c.loadSlot(symbol)
+				c.emit(code.OpCell)
+				c.storeSlot(symbol)
+			}
+		}
 		err := c.Compile(node.Body)
 		if err != nil {
 			return err
@@ -353,28 +382,11 @@ func (c *Compiler) Compile(node ast.Node) error {
 			c.emit(code.OpReturn)
 		}
 
-		numLocals := c.symbolTable.numDefinitions
-		freeSymbols := c.symbolTable.FreeSymbol
-		instruction := c.leaveScope()
+		c.emitClosure(node.Name, len(node.Parameters))
 
-		for _, s := range freeSymbols {
-			c.loadSymbol(s)
-		}
-
-		compiledFn := &object.CompiledFunction{
-			Instructions:  instruction,
-			NumLocals:     numLocals,
-			NumParameters: len(node.Parameters),
-			Name:          node.Name,
-		}
-		// c.emit(code.OpConstant, c.addConstant(compiledFn))
-		constantFnIndex := c.addConstant(compiledFn)
-
-		if c.compilerCtx.isCompClass {
-			c.emit(code.OpMethod, constantFnIndex, len(freeSymbols))
-		} else {
-			c.emit(code.OpClosure, constantFnIndex, len(freeSymbols))
-		}
+	case *ast.MacroLiteral:
+		// 宏在编译前展开, 留到这里的宏字面量不是 let 定义的
+		return c.errorf(node, CodeMacroOutsideLet, "macro must be defined by a let statement")
 
 	case *ast.ReturnStatement:
 		err := c.Compile(node.ReturnValue)
@@ -395,8 +407,16 @@ func (c *Compiler) Compile(node ast.Node) error {
 			}
 		}
 
-		c.emit(code.OpCall, len(node.Arguments))
+		if c.tailCalls[node] {
+			c.emit(code.OpTailCall, len(node.Arguments))
+		} else {
+			c.emit(code.OpCall, len(node.Arguments))
+		}
 	case *ast.WhileStatement:
+		if truthy, ok := c.constantCondition(node.Condition); ok && !truthy {
+			// 循环体不会执行
+			return c.compileDiscarded(func() error { return c.Compile(node.Body) })
+		}
 		loopStart := len(c.currentInstructions())
 
 		err := c.Compile(node.Condition)
@@ -413,47 +433,69 @@ func (c *Compiler) Compile(node ast.Node) error {
 		afterPos := len(c.currentInstructions())
 		c.changeOperand(jumpNotPos, afterPos)
 	case *ast.AssignExpression:
-		var symbol Symbol
-		var set_type byte
-		switch child_node := node.Left.(type) {
+		switch left := node.Left.(type) {
 		case *ast.Identifier:
-			symbol = c.symbolTable.Define(child_node.Value)
-			set_type = code.SetTypeVar
+			symbol, fresh := c.resolveAssignTarget(left)
+			switch {
+			case symbol.Const:
+				d := c.errorf(left, CodeAssignToConst, "cannot assign to constant `%s`", symbol.Name)
+				d.Notes = declaredHere(symbol, "was declared as a constant")
+				return d
+			case symbol.Scope == BuiltinScope || symbol.Scope == FunctionScope:
+				return c.errorf(left, CodeInvalidAssignment, "cannot assign to `%s`", symbol.Name)
+			}
+
+			err := c.Compile(node.ExpandedValue())
+			if err != nil {
+				return err
+			}
+			c.initSymbol(symbol, fresh)
 		case *ast.IndexExpression:
-			symbol = c.symbolTable.Define(child_node.Left.(*ast.Identifier).Value)
-			set_type = code.SetTypeArray
-			err := c.Compile(child_node.Index)
+			// a[i][j] = v: 先求出 a[i], 再原地修改
+			err := c.Compile(left.Left)
 			if err != nil {
-				return nil
+				return err
 			}
-
-		}
-
-		err := c.Compile(node.Value)
-		if err != nil {
-			return err
-		}
-
-		if symbol.Scope == GlobalScope {
-			switch set_type {
-			case code.SetTypeVar:
-				c.emit(code.OpSetGlobal, int(code.SetTypeVar), symbol.Index)
-			case code.SetTypeArray:
-				c.emit(code.OpSetGlobal, int(code.SetTypeArray), symbol.Index)
-
+			err = c.Compile(left.Index)
+			if err != nil {
+				return err
 			}
-		} else {
-			switch set_type {
-			case code.SetTypeVar:
-				c.emit(code.OpSetLocal, symbol.Index)
-			case code.SetTypeArray:
-				c.emit(code.OpSetLocal, symbol.Index)
+			err = c.compileAssignedValue(node, func() {
+				c.emit(code.OpDup, 2)
+				c.emit(code.OpIndex)
+			})
+			if err != nil {
+				return err
 			}
+			c.emit(code.OpSetIndex)
+		case *ast.InfixExpression:
+			if left.Operator != token.DOT {
+				return c.errorf(left, CodeInvalidAssignment, "invalid assignment target %s", left.String())
+			}
+			name, err := c.propertyName(left)
+			if err != nil {
+				return err
+			}
+			err = c.Compile(left.Left)
+			if err != nil {
+				return err
+			}
+			err = c.compileAssignedValue(node, func() {
+				c.emit(code.OpDup, 1)
+				c.emit(code.OpGetProperty, c.addConstant(name))
+			})
+			if err != nil {
+				return err
+			}
+			c.emit(code.OpSetProperty, c.addConstant(name))
+		default:
+			return c.errorf(node.Left, CodeInvalidAssignment, "invalid assignment target %s", node.Left.String())
 		}
 	case *ast.ForStatement:
 		// loopStart := len(c.currentInstructions())
 		loopStart := 0
-		// c.enterScope()
+		// for 的 let 变量只在循环内可见
+		c.enterBlockScope()
 		err := c.Compile(node.LetStmt)
 		if err != nil {
 			return err
@@ -469,6 +511,16 @@ func (c *Compiler) Compile(node ast.Node) error {
 
 		incStart := len(c.currentInstructions())
 
+		// 每次迭代的循环变量是新的绑定: 在 cell 中的循环变量递增前换成新的 cell,
+		// 本次迭代中创建的闭包保留原来的 cell
+		if node.LetStmt != nil {
+			if symbol, ok := c.symbolTable.Lookup(node.LetStmt.Name.Value); ok && symbol.Cell {
+				c.loadSymbol(symbol)
+				c.emit(code.OpCell)
+				c.storeSlot(symbol)
+			}
+		}
+
 		err = c.Compile(node.Inc)
 		if err != nil {
 			return err
@@ -484,28 +536,135 @@ func (c *Compiler) Compile(node ast.Node) error {
 		c.emit(code.OpLoop, incStart+loopStart)
 		jumpNotEndPos := len(c.currentInstructions())
 		c.changeOperand(jumpNotPos, jumpNotEndPos+loopStart)
+		c.leaveBlockScope()
 
 		// instruction := c.leaveScope()
 		// c.scopes[c.scopeIndex].instruction = append(c.scopes[c.scopeIndex].instruction, instruction...)
 		// fmt.Println(instruction)
 
 	case *ast.ClassStmt:
-		c.compilerCtx.isCompClass = true
-		symbol := c.symbolTable.Define(node.Name.Value)
-		//emit OP_CLASS create a class
-		c.emit(code.OpClass)
-		c.emit(code.OpDefineClass, symbol.Index)
+		symbol, fresh := c.defineVariable(node.Name)
 
-		err := c.Compile(node.Body)
+		err := c.compileClassBody(node)
 		if err != nil {
 			return err
 		}
-		c.emit(code.OpPop)
-		c.compilerCtx.isCompClass = false
+		c.emit(code.OpClass, c.addConstant(&object.String{Value: node.Name.Value}))
+		c.initSymbol(symbol, fresh)
 	} //switch end
 	return nil
 }
 
+func (c *Compiler) emitInfixOperator(node ast.Node, operator string) error {
+	switch operator {
+	case "+":
+		c.emit(code.OpAdd)
+	case "-":
+		c.emit(code.OpSub)
+	case "*":
+		c.emit(code.OpMul)
+	case "/":
+		c.emit(code.OpDiv)
+	case "<":
+		c.emit(code.OpLessThan)
+	case ">":
+		c.emit(code.OpGreaterThan)
+	case "==":
+		c.emit(code.OpEqual)
+	case "!=":
+		c.emit(code.OpNotEqual)
+	case "<=":
+		c.emit(code.OpLessEqual)
+	case ">=":
+		c.emit(code.OpGreaterEqual)
+	default:
+		return c.errorf(node, CodeUnknownOperator, "unknown operator %s", operator)
+	}
+	return nil
+}
+
+// 元素和属性赋值要写入的值; 目标已经在栈上, 复合赋值用 loadCurrent 复制目标并读出当前值,
+// 目标和下标只求值一次
+func (c *Compiler) compileAssignedValue(node *ast.AssignExpression, loadCurrent func()) error {
+	operator := node.CompoundOperator()
+	if operator == "" {
+		return c.Compile(node.Value)
+	}
+	loadCurrent()
+	err := c.Compile(node.Value)
+	if err != nil {
+		return err
+	}
+	return c.emitInfixOperator(node, operator)
+}
+
+// 逐句编译; 优化时 return 之后的语句不会执行, 见 compileDiscarded
+func (c *Compiler) compileStatements(stmts []ast.Statement) error {
+	steps := []func() error{}
+	for i, stmt := range stmts {
+		stmt := stmt
+		steps = append(steps, func() error { return c.Compile(stmt) })
+		if _, ok := stmt.(*ast.ReturnStatement); ok && c.optimization >= OptimizeBasic && i+1 < len(stmts) {
+			rest := stmts[i+1:]
+			steps = append(steps, func() error {
+				return c.compileDiscarded(func() error { return c.compileStatements(rest) })
+			})
+			break
+		}
+	}
+	return c.compileEach(steps...)
+}
+
+// 把记录的未定义名字和编译返回的诊断合并, 按源码位置排序
+func (c *Compiler) withUndefined(err error) error {
+	if len(c.undefined) == 0 {
+		return err
+	}
+	diagnostics, ok := AsDiagnostics(err)
+	if err != nil && !ok {
+		return err
+	}
+	diagnostics = append(append(Diagnostics{}, c.undefined...), diagnostics...)
+	sort.SliceStable(diagnostics, func(i, j int) bool {
+		a, b := diagnostics[i].Span.Start, diagnostics[j].Span.Start
+		return a.Line < b.Line || a.Line == b.Line && a.Column < b.Column
+	})
+	return diagnostics
+}
+
+// 依次编译; 一步出错时记录诊断, 恢复到这一步之前的作用域后继续编译之后的部分,
+// 最后返回所有诊断. 不是诊断的错误直接返回
+func (c *Compiler) compileEach(steps ...func() error) error {
+	var diagnostics Diagnostics
+	for _, step := range steps {
+		if err := c.compileRecovering(&diagnostics, step); err != nil {
+			return err
+		}
+	}
+	if len(diagnostics) > 0 {
+		return diagnostics
+	}
+	return nil
+}
+
+// 执行一步编译, 产生诊断时追加到 diagnostics 并恢复作用域; 只返回不是诊断的错误
+func (c *Compiler) compileRecovering(diagnostics *Diagnostics, step func() error) error {
+	scopes, symbolTable := len(c.scopes), c.symbolTable
+	err := step()
+	if err == nil {
+		return nil
+	}
+	found, ok := AsDiagnostics(err)
+	if !ok {
+		return err
+	}
+	*diagnostics = append(*diagnostics, found...)
+	c.scopes = c.scopes[:scopes]
+	c.scopeIndex = scopes - 1
+	c.symbolTable = symbolTable
+	return nil
+}
+
 func (c *Compiler) addConstant(obj object.Object) int {
 	c.constants = append(c.constants, obj)
 	return len(c.constants) - 1
@@ -517,6 +676,10 @@ func (c *Compiler) addConstant(obj object.Object) int {
 func (c *Compiler) emit(op code.Opcode, operands ...int) int {
 	ins := code.Make(op, operands...)
 	pos := c.addInstruction(ins)
+	if c.position.IsValid() {
+		scope := &c.scopes[c.scopeIndex]
+		scope.lines = scope.lines.Add(pos, c.position.Line, c.position.Column)
+	}
 
 	c.setLastInstruction(op, pos)
 	return pos
@@ -532,13 +695,23 @@ func (c *Compiler) addInstruction(ins []byte) int {
 }
 
 func (c *Compiler) ByteCode() *ByteCode {
+	// Instruction: c.instructions,
+	ins, lines := c.finishInstructions(c.currentInstructions(), c.scopes[c.scopeIndex].lines)
 	return &ByteCode{
-		// Instruction: c.instructions,
-		Instruction: c.currentInstructions(),
+		Instruction: ins,
 		Constants:   c.constants,
+		Lines:       lines,
 	}
 }
 
+// 一个函数的指令生成完毕后做窥孔优化
+func (c *Compiler) finishInstructions(ins code.Instruction, lines code.LineTable) (code.Instruction, code.LineTable) {
+	if c.optimization < OptimizePeephole {
+		return ins, lines
+	}
+	return peephole(ins, lines)
+}
+
 func (c *Compiler) setLastInstruction(op code.Opcode, pos int) {
 	previous := c.scopes[c.scopeIndex].lastInstruction
 	last := EmittedInstruction{Opcode: op, Position: pos}
@@ -565,6 +738,7 @@ func (c *Compiler) removeLastOpPop() {
 	new := old[:last.Position]
 	c.scopes[c.scopeIndex].instruction = new
 	c.scopes[c.scopeIndex].lastInstruction = prev
+	c.scopes[c.scopeIndex].lines = c.scopes[c.scopeIndex].lines.Truncate(last.Position)
 }
 
 func (c *Compiler) changeOperand(opPos int, operand int) {
@@ -601,19 +775,216 @@ func (c *Compiler) leaveScope() code.Instruction {
 	return instruction
 }
 
+// if 分支的值留在栈上; 分支以 let 等语句结尾时值为 null
+// 只编译条件为常量时会执行的分支, 分支为 nil 时结果为 null
+func (c *Compiler) compileBranch(branch *ast.BlockStatement) error {
+	start := len(c.currentInstructions())
+	if branch != nil {
+		err := c.Compile(branch)
+		if err != nil {
+			return err
+		}
+	}
+	// 分支没有生成指令时, 最后一条指令属于前面的语句
+	if len(c.currentInstructions()) == start {
+		c.emit(code.OpNull)
+		return nil
+	}
+	c.branchValue()
+	return nil
+}
+
+func (c *Compiler) branchValue() {
+	if c.lastInstructionIs(code.OpPop) {
+		c.removeLastOpPop()
+	} else {
+		c.emit(code.OpNull)
+	}
+}
+
+// 块级作用域只切换符号表, 指令仍写入当前函数
+func (c *Compiler) enterBlockScope() {
+	c.symbolTable = NewBlockSymbolTable(c.symbolTable)
+}
+
+func (c *Compiler) leaveBlockScope() {
+	c.symbolTable = c.symbolTable.Outer
+}
+
 func (c *Compiler) replaceLastOpPopToOpReturn() {
 	lastPos := c.scopes[c.scopeIndex].lastInstruction.Position
 	c.replaceInstruction(lastPos, code.Make(code.OpReturnValue))
 	c.scopes[c.scopeIndex].lastInstruction.Opcode = code.OpReturnValue
 }
 
+// 类体编译为以 this 为参数的函数, 返回 this;
+// 类体中 let 定义的成员同时写入实例属性, 方法通过自由变量捕获 this
+func (c *Compiler) compileClassBody(node *ast.ClassStmt) error {
+	c.enterScope()
+	this := c.symbolTable.Define("this")
+
+	// 与 compileStatements 一样, 一个成员出错时继续编译之后的成员
+	steps := []func() error{}
+	for _, stmt := range node.Body.Statements {
+		stmt := stmt
+		steps = append(steps, func() error {
+			err := c.Compile(stmt)
+			if err != nil {
+				return err
+			}
+
+			let, ok := stmt.(*ast.LetStatement)
+			if !ok {
+				return nil
+			}
+			member, _ := c.symbolTable.Resolve(let.Name.Value)
+			c.loadSymbol(this)
+			c.loadSymbol(member)
+			c.emit(code.OpSetProperty, c.addConstant(&object.String{Value: let.Name.Value}))
+			return nil
+		})
+	}
+	if err := c.compileEach(steps...); err != nil {
+		return err
+	}
+
+	c.loadSymbol(this)
+	c.emit(code.OpReturnValue)
+
+	c.emitClosure(node.Name.Value, 1)
+	return nil
+}
+
+// 离开函数作用域, 把函数放入常量池并生成 OpClosure
+func (c *Compiler) emitClosure(name string, numParameters int) {
+	numLocals := c.symbolTable.numDefinitions
+	freeSymbols := c.symbolTable.FreeSymbol
+	lines := c.scopes[c.scopeIndex].lines
+	instruction, lines := c.finishInstructions(c.leaveScope(), lines)
+
+	// cell 中的变量捕获 cell 本身
+	for _, s := range freeSymbols {
+		c.loadSlot(s)
+	}
+
+	compiledFn := &object.CompiledFunction{
+		Instructions:  instruction,
+		NumLocals:     numLocals,
+		NumParameters: numParameters,
+		Name:          name,
+		Lines:         lines,
+	}
+	constantFnIndex := c.addConstant(compiledFn)
+	c.emit(code.OpClosure, constantFnIndex, len(freeSymbols))
+}
+
+// foo.bar 中的 bar
+func (c *Compiler) propertyName(node *ast.InfixExpression) (*object.String, error) {
+	ident, ok := node.Right.(*ast.Identifier)
+	if !ok {
+		return nil, c.errorf(node.Right, CodeInvalidProperty, "invalid property name %s", node.Right.String())
+	}
+	return &object.String{Value: ident.Value}, nil
+}
+
+// const NAME = expr; 字面量初始值直接放入常量池, 引用处内联
+func (c *Compiler) compileConst(node *ast.LetStatement) error {
+	c.symbolTable.DefineConst(node.Name.Value)
+	symbol := c.symbolTable.declaredAt(node.Name.Value, node.Name.Token.Pos)
+
+	var literal object.Object
+	switch value := node.Value.(type) {
+	case *ast.IntegerLiteral:
+		literal = &object.Integer{Value: value.Value}
+	case *ast.StringLiteral:
+		literal = &object.String{Value: value.Value}
+	}
+
+	if literal == nil {
+		err := c.Compile(node.Value)
+		if err != nil {
+			return err
+		}
+		c.storeSymbol(symbol)
+		return nil
+	}
+
+	constIndex := c.addConstant(literal)
+	c.emit(code.OpConstant, constIndex)
+	c.storeSymbol(symbol)
+	c.symbolTable.InlineConst(symbol.Name, constIndex)
+	return nil
+}
+
+// 赋值目标: 先查找已有变量, 找不到时在当前作用域定义, fresh 表示新定义的变量
+func (c *Compiler) resolveAssignTarget(name *ast.Identifier) (symbol Symbol, fresh bool) {
+	symbol, ok := c.symbolTable.Resolve(name.Value)
+	if ok {
+		return symbol, false
+	}
+	symbol = c.symbolTable.Define(name.Value)
+	if c.cells[name] {
+		symbol = c.symbolTable.markCell(name.Value)
+	}
+	return symbol, true
+}
+
+// let、class 定义的变量; 同一作用域中重复定义时沿用原来的槽位和 cell, fresh 为 false
+func (c *Compiler) defineVariable(name *ast.Identifier) (symbol Symbol, fresh bool) {
+	existing, ok := c.symbolTable.Lookup(name.Value)
+	fresh = !ok || (existing.Scope != GlobalScope && existing.Scope != LocalScope)
+	symbol = c.symbolTable.DefineAt(name.Value, name.Token.Pos)
+	if fresh && c.cells[name] {
+		symbol = c.symbolTable.markCell(name.Value)
+	}
+	return symbol, fresh
+}
+
+// 变量的初始值: 新定义的 cell 变量每次执行都放入新的 cell (循环中每次迭代各有一个)
+func (c *Compiler) initSymbol(s Symbol, fresh bool) {
+	if s.Cell && fresh {
+		c.emit(code.OpCell)
+		c.storeSlot(s)
+		return
+	}
+	c.storeSymbol(s)
+}
+
+func (c *Compiler) storeSymbol(s Symbol) {
+	if s.Cell {
+		c.loadSlot(s)
+		c.emit(code.OpSetCell)
+		return
+	}
+	c.storeSlot(s)
+}
+
+// 读写槽位本身, cell 变量的槽位中是 cell
+func (c *Compiler) storeSlot(s Symbol) {
+	switch s.Scope {
+	case GlobalScope:
+		c.emit(code.OpSetGlobal, int(code.SetTypeVar), s.Index)
+	case LocalScope:
+		c.emit(code.OpSetLocal, s.Index)
+	case FreeScope:
+		c.emit(code.OpSetFreeVar, s.Index)
+	}
+}
+
 func (c *Compiler) loadSymbol(s Symbol) {
+	if s.Inline {
+		c.emit(code.OpConstant, s.ConstIndex)
+		return
+	}
+	c.loadSlot(s)
+	if s.Cell {
+		c.emit(code.OpGetCell)
+	}
+}
+
+func (c *Compiler) loadSlot(s Symbol) {
 	switch s.Scope {
 	case GlobalScope:
-		if c.compilerCtx.infixDot {
-			c.emit(code.OpGetProperty, s.Index)
-			return
-		}
 		c.emit(code.OpGetGlobal, s.Index)
 	case LocalScope:
 		c.emit(code.OpGetLocal, s.Index)
@@ -7,6 +7,7 @@ import (
 	"monkey/lexer"
 	"monkey/object"
 	"monkey/parser"
+	"reflect"
 	"testing"
 )
 
@@ -111,8 +112,7 @@ func TestBooleanExpressions(t *testing.T) {
 			expectedInstruction: []code.Instruction{
 				code.Make(code.OpConstant, 0),
 				code.Make(code.OpConstant, 1),
-				code.Make(code.OpLessThan),
-				code.Make(code.OpBang),
+				code.Make(code.OpGreaterEqual),
 				code.Make(code.OpPop),
 			},
 		},
@@ -132,8 +132,7 @@ func TestBooleanExpressions(t *testing.T) {
 			expectedInstruction: []code.Instruction{
 				code.Make(code.OpConstant, 0),
 				code.Make(code.OpConstant, 1),
-				code.Make(code.OpGreaterThan),
-				code.Make(code.OpBang),
+				code.Make(code.OpLessEqual),
 				code.Make(code.OpPop),
 			},
 		},
@@ -328,10 +327,23 @@ func TestGlobalLetStatements(t *testing.T) {
 			},
 		},
 		{
-			input: "let a = [0,1,2]; a[2] = 5; a[2];",
-			// input:             `let a = 1, a = 2; a;`,
-			expectedConstants:   []interface{}{1},
-			expectedInstruction: []code.Instruction{},
+			input:             "let a = [0,1,2]; a[2] = 5; a[2];",
+			expectedConstants: []interface{}{0, 1, 2, 2, 5, 2},
+			expectedInstruction: []code.Instruction{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpConstant, 2),
+				code.Make(code.OpArray, 3),
+				code.Make(code.OpSetGlobal, 0, 0),
+				code.Make(code.OpGetGlobal, 0),
+				code.Make(code.OpConstant, 3),
+				code.Make(code.OpConstant, 4),
+				code.Make(code.OpSetIndex),
+				code.Make(code.OpGetGlobal, 0),
+				code.Make(code.OpConstant, 5),
+				code.Make(code.OpIndex),
+				code.Make(code.OpPop),
+			},
 		},
 	}
 
@@ -485,6 +497,41 @@ func TestIndexExpressions(t *testing.T) {
 	runCompilerTest(t, tests)
 }
 
+func TestSliceExpressions(t *testing.T) {
+	tests := []compilerTestCase{
+		{
+			input:             "[1,2,3][1:]",
+			expectedConstants: []interface{}{1, 2, 3, 1},
+			expectedInstruction: []code.Instruction{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpConstant, 2),
+				code.Make(code.OpArray, 3),
+				code.Make(code.OpConstant, 3),
+				code.Make(code.OpNull),
+				code.Make(code.OpNull),
+				code.Make(code.OpSlice),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input:             `"abc"[:-1:2]`,
+			expectedConstants: []interface{}{"abc", 1, 2},
+			expectedInstruction: []code.Instruction{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpNull),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpMinus),
+				code.Make(code.OpConstant, 2),
+				code.Make(code.OpSlice),
+				code.Make(code.OpPop),
+			},
+		},
+	}
+
+	runCompilerTest(t, tests)
+}
+
 func TestFunctionsReturnValueAndWithoutReturnValue(t *testing.T) {
 	tests := []compilerTestCase{
 		{
@@ -806,7 +853,7 @@ func TestBuiltin(t *testing.T) {
 					code.Make(code.OpGetBuiltin, 0),
 					code.Make(code.OpConstant, 0),
 					code.Make(code.OpArray, 1),
-					code.Make(code.OpCall, 1),
+					code.Make(code.OpTailCall, 1),
 					code.Make(code.OpReturnValue),
 				},
 			},
@@ -877,6 +924,38 @@ func TestClosures(t *testing.T) {
 				code.Make(code.OpPop),
 			},
 		},
+		{
+			// 捕获后又被赋值的变量放在 cell 中, 闭包捕获 cell 本身
+			input: `fn(a) { let c = 0; fn() { c = c + a; }; c }`,
+			expectedConstants: []interface{}{
+				0,
+				[]code.Instruction{
+					code.Make(code.OpGetFreeVar, 0),
+					code.Make(code.OpGetCell),
+					code.Make(code.OpGetFreeVar, 1),
+					code.Make(code.OpAdd),
+					code.Make(code.OpGetFreeVar, 0),
+					code.Make(code.OpSetCell),
+					code.Make(code.OpReturn),
+				},
+				[]code.Instruction{
+					code.Make(code.OpConstant, 0),
+					code.Make(code.OpCell),
+					code.Make(code.OpSetLocal, 1),
+					code.Make(code.OpGetLocal, 1),
+					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpClosure, 1, 2),
+					code.Make(code.OpPop),
+					code.Make(code.OpGetLocal, 1),
+					code.Make(code.OpGetCell),
+					code.Make(code.OpReturnValue),
+				},
+			},
+			expectedInstruction: []code.Instruction{
+				code.Make(code.OpClosure, 2, 0),
+				code.Make(code.OpPop),
+			},
+		},
 	}
 
 	runCompilerTest(t, tests)
@@ -896,7 +975,7 @@ func TestRecursiveFun(t *testing.T) {
 					code.Make(code.OpGetLocal, 0),
 					code.Make(code.OpConstant, 0),
 					code.Make(code.OpSub),
-					code.Make(code.OpCall, 1),
+					code.Make(code.OpTailCall, 1),
 					code.Make(code.OpReturnValue),
 				},
 				1,
@@ -915,6 +994,66 @@ func TestRecursiveFun(t *testing.T) {
 	runCompilerTest(t, tests)
 }
 
+func TestTailCalls(t *testing.T) {
+	tests := []compilerTestCase{
+		{
+			// return 的值和 if 分支末尾的调用是尾调用, 参数中的调用不是
+			input: `fn(f) { if (true) { return f(f(1)); } else { f(2) } }`,
+			expectedConstants: []interface{}{
+				1,
+				2,
+				[]code.Instruction{
+					code.Make(code.OpTrue),
+					code.Make(code.OpJumpNotTruthy, 20),
+					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpConstant, 0),
+					code.Make(code.OpCall, 1),
+					code.Make(code.OpTailCall, 1),
+					code.Make(code.OpReturnValue),
+					code.Make(code.OpNull),
+					code.Make(code.OpJump, 27),
+					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpConstant, 1),
+					code.Make(code.OpTailCall, 1),
+					code.Make(code.OpReturnValue),
+				},
+			},
+			expectedInstruction: []code.Instruction{
+				code.Make(code.OpClosure, 2, 0),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			// 后面还有语句或者结果还要参与运算的调用不是尾调用
+			input: `fn(f) { f(1); f(2) + 1 }`,
+			expectedConstants: []interface{}{
+				1,
+				2,
+				1,
+				[]code.Instruction{
+					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpConstant, 0),
+					code.Make(code.OpCall, 1),
+					code.Make(code.OpPop),
+					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpConstant, 1),
+					code.Make(code.OpCall, 1),
+					code.Make(code.OpConstant, 2),
+					code.Make(code.OpAdd),
+					code.Make(code.OpReturnValue),
+				},
+			},
+			expectedInstruction: []code.Instruction{
+				code.Make(code.OpClosure, 3, 0),
+				code.Make(code.OpPop),
+			},
+		},
+	}
+
+	runCompilerTest(t, tests)
+}
+
 func TestWhileStatement(t *testing.T) {
 	tests := []compilerTestCase{
 		{
@@ -929,12 +1068,12 @@ func TestWhileStatement(t *testing.T) {
 			},
 			expectedInstruction: []code.Instruction{
 				code.Make(code.OpConstant, 0),
-				code.Make(code.OpSetGlobal, 0),
+				code.Make(code.OpSetGlobal, 0, 0),
 				code.Make(code.OpConstant, 1),
 				code.Make(code.OpConstant, 2),
 				code.Make(code.OpLessThan),
-				code.Make(code.OpJumpNotTruthy, 19),
-				code.Make(code.OpLoop, 6),
+				code.Make(code.OpJumpNotTruthy, 20),
+				code.Make(code.OpLoop, 7),
 			},
 		},
 	}
@@ -976,17 +1115,88 @@ func TestAssignExpression(t *testing.T) {
 				1,
 				[]code.Instruction{
 					code.Make(code.OpGetLocal, 0),
-					code.Make(code.OpSetGlobal, 0),
+					code.Make(code.OpSetGlobal, 0, 0),
 					code.Make(code.OpReturn),
 				},
 			},
 			expectedInstruction: []code.Instruction{
 				code.Make(code.OpConstant, 0),
-				code.Make(code.OpSetGlobal, 0),
+				code.Make(code.OpSetGlobal, 0, 0),
 				code.Make(code.OpConstant, 1),
-				code.Make(code.OpSetGlobal, 0),
-				code.Make(code.OpClosure, 2),
-				code.Make(code.OpSetGlobal, 1),
+				code.Make(code.OpSetGlobal, 0, 0),
+				code.Make(code.OpClosure, 2, 0),
+				code.Make(code.OpSetGlobal, 0, 1),
+			},
+		},
+		{
+			input: `
+				let h = {};
+				h.a = 1;
+				h["b"] = h.a;
+			`,
+			expectedConstants: []interface{}{1, "a", "b", "a"},
+			expectedInstruction: []code.Instruction{
+				code.Make(code.OpHash, 0),
+				code.Make(code.OpSetGlobal, 0, 0),
+				code.Make(code.OpGetGlobal, 0),
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpSetProperty, 1),
+				code.Make(code.OpGetGlobal, 0),
+				code.Make(code.OpConstant, 2),
+				code.Make(code.OpGetGlobal, 0),
+				code.Make(code.OpGetProperty, 3),
+				code.Make(code.OpSetIndex),
+			},
+		},
+		{
+			// 复合赋值复制栈上的目标和下标, 不再求值一次
+			input:             `let a = [1]; a[0] += 2; a.b -= 3;`,
+			expectedConstants: []interface{}{1, 0, 2, "b", 3, "b"},
+			expectedInstruction: []code.Instruction{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpArray, 1),
+				code.Make(code.OpSetGlobal, 0, 0),
+				code.Make(code.OpGetGlobal, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpDup, 2),
+				code.Make(code.OpIndex),
+				code.Make(code.OpConstant, 2),
+				code.Make(code.OpAdd),
+				code.Make(code.OpSetIndex),
+				code.Make(code.OpGetGlobal, 0),
+				code.Make(code.OpDup, 1),
+				code.Make(code.OpGetProperty, 3),
+				code.Make(code.OpConstant, 4),
+				code.Make(code.OpSub),
+				code.Make(code.OpSetProperty, 5),
+			},
+		},
+		{
+			input: `
+				let f = fn() { let a = [[1]]; a[0][0] = 2; };
+			`,
+			expectedConstants: []interface{}{
+				1,
+				0,
+				0,
+				2,
+				[]code.Instruction{
+					code.Make(code.OpConstant, 0),
+					code.Make(code.OpArray, 1),
+					code.Make(code.OpArray, 1),
+					code.Make(code.OpSetLocal, 0),
+					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpConstant, 1),
+					code.Make(code.OpIndex),
+					code.Make(code.OpConstant, 2),
+					code.Make(code.OpConstant, 3),
+					code.Make(code.OpSetIndex),
+					code.Make(code.OpReturn),
+				},
+			},
+			expectedInstruction: []code.Instruction{
+				code.Make(code.OpClosure, 4, 0),
+				code.Make(code.OpSetGlobal, 0, 0),
 			},
 		},
 	}
@@ -1040,22 +1250,151 @@ func TestForStatement(t *testing.T) {
 			},
 			expectedInstruction: []code.Instruction{
 				code.Make(code.OpConstant, 0),
-				code.Make(code.OpSetGlobal, 0),
+				code.Make(code.OpSetGlobal, 0, 0),
 				code.Make(code.OpGetGlobal, 0),
 				code.Make(code.OpConstant, 1),
 				code.Make(code.OpGreaterThan),
-				code.Make(code.OpJumpNotTruthy, 43),
-				code.Make(code.OpJump, 32),
+				code.Make(code.OpJumpNotTruthy, 45),
+				code.Make(code.OpJump, 34),
 				code.Make(code.OpGetGlobal, 0),
 				code.Make(code.OpConstant, 2),
 				code.Make(code.OpAdd),
-				code.Make(code.OpSetGlobal, 0),
-				code.Make(code.OpLoop, 6),
+				code.Make(code.OpSetGlobal, 0, 0),
+				code.Make(code.OpLoop, 7),
 				code.Make(code.OpGetBuiltin, 1),
 				code.Make(code.OpGetGlobal, 0),
 				code.Make(code.OpCall, 1),
 				code.Make(code.OpPop),
-				code.Make(code.OpLoop, 19),
+				code.Make(code.OpLoop, 20),
+			},
+		},
+	}
+
+	runCompilerTest(t, tests)
+}
+
+func TestBlockScopes(t *testing.T) {
+	tests := []compilerTestCase{
+		{
+			input: `
+				let a = 1;
+				if (true) { let a = 2; a; }
+				a;
+			`,
+			expectedConstants: []interface{}{1, 2},
+			expectedInstruction: []code.Instruction{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpSetGlobal, 0, 0),
+				code.Make(code.OpTrue),
+				code.Make(code.OpJumpNotTruthy, 24),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpSetGlobal, 0, 1),
+				code.Make(code.OpGetGlobal, 1),
+				code.Make(code.OpJump, 25),
+				code.Make(code.OpNull),
+				code.Make(code.OpPop),
+				code.Make(code.OpGetGlobal, 0),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input: `
+				let a = 1;
+				fn() { let a = 2; a };
+			`,
+			expectedConstants: []interface{}{
+				1,
+				2,
+				[]code.Instruction{
+					code.Make(code.OpConstant, 1),
+					code.Make(code.OpSetLocal, 0),
+					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpReturnValue),
+				},
+			},
+			expectedInstruction: []code.Instruction{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpSetGlobal, 0, 0),
+				code.Make(code.OpClosure, 2, 0),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input: `
+				for (let i = 0; i < 1; i = i + 1) { fn() { i }; }
+			`,
+			expectedConstants: []interface{}{
+				0,
+				1,
+				1,
+				[]code.Instruction{
+					code.Make(code.OpGetFreeVar, 0),
+					code.Make(code.OpReturnValue),
+				},
+			},
+			expectedInstruction: []code.Instruction{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpSetGlobal, 0, 0),
+				code.Make(code.OpGetGlobal, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpLessThan),
+				code.Make(code.OpJumpNotTruthy, 45),
+				code.Make(code.OpJump, 34),
+				code.Make(code.OpGetGlobal, 0),
+				code.Make(code.OpConstant, 2),
+				code.Make(code.OpAdd),
+				code.Make(code.OpSetGlobal, 0, 0),
+				code.Make(code.OpLoop, 7),
+				code.Make(code.OpGetGlobal, 0),
+				code.Make(code.OpClosure, 3, 1),
+				code.Make(code.OpPop),
+				code.Make(code.OpLoop, 20),
+			},
+		},
+	}
+
+	runCompilerTest(t, tests)
+}
+
+func TestConstStatements(t *testing.T) {
+	tests := []compilerTestCase{
+		{
+			input:             `const a = 1; a + a;`,
+			expectedConstants: []interface{}{1},
+			expectedInstruction: []code.Instruction{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpSetGlobal, 0, 0),
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpAdd),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input: `const s = "monkey"; fn() { s };`,
+			expectedConstants: []interface{}{
+				"monkey",
+				[]code.Instruction{
+					code.Make(code.OpConstant, 0),
+					code.Make(code.OpReturnValue),
+				},
+			},
+			expectedInstruction: []code.Instruction{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpSetGlobal, 0, 0),
+				code.Make(code.OpClosure, 1, 0),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input:             `const a = [1]; a;`,
+			expectedConstants: []interface{}{1},
+			expectedInstruction: []code.Instruction{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpArray, 1),
+				code.Make(code.OpSetGlobal, 0, 0),
+				code.Make(code.OpGetGlobal, 0),
+				code.Make(code.OpPop),
 			},
 		},
 	}
@@ -1063,38 +1402,94 @@ func TestForStatement(t *testing.T) {
 	runCompilerTest(t, tests)
 }
 
+func TestConstReassignment(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{`const a = 1; a = 2;`, "cannot assign to constant `a`"},
+		{`const a = 1; a += 2;`, "cannot assign to constant `a`"},
+		{`const a = [1]; fn() { a = 2; };`, "cannot assign to constant `a`"},
+		{`const a = 1; let a = 2;`, "constant `a` already declared"},
+		{`const a = 1; const a = 2;`, "constant `a` already declared"},
+	}
+
+	for _, tt := range tests {
+		compiler := New()
+		err := compiler.Compile(parse(tt.input))
+		if err == nil {
+			t.Errorf("expected compiler error for %q", tt.input)
+			continue
+		}
+		if err.Error() != tt.expected {
+			t.Errorf("wrong compiler error. want=%q, got=%q", tt.expected, err)
+		}
+	}
+
+	// 块内可以遮蔽外层常量
+	compiler := New()
+	err := compiler.Compile(parse(`const a = 1; if (true) { let a = 2; a = 3; }`))
+	if err != nil {
+		t.Errorf("shadowing a constant in a block failed: %s", err)
+	}
+}
+
 func TestClassStatement(t *testing.T) {
 	tests := []compilerTestCase{
 		{
 			input: `
 				class Foo {
 					this.a = 1;
-					this.b = 2;
 					let bar = fn() {
-						return 1;
+						return this.a;
 					};
 				}
 				let foo = Foo();
 				foo.bar();
-				foo.a;
-				foo.b;
+				foo.a = 2;
 			`,
 			expectedConstants: []interface{}{
 				1,
+				"a",
+				"a",
 				[]code.Instruction{
+					code.Make(code.OpGetFreeVar, 0),
+					code.Make(code.OpGetProperty, 2),
+					code.Make(code.OpReturnValue),
+				},
+				"bar",
+				[]code.Instruction{
+					code.Make(code.OpGetLocal, 0),
 					code.Make(code.OpConstant, 0),
+					code.Make(code.OpSetProperty, 1),
+					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpClosure, 3, 1),
+					code.Make(code.OpSetLocal, 1),
+					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpGetLocal, 1),
+					code.Make(code.OpSetProperty, 4),
+					code.Make(code.OpGetLocal, 0),
 					code.Make(code.OpReturnValue),
 				},
+				"Foo",
+				"bar",
+				2,
+				"a",
 			},
 			expectedInstruction: []code.Instruction{
-				code.Make(code.OpClass),
-				code.Make(code.OpDefineClass, 0),
-				code.Make(code.OpMethod, 1),
-				code.Make(code.OpSetGlobal, 1),
-				code.Make(code.OpPop),
+				code.Make(code.OpClosure, 5, 0),
+				code.Make(code.OpClass, 6),
+				code.Make(code.OpSetGlobal, 0, 0),
 				code.Make(code.OpGetGlobal, 0),
 				code.Make(code.OpCall, 0),
-				code.Make(code.OpSetGlobal, 2),
+				code.Make(code.OpSetGlobal, 0, 1),
+				code.Make(code.OpGetGlobal, 1),
+				code.Make(code.OpGetProperty, 7),
+				code.Make(code.OpCall, 0),
+				code.Make(code.OpPop),
+				code.Make(code.OpGetGlobal, 1),
+				code.Make(code.OpConstant, 8),
+				code.Make(code.OpSetProperty, 9),
 			},
 		},
 	}
@@ -1102,11 +1497,42 @@ func TestClassStatement(t *testing.T) {
 	runCompilerTest(t, tests)
 }
 
+func TestInvalidAssignment(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{`len = 1;`, "cannot assign to `len`"},
+		{`1 = 2;`, "invalid assignment target 1"},
+		{`let a = {}; a.(1) = 2;`, "invalid property name 1"},
+		{`this.a = 1;`, "`this` outside of class"},
+		{`puts(macro(a) { a });`, "macro must be defined by a let statement"},
+	}
+
+	for _, tt := range tests {
+		compiler := New()
+		err := compiler.Compile(parse(tt.input))
+		if err == nil {
+			t.Errorf("expected compiler error for %q", tt.input)
+			continue
+		}
+		if err.Error() != tt.expected {
+			t.Errorf("wrong compiler error. want=%q, got=%q", tt.expected, err)
+		}
+	}
+}
+
 func runCompilerTest(t *testing.T, tests []compilerTestCase) {
+	t.Helper()
+	runCompilerTestWithLevel(t, tests, OptimizeNone)
+}
+
+func runCompilerTestWithLevel(t *testing.T, tests []compilerTestCase, level OptimizationLevel) {
 	t.Helper()
 	for _, tt := range tests {
 		program := parse(tt.input)
 		compiler := New()
+		compiler.SetOptimizationLevel(level)
 		err := compiler.Compile(program)
 
 		if err != nil {
@@ -1208,3 +1634,81 @@ func testStringObject(expected string, actual object.Object) error {
 
 	return nil
 }
+
+// 每条指令记录生成它的节点的位置: 中缀表达式是运算符, 调用是 (
+func TestLineTable(t *testing.T) {
+	input := `let x = 1;
+puts(x +
+  "a");`
+	expected := code.LineTable{
+		{Offset: 0, Line: 1, Column: 9},  // OpConstant 1
+		{Offset: 3, Line: 1, Column: 1},  // OpSetGlobal
+		{Offset: 7, Line: 2, Column: 1},  // OpGetBuiltin puts
+		{Offset: 9, Line: 2, Column: 6},  // OpGetGlobal x
+		{Offset: 12, Line: 3, Column: 3}, // OpConstant "a"
+		{Offset: 15, Line: 2, Column: 8}, // OpAdd
+		{Offset: 16, Line: 2, Column: 5}, // OpCall
+		{Offset: 18, Line: 2, Column: 1}, // OpPop
+	}
+
+	for _, level := range []OptimizationLevel{OptimizeNone, OptimizePeephole} {
+		comp := New()
+		comp.SetOptimizationLevel(level)
+		if err := comp.Compile(parse(input)); err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+		if got := comp.ByteCode().Lines; !reflect.DeepEqual(got, expected) {
+			t.Errorf("wrong line table at level %d.\nwant=%v\ngot= %v", level, expected, got)
+		}
+	}
+}
+
+// 删除和替换指令后函数的位置表仍然对应指令
+func TestFunctionLineTable(t *testing.T) {
+	input := `fn(x) {
+  if (x) { let y = 1; }
+  x + 1
+}`
+	tests := []struct {
+		level    OptimizationLevel
+		expected code.LineTable
+	}{
+		{
+			OptimizeNone,
+			code.LineTable{
+				{Offset: 0, Line: 2, Column: 7},  // OpGetLocal x
+				{Offset: 2, Line: 2, Column: 3},  // OpJumpNotTruthy
+				{Offset: 5, Line: 2, Column: 20}, // OpConstant 1
+				{Offset: 8, Line: 2, Column: 12}, // OpSetLocal
+				{Offset: 10, Line: 2, Column: 3}, // OpNull; OpJump; OpNull; OpPop
+				{Offset: 16, Line: 3, Column: 3}, // OpGetLocal x
+				{Offset: 18, Line: 3, Column: 7}, // OpConstant 1
+				{Offset: 21, Line: 3, Column: 5}, // OpAdd
+				{Offset: 22, Line: 3, Column: 3}, // OpReturnValue
+			},
+		},
+		{
+			OptimizePeephole,
+			code.LineTable{
+				{Offset: 0, Line: 2, Column: 7},  // OpGetLocal x
+				{Offset: 2, Line: 2, Column: 3},  // OpJumpNotTruthy
+				{Offset: 5, Line: 2, Column: 20}, // OpConstant 1
+				{Offset: 8, Line: 2, Column: 12}, // OpSetLocal
+				{Offset: 10, Line: 3, Column: 3}, // OpAddLocalConstant; OpReturnValue
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		comp := New()
+		comp.SetOptimizationLevel(tt.level)
+		if err := comp.Compile(parse(input)); err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+		constants := comp.ByteCode().Constants
+		fn := constants[len(constants)-1].(*object.CompiledFunction)
+		if !reflect.DeepEqual(fn.Lines, tt.expected) {
+			t.Errorf("wrong line table at level %d.\nwant=%v\ngot= %v", tt.level, tt.expected, fn.Lines)
+		}
+	}
+}
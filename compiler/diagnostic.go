@@ -0,0 +1,167 @@
+package compiler
+
+import (
+	"fmt"
+	"monkey/ast"
+	"monkey/suggest"
+	"monkey/token"
+	"strings"
+)
+
+type Severity string
+
+const (
+	SeverityError   Severity = "error"
+	SeverityWarning Severity = "warning"
+)
+
+// 诊断代码, 编辑器和 CI 按代码识别错误, 已有的代码不能改变含义
+const (
+	CodeSyntax            = "E0000" // 语法错误, 由调用者从解析器的错误转换
+	CodeUndefinedVariable = "E0001"
+	CodeThisOutsideClass  = "E0002"
+	CodeConstRedeclared   = "E0003"
+	CodeAssignToConst     = "E0004"
+	CodeInvalidAssignment = "E0005" // 赋值给内置函数、函数名或不能赋值的表达式
+	CodeInvalidProperty   = "E0006"
+	CodeMacroOutsideLet   = "E0007"
+	CodeUnknownOperator   = "E0008"
+	CodeMacroExpansion    = "E0009" // 宏展开失败, 由调用者从宏展开的错误转换
+)
+
+// 源码范围 [Start, End); 没有位置信息时 Start 无效
+type Span struct {
+	Start token.Position `json:"start"`
+	End   token.Position `json:"end"`
+}
+
+// 编译期的错误或警告
+type Diagnostic struct {
+	Severity Severity `json:"severity"`
+	Code     string   `json:"code"`
+	Span     Span     `json:"span"`
+	Message  string   `json:"message"`
+	Notes    []Note   `json:"notes,omitempty"`
+}
+
+// 诊断的补充说明, 例如相关的声明位置; Span 可以无效
+type Note struct {
+	Span    Span   `json:"span"`
+	Message string `json:"message"`
+}
+
+// 只包含错误信息; 带位置的输出见 Report
+func (d *Diagnostic) Error() string {
+	return d.Message
+}
+
+// file:line:column: error[E0001]: message, 之后是源码行和标出范围的 ^^^, 最后是补充说明;
+// source 为空时没有源码行
+func (d *Diagnostic) Report(file, source string) string {
+	var out strings.Builder
+	fmt.Fprintf(&out, "%s: %s[%s]: %s", location(file, d.Span), d.Severity, d.Code, d.Message)
+	lines := strings.Split(strings.ReplaceAll(source, "\r\n", "\n"), "\n")
+	if source != "" && d.Span.Start.IsValid() && d.Span.Start.Line <= len(lines) {
+		line := lines[d.Span.Start.Line-1]
+		out.WriteString("\n\t" + line + "\n\t" + underline(line, d.Span))
+	}
+	for _, note := range d.Notes {
+		fmt.Fprintf(&out, "\n%s: note: %s", location(file, note.Span), note.Message)
+	}
+	return out.String()
+}
+
+func location(file string, span Span) string {
+	if !span.Start.IsValid() {
+		return file
+	}
+	return fmt.Sprintf("%s:%s", file, span.Start)
+}
+
+// 范围第一行下面的 ^, 跨行的范围标到行尾; 制表符保留以便和源码行对齐
+func underline(line string, span Span) string {
+	start := span.Start.Column - 1
+	if start > len(line) {
+		start = len(line)
+	}
+	end := len(line)
+	if span.End.Line == span.Start.Line && span.End.Column-1 < end {
+		end = span.End.Column - 1
+	}
+
+	if end < start+1 {
+		end = start + 1
+	}
+
+	var out strings.Builder
+	for _, ch := range line[:start] {
+		if ch == '\t' {
+			out.WriteRune('\t')
+		} else {
+			out.WriteRune(' ')
+		}
+	}
+	width := 1
+	if end <= len(line) {
+		width = len([]rune(line[start:end]))
+	}
+	out.WriteString(strings.Repeat("^", width))
+	return out.String()
+}
+
+// 一次编译的所有诊断, 按源码顺序
+type Diagnostics []*Diagnostic
+
+func (d Diagnostics) Error() string {
+	messages := make([]string, len(d))
+	for i, diagnostic := range d {
+		messages[i] = diagnostic.Message
+	}
+	return strings.Join(messages, "\n")
+}
+
+// 编译错误的诊断; err 不是编译器产生的错误时返回 false
+func AsDiagnostics(err error) (Diagnostics, bool) {
+	switch err := err.(type) {
+	case Diagnostics:
+		return err, true
+	case *Diagnostic:
+		return Diagnostics{err}, true
+	}
+	return nil, false
+}
+
+// node 处的错误; node 没有位置信息时 (宏展开生成的节点) 使用正在编译的外层节点的位置
+func (c *Compiler) errorf(node ast.Node, code string, format string, a ...interface{}) *Diagnostic {
+	start, end := ast.Span(node)
+	if !start.IsValid() {
+		start, end = c.position, c.position
+	}
+	return &Diagnostic{
+		Severity: SeverityError,
+		Code:     code,
+		Span:     Span{Start: start, End: end},
+		Message:  fmt.Sprintf(format, a...),
+	}
+}
+
+// 变量声明位置的说明
+func declaredHere(symbol Symbol, what string) []Note {
+	if !symbol.Pos.IsValid() {
+		return nil
+	}
+	end := token.Position{Offset: symbol.Pos.Offset + len(symbol.Name), Line: symbol.Pos.Line, Column: symbol.Pos.Column + len(symbol.Name)}
+	return []Note{{
+		Span:    Span{Start: symbol.Pos, End: end},
+		Message: fmt.Sprintf("`%s` %s here", symbol.Name, what),
+	}}
+}
+
+// 在 candidates 中找拼写相近的名字, 说明的范围与诊断相同, 编辑器可以直接替换
+func didYouMean(span Span, name string, candidates []string) []Note {
+	closest, ok := suggest.Closest(name, candidates)
+	if !ok {
+		return nil
+	}
+	return []Note{{Span: span, Message: fmt.Sprintf("did you mean '%s'?", closest)}}
+}
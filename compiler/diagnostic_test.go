@@ -0,0 +1,229 @@
+package compiler
+
+import (
+	"monkey/token"
+	"reflect"
+	"testing"
+)
+
+func pos(line, column, offset int) token.Position {
+	return token.Position{Offset: offset, Line: line, Column: column}
+}
+
+func TestDiagnostics(t *testing.T) {
+	input := "const a = 1;\nlet f = fn() { let x = y; a = 2; x };\nlet g = fn() { f() };\nthis.z = g();\n"
+
+	err := New().Compile(parse(input))
+	diagnostics, ok := AsDiagnostics(err)
+	if !ok {
+		t.Fatalf("expected diagnostics, got %T (%v)", err, err)
+	}
+
+	expected := Diagnostics{
+		{
+			Severity: SeverityError,
+			Code:     CodeUndefinedVariable,
+			Span:     Span{Start: pos(2, 24, 36), End: pos(2, 25, 37)},
+			Message:  "undefined variable `y`",
+		},
+		{
+			Severity: SeverityError,
+			Code:     CodeAssignToConst,
+			Span:     Span{Start: pos(2, 27, 39), End: pos(2, 28, 40)},
+			Message:  "cannot assign to constant `a`",
+			Notes: []Note{{
+				Span:    Span{Start: pos(1, 7, 6), End: pos(1, 8, 7)},
+				Message: "`a` was declared as a constant here",
+			}},
+		},
+		{
+			Severity: SeverityError,
+			Code:     CodeThisOutsideClass,
+			Span:     Span{Start: pos(4, 1, 73), End: pos(4, 5, 77)},
+			Message:  "`this` outside of class",
+		},
+	}
+	if !reflect.DeepEqual(diagnostics, expected) {
+		t.Errorf("wrong diagnostics.\nwant=%s\ngot= %s", describeDiagnostics(expected), describeDiagnostics(diagnostics))
+	}
+	if err.Error() != "undefined variable `y`\ncannot assign to constant `a`\n`this` outside of class" {
+		t.Errorf("wrong error message: %q", err)
+	}
+}
+
+// 出错之后恢复作用域, 之后的语句正常编译
+func TestDiagnosticsRecovery(t *testing.T) {
+	input := `
+		let f = fn(a) { if (a) { let b = c; } };
+		let d = fn() { a };
+		let e = f(1);
+		e
+	`
+	err := New().Compile(parse(input))
+	diagnostics, ok := AsDiagnostics(err)
+	if !ok {
+		t.Fatalf("expected diagnostics, got %T (%v)", err, err)
+	}
+	messages := []string{}
+	for _, d := range diagnostics {
+		messages = append(messages, d.Message)
+	}
+	expected := []string{"undefined variable `c`", "undefined variable `a`"}
+	if !reflect.DeepEqual(messages, expected) {
+		t.Errorf("wrong diagnostics. want=%q, got=%q", expected, messages)
+	}
+}
+
+// if 的两个分支和类的成员中出错后也继续编译
+func TestDiagnosticsRecoveryInBranchesAndClasses(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected []string
+	}{
+		{
+			"let p = 1; if (p) { let q = yy; } else { ww }",
+			[]string{"undefined variable `yy`", "undefined variable `ww`"},
+		},
+		{
+			"if (pp) { yy } else { ww }; zz",
+			[]string{"undefined variable `pp`", "undefined variable `yy`", "undefined variable `ww`", "undefined variable `zz`"},
+		},
+		{
+			"class K { let m = fn(){ qq }; let n = rr; }",
+			[]string{"undefined variable `qq`", "undefined variable `rr`"},
+		},
+		{
+			"let f = fn(a) { class K { let m = xx; let n = a + yy; } if (a) { K } else { zz } }",
+			[]string{"undefined variable `xx`", "undefined variable `yy`", "undefined variable `zz`"},
+		},
+	}
+
+	for _, tt := range tests {
+		for _, level := range []OptimizationLevel{OptimizeNone, OptimizeBasic} {
+			compiler := New()
+			compiler.SetOptimizationLevel(level)
+			err := compiler.Compile(parse(tt.input))
+			diagnostics, ok := AsDiagnostics(err)
+			if !ok {
+				t.Fatalf("expected diagnostics for %q, got %T (%v)", tt.input, err, err)
+			}
+			messages := []string{}
+			for _, d := range diagnostics {
+				messages = append(messages, d.Message)
+			}
+			if !reflect.DeepEqual(messages, tt.expected) {
+				t.Errorf("wrong diagnostics for %q at level %d. want=%q, got=%q", tt.input, level, tt.expected, messages)
+			}
+		}
+	}
+}
+
+// 未定义的名字用 OpNull 占位, 同一个表达式或循环中的其他名字也会报告
+func TestDiagnosticsRecoveryInExpressions(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected []string
+	}{
+		{"while (aa) { bb; }", []string{"undefined variable `aa`", "undefined variable `bb`"}},
+		{"for (let i = 0; i < cc; i += 1) { dd }", []string{"undefined variable `cc`", "undefined variable `dd`"}},
+		{"[hh, ii]", []string{"undefined variable `hh`", "undefined variable `ii`"}},
+		{"{ee: ff}", []string{"undefined variable `ee`", "undefined variable `ff`"}},
+		{"kk[ll] = mm", []string{"undefined variable `kk`", "undefined variable `ll`", "undefined variable `mm`"}},
+		{"let f = fn(a) { gg(a, hh) }; f(ii)", []string{"undefined variable `gg`", "undefined variable `hh`", "undefined variable `ii`"}},
+		// 与其他诊断按源码顺序排列
+		{"const c = 1; [aa, fn() { c = 2 }]; bb", []string{"undefined variable `aa`", "cannot assign to constant `c`", "undefined variable `bb`"}},
+	}
+
+	for _, tt := range tests {
+		for _, level := range []OptimizationLevel{OptimizeNone, OptimizeBasic, OptimizePeephole} {
+			compiler := New()
+			compiler.SetOptimizationLevel(level)
+			err := compiler.Compile(parse(tt.input))
+			diagnostics, ok := AsDiagnostics(err)
+			if !ok {
+				t.Fatalf("expected diagnostics for %q, got %T (%v)", tt.input, err, err)
+			}
+			messages := []string{}
+			for _, d := range diagnostics {
+				messages = append(messages, d.Message)
+			}
+			if !reflect.DeepEqual(messages, tt.expected) {
+				t.Errorf("wrong diagnostics for %q at level %d. want=%q, got=%q", tt.input, level, tt.expected, messages)
+			}
+		}
+	}
+}
+
+func TestUndefinedVariableSuggestions(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string // 没有建议时为空
+	}{
+		{`let counter = 1; countr`, "did you mean 'counter'?"},
+		{`psuh([], 1)`, "did you mean 'push'?"},
+		{`let total = 1; fn() { let totals = 2; totl }`, "did you mean 'total'?"},
+		// 距离相同时内层作用域优先
+		{`let abcd = 1; fn() { let abce = 2; abcf }`, "did you mean 'abce'?"},
+		{`let f = fn(value) { fn() { valeu } }`, "did you mean 'value'?"},
+		{`let foo = 1; bar`, ""},
+		{`let a = 1; b`, ""},
+	}
+
+	for _, tt := range tests {
+		err := New().Compile(parse(tt.input))
+		diagnostics, ok := AsDiagnostics(err)
+		if !ok || len(diagnostics) != 1 {
+			t.Fatalf("expected one diagnostic for %q, got %v", tt.input, err)
+		}
+		d := diagnostics[0]
+		if tt.expected == "" {
+			if len(d.Notes) != 0 {
+				t.Errorf("unexpected notes for %q: %v", tt.input, d.Notes)
+			}
+			continue
+		}
+		if len(d.Notes) != 1 || d.Notes[0].Message != tt.expected {
+			t.Errorf("wrong suggestion for %q. want=%q, got=%v", tt.input, tt.expected, d.Notes)
+			continue
+		}
+		if d.Notes[0].Span != d.Span {
+			t.Errorf("suggestion span should be the undefined name: %v", d.Notes[0].Span)
+		}
+	}
+}
+
+func TestDiagnosticReport(t *testing.T) {
+	d := &Diagnostic{
+		Severity: SeverityError,
+		Code:     CodeAssignToConst,
+		Span:     Span{Start: pos(2, 2, 14), End: pos(2, 7, 19)},
+		Message:  "cannot assign to constant `limit`",
+		Notes: []Note{{
+			Span:    Span{Start: pos(1, 7, 6), End: pos(1, 12, 11)},
+			Message: "`limit` was declared as a constant here",
+		}},
+	}
+	source := "const limit = 1;\r\n\tlimit = 3;\r\n"
+
+	expected := "a.mon:2:2: error[E0004]: cannot assign to constant `limit`\n" +
+		"\t\tlimit = 3;\n" +
+		"\t\t^^^^^\n" +
+		"a.mon:1:7: note: `limit` was declared as a constant here"
+	if got := d.Report("a.mon", source); got != expected {
+		t.Errorf("wrong report.\nwant=%q\ngot= %q", expected, got)
+	}
+
+	d = &Diagnostic{Severity: SeverityError, Code: CodeSyntax, Message: "expected next token to be ')'"}
+	expected = "a.mon: error[E0000]: expected next token to be ')'"
+	if got := d.Report("a.mon", source); got != expected {
+		t.Errorf("wrong report without span.\nwant=%q\ngot= %q", expected, got)
+	}
+}
+
+func describeDiagnostics(diagnostics Diagnostics) string {
+	out := ""
+	for _, d := range diagnostics {
+		out += "\n  " + d.Report("input", "")
+	}
+	return out
+}
@@ -0,0 +1,196 @@
+package compiler
+
+import (
+	"fmt"
+	"monkey/ast"
+	"monkey/token"
+)
+
+type OptimizationLevel int
+
+const (
+	OptimizeNone     OptimizationLevel = iota // 按源码逐句编译
+	OptimizeBasic                             // 常量折叠、裁剪常量条件的分支、删除 return 之后的代码 (仍检查其中的名字)
+	OptimizePeephole                          // 在生成的指令上做窥孔优化, 见 peephole.go
+)
+
+func (c *Compiler) SetOptimizationLevel(level OptimizationLevel) {
+	c.optimization = level
+}
+
+// 编译前在语法树上做的优化, 在拷贝上进行, 不修改调用者的语法树
+func optimize(program *ast.Program) (*ast.Program, error) {
+	optimized, err := ast.Rewrite(ast.Clone(program), func(node ast.Node) ast.Node {
+		switch node := node.(type) {
+		case *ast.InfixExpression:
+			if folded := foldInfix(node); folded != nil {
+				return folded
+			}
+		case *ast.PrefixExpression:
+			if folded := foldPrefix(node); folded != nil {
+				return folded
+			}
+		}
+		return node
+	})
+	if err != nil {
+		return nil, err
+	}
+	return optimized.(*ast.Program), nil
+}
+
+// 两边都是字面量时在编译期求值; 类型不符、除以 0 等运行时错误留给虚拟机报告
+func foldInfix(node *ast.InfixExpression) ast.Expression {
+	switch node.Operator {
+	case "&&", "||":
+		// 与虚拟机一致: 返回决定结果的操作数
+		truthy, ok := constantTruthiness(node.Left)
+		if !ok {
+			return nil
+		}
+		if truthy == (node.Operator == "||") {
+			// 右边是字面量时才能丢掉, 否则其中的名字不会被检查
+			if _, ok := constantTruthiness(node.Right); !ok {
+				return nil
+			}
+			return node.Left
+		}
+		return node.Right
+	}
+
+	switch left := node.Left.(type) {
+	case *ast.IntegerLiteral:
+		right, ok := node.Right.(*ast.IntegerLiteral)
+		if !ok {
+			return nil
+		}
+		return foldIntegers(node.Operator, left.Value, right.Value)
+	case *ast.StringLiteral:
+		right, ok := node.Right.(*ast.StringLiteral)
+		if !ok {
+			return nil
+		}
+		switch node.Operator {
+		case "+":
+			return stringLiteral(left.Value + right.Value)
+		case "==":
+			return booleanLiteral(left.Value == right.Value)
+		case "!=":
+			return booleanLiteral(left.Value != right.Value)
+		case "<":
+			return booleanLiteral(left.Value < right.Value)
+		case ">":
+			return booleanLiteral(left.Value > right.Value)
+		case "<=":
+			return booleanLiteral(left.Value <= right.Value)
+		case ">=":
+			return booleanLiteral(left.Value >= right.Value)
+		}
+	case *ast.Boolean:
+		right, ok := node.Right.(*ast.Boolean)
+		if !ok {
+			return nil
+		}
+		switch node.Operator {
+		case "==":
+			return booleanLiteral(left.Value == right.Value)
+		case "!=":
+			return booleanLiteral(left.Value != right.Value)
+		}
+	}
+	return nil
+}
+
+func foldIntegers(operator string, left, right int64) ast.Expression {
+	switch operator {
+	case "+":
+		return integerLiteral(left + right)
+	case "-":
+		return integerLiteral(left - right)
+	case "*":
+		return integerLiteral(left * right)
+	case "/":
+		if right == 0 {
+			return nil
+		}
+		return integerLiteral(left / right)
+	case "<":
+		return booleanLiteral(left < right)
+	case ">":
+		return booleanLiteral(left > right)
+	case "<=":
+		return booleanLiteral(left <= right)
+	case ">=":
+		return booleanLiteral(left >= right)
+	case "==":
+		return booleanLiteral(left == right)
+	case "!=":
+		return booleanLiteral(left != right)
+	}
+	return nil
+}
+
+func foldPrefix(node *ast.PrefixExpression) ast.Expression {
+	switch node.Operator {
+	case "-":
+		if right, ok := node.Right.(*ast.IntegerLiteral); ok {
+			return integerLiteral(-right.Value)
+		}
+	case "!":
+		if truthy, ok := constantTruthiness(node.Right); ok {
+			return booleanLiteral(!truthy)
+		}
+	}
+	return nil
+}
+
+// 字面量的真假, 与虚拟机的 isTruthy 一致: 只有 false 和 null 为假
+func constantTruthiness(exp ast.Expression) (truthy bool, ok bool) {
+	switch exp := exp.(type) {
+	case *ast.Boolean:
+		return exp.Value, true
+	case *ast.IntegerLiteral, *ast.StringLiteral:
+		return true, true
+	}
+	return false, false
+}
+
+// 条件是字面量时只编译会执行的分支或循环体
+func (c *Compiler) constantCondition(condition ast.Expression) (truthy bool, ok bool) {
+	if c.optimization < OptimizeBasic {
+		return false, false
+	}
+	return constantTruthiness(condition)
+}
+
+// 不会执行的代码 (裁剪的分支、return 之后的语句) 在符号表的副本上编译,
+// 名字错误和不优化时一样报告, 生成的指令、常量和定义的变量都丢弃
+func (c *Compiler) compileDiscarded(compile func() error) error {
+	scopes, scope := len(c.scopes), c.scopes[c.scopeIndex]
+	constants, symbolTable := len(c.constants), c.symbolTable
+
+	c.symbolTable = symbolTable.snapshot()
+	err := compile()
+
+	c.scopes = c.scopes[:scopes]
+	c.scopeIndex = scopes - 1
+	c.scopes[c.scopeIndex] = scope
+	c.constants = c.constants[:constants]
+	c.symbolTable = symbolTable
+	return err
+}
+
+func integerLiteral(value int64) *ast.IntegerLiteral {
+	return &ast.IntegerLiteral{Token: token.Token{Type: token.INT, Literal: fmt.Sprintf("%d", value)}, Value: value}
+}
+
+func stringLiteral(value string) *ast.StringLiteral {
+	return &ast.StringLiteral{Token: token.Token{Type: token.STRING, Literal: value}, Value: value}
+}
+
+func booleanLiteral(value bool) *ast.Boolean {
+	if value {
+		return &ast.Boolean{Token: token.Token{Type: token.TRUE, Literal: "true"}, Value: true}
+	}
+	return &ast.Boolean{Token: token.Token{Type: token.FALSE, Literal: "false"}, Value: false}
+}
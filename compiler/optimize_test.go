@@ -0,0 +1,228 @@
+package compiler
+
+import (
+	"monkey/code"
+	"monkey/object"
+	"testing"
+)
+
+func TestConstantFolding(t *testing.T) {
+	tests := []compilerTestCase{
+		{
+			input:             "1 + 2 * 3 - 4 / 2",
+			expectedConstants: []interface{}{5},
+			expectedInstruction: []code.Instruction{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input:             `"mon" + "key"; "a" + "b" == "ab"; 1 < 2; 3 >= 4; true != false`,
+			expectedConstants: []interface{}{"monkey"},
+			expectedInstruction: []code.Instruction{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpPop),
+				code.Make(code.OpTrue),
+				code.Make(code.OpPop),
+				code.Make(code.OpTrue),
+				code.Make(code.OpPop),
+				code.Make(code.OpFalse),
+				code.Make(code.OpPop),
+				code.Make(code.OpTrue),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input:             "-(2 - 5); !5; !!false",
+			expectedConstants: []interface{}{3},
+			expectedInstruction: []code.Instruction{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpPop),
+				code.Make(code.OpFalse),
+				code.Make(code.OpPop),
+				code.Make(code.OpFalse),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			// 与虚拟机一致, && 和 || 返回决定结果的操作数
+			input:             "let x = 5; false || x; 0 && x",
+			expectedConstants: []interface{}{5},
+			expectedInstruction: []code.Instruction{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpSetGlobal, 0, 0),
+				code.Make(code.OpGetGlobal, 0),
+				code.Make(code.OpPop),
+				code.Make(code.OpGetGlobal, 0),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			// 运行时错误不折叠
+			input:             `1 / 0; 1 + "a"`,
+			expectedConstants: []interface{}{1, 0, 1, "a"},
+			expectedInstruction: []code.Instruction{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpDiv),
+				code.Make(code.OpPop),
+				code.Make(code.OpConstant, 2),
+				code.Make(code.OpConstant, 3),
+				code.Make(code.OpAdd),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			// 折叠后的常量可以内联
+			input:             "const hour = 60 * 60; hour",
+			expectedConstants: []interface{}{3600},
+			expectedInstruction: []code.Instruction{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpSetGlobal, 0, 0),
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpPop),
+			},
+		},
+	}
+
+	runCompilerTestWithLevel(t, tests, OptimizeBasic)
+}
+
+func TestDeadCodeElimination(t *testing.T) {
+	tests := []compilerTestCase{
+		{
+			input:             "if (1 > 2) { 10 } else { 20 }; 3333;",
+			expectedConstants: []interface{}{20, 3333},
+			expectedInstruction: []code.Instruction{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpPop),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input:             "if (false) { 10 }; if (true) { }",
+			expectedConstants: []interface{}{},
+			expectedInstruction: []code.Instruction{
+				code.Make(code.OpNull),
+				code.Make(code.OpPop),
+				code.Make(code.OpNull),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input:               "while (false) { puts(1); }",
+			expectedConstants:   []interface{}{},
+			expectedInstruction: []code.Instruction{},
+		},
+		{
+			input: "fn() { return 1; puts(2); }",
+			expectedConstants: []interface{}{
+				1,
+				[]code.Instruction{
+					code.Make(code.OpConstant, 0),
+					code.Make(code.OpReturnValue),
+				},
+			},
+			expectedInstruction: []code.Instruction{
+				code.Make(code.OpClosure, 1, 0),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input: "fn(x) { if (x) { return 1; x; } 2 }",
+			expectedConstants: []interface{}{
+				1,
+				2,
+				[]code.Instruction{
+					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpJumpNotTruthy, 13),
+					code.Make(code.OpConstant, 0),
+					code.Make(code.OpReturnValue),
+					code.Make(code.OpNull),
+					code.Make(code.OpJump, 14),
+					code.Make(code.OpNull),
+					code.Make(code.OpPop),
+					code.Make(code.OpConstant, 1),
+					code.Make(code.OpReturnValue),
+				},
+			},
+			expectedInstruction: []code.Instruction{
+				code.Make(code.OpClosure, 2, 0),
+				code.Make(code.OpPop),
+			},
+		},
+	}
+
+	runCompilerTestWithLevel(t, tests, OptimizeBasic)
+}
+
+// 优化在拷贝上进行, 编译之后源程序的语法树不变
+func TestOptimizeKeepsProgram(t *testing.T) {
+	program := parse("if (1 + 1 == 2) { return 3; 4 }")
+	before := program.String()
+
+	compiler := New()
+	compiler.SetOptimizationLevel(OptimizeBasic)
+	if err := compiler.Compile(program); err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+	if program.String() != before {
+		t.Errorf("program changed. want=%q, got=%q", before, program.String())
+	}
+}
+
+// 裁剪掉的代码中的名字仍然检查, 各优化级别接受和拒绝相同的程序
+func TestDiscardedCodeIsChecked(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"if (false) { nope }", "undefined variable `nope`"},
+		{"if (true) { 1 } else { nope }", "undefined variable `nope`"},
+		{"if (false) { aa } else { bb }", "undefined variable `aa`\nundefined variable `bb`"},
+		{"let f = fn() { return 1; nope }; f()", "undefined variable `nope`"},
+		{"while (false) { nope }", "undefined variable `nope`"},
+		{"true || nope; false && nope", "undefined variable `nope`\nundefined variable `nope`"},
+		{"const c = 1; if (false) { c = 2; }", "cannot assign to constant `c`"},
+		// 裁剪的代码中定义的变量在外面不可见
+		{"let f = fn() { return 1; let x = 2; }; if (false) { let y = 1; } x; y", "undefined variable `x`\nundefined variable `y`"},
+		{"if (false) { let x = 1; } else { x }", "undefined variable `x`"},
+	}
+
+	for _, tt := range tests {
+		for _, level := range []OptimizationLevel{OptimizeNone, OptimizeBasic, OptimizePeephole} {
+			compiler := New()
+			compiler.SetOptimizationLevel(level)
+			err := compiler.Compile(parse(tt.input))
+			if err == nil || err.Error() != tt.expected {
+				t.Errorf("wrong error for %q at level %d. want=%q, got=%v", tt.input, level, tt.expected, err)
+			}
+		}
+	}
+}
+
+// 裁剪的代码不占用变量槽位和常量
+func TestDiscardedCodeLeavesNoState(t *testing.T) {
+	compiler := New()
+	compiler.SetOptimizationLevel(OptimizeBasic)
+	err := compiler.Compile(parse(`let g = 1; let f = fn() { return g; let a = fn() { g + 2 }; a() }; if (false) { let b = 3; }`))
+	if err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	constants := compiler.ByteCode().Constants
+	if len(constants) != 2 {
+		t.Fatalf("wrong number of constants. want=2, got=%d (%v)", len(constants), constants)
+	}
+	fn, ok := constants[1].(*object.CompiledFunction)
+	if !ok {
+		t.Fatalf("constant is not CompiledFunction. got=%T", constants[1])
+	}
+	if fn.NumLocals != 0 {
+		t.Errorf("wrong NumLocals. want=0, got=%d", fn.NumLocals)
+	}
+	if globals := compiler.symbolTable.numDefinitions; globals != 2 {
+		t.Errorf("wrong number of globals. want=2, got=%d", globals)
+	}
+}
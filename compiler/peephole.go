@@ -0,0 +1,243 @@
+package compiler
+
+import "monkey/code"
+
+// 窥孔优化: 在一个函数生成的指令上做局部替换.
+// 指令先解码为链表节点, 跳转指令直接指向目标节点; 删除节点后跳转落到之后第一条保留的指令,
+// 重新编码时再计算偏移量, 所以替换不会破坏跳转
+type peepholeNode struct {
+	op       code.Opcode
+	operands []int
+	target   *peepholeNode // 跳转目标, 指令末尾用 end 节点表示
+	index    int
+	removed  bool
+	line     code.LineEntry // 源码位置, Line 为 0 表示没有
+}
+
+type peepholeList struct {
+	nodes []*peepholeNode
+	end   *peepholeNode
+}
+
+// 操作数是跳转位置的指令
+func isJump(op code.Opcode) bool {
+	switch op {
+	case code.OpJump, code.OpJumpNotTruthy, code.OpAnd, code.OpOr, code.OpLoop:
+		return true
+	}
+	return false
+}
+
+// 之后的指令只能通过跳转到达
+func isTerminator(op code.Opcode) bool {
+	switch op {
+	case code.OpJump, code.OpLoop, code.OpReturnValue, code.OpReturn:
+		return true
+	}
+	return false
+}
+
+func peephole(ins code.Instruction, lines code.LineTable) (code.Instruction, code.LineTable) {
+	list, ok := decodePeephole(ins, lines)
+	if !ok {
+		return ins, lines
+	}
+	for {
+		changed := list.threadJumps()
+		changed = list.removeUnreachable() || changed
+		changed = list.rewrite() || changed
+		if !changed {
+			return list.encode()
+		}
+	}
+}
+
+func decodePeephole(ins code.Instruction, lines code.LineTable) (*peepholeList, bool) {
+	list := &peepholeList{}
+	byOffset := map[int]*peepholeNode{}
+	for i := 0; i < len(ins); {
+		def, err := code.Lookup(ins[i])
+		if err != nil {
+			return nil, false
+		}
+		operands, read := code.ReadOperands(def, ins[i+1:])
+		node := &peepholeNode{op: code.Opcode(ins[i]), operands: operands, index: len(list.nodes)}
+		node.line, _ = lines.Lookup(i)
+		list.nodes = append(list.nodes, node)
+		byOffset[i] = node
+		i += read + 1
+	}
+	list.end = &peepholeNode{index: len(list.nodes)}
+	byOffset[len(ins)] = list.end
+
+	for _, node := range list.nodes {
+		if !isJump(node.op) {
+			continue
+		}
+		target, ok := byOffset[node.operands[0]]
+		if !ok {
+			return nil, false
+		}
+		node.target = target
+	}
+	return list, true
+}
+
+// 从 node 开始第一条保留的指令
+func (l *peepholeList) live(node *peepholeNode) *peepholeNode {
+	for node != l.end && node.removed {
+		node = l.nodeAt(node.index + 1)
+	}
+	return node
+}
+
+func (l *peepholeList) nodeAt(index int) *peepholeNode {
+	if index >= len(l.nodes) {
+		return l.end
+	}
+	return l.nodes[index]
+}
+
+// node 之后第一条保留的指令
+func (l *peepholeList) next(node *peepholeNode) *peepholeNode {
+	return l.live(l.nodeAt(node.index + 1))
+}
+
+// 所有跳转目标
+func (l *peepholeList) targets() map[*peepholeNode]bool {
+	targets := map[*peepholeNode]bool{}
+	for _, node := range l.nodes {
+		if !node.removed && node.target != nil {
+			targets[l.live(node.target)] = true
+		}
+	}
+	return targets
+}
+
+// 跳转到无条件跳转时直接跳到最终目标
+func (l *peepholeList) threadJumps() bool {
+	changed := false
+	for _, node := range l.nodes {
+		if node.removed || node.target == nil {
+			continue
+		}
+		target := l.live(node.target)
+		// 最多经过 len(nodes) 次跳转, 避免死循环
+		for hops := 0; hops < len(l.nodes) && target != node && isUnconditionalJump(target); hops++ {
+			target = l.live(target.target)
+		}
+		if target != l.live(node.target) {
+			node.target = target
+			changed = true
+		}
+	}
+	return changed
+}
+
+func isUnconditionalJump(node *peepholeNode) bool {
+	return node.op == code.OpJump || node.op == code.OpLoop
+}
+
+// 删除 return 和无条件跳转之后、下一个跳转目标之前的指令
+func (l *peepholeList) removeUnreachable() bool {
+	targets := l.targets()
+	changed := false
+	unreachable := false
+	for _, node := range l.nodes {
+		if node.removed {
+			continue
+		}
+		if targets[node] {
+			unreachable = false
+		}
+		if unreachable {
+			node.removed = true
+			changed = true
+			continue
+		}
+		unreachable = isTerminator(node.op)
+	}
+	return changed
+}
+
+// 替换相邻的指令, 被删除或合并的指令不能是跳转目标
+func (l *peepholeList) rewrite() bool {
+	targets := l.targets()
+	for _, node := range l.nodes {
+		if node.removed {
+			continue
+		}
+		second := l.next(node)
+		if second == l.end {
+			break
+		}
+
+		switch {
+		// 跳到下一条指令的跳转没有效果
+		case isUnconditionalJump(node) && l.live(node.target) == second:
+			node.removed = true
+			return true
+
+		// OpNull; OpPop 没有效果
+		case node.op == code.OpNull && l.isDiscardingPop(second) && !targets[second]:
+			node.removed = true
+			second.removed = true
+			return true
+
+		// OpNull; OpJump -> OpPop: 压入的 null 马上被弹出, 直接跳过 OpPop
+		case node.op == code.OpNull && second.op == code.OpJump && !targets[second] &&
+			l.isDiscardingPop(l.live(second.target)):
+			node.removed = true
+			second.target = l.next(l.live(second.target))
+			return true
+
+		// OpGetLocal; OpConstant; OpAdd -> OpAddLocalConstant
+		case node.op == code.OpGetLocal && second.op == code.OpConstant && !targets[second]:
+			third := l.next(second)
+			if third == l.end || third.op != code.OpAdd || targets[third] {
+				continue
+			}
+			node.op = code.OpAddLocalConstant
+			node.operands = []int{node.operands[0], second.operands[0]}
+			second.removed = true
+			third.removed = true
+			return true
+		}
+	}
+	return false
+}
+
+// 主程序最后弹出的值是程序的结果 (LastPoppedStackElem), 最后一条 OpPop 不能省略
+func (l *peepholeList) isDiscardingPop(node *peepholeNode) bool {
+	return node != l.end && node.op == code.OpPop && l.next(node) != l.end
+}
+
+// 重新编码, 跳转的操作数换成目标的新位置, 源码位置随指令移动
+func (l *peepholeList) encode() (code.Instruction, code.LineTable) {
+	offsets := map[*peepholeNode]int{}
+	offset := 0
+	for _, node := range l.nodes {
+		if node.removed {
+			continue
+		}
+		offsets[node] = offset
+		offset += len(code.Make(node.op, node.operands...))
+	}
+	offsets[l.end] = offset
+
+	ins := code.Instruction{}
+	var lines code.LineTable
+	for _, node := range l.nodes {
+		if node.removed {
+			continue
+		}
+		if node.target != nil {
+			node.operands[0] = offsets[l.live(node.target)]
+		}
+		if node.line.Line > 0 {
+			lines = lines.Add(len(ins), node.line.Line, node.line.Column)
+		}
+		ins = append(ins, code.Make(node.op, node.operands...)...)
+	}
+	return ins, lines
+}
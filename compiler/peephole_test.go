@@ -0,0 +1,203 @@
+package compiler
+
+import (
+	"monkey/code"
+	"testing"
+)
+
+func TestPeephole(t *testing.T) {
+	tests := []compilerTestCase{
+		{
+			// OpGetLocal; OpConstant; OpAdd 合并为超指令
+			input: "fn(x) { x + 1 }",
+			expectedConstants: []interface{}{
+				1,
+				[]code.Instruction{
+					code.Make(code.OpAddLocalConstant, 0, 0),
+					code.Make(code.OpReturnValue),
+				},
+			},
+			expectedInstruction: []code.Instruction{
+				code.Make(code.OpClosure, 1, 0),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			// 删除 OpNull; OpPop, 跳到下一条指令的 OpJump 也一并删除
+			input: "fn(x) { if (x) { let y = 1; } x }",
+			expectedConstants: []interface{}{
+				1,
+				[]code.Instruction{
+					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpJumpNotTruthy, 10),
+					code.Make(code.OpConstant, 0),
+					code.Make(code.OpSetLocal, 1),
+					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpReturnValue),
+				},
+			},
+			expectedInstruction: []code.Instruction{
+				code.Make(code.OpClosure, 1, 0),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			// 内层 if 的 OpJump 跳到外层的 OpJump, 直接跳到最终位置
+			input: "fn(a, b) { if (a) { if (b) { 1 } else { 2 } } else { 3 } }",
+			expectedConstants: []interface{}{
+				1,
+				2,
+				3,
+				[]code.Instruction{
+					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpJumpNotTruthy, 22),
+					code.Make(code.OpGetLocal, 1),
+					code.Make(code.OpJumpNotTruthy, 16),
+					code.Make(code.OpConstant, 0),
+					code.Make(code.OpJump, 25),
+					code.Make(code.OpConstant, 1),
+					code.Make(code.OpJump, 25),
+					code.Make(code.OpConstant, 2),
+					code.Make(code.OpReturnValue),
+				},
+			},
+			expectedInstruction: []code.Instruction{
+				code.Make(code.OpClosure, 3, 0),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			// return 之后到下一个跳转目标之前的指令不会执行
+			input: "fn(x) { if (x) { return 1; x; } 2 }",
+			expectedConstants: []interface{}{
+				1,
+				2,
+				[]code.Instruction{
+					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpJumpNotTruthy, 9),
+					code.Make(code.OpConstant, 0),
+					code.Make(code.OpReturnValue),
+					code.Make(code.OpConstant, 1),
+					code.Make(code.OpReturnValue),
+				},
+			},
+			expectedInstruction: []code.Instruction{
+				code.Make(code.OpClosure, 2, 0),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			// 主程序最后一条 OpPop 弹出的是程序的结果, 不能删除
+			input:             "let x = 1; if (x) { let y = 2; }",
+			expectedConstants: []interface{}{1, 2},
+			expectedInstruction: []code.Instruction{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpSetGlobal, 0, 0),
+				code.Make(code.OpGetGlobal, 0),
+				code.Make(code.OpJumpNotTruthy, 24),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpSetGlobal, 0, 1),
+				code.Make(code.OpNull),
+				code.Make(code.OpJump, 25),
+				code.Make(code.OpNull),
+				code.Make(code.OpPop),
+			},
+		},
+	}
+
+	runCompilerTestWithLevel(t, tests, OptimizePeephole)
+}
+
+// 直接在指令上测试, 跳转目标要随删除的指令一起移动
+func TestPeepholeJumps(t *testing.T) {
+	tests := []struct {
+		input    []code.Instruction
+		expected []code.Instruction
+	}{
+		{
+			// 跳转链: 跳到 OpJump 0 的跳转直接跳到 0, 之后这条 OpJump 不再可达
+			input: []code.Instruction{
+				code.Make(code.OpTrue),
+				code.Make(code.OpJumpNotTruthy, 9),
+				code.Make(code.OpFalse),
+				code.Make(code.OpPop),
+				code.Make(code.OpLoop, 0),
+				code.Make(code.OpJump, 0),
+			},
+			expected: []code.Instruction{
+				code.Make(code.OpTrue),
+				code.Make(code.OpJumpNotTruthy, 0),
+				code.Make(code.OpFalse),
+				code.Make(code.OpPop),
+				code.Make(code.OpLoop, 0),
+			},
+		},
+		{
+			// 删除 OpNull; OpPop 后, 跳到 OpNull 的跳转指向之后的指令
+			input: []code.Instruction{
+				code.Make(code.OpTrue),
+				code.Make(code.OpJumpNotTruthy, 4),
+				code.Make(code.OpNull),
+				code.Make(code.OpPop),
+				code.Make(code.OpTrue),
+				code.Make(code.OpPop),
+			},
+			expected: []code.Instruction{
+				code.Make(code.OpTrue),
+				code.Make(code.OpJumpNotTruthy, 4),
+				code.Make(code.OpTrue),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			// OpPop 是跳转目标时不能删除
+			input: []code.Instruction{
+				code.Make(code.OpTrue),
+				code.Make(code.OpJumpNotTruthy, 5),
+				code.Make(code.OpNull),
+				code.Make(code.OpPop),
+				code.Make(code.OpTrue),
+				code.Make(code.OpPop),
+			},
+			expected: []code.Instruction{
+				code.Make(code.OpTrue),
+				code.Make(code.OpJumpNotTruthy, 5),
+				code.Make(code.OpNull),
+				code.Make(code.OpPop),
+				code.Make(code.OpTrue),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			// 合并超指令后, 循环跳回的位置不变
+			input: []code.Instruction{
+				code.Make(code.OpGetLocal, 0),
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpAdd),
+				code.Make(code.OpSetLocal, 0),
+				code.Make(code.OpGetLocal, 0),
+				code.Make(code.OpJumpNotTruthy, 16),
+				code.Make(code.OpLoop, 0),
+				code.Make(code.OpNull),
+				code.Make(code.OpReturnValue),
+			},
+			expected: []code.Instruction{
+				code.Make(code.OpAddLocalConstant, 0, 0),
+				code.Make(code.OpSetLocal, 0),
+				code.Make(code.OpGetLocal, 0),
+				code.Make(code.OpJumpNotTruthy, 14),
+				code.Make(code.OpLoop, 0),
+				code.Make(code.OpNull),
+				code.Make(code.OpReturnValue),
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		got, _ := peephole(concatInstructions(tt.input), nil)
+		expected := concatInstructions(tt.expected)
+		if got.String() != expected.String() {
+			t.Errorf("wrong instructions.\nwant=%s\ngot= %s", expected, got)
+		}
+	}
+}
@@ -1,5 +1,10 @@
 package compiler
 
+import (
+	"monkey/token"
+	"sort"
+)
+
 type SymbolScope string
 
 const (
@@ -14,6 +19,13 @@ type Symbol struct {
 	Name  string
 	Scope SymbolScope
 	Index int
+	Block bool // 定义在块级作用域中 ({}、if、while、for)
+	Const bool // const 声明, 不允许重新赋值
+	// 初始值是字面量的常量, 引用时直接加载常量池中的值
+	Inline     bool
+	ConstIndex int
+	Pos        token.Position // 声明的位置, 只记录 let、const 和 class 声明的变量
+	Cell       bool           // 槽位中是 *object.Cell, 见 cells.go
 }
 
 type SymbolTable struct {
@@ -21,6 +33,7 @@ type SymbolTable struct {
 	store          map[string]Symbol
 	FreeSymbol     []Symbol
 	numDefinitions int
+	block          bool // 块级作用域, 与所在函数(或全局)共享变量槽位
 }
 
 func NewSymbolTable() *SymbolTable {
@@ -35,25 +48,36 @@ func NewEnclosedSymbolTable(outer *SymbolTable) *SymbolTable {
 	return s
 }
 
+// 块级作用域: 变量只在块内可见, 但槽位仍由所在函数(或全局)分配
+func NewBlockSymbolTable(outer *SymbolTable) *SymbolTable {
+	s := NewEnclosedSymbolTable(outer)
+	s.block = true
+	return s
+}
+
+// 所在的函数(或全局)符号表, 负责分配槽位
+func (sym *SymbolTable) owner() *SymbolTable {
+	table := sym
+	for table.block {
+		table = table.Outer
+	}
+	return table
+}
+
+// 在当前作用域中定义变量; 同一作用域重复定义复用原来的槽位,
+// 外层作用域的同名变量会被遮蔽而不是覆盖
 func (sym *SymbolTable) Define(name string) Symbol {
-	symbol := Symbol{Name: name, Index: sym.numDefinitions}
-
-	// 先查找符号，如果存在，就使用找到符号的索引, 有必要重写一个函数
-	res, ok := sym.Resolve(name)
-	if ok {
-		symbol.Index = res.Index
-		if sym.Outer != nil {
-			symbol.Scope = res.Scope
-		} else {
-			symbol.Scope = res.Scope
-		}
+	if res, ok := sym.store[name]; ok && (res.Scope == GlobalScope || res.Scope == LocalScope) {
+		return res
+	}
+
+	owner := sym.owner()
+	symbol := Symbol{Name: name, Index: owner.numDefinitions, Block: sym.block}
+	owner.numDefinitions += 1
+	if owner.Outer == nil {
+		symbol.Scope = GlobalScope
 	} else {
-		sym.numDefinitions += 1
-		if sym.Outer == nil {
-			symbol.Scope = GlobalScope
-		} else {
-			symbol.Scope = LocalScope
-		}
+		symbol.Scope = LocalScope
 	}
 
 	sym.store[name] = symbol
@@ -61,6 +85,69 @@ func (sym *SymbolTable) Define(name string) Symbol {
 	return symbol
 }
 
+// const 声明
+func (sym *SymbolTable) DefineConst(name string) Symbol {
+	symbol := sym.Define(name)
+	symbol.Const = true
+	sym.store[name] = symbol
+	return symbol
+}
+
+// 将常量内联为常量池中的字面量
+func (sym *SymbolTable) InlineConst(name string, constIndex int) Symbol {
+	symbol := sym.store[name]
+	symbol.Inline = true
+	symbol.ConstIndex = constIndex
+	sym.store[name] = symbol
+	return symbol
+}
+
+// 当前作用域中的 name 改为放在 cell 中
+func (sym *SymbolTable) markCell(name string) Symbol {
+	symbol := sym.store[name]
+	symbol.Cell = true
+	sym.store[name] = symbol
+	return symbol
+}
+
+// 定义变量并记录声明的位置
+func (sym *SymbolTable) DefineAt(name string, pos token.Position) Symbol {
+	sym.Define(name)
+	return sym.declaredAt(name, pos)
+}
+
+// 记录当前作用域中 name 的声明位置
+func (sym *SymbolTable) declaredAt(name string, pos token.Position) Symbol {
+	symbol := sym.store[name]
+	symbol.Pos = pos
+	sym.store[name] = symbol
+	return symbol
+}
+
+// 当前作用域能看到的所有名字 (包括内置函数), 内层作用域在前, 同一作用域内按名字排序
+func (sym *SymbolTable) visibleNames() []string {
+	names := []string{}
+	seen := map[string]bool{}
+	for table := sym; table != nil; table = table.Outer {
+		scope := []string{}
+		for name := range table.store {
+			if !seen[name] {
+				seen[name] = true
+				scope = append(scope, name)
+			}
+		}
+		sort.Strings(scope)
+		names = append(names, scope...)
+	}
+	return names
+}
+
+// 只在当前作用域查找, 不向外层查找
+func (sym *SymbolTable) Lookup(name string) (Symbol, bool) {
+	symbol, ok := sym.store[name]
+	return symbol, ok
+}
+
 func (sym *SymbolTable) Resolve(name string) (Symbol, bool) {
 	symbol, ok := sym.store[name]
 	if !ok && sym.Outer != nil {
@@ -69,7 +156,14 @@ func (sym *SymbolTable) Resolve(name string) (Symbol, bool) {
 			return symbol, ok
 		}
 
-		if symbol.Scope == GlobalScope || symbol.Scope == BuiltinScope {
+		// 块与外层属于同一个函数, 不需要捕获
+		if sym.block {
+			return symbol, ok
+		}
+
+		// 块级的全局变量按值捕获, 循环中创建的闭包各自持有当次迭代的值
+		// 内联的常量直接加载字面量, 不需要捕获
+		if (symbol.Scope == GlobalScope && !symbol.Block) || symbol.Scope == BuiltinScope || symbol.Inline {
 			return symbol, ok
 		}
 
@@ -79,6 +173,21 @@ func (sym *SymbolTable) Resolve(name string) (Symbol, bool) {
 	return symbol, ok
 }
 
+// 整条符号表链的副本, 在副本上定义和捕获变量不影响原来的符号表
+func (sym *SymbolTable) snapshot() *SymbolTable {
+	if sym == nil {
+		return nil
+	}
+	copied := *sym
+	copied.Outer = sym.Outer.snapshot()
+	copied.store = make(map[string]Symbol, len(sym.store))
+	for name, symbol := range sym.store {
+		copied.store[name] = symbol
+	}
+	copied.FreeSymbol = append([]Symbol{}, sym.FreeSymbol...)
+	return &copied
+}
+
 func (sym *SymbolTable) DefineBuiltin(index int, name string) Symbol {
 	symbol := Symbol{Name: name, Index: index, Scope: BuiltinScope}
 	sym.store[name] = symbol
@@ -88,7 +197,7 @@ func (sym *SymbolTable) DefineBuiltin(index int, name string) Symbol {
 func (sym *SymbolTable) DefineFree(original Symbol) Symbol {
 	sym.FreeSymbol = append(sym.FreeSymbol, original)
 	symbol := Symbol{Name: original.Name, Index: len(sym.FreeSymbol) - 1,
-		Scope: FreeScope}
+		Scope: FreeScope, Const: original.Const, Pos: original.Pos, Cell: original.Cell}
 
 	sym.store[original.Name] = symbol
 	return symbol
@@ -290,3 +290,38 @@ func TestDefineFuncionName(t *testing.T) {
 		t.Errorf("expected '%s' to resolve to %+v, got=%+v", expect.Name, expect, res)
 	}
 }
+
+func TestBlockScope(t *testing.T) {
+	global := NewSymbolTable()
+	global.Define("a")
+
+	block := NewBlockSymbolTable(global)
+	shadow := block.Define("a")
+	expect := Symbol{Name: "a", Scope: GlobalScope, Index: 1, Block: true}
+	if shadow != expect {
+		t.Errorf("expected shadowed a=%+v, got=%+v", expect, shadow)
+	}
+
+	res, ok := global.Resolve("a")
+	if !ok || res.Index != 0 {
+		t.Errorf("outer a was overwritten by block definition: %+v", res)
+	}
+
+	fLocal := NewEnclosedSymbolTable(global)
+	fLocal.Define("b")
+	fBlock := NewBlockSymbolTable(fLocal)
+	c := fBlock.Define("c")
+	expect = Symbol{Name: "c", Scope: LocalScope, Index: 1, Block: true}
+	if c != expect {
+		t.Errorf("expected c=%+v, got=%+v", expect, c)
+	}
+	if fLocal.numDefinitions != 2 {
+		t.Errorf("block slots not allocated from enclosing function. got=%d", fLocal.numDefinitions)
+	}
+
+	inner := NewEnclosedSymbolTable(block)
+	free, ok := inner.Resolve("a")
+	if !ok || free.Scope != FreeScope {
+		t.Errorf("block global should be captured as free, got=%+v", free)
+	}
+}
@@ -0,0 +1,233 @@
+// 差分测试: 同一段程序分别交给解释器 (evaluator) 和编译器+虚拟机执行,
+// 比较输出、结果和错误信息, 并与 .out 文件中的期望结果对照
+package conformance
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"monkey/ast"
+	"monkey/compiler"
+	"monkey/evaluator"
+	"monkey/lexer"
+	"monkey/object"
+	"monkey/parser"
+	"monkey/vm"
+	"strings"
+)
+
+// 一次运行的结果
+type Outcome struct {
+	Output string // puts 的输出
+	Result string // 最后一条表达式语句的值, 最后一条不是表达式语句时为空
+	Error  string
+}
+
+// .out 文件的格式: 先是输出, 然后是 "=> 结果" 和 "error: 错误信息"
+func (o Outcome) String() string {
+	var out strings.Builder
+	out.WriteString(o.Output)
+	if o.Result != "" {
+		out.WriteString("=> " + o.Result + "\n")
+	}
+	if o.Error != "" {
+		out.WriteString("error: " + o.Error + "\n")
+	}
+	return out.String()
+}
+
+type engine func(program *ast.Program) (object.Object, error)
+
+func RunEvaluator(input string) Outcome {
+	return run(input, runEvaluator)
+}
+
+func runEvaluator(program *ast.Program) (object.Object, error) {
+	expanded, err := evaluator.ExpandProgram(program, object.NewEnvironment())
+	if err != nil {
+		return nil, err
+	}
+	return evaluator.Eval(expanded, object.NewEnvironment()), nil
+}
+
+func RunVM(input string) Outcome {
+	return RunVMWithLevel(input, compiler.OptimizeNone)
+}
+
+// 打开编译期优化后的结果必须和不优化时一样
+func RunVMWithLevel(input string, level compiler.OptimizationLevel) Outcome {
+	return run(input, vmEngine(level))
+}
+
+func vmEngine(level compiler.OptimizationLevel) engine {
+	return func(program *ast.Program) (object.Object, error) {
+		program, err := evaluator.ExpandProgram(program, object.NewEnvironment())
+		if err != nil {
+			return nil, err
+		}
+		comp := compiler.New()
+		comp.SetOptimizationLevel(level)
+		if err := comp.Compile(program); err != nil {
+			return nil, err
+		}
+		machine := vm.New(comp.ByteCode())
+		if err := machine.Run(); err != nil {
+			return nil, err
+		}
+		return machine.LastPoppedStackElem(), nil
+	}
+}
+
+func run(input string, execute engine) Outcome {
+	p := parser.New(lexer.New(input))
+	program := p.ParserProgram()
+	if len(p.Errors()) != 0 {
+		return Outcome{Error: "parser errors: " + strings.Join(p.Errors(), "; ")}
+	}
+	return runProgram(program, execute)
+}
+
+// 执行期间捕获 puts 的输出; 引擎 panic 时记为错误
+func runProgram(program *ast.Program, execute engine) (outcome Outcome) {
+	hasResult := endsWithExpression(program)
+
+	var output bytes.Buffer
+	saved := object.Output
+	object.Output = &output
+	defer func() {
+		object.Output = saved
+		outcome.Output = output.String()
+		if r := recover(); r != nil {
+			outcome.Result = ""
+			outcome.Error = fmt.Sprintf("panic: %v", r)
+		}
+	}()
+
+	result, err := execute(program)
+	switch {
+	case err != nil:
+		outcome.Error = err.Error()
+	case result == nil:
+	case result.Type() == object.ERROR_OBJ:
+		// 虚拟机中内置函数的错误是普通的值
+		outcome.Error = result.(*object.Error).Message
+	case hasResult:
+		outcome.Result = result.Inspect()
+	}
+	return outcome
+}
+
+// 赋值表达式没有值, 也不算作结果
+func endsWithExpression(program *ast.Program) bool {
+	if len(program.Statements) == 0 {
+		return false
+	}
+	stmt, ok := program.Statements[len(program.Statements)-1].(*ast.ExpressionStatement)
+	if !ok {
+		return false
+	}
+	_, isAssign := stmt.Expression.(*ast.AssignExpression)
+	return !isAssign
+}
+
+// 两个引擎结果不一致的地方, 一致时返回 nil
+func Compare(eval, machine Outcome) []string {
+	diffs := []string{}
+	if eval.Output != machine.Output {
+		diffs = append(diffs, fmt.Sprintf("output differs:\n  evaluator: %q\n  vm:        %q", eval.Output, machine.Output))
+	}
+	if eval.Result != machine.Result {
+		diffs = append(diffs, fmt.Sprintf("result differs:\n  evaluator: %q\n  vm:        %q", eval.Result, machine.Result))
+	}
+	if eval.Error != machine.Error {
+		diffs = append(diffs, fmt.Sprintf("error differs:\n  evaluator: %q\n  vm:        %q", eval.Error, machine.Error))
+	}
+	if len(diffs) == 0 {
+		return nil
+	}
+	return diffs
+}
+
+type Report struct {
+	Name      string
+	Evaluator Outcome
+	VM        Outcome
+	Expected  *string // 没有 .out 文件时为 nil
+	Problems  []string
+}
+
+func (r *Report) Failed() bool {
+	return len(r.Problems) != 0
+}
+
+func (r *Report) String() string {
+	if !r.Failed() {
+		return "ok   " + r.Name
+	}
+	var out strings.Builder
+	out.WriteString("FAIL " + r.Name)
+	for _, problem := range r.Problems {
+		out.WriteString("\n    " + strings.ReplaceAll(problem, "\n", "\n    "))
+	}
+	return out.String()
+}
+
+// 期望结果文件: foo.mon 对应 foo.out
+func ExpectedPath(path string) string {
+	return strings.TrimSuffix(path, ".mon") + ".out"
+}
+
+// 两个引擎各运行一次, 互相比较并与期望结果比较
+func Check(name, input string, expected *string) *Report {
+	report := &Report{
+		Name:      name,
+		Evaluator: RunEvaluator(input),
+		VM:        RunVM(input),
+		Expected:  expected,
+	}
+	report.Problems = append(report.Problems, Compare(report.Evaluator, report.VM)...)
+	for _, level := range []compiler.OptimizationLevel{compiler.OptimizeBasic, compiler.OptimizePeephole} {
+		if optimized := RunVMWithLevel(input, level); optimized != report.VM {
+			report.Problems = append(report.Problems, fmt.Sprintf("vm at optimization level %d differs:\n  want: %q\n  got:  %q", level, report.VM.String(), optimized.String()))
+		}
+	}
+
+	if expected == nil {
+		report.Problems = append(report.Problems, "missing expected output")
+		return report
+	}
+	if got := report.Evaluator.String(); got != *expected {
+		report.Problems = append(report.Problems, fmt.Sprintf("evaluator does not match expected output:\n  want: %q\n  got:  %q", *expected, got))
+	}
+	if got := report.VM.String(); got != *expected {
+		report.Problems = append(report.Problems, fmt.Sprintf("vm does not match expected output:\n  want: %q\n  got:  %q", *expected, got))
+	}
+	return report
+}
+
+func CheckFile(path string) (*Report, error) {
+	input, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var expected *string
+	data, err := ioutil.ReadFile(ExpectedPath(path))
+	if err == nil {
+		content := string(data)
+		expected = &content
+	}
+	return Check(path, string(input), expected), nil
+}
+
+// 两个引擎结果一致时把结果写入 .out 文件, 不一致时返回错误
+func Update(path string) error {
+	report, err := CheckFile(path)
+	if err != nil {
+		return err
+	}
+	if diffs := Compare(report.Evaluator, report.VM); diffs != nil {
+		return fmt.Errorf("%s: engines disagree, not updating:\n%s", path, strings.Join(diffs, "\n"))
+	}
+	return ioutil.WriteFile(ExpectedPath(path), []byte(report.Evaluator.String()), 0644)
+}
@@ -0,0 +1,199 @@
+package conformance
+
+import (
+	"flag"
+	"io/ioutil"
+	"monkey/ast"
+	"monkey/compiler"
+	"monkey/evaluator"
+	"monkey/formatter"
+	"monkey/lexer"
+	"monkey/object"
+	"monkey/parser"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "rewrite the .out files from the current results")
+
+// testdata 下的每个程序都要在两个引擎上得到相同且符合 .out 的结果
+func TestConformance(t *testing.T) {
+	files, err := filepath.Glob("testdata/*.mon")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) == 0 {
+		t.Fatal("no conformance programs found")
+	}
+
+	for _, file := range files {
+		file := file
+		t.Run(strings.TrimSuffix(filepath.Base(file), ".mon"), func(t *testing.T) {
+			if *update {
+				if err := Update(file); err != nil {
+					t.Fatal(err)
+				}
+			}
+			report, err := CheckFile(file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, problem := range report.Problems {
+				t.Error(problem)
+			}
+		})
+	}
+}
+
+// 宏程序经过 JSON 序列化和反序列化后, 展开和运行的结果不变
+func TestMacroJSONRoundTrip(t *testing.T) {
+	files, err := filepath.Glob("testdata/*macro*.mon")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) == 0 {
+		t.Fatal("no macro programs found")
+	}
+
+	for _, file := range files {
+		input, err := ioutil.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected, err := ioutil.ReadFile(ExpectedPath(file))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		data, err := ast.MarshalJSON(parseProgram(t, string(input)))
+		if err != nil {
+			t.Fatalf("%s: marshal failed: %s", file, err)
+		}
+		engines := map[string]engine{"evaluator": runEvaluator, "vm": vmEngine(compiler.OptimizeNone)}
+		for name, execute := range engines {
+			// 引擎会修改语法树, 每次重新反序列化
+			program, err := ast.UnmarshalJSON(data)
+			if err != nil {
+				t.Fatalf("%s: unmarshal failed: %s", file, err)
+			}
+			if got := runProgram(program, execute).String(); got != string(expected) {
+				t.Errorf("%s: %s result differs after a json round trip.\nwant=%q\ngot=%q", file, name, expected, got)
+			}
+		}
+	}
+}
+
+// monkey expand 打印的源码可以重新解析, 运行结果与展开前相同
+func TestExpandedSourceReparses(t *testing.T) {
+	files, err := filepath.Glob("testdata/*macro*.mon")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, file := range files {
+		input, err := ioutil.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expanded, err := evaluator.ExpandProgram(parseProgram(t, string(input)), object.NewEnvironment())
+		if err != nil {
+			// 展开失败的程序由 .out 检查错误信息
+			continue
+		}
+		expected, err := ioutil.ReadFile(ExpectedPath(file))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		source := formatter.FormatProgram(expanded, nil, formatter.DefaultConfig())
+		p := parser.New(lexer.New(source))
+		reparsed := p.ParserProgram()
+		if len(p.Errors()) != 0 {
+			t.Errorf("%s: expanded source does not parse: %v\n%s", file, p.Errors(), source)
+			continue
+		}
+		if reparsed.String() != expanded.String() {
+			t.Errorf("%s: expanded source does not round-trip.\nwant=%q\ngot=%q", file, expanded.String(), reparsed.String())
+		}
+		if got := run(source, runEvaluator).String(); got != string(expected) {
+			t.Errorf("%s: expanded source gives a different result.\nwant=%q\ngot=%q", file, expected, got)
+		}
+	}
+}
+
+func parseProgram(t *testing.T, input string) *ast.Program {
+	t.Helper()
+	p := parser.New(lexer.New(input))
+	program := p.ParserProgram()
+	if len(p.Errors()) != 0 {
+		t.Fatalf("parser errors: %v", p.Errors())
+	}
+	return program
+}
+
+func TestCompare(t *testing.T) {
+	same := Outcome{Output: "1\n", Result: "2"}
+	if diffs := Compare(same, same); diffs != nil {
+		t.Errorf("expected no differences, got=%v", diffs)
+	}
+
+	diffs := Compare(
+		Outcome{Output: "1\n", Result: "true"},
+		Outcome{Output: "2\n", Error: "type mismatch: INTEGER + STRING"},
+	)
+	want := []string{"output differs", "result differs", "error differs"}
+	if len(diffs) != len(want) {
+		t.Fatalf("wrong number of differences. want=%d, got=%d (%v)", len(want), len(diffs), diffs)
+	}
+	for i, prefix := range want {
+		if !strings.HasPrefix(diffs[i], prefix) {
+			t.Errorf("diffs[%d] wrong. want prefix %q, got=%q", i, prefix, diffs[i])
+		}
+	}
+}
+
+func TestCheck(t *testing.T) {
+	expected := "3\n=> 4\n"
+	report := Check("ok", "puts(1 + 2); 2 * 2", &expected)
+	if report.Failed() {
+		t.Errorf("unexpected problems:\n%s", report)
+	}
+
+	wrong := "3\n=> 5\n"
+	report = Check("wrong", "puts(1 + 2); 2 * 2", &wrong)
+	if len(report.Problems) != 2 {
+		t.Errorf("expected a problem for each engine, got:\n%s", report)
+	}
+
+	report = Check("missing", "1", nil)
+	if !report.Failed() || !strings.Contains(report.String(), "missing expected output") {
+		t.Errorf("expected a missing output problem, got:\n%s", report)
+	}
+
+	report = Check("parse", "let = 1;", nil)
+	if !strings.HasPrefix(report.Evaluator.Error, "parser errors:") {
+		t.Errorf("expected parser errors, got=%q", report.Evaluator.Error)
+	}
+}
+
+// 没有 return 的最后一条语句不产生结果, 错误值算作错误
+func TestOutcome(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{`puts("a"); let x = 1;`, "a\n"},
+		{`let x = 1; x = 2;`, ""},
+		{`puts(1, 2); [1, 2]`, "1\n2\n=> [1, 2]\n"},
+		{`puts("before"); len(1)`, "before\nerror: argument to `len` not supported, got INTEGER\n"},
+	}
+
+	for _, tt := range tests {
+		for name, outcome := range map[string]Outcome{"evaluator": RunEvaluator(tt.input), "vm": RunVM(tt.input)} {
+			if got := outcome.String(); got != tt.expected {
+				t.Errorf("%s: %q wrong.\nwant=%q\ngot= %q", name, tt.input, tt.expected, got)
+			}
+		}
+	}
+}
@@ -0,0 +1,183 @@
+// 反汇编: 列出常量池, 再依次列出主程序和常量池中的每个函数;
+// 跳转目标显示为标签, 有位置表时在指令前标注对应的源码行
+package disasm
+
+import (
+	"fmt"
+	"monkey/code"
+	"monkey/compiler"
+	"monkey/object"
+	"sort"
+	"strings"
+)
+
+// source 为空时只标注行号
+func Disassemble(bc *compiler.ByteCode, source string) string {
+	d := &disassembler{constants: bc.Constants}
+	if source != "" {
+		d.sourceLines = strings.Split(strings.ReplaceAll(source, "\r\n", "\n"), "\n")
+	}
+
+	d.writeConstants()
+	d.out.WriteString("\nmain:\n")
+	d.writeInstructions(bc.Instruction, bc.Lines)
+	for i, constant := range bc.Constants {
+		fn, ok := constant.(*object.CompiledFunction)
+		if !ok {
+			continue
+		}
+		fmt.Fprintf(&d.out, "\n%s [constant %d] params=%d locals=%d:\n", functionName(fn), i, fn.NumParameters, fn.NumLocals)
+		d.writeInstructions(fn.Instructions, fn.Lines)
+	}
+	return d.out.String()
+}
+
+type disassembler struct {
+	out         strings.Builder
+	constants   []object.Object
+	sourceLines []string
+}
+
+func (d *disassembler) writeConstants() {
+	d.out.WriteString("constants:\n")
+	if len(d.constants) == 0 {
+		d.out.WriteString("  (none)\n")
+	}
+	width := 0
+	for _, constant := range d.constants {
+		if len(constant.Type()) > width {
+			width = len(constant.Type())
+		}
+	}
+	for i, constant := range d.constants {
+		fmt.Fprintf(&d.out, "  %4d  %-*s  %s\n", i, width, constant.Type(), describe(constant))
+	}
+}
+
+// 一个函数的指令; 跳转目标按位置顺序编号为 L1, L2, ...
+func (d *disassembler) writeInstructions(ins code.Instruction, lines code.LineTable) {
+	labels := jumpLabels(ins)
+	line := 0
+
+	i := 0
+	for i < len(ins) {
+		if label, ok := labels[i]; ok {
+			fmt.Fprintf(&d.out, "%s:\n", label)
+		}
+		if entry, ok := lines.Lookup(i); ok && entry.Line != line {
+			line = entry.Line
+			d.writeSourceLine(line)
+		}
+
+		def, err := code.Lookup(ins[i])
+		if err != nil {
+			fmt.Fprintf(&d.out, "  %04d  Error: %s\n", i, err)
+			i++
+			continue
+		}
+		if i+1+def.Width() > len(ins) {
+			fmt.Fprintf(&d.out, "  %04d  Error: %s is missing operands\n", i, def.Name)
+			return
+		}
+		operands, read := code.ReadOperands(def, ins[i+1:])
+
+		text, comment := d.instruction(code.Opcode(ins[i]), def, operands, labels)
+		if comment == "" {
+			fmt.Fprintf(&d.out, "  %04d  %s\n", i, text)
+		} else {
+			fmt.Fprintf(&d.out, "  %04d  %-28s ; %s\n", i, text, comment)
+		}
+		i += 1 + read
+	}
+	// 跳到指令末尾的标签
+	if label, ok := labels[len(ins)]; ok {
+		fmt.Fprintf(&d.out, "%s:\n", label)
+	}
+}
+
+func (d *disassembler) writeSourceLine(line int) {
+	if line <= len(d.sourceLines) {
+		fmt.Fprintf(&d.out, "  ; %d | %s\n", line, strings.TrimSpace(d.sourceLines[line-1]))
+		return
+	}
+	fmt.Fprintf(&d.out, "  ; line %d\n", line)
+}
+
+// 指令文本和注释: 跳转显示标签, 引用常量、属性名和内置函数的指令在注释中显示内容
+func (d *disassembler) instruction(op code.Opcode, def *code.Definition, operands []int, labels map[int]string) (string, string) {
+	parts := []string{def.Name}
+	for _, operand := range operands {
+		parts = append(parts, fmt.Sprintf("%d", operand))
+	}
+
+	comment := ""
+	switch op {
+	case code.OpJump, code.OpJumpNotTruthy, code.OpAnd, code.OpOr, code.OpLoop:
+		parts[1] = labels[operands[0]]
+	case code.OpConstant, code.OpClosure, code.OpClass, code.OpGetProperty, code.OpSetProperty:
+		comment = d.constant(operands[0])
+	case code.OpAddLocalConstant:
+		comment = "+ " + d.constant(operands[1])
+	case code.OpGetBuiltin:
+		if operands[0] < len(object.Builtins) {
+			comment = object.Builtins[operands[0]].Name
+		}
+	}
+	return strings.Join(parts, " "), comment
+}
+
+func (d *disassembler) constant(index int) string {
+	if index >= len(d.constants) {
+		return fmt.Sprintf("<constant %d out of range>", index)
+	}
+	return describe(d.constants[index])
+}
+
+func describe(constant object.Object) string {
+	switch constant := constant.(type) {
+	case *object.String:
+		return fmt.Sprintf("%q", constant.Value)
+	case *object.CompiledFunction:
+		return functionName(constant)
+	default:
+		return constant.Inspect()
+	}
+}
+
+func functionName(fn *object.CompiledFunction) string {
+	if fn.Name == "" {
+		return "fn <anonymous>"
+	}
+	return "fn " + fn.Name
+}
+
+func jumpLabels(ins code.Instruction) map[int]string {
+	targets := []int{}
+	seen := map[int]bool{}
+	for i := 0; i < len(ins); {
+		def, err := code.Lookup(ins[i])
+		if err != nil {
+			i++
+			continue
+		}
+		if i+1+def.Width() > len(ins) {
+			break
+		}
+		operands, read := code.ReadOperands(def, ins[i+1:])
+		switch code.Opcode(ins[i]) {
+		case code.OpJump, code.OpJumpNotTruthy, code.OpAnd, code.OpOr, code.OpLoop:
+			if !seen[operands[0]] {
+				seen[operands[0]] = true
+				targets = append(targets, operands[0])
+			}
+		}
+		i += 1 + read
+	}
+
+	sort.Ints(targets)
+	labels := map[int]string{}
+	for i, target := range targets {
+		labels[target] = fmt.Sprintf("L%d", i+1)
+	}
+	return labels
+}
@@ -0,0 +1,133 @@
+package disasm
+
+import (
+	"monkey/code"
+	"monkey/compiler"
+	"monkey/lexer"
+	"monkey/object"
+	"monkey/parser"
+	"testing"
+)
+
+func compile(t *testing.T, input string) *compiler.ByteCode {
+	t.Helper()
+	p := parser.New(lexer.New(input))
+	program := p.ParserProgram()
+	if len(p.Errors()) != 0 {
+		t.Fatalf("parser errors: %v", p.Errors())
+	}
+	comp := compiler.New()
+	if err := comp.Compile(program); err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+	return comp.ByteCode()
+}
+
+func TestDisassemble(t *testing.T) {
+	input := `let f = fn(x) {
+  if (x > 1) { x } else { "small" }
+};
+puts(f(2));
+`
+	expected := `constants:
+     0  INTEGER                1
+     1  STRING                 "small"
+     2  COMPILER_FUNCTION_OBJ  fn f
+     3  INTEGER                2
+
+main:
+  ; 1 | let f = fn(x) {
+  0000  OpClosure 2 0                ; fn f
+  0004  OpSetGlobal 0 0
+  ; 4 | puts(f(2));
+  0008  OpGetBuiltin 1               ; puts
+  0010  OpGetGlobal 0
+  0013  OpConstant 3                 ; 2
+  0016  OpCall 1
+  0018  OpCall 1
+  0020  OpPop
+
+fn f [constant 2] params=1 locals=1:
+  ; 2 | if (x > 1) { x } else { "small" }
+  0000  OpGetLocal 0
+  0002  OpConstant 0                 ; 1
+  0005  OpGreaterThan
+  0006  OpJumpNotTruthy L1
+  0009  OpGetLocal 0
+  0011  OpJump L2
+L1:
+  0014  OpConstant 1                 ; "small"
+L2:
+  0017  OpReturnValue
+`
+	got := Disassemble(compile(t, input), input)
+	if got != expected {
+		t.Errorf("wrong disassembly.\nwant=\n%s\ngot=\n%s", expected, got)
+	}
+}
+
+// 没有源码时只显示行号
+func TestDisassembleWithoutSource(t *testing.T) {
+	expected := `constants:
+     0  INTEGER  1
+
+main:
+  ; line 1
+  0000  OpTrue
+  0001  OpJumpNotTruthy L1
+  0004  OpConstant 0                 ; 1
+  0007  OpJump L2
+L1:
+  0010  OpNull
+L2:
+  0011  OpPop
+`
+	got := Disassemble(compile(t, "if (true) { 1 }"), "")
+	if got != expected {
+		t.Errorf("wrong disassembly.\nwant=\n%s\ngot=\n%s", expected, got)
+	}
+}
+
+// 无法识别的操作码、不完整的操作数和越界的常量
+func TestDisassembleInvalidInstructions(t *testing.T) {
+	ins := code.Instruction{}
+	ins = append(ins, code.Make(code.OpJump, 7)...)
+	ins = append(ins, 255)
+	ins = append(ins, code.Make(code.OpConstant, 5)...)
+	ins = append(ins, code.Make(code.OpConstant, 1)[:2]...)
+	bc := &compiler.ByteCode{Instruction: ins, Constants: []object.Object{}}
+
+	expected := `constants:
+  (none)
+
+main:
+  0000  OpJump L1
+  0003  Error: opcode 255 undefined
+  0004  OpConstant 5                 ; <constant 5 out of range>
+L1:
+  0007  Error: OpConstant is missing operands
+`
+	got := Disassemble(bc, "")
+	if got != expected {
+		t.Errorf("wrong disassembly.\nwant=\n%s\ngot=\n%s", expected, got)
+	}
+}
+
+// 跳到指令末尾的标签显示在最后
+func TestDisassembleLabelAtEnd(t *testing.T) {
+	expected := `constants:
+  (none)
+
+main:
+L1:
+  ; line 1
+  0000  OpFalse
+  0001  OpJumpNotTruthy L2
+  0004  OpLoop L1
+L2:
+`
+	got := Disassemble(compile(t, "while (false) {}"), "")
+	if got != expected {
+		t.Errorf("wrong disassembly.\nwant=\n%s\ngot=\n%s", expected, got)
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"monkey/ast"
 	"monkey/object"
+	"monkey/token"
 )
 
 var (
@@ -39,6 +40,12 @@ func Eval(node ast.Node, env *object.Environment) object.Object {
 		if isError(left) {
 			return left
 		}
+		if node.Operator == token.DOT {
+			return evalPropertyExpression(node, left)
+		}
+		if node.Operator == "&&" || node.Operator == "||" {
+			return evalLogicalExpression(node, left, env)
+		}
 
 		right := Eval(node.Right, env)
 		if isError(right) {
@@ -62,11 +69,19 @@ func Eval(node ast.Node, env *object.Environment) object.Object {
 		}
 
 	case *ast.LetStatement:
+		// 与编译器一致, 常量不能被重新声明或遮蔽
+		if env.IsConst(node.Name.Value) {
+			return newError("constant `%s` already declared", node.Name.Value)
+		}
 		letValue := Eval(node.Value, env)
 		if isError(letValue) {
 			return letValue
 		}
-		env.Set(node.Name.Value, letValue)
+		if node.IsConst() {
+			env.SetConst(node.Name.Value, letValue)
+		} else {
+			env.Set(node.Name.Value, letValue)
+		}
 		// return letValue
 
 	case *ast.Identifier:
@@ -75,7 +90,7 @@ func Eval(node ast.Node, env *object.Environment) object.Object {
 	case *ast.FunctionLiteral:
 		params := node.Parameters
 		body := node.Body
-		return &object.Function{Parameters: params, Body: body, Env: env}
+		return &object.Function{Parameters: params, Body: body, Env: env, TailCalls: ast.TailCalls(node)}
 
 	case *ast.CallExpression:
 		if node.Function.TokenLiteral() == "quote" {
@@ -89,6 +104,9 @@ func Eval(node ast.Node, env *object.Environment) object.Object {
 		if len(args) == 1 && isError(args[0]) {
 			return args[0]
 		}
+		if fn, ok := function.(*object.Function); ok && isTailCall(node, env) {
+			return &tailCall{fn: fn, args: args}
+		}
 		return applyFunction(function, args)
 
 	case *ast.StringLiteral:
@@ -112,8 +130,32 @@ func Eval(node ast.Node, env *object.Environment) object.Object {
 		}
 		return evalIndexExpression(left, index)
 
+	case *ast.SliceExpression:
+		return evalSliceExpression(node, env)
+
 	case *ast.HashLiteral:
 		return evalHashLiteral(node, env)
+
+	case *ast.AssignExpression:
+		return evalAssignExpression(node, env)
+
+	case *ast.WhileStatement:
+		return evalWhileStatement(node, env)
+
+	case *ast.ForStatement:
+		return evalForStatement(node, env)
+
+	case *ast.ClassStmt:
+		// 与虚拟机一致: 类体是以 this 为参数的函数, 实例化时执行
+		this := &ast.Identifier{Token: node.Token, Value: "this"}
+		body := &object.Function{Parameters: []*ast.Identifier{this}, Body: node.Body, Env: env}
+		env.Set(node.Name.Value, &object.Class{Name: node.Name.Value, Body: body})
+
+	case *ast.ThisLiteral:
+		if this, ok := env.Get(node.Value); ok {
+			return this
+		}
+		return newError("`this` outside of class")
 	}
 
 	return nil
@@ -143,10 +185,10 @@ func evalBlockStatements(block *ast.BlockStatement, env *object.Environment) obj
 
 	for _, statement := range block.Statements {
 		result = Eval(statement, env)
+		if result == nil {
+			continue
+		}
 		rt := result.Type()
-		// if result != nil && result.Type() == object.RETURN_VALUE_OBJ {
-		// 	return result
-		// }
 		if rt == object.RETURN_VALUE_OBJ || rt == object.ERROR_OBJ {
 			return result
 		}
@@ -207,13 +249,14 @@ func evalInfixExpression(
 	case left.Type() == object.STRING && right.Type() == object.STRING:
 		return evalStringInfixExpression(operator, left, right)
 
+	case left.Type() == object.ARRAY_OBJ && right.Type() == object.ARRAY_OBJ && isOrderingOperator(operator):
+		return evalOrderingExpression(operator, left, right)
+
 	case operator == "==":
-		return nativeBoolToBooleanObject(left == right)
+		return nativeBoolToBooleanObject(object.Equal(left, right))
 
 	case operator == "!=":
-		return nativeBoolToBooleanObject(left != right)
-	case operator == "&&" || operator == "||":
-		return evalBooleanInfixExpression(operator, left, right)
+		return nativeBoolToBooleanObject(!object.Equal(left, right))
 	case left.Type() != right.Type():
 		return newError("type mismatch: %s %s %s", left.Type(), operator, right.Type())
 	default:
@@ -255,22 +298,12 @@ func evalIntegerInfixExpression(
 	}
 }
 
-func evalBooleanInfixExpression(
-	operator string,
-	left object.Object,
-	right object.Object,
-) object.Object {
-	leftValue := left.(*object.Boolean).Value
-	rightValue := right.(*object.Boolean).Value
-
-	switch operator {
-	case "&&":
-		return nativeBoolToBooleanObject(leftValue && rightValue)
-	case "||":
-		return nativeBoolToBooleanObject(leftValue || rightValue)
-	default:
-		return newError("unknown operator: %s %s %s", left.Type(), operator, right.Type())
+// 与虚拟机一致: 短路求值, 结果是决定真假的那个操作数
+func evalLogicalExpression(node *ast.InfixExpression, left object.Object, env *object.Environment) object.Object {
+	if isTruthy(left) == (node.Operator == "||") {
+		return left
 	}
+	return Eval(node.Right, env)
 }
 
 func evalIfExpression(node *ast.IfExpression, env *object.Environment) object.Object {
@@ -280,10 +313,11 @@ func evalIfExpression(node *ast.IfExpression, env *object.Environment) object.Ob
 		return condition
 	}
 
+	// 分支是独立的块级作用域
 	if isTruthy(condition) {
-		return Eval(node.Consequence, env)
+		return Eval(node.Consequence, object.NewEnclosedEnvironment(env))
 	} else if node.Alternative != nil {
-		return Eval(node.Alternative, env)
+		return Eval(node.Alternative, object.NewEnclosedEnvironment(env))
 	} else {
 		return NULL
 	}
@@ -316,9 +350,24 @@ func evalExpression(exps []ast.Expression, env *object.Environment) []object.Obj
 	return result
 }
 
+// 函数体返回 tailCall 时继续调用, 直到得到最终结果
 func applyFunction(fn object.Object, args []object.Object) object.Object {
+	for {
+		result := callFunction(fn, args)
+		call, ok := result.(*tailCall)
+		if !ok {
+			return result
+		}
+		fn, args = call.fn, call.args
+	}
+}
+
+func callFunction(fn object.Object, args []object.Object) object.Object {
 	switch fn := fn.(type) {
 	case *object.Function:
+		if len(args) != len(fn.Parameters) {
+			return newError("wrong number of arguments.want=%d, got=%d", len(fn.Parameters), len(args))
+		}
 		extendedEnv := extendFunctionEnv(fn, args)
 		evaluated := Eval(fn.Body, extendedEnv)
 		return unwrapReturnValue(evaluated)
@@ -329,26 +378,121 @@ func applyFunction(fn object.Object, args []object.Object) object.Object {
 		}
 		return NULL
 
+	case *object.Class:
+		return instantiate(fn, args)
+
 	default:
 		return newError("not a function: %s", fn.Type())
 	}
 }
 
 func extendFunctionEnv(fn *object.Function, args []object.Object) *object.Environment {
-	env := object.NewEnclosedEnvironment(fn.Env)
+	env := object.NewFunctionEnvironment(fn)
 
 	// if len(args) != len(fn.Parameters) {
 	// 	return newError("parameters length mismatch: ", fn.Type())
 	// }
 	for paramIdx, param := range fn.Parameters {
-		if paramIdx+1 > len(args) {
-			panic("参数长度不够")
-		}
 		env.Set(param.Value, args[paramIdx])
 	}
 	return env
 }
 
+// Foo(args): 创建实例, 以实例为 this 执行类体, 类体中 let 定义的成员写入实例属性, 再调用 init
+func instantiate(class *object.Class, args []object.Object) object.Object {
+	body := class.Body.(*object.Function)
+	instance := object.NewInstance(class)
+	env := extendFunctionEnv(body, []object.Object{instance})
+
+	for _, stmt := range body.Body.Statements {
+		result := Eval(stmt, env)
+		if isError(result) {
+			return result
+		}
+		let, ok := stmt.(*ast.LetStatement)
+		if !ok {
+			continue
+		}
+		member, _ := env.Get(let.Name.Value)
+		if err := object.SetProperty(instance, let.Name.Value, member); err != nil {
+			return err
+		}
+	}
+
+	if init, ok := instance.Fields["init"]; ok {
+		result := applyFunction(init, args)
+		if isError(result) {
+			return result
+		}
+	} else if len(args) > 0 {
+		return newError("wrong number of arguments.want=0, got=%d", len(args))
+	}
+	return instance
+}
+
+// 与编译器一致: 循环体是块级作用域, 每次迭代使用新的环境
+func evalWhileStatement(node *ast.WhileStatement, env *object.Environment) object.Object {
+	for {
+		condition := Eval(node.Condition, env)
+		if isError(condition) {
+			return condition
+		}
+		if !isTruthy(condition) {
+			return nil
+		}
+
+		result := Eval(node.Body, object.NewEnclosedEnvironment(env))
+		if isReturnOrError(result) {
+			return result
+		}
+	}
+}
+
+// for 的 let 变量只在循环内可见; 每次迭代复制一份循环变量,
+// 与虚拟机一致, 循环体中创建的闭包看到的是当次迭代的值
+func evalForStatement(node *ast.ForStatement, env *object.Environment) object.Object {
+	loopEnv := object.NewEnclosedEnvironment(env)
+	if node.LetStmt != nil {
+		if result := Eval(node.LetStmt, loopEnv); isError(result) {
+			return result
+		}
+	}
+
+	for {
+		condition := Eval(node.Condition, loopEnv)
+		if isError(condition) {
+			return condition
+		}
+		if !isTruthy(condition) {
+			return nil
+		}
+
+		result := Eval(node.Body, object.NewEnclosedEnvironment(loopEnv))
+		if isReturnOrError(result) {
+			return result
+		}
+
+		if node.LetStmt != nil {
+			name := node.LetStmt.Name.Value
+			value, _ := loopEnv.Get(name)
+			loopEnv = object.NewEnclosedEnvironment(env)
+			loopEnv.Set(name, value)
+		}
+		if node.Inc != nil {
+			if result := Eval(node.Inc, loopEnv); isError(result) {
+				return result
+			}
+		}
+	}
+}
+
+func isReturnOrError(obj object.Object) bool {
+	if obj == nil {
+		return false
+	}
+	return obj.Type() == object.RETURN_VALUE_OBJ || obj.Type() == object.ERROR_OBJ
+}
+
 func unwrapReturnValue(obj object.Object) object.Object {
 	if returnValue, ok := obj.(*object.ReturnValue); ok {
 		return returnValue.Value
@@ -367,15 +511,46 @@ func evalStringInfixExpression(operator string, left, right object.Object) objec
 		return nativeBoolToBooleanObject(leftValue == rightValue)
 	case "!=":
 		return nativeBoolToBooleanObject(leftValue != rightValue)
+	case "<", "<=", ">", ">=":
+		return evalOrderingExpression(operator, left, right)
 	default:
 		return newError("unknown operator: %s %s %s", left.Type(), operator, right.Type())
 	}
 }
 
+func isOrderingOperator(operator string) bool {
+	switch operator {
+	case "<", "<=", ">", ">=":
+		return true
+	}
+	return false
+}
+
+// 字符串、数组按字典序比较
+func evalOrderingExpression(operator string, left, right object.Object) object.Object {
+	result, err := object.Compare(left, right)
+	if err != nil {
+		return err
+	}
+
+	switch operator {
+	case "<":
+		return nativeBoolToBooleanObject(result < 0)
+	case "<=":
+		return nativeBoolToBooleanObject(result <= 0)
+	case ">":
+		return nativeBoolToBooleanObject(result > 0)
+	default:
+		return nativeBoolToBooleanObject(result >= 0)
+	}
+}
+
 func evalIndexExpression(left object.Object, index object.Object) object.Object {
 	switch {
 	case left.Type() == object.ARRAY_OBJ && index.Type() == object.INTEGER_OBJ:
 		return evalArrayIndex(left, index)
+	case left.Type() == object.STRING && index.Type() == object.INTEGER_OBJ:
+		return evalStringIndex(left, index)
 	case left.Type() == object.HASH_OBJ:
 		return evalHashIndexExpression(left, index)
 	default:
@@ -385,15 +560,50 @@ func evalIndexExpression(left object.Object, index object.Object) object.Object
 
 func evalArrayIndex(array, index object.Object) object.Object {
 	arrayObject := array.(*object.Array)
-	idx := index.(*object.Integer).Value
 
-	max := int64(len(arrayObject.ELements) - 1)
-	if idx < 0 || idx > max {
+	idx, ok := object.NormalizeIndex(index.(*object.Integer).Value, len(arrayObject.ELements))
+	if !ok {
 		return NULL
 	}
 	return arrayObject.ELements[idx]
 }
 
+func evalStringIndex(str, index object.Object) object.Object {
+	value := str.(*object.String).Value
+
+	idx, ok := object.NormalizeIndex(index.(*object.Integer).Value, len(value))
+	if !ok {
+		return NULL
+	}
+	return &object.String{Value: value[idx : idx+1]}
+}
+
+func evalSliceExpression(node *ast.SliceExpression, env *object.Environment) object.Object {
+	left := Eval(node.Left, env)
+	if isError(left) {
+		return left
+	}
+
+	bounds := []object.Object{}
+	for _, bound := range []ast.Expression{node.Start, node.End, node.Step} {
+		if bound == nil {
+			bounds = append(bounds, NULL)
+			continue
+		}
+		value := Eval(bound, env)
+		if isError(value) {
+			return value
+		}
+		bounds = append(bounds, value)
+	}
+
+	result, err := object.Slice(left, bounds[0], bounds[1], bounds[2])
+	if err != nil {
+		return err
+	}
+	return result
+}
+
 func evalHashLiteral(node *ast.HashLiteral, env *object.Environment) object.Object {
 	pairs := make(map[object.HashKey]object.HashPair)
 
@@ -404,7 +614,7 @@ func evalHashLiteral(node *ast.HashLiteral, env *object.Environment) object.Obje
 		}
 		hashKey, ok := key.(object.HashAble)
 		if !ok {
-			return newError("unusable as hash key: %s", hashKey.HashKey().Type)
+			return newError("unusable as hash key: %s", key.Type())
 		}
 		value := Eval(valueNode, env)
 		if isError(value) {
@@ -433,6 +643,96 @@ func evalHashIndexExpression(hash, index object.Object) object.Object {
 	return pair.Value
 }
 
+// obj.name
+func evalPropertyExpression(node *ast.InfixExpression, obj object.Object) object.Object {
+	ident, ok := node.Right.(*ast.Identifier)
+	if !ok {
+		return newError("invalid property name %s", node.Right.String())
+	}
+	value, err := object.GetProperty(obj, ident.Value)
+	if err != nil {
+		return err
+	}
+	return value
+}
+
+// 与虚拟机一致: 赋值不产生值, 数组/哈希原地修改
+func evalAssignExpression(node *ast.AssignExpression, env *object.Environment) object.Object {
+	switch left := node.Left.(type) {
+	case *ast.Identifier:
+		if _, ok := builtins[left.Value]; ok {
+			return newError("cannot assign to `%s`", left.Value)
+		}
+		value := Eval(node.ExpandedValue(), env)
+		if isError(value) {
+			return value
+		}
+		if result := env.Assign(left.Value, value); isError(result) {
+			return result
+		}
+	case *ast.IndexExpression:
+		target := Eval(left.Left, env)
+		if isError(target) {
+			return target
+		}
+		index := Eval(left.Index, env)
+		if isError(index) {
+			return index
+		}
+		value := evalAssignedValue(node, env, func() object.Object {
+			return evalIndexExpression(target, index)
+		})
+		if isError(value) {
+			return value
+		}
+		if err := object.SetIndex(target, index, value); err != nil {
+			return err
+		}
+	case *ast.InfixExpression:
+		ident, ok := left.Right.(*ast.Identifier)
+		if left.Operator != token.DOT || !ok {
+			return newError("invalid assignment target %s", left.String())
+		}
+		target := Eval(left.Left, env)
+		if isError(target) {
+			return target
+		}
+		value := evalAssignedValue(node, env, func() object.Object {
+			value, err := object.GetProperty(target, ident.Value)
+			if err != nil {
+				return err
+			}
+			return value
+		})
+		if isError(value) {
+			return value
+		}
+		if err := object.SetProperty(target, ident.Value, value); err != nil {
+			return err
+		}
+	default:
+		return newError("invalid assignment target %s", node.Left.String())
+	}
+	return nil
+}
+
+// 元素和属性赋值要写入的值; 复合赋值用 current 读出当前值, 目标和下标不会再求值一次
+func evalAssignedValue(node *ast.AssignExpression, env *object.Environment, current func() object.Object) object.Object {
+	operator := node.CompoundOperator()
+	if operator == "" {
+		return Eval(node.Value, env)
+	}
+	left := current()
+	if isError(left) {
+		return left
+	}
+	right := Eval(node.Value, env)
+	if isError(right) {
+		return right
+	}
+	return evalInfixExpression(operator, left, right)
+}
+
 func isTruthy(obj object.Object) bool {
 	switch obj {
 	case NULL:
@@ -62,6 +62,23 @@ func TestQuoteUnquote(t *testing.T) {
 			`quote(unquote(quote(4+4)))`,
 			"(4 + 4)",
 		},
+		{
+			"quote(f(unquote(1 + 1), [unquote(3)]))",
+			"f(2, [3])",
+		},
+		{
+			"quote(fn() { x = unquote(2) })",
+			"fn() { x = 2 }",
+		},
+		{
+			// 每次调用都从原始的函数体展开, 不会被上一次的 unquote 结果污染
+			"let f = fn(x) { quote(1 + unquote(x)) }; f(2); f(3)",
+			"(1 + 3)",
+		},
+		{
+			"let q = quote(a); quote([unquote(q), unquote(q)])",
+			"[a, a]",
+		},
 	}
 	for _, tt := range tests {
 		evaluated := testEval(tt.input)
@@ -77,3 +94,54 @@ func TestQuoteUnquote(t *testing.T) {
 		}
 	}
 }
+
+func TestQuoteUnquoteSplice(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"quote(f(unquote_splice([1, 2]), 3))", "f(1, 2, 3)"},
+		{"quote([0, unquote_splice([]), 1])", "[0, 1]"},
+		{"let args = quote([a, b + 1]); quote(f(unquote_splice(args)))", "f(a, (b + 1))"},
+		{"quote([unquote_splice([quote(x), true, quote(y * 2)])])", "[x, true, (y * 2)]"},
+		{
+			"let body = quote(fn() { let x = 1; puts(x); }); quote(if (c) { unquote_splice(body); x })",
+			"if (c) { let x = 1;puts(x);x }",
+		},
+		{"let body = quote(fn() { a; b }); quote(f(unquote_splice(body)))", "f(a, b)"},
+	}
+	for _, tt := range tests {
+		evaluated := testEval(tt.input)
+		quote, ok := evaluated.(*object.Quote)
+		if !ok {
+			t.Fatalf("expected *object.Quote for %q. got=%T (%+v)", tt.input, evaluated, evaluated)
+		}
+		if quote.Node.String() != tt.expected {
+			t.Errorf("no equal.got=%q,want=%q", quote.Node.String(), tt.expected)
+		}
+	}
+}
+
+func TestQuoteUnquoteSpliceErrors(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"quote(1 + unquote_splice([2]))", "unquote_splice is only allowed in a list of statements, arguments or elements"},
+		{"quote(f(unquote_splice(1)))", "argument to `unquote_splice` must be ARRAY or QUOTE, got INTEGER"},
+		{"quote(f(unquote_splice(quote(a + b))))", "cannot splice (a + b), want an array or fn() { ... }"},
+		{"quote(f(unquote_splice(quote(fn() { let x = 1; }))))", "cannot splice statement let x = 1; into an expression list"},
+		{`quote(f(unquote_splice(["a"])))`, "cannot splice STRING"},
+	}
+	for _, tt := range tests {
+		evaluated := testEval(tt.input)
+		errObj, ok := evaluated.(*object.Error)
+		if !ok {
+			t.Errorf("expected *object.Error for %q. got=%T (%+v)", tt.input, evaluated, evaluated)
+			continue
+		}
+		if errObj.Message != tt.expected {
+			t.Errorf("wrong error message. want=%q, got=%q", tt.expected, errObj.Message)
+		}
+	}
+}
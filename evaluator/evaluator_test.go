@@ -1,9 +1,12 @@
 package evaluator
 
 import (
+	"io/ioutil"
 	"monkey/lexer"
 	"monkey/object"
 	"monkey/parser"
+	"path/filepath"
+	"runtime/debug"
 	"testing"
 )
 
@@ -70,6 +73,52 @@ func TestEvalBooleanExpression(t *testing.T) {
 	}
 }
 
+func TestStructuralComparison(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected bool
+	}{
+		{`"a" + "b" == "ab"`, true},
+		{"[1, [2, 3]] == [1, [2, 3]]", true},
+		{"[1, 2] == [1, 2, 3]", false},
+		{"[1, 2] != [2, 1]", true},
+		{`{"a": [1], "b": 2} == {"b": 2, "a": [1]}`, true},
+		{`{"a": 1} == {"a": 2}`, false},
+		{`[1] == "1"`, false},
+		{"let f = fn() {}; f == f", true},
+		{`"abc" < "abd"`, true},
+		{`"b" > "abc"`, true},
+		{`"ab" <= "ab"`, true},
+		{`"" >= "a"`, false},
+		{"[1, 2] < [1, 3]", true},
+		{"[1, 2] < [1, 2, 0]", true},
+		{"[2] > [1, 9]", true},
+		{`[["a"], 1] >= [["a"], 1]`, true},
+	}
+
+	for _, tt := range tests {
+		testBooleanObject(t, testEval(tt.input), tt.expected)
+	}
+}
+
+// 与虚拟机一致: 短路求值, 返回决定结果的操作数
+func TestLogicalOperators(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected int64
+	}{
+		{"true && 1", 1},
+		{"0 || 2", 0},
+		{"false || 2", 2},
+		{"let a = 1; let f = fn() { a = 2; true }; true || f(); a", 1},
+	}
+
+	for _, tt := range tests {
+		testIntegerObject(t, testEval(tt.input), tt.expected)
+	}
+	testBooleanObject(t, testEval("false && 1"), false)
+}
+
 func TestBangOperator(t *testing.T) {
 	tests := []struct {
 		input    string
@@ -145,6 +194,8 @@ func TestErrorHandling(t *testing.T) {
 		{"if(10 > 1){ true + false;}", "unknown operator: BOOLEAN + BOOLEAN"},
 		{"if(10 > 1){if(10>1){return true + false;} return 1;}", "unknown operator: BOOLEAN + BOOLEAN"},
 		{"if(10 > 1){if(10>true){return 10;} return 1;}", "type mismatch: INTEGER > BOOLEAN"},
+		{`"a" < "b" + 1`, "type mismatch: STRING + INTEGER"},
+		{`[1] > ["a"]`, "cannot compare INTEGER and STRING"},
 		{"foobar;", "identifier not found: foobar"},
 		{`"hello" - "world"`, "unknown operator: STRING - STRING"},
 	}
@@ -172,6 +223,130 @@ func TestLetStatement(t *testing.T) {
 		{"let a = 5 * 5;a;", 25},
 		{"let a = 5;let b = a;b;", 5},
 		{"let a = 1;let b = a;let c= a+b+1;c;", 3},
+		{"let a = 1; if (true) { let a = 2; }; a;", 1},
+		{"let a = 1; if (false) { 0 } else { let a = 2; }; a;", 1},
+	}
+
+	for _, tt := range tests {
+		testIntegerObject(t, testEval(tt.input), tt.expected)
+	}
+}
+
+func TestAssignExpression(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected int64
+	}{
+		{"let a = 1; a = a + 2; a;", 3},
+		{"let a = 1; a += 2; a *= 3; a;", 9},
+		{"let a = 1; let f = fn() { a = 5; }; f(); a;", 5},
+		{"let a = 1; if (true) { a = 2; }; a;", 2},
+		{"let a = [0, 1, 2]; a[1] = 5; a[1];", 5},
+		{"let a = [1, 2]; a[0] += 4; a[0];", 5},
+		{`let h = {"k": 1}; h["k"] = 2; h["n"] = 3; h["k"] + h["n"];`, 5},
+		{"let a = [[0, 1], [2, 3]]; a[1][0] = 9; a[1][0];", 9},
+		{"let f = fn() { let a = [1, 2]; a[0] = 7; a[0] }; f();", 7},
+		{`let h = {}; h.x = 4; h.x;`, 4},
+		{`let h = {"inner": {}}; h.inner.x = 4; h["inner"]["x"];`, 4},
+		// 原地修改: 别名可见
+		{"let a = [1, 2]; let b = a; b[0] = 9; a[0];", 9},
+		{"let a = [1]; let f = fn(x) { x[0] = 5; }; f(a); a[0];", 5},
+		{"let a = [1]; let b = a; b = [2]; a[0];", 1},
+		// 复合赋值的目标和下标只求值一次
+		{"let n = 0; let next = fn() { n = n + 1; n }; let a = [0, 0, 0, 0]; a[next()] += 10; a[1] * 10 + n;", 101},
+		{`let calls = 0; let h = {"x": 1}; let get = fn() { calls += 1; h }; get().x += 5; h.x * 10 + calls;`, 61},
+	}
+
+	for _, tt := range tests {
+		testIntegerObject(t, testEval(tt.input), tt.expected)
+	}
+}
+
+// 容器包含自己时输出占位符, 不会无限递归
+func TestSelfReferencingInspect(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"let a = [0]; a[0] = a; a", "[[...]]"},
+		{"let a = [1, 2]; a[1] = [a]; a", "[1, [[...]]]"},
+		{`let h = {}; h.s = h; h`, "{s:{...}}"},
+		{`let h = {}; let a = [h]; h.a = a; a`, "[{a:[...]}]"},
+		{"let a = [0]; let b = [a, a]; a[0] = 1; b", "[[1], [1]]"},
+	}
+
+	for _, tt := range tests {
+		evaluated := testEval(tt.input)
+		if evaluated.Inspect() != tt.expected {
+			t.Errorf("wrong inspect for %q. want=%q, got=%q", tt.input, tt.expected, evaluated.Inspect())
+		}
+	}
+}
+
+func TestAssignErrors(t *testing.T) {
+	tests := []struct {
+		input           string
+		expectedMessage string
+	}{
+		{"let a = [1]; a[1] = 2;", "index out of range [1] with length 1"},
+		{`let a = [1]; a["x"] = 2;`, "array index must be INTEGER, got STRING"},
+		{"let n = 1; n[0] = 2;", "index assignment not supported: INTEGER"},
+		{"const c = 1; c = 2;", "cannot assign to constant `c`"},
+		{"const c = 1; c += 1;", "cannot assign to constant `c`"},
+		{"const c = [1]; let f = fn() { c = 2; }; f();", "cannot assign to constant `c`"},
+		{"const c = 1; let c = 2;", "constant `c` already declared"},
+		{"const c = 1; let f = fn() { let c = 2; c }; f();", "constant `c` already declared"},
+		{"let h = {}; h.x;", "undefined property `x`"},
+		{`let h = {"name": 1, "age": 2}; h.nmae;`, "undefined property `nmae`, did you mean 'name'?"},
+		{`class Foo { let bar = fn() { 1 }; } Foo().baz();`, "undefined property `baz` on Foo, did you mean 'bar'?"},
+		{"len = 1;", "cannot assign to `len`"},
+		{"1 = 2;", "invalid assignment target 1"},
+	}
+
+	for _, tt := range tests {
+		evaluated := testEval(tt.input)
+		err, ok := evaluated.(*object.Error)
+		if !ok {
+			t.Errorf("object isn't Error. got=%T (%+v)", evaluated, evaluated)
+			continue
+		}
+		if err.Message != tt.expectedMessage {
+			t.Errorf("wrong error message. expected=%q, got=%q", tt.expectedMessage, err.Message)
+		}
+	}
+}
+
+func TestWhileStatement(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected int64
+	}{
+		{"let foo = 0; while (foo < 2) { let a = 1; foo = foo + a; } foo;", 2},
+		// 循环体是块级作用域
+		{"let foo = 0; let i = 0; while (i < 2) { let foo = 5; i = i + 1; } foo;", 0},
+		{"let f = fn() { let i = 0; while (true) { i += 1; if (i == 3) { return i; } } }; f();", 3},
+	}
+
+	for _, tt := range tests {
+		testIntegerObject(t, testEval(tt.input), tt.expected)
+	}
+}
+
+func TestForStatement(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected int64
+	}{
+		{"let b = 0; for (let a = 0; a < 3; a = a + 1) { b = b + a; } b;", 3},
+		{"let a = 1; for (let a = 0; a < 3; a = a + 1) { } a;", 1},
+		{"let f = fn() { for (let i = 0; i < 10; i += 1) { if (i == 4) { return i * 10; } } 0 }; f();", 40},
+		// 每次迭代的闭包看到当次的循环变量
+		{`let fns = [];
+		for (let i = 0; i < 3; i = i + 1) { fns = push(fns, fn() { i }); }
+		fns[0]() + fns[1]() * 10 + fns[2]() * 100;`, 210},
+		{`let fns = [];
+		for (let i = 0; i < 3; i = i + 1) { let j = i * 2; fns = push(fns, fn() { j }); }
+		fns[0]() + fns[1]() * 10 + fns[2]() * 100;`, 420},
 	}
 
 	for _, tt := range tests {
@@ -179,6 +354,77 @@ func TestLetStatement(t *testing.T) {
 	}
 }
 
+func TestClassStatement(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected interface{}
+	}{
+		{`class Cat { let bar = fn() { 1 }; } let cat = Cat(); cat.bar();`, 1},
+		{`class Counter {
+			this.n = 0;
+			let inc = fn() { this.n = this.n + 1; this.n };
+		}
+		let c = Counter();
+		c.inc();
+		c.inc();`, 2},
+		{`class Point {
+			let init = fn(x, y) { this.x = x; this.y = y; };
+			let sum = fn() { this.x + this.y };
+		}
+		let p = Point(3, 4);
+		p.x = 10;
+		p.sum();`, 14},
+		// 实例是引用
+		{`class Box { this.v = 1; } let a = Box(); let b = a; b.v = 5; a.v;`, 5},
+		{`class Box { this.v = 1; } let a = Box(); let b = Box(); b.v = 5; a.v;`, 1},
+		{`class Foo { } Foo(1);`, "wrong number of arguments.want=0, got=1"},
+		{`class Foo { let init = fn(x) { }; } Foo();`, "wrong number of arguments.want=1, got=0"},
+		{`class Foo { } Foo().x;`, "undefined property `x` on Foo"},
+		{`this;`, "`this` outside of class"},
+		{`let f = fn() { this.x }; f();`, "`this` outside of class"},
+		{`let f = fn(a, b) { a }; f(1);`, "wrong number of arguments.want=2, got=1"},
+	}
+
+	for _, tt := range tests {
+		evaluated := testEval(tt.input)
+		switch expected := tt.expected.(type) {
+		case int:
+			testIntegerObject(t, evaluated, int64(expected))
+		case string:
+			err, ok := evaluated.(*object.Error)
+			if !ok {
+				t.Errorf("object isn't Error. got=%T (%+v)", evaluated, evaluated)
+				continue
+			}
+			if err.Message != expected {
+				t.Errorf("wrong error message. expected=%q, got=%q", expected, err.Message)
+			}
+		}
+	}
+}
+
+// 仓库里的示例程序在解释器中也能运行
+func TestRepositoryPrograms(t *testing.T) {
+	files, err := filepath.Glob("../*.mon")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		p := parser.New(lexer.New(string(data)))
+		program := p.ParserProgram()
+		if len(p.Errors()) != 0 {
+			t.Fatalf("%s: parser errors: %v", file, p.Errors())
+		}
+		if result := Eval(program, object.NewEnvironment()); isError(result) {
+			t.Errorf("%s: %s", file, result.Inspect())
+		}
+	}
+}
+
 func TestFunctionObject(t *testing.T) {
 	input := `fn(x) {x+2;}`
 
@@ -273,6 +519,9 @@ func TestBuiltinFunctions(t *testing.T) {
 		{`len(1)`, "argument to `len` not supported, got INTEGER"},
 		{`len("one","two")`, "wrong number of arguments. got 2, want 1"},
 		{"first(1)", "argument to `first` must be an array, got INTEGER"},
+		{"shift([1, 2], 0)[0]", 0},
+		{"len(remove([1, 2]))", 1},
+		{"remove(1)", "argument to `remove` must be an array, got INTEGER"},
 	}
 
 	for _, tt := range tests {
@@ -322,7 +571,8 @@ func TestArrayIndexExpression(t *testing.T) {
 		{"[1,2,3][1+1];", 3},
 		{"let arr = [1,2,3];arr[0]+arr[1]+arr[2];", 6},
 		{"[1,2,3][3]", nil},
-		{"[1,2,3][-1]", nil},
+		{"[1,2,3][-1]", 3},
+		{"[1,2,3][-4]", nil},
 	}
 
 	for _, tt := range tests {
@@ -336,6 +586,66 @@ func TestArrayIndexExpression(t *testing.T) {
 	}
 }
 
+func TestStringIndexAndSlice(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected interface{}
+	}{
+		{`"abc"[1]`, "b"},
+		{`"abc"[-1]`, "c"},
+		{`"abc"[5]`, nil},
+		{`"monkey"[1:3]`, "on"},
+		{`"monkey"[::-1]`, "yeknom"},
+		{`"monkey"[-3:]`, "key"},
+		{`"monkey"[10:]`, ""},
+	}
+
+	for _, tt := range tests {
+		evaluated := testEval(tt.input)
+		expected, ok := tt.expected.(string)
+		if !ok {
+			testNullObject(t, evaluated)
+			continue
+		}
+		str, ok := evaluated.(*object.String)
+		if !ok {
+			t.Errorf("object isn't String. got=%T (%+v)", evaluated, evaluated)
+			continue
+		}
+		if str.Value != expected {
+			t.Errorf("wrong string. expected=%q, got=%q", expected, str.Value)
+		}
+	}
+}
+
+func TestArraySlice(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected []int64
+	}{
+		{"[1,2,3,4][1:3]", []int64{2, 3}},
+		{"[1,2,3,4][-2:]", []int64{3, 4}},
+		{"[1,2,3,4][::-2]", []int64{4, 2}},
+		{"[1,2,3,4][3:1]", []int64{}},
+	}
+
+	for _, tt := range tests {
+		evaluated := testEval(tt.input)
+		array, ok := evaluated.(*object.Array)
+		if !ok {
+			t.Errorf("object isn't Array. got=%T (%+v)", evaluated, evaluated)
+			continue
+		}
+		if len(array.ELements) != len(tt.expected) {
+			t.Errorf("wrong num of elements. expected=%d, got=%d", len(tt.expected), len(array.ELements))
+			continue
+		}
+		for i, expected := range tt.expected {
+			testIntegerObject(t, array.ELements[i], expected)
+		}
+	}
+}
+
 func TestHashLiterals(t *testing.T) {
 	input := `let two = "two";
 		{
@@ -432,6 +742,80 @@ func testNullObject(t *testing.T, obj object.Object) bool {
 	return true
 }
 
+// 尾调用由 applyFunction 循环执行, 限制 Go 的栈大小后 10 万次尾递归仍能完成
+func TestTailCalls(t *testing.T) {
+	defer debug.SetMaxStack(debug.SetMaxStack(16 << 20))
+
+	tests := []struct {
+		input    string
+		expected interface{}
+	}{
+		{`
+		let loop = fn(n, acc) {
+			if (n == 0) { acc } else { loop(n - 1, acc + 1) }
+		};
+		loop(100000, 0);
+		`, 100000},
+		{`
+		let isEven = fn(n) { if (n == 0) { return true; } return isOdd(n - 1); };
+		let isOdd = fn(n) { if (n == 0) { return false; } return isEven(n - 1); };
+		isOdd(100001)
+		`, true},
+		{`
+		let sum = fn(arr, acc) {
+			while (true) {
+				if (len(arr) == 0) { return acc; }
+				return sum(rest(arr), acc + first(arr));
+			}
+		};
+		sum([1, 2, 3, 4], 0)
+		`, 10},
+		{`
+		class Box { let init = fn(v) { this.v = v; }; }
+		let size = fn(a) { len(a) };
+		let box = fn(v) { Box(v) };
+		box(size([1, 2])).v
+		`, 2},
+		{`let f = fn(a) { a }; let g = fn() { f() }; g()`, "wrong number of arguments.want=1, got=0"},
+	}
+
+	for _, tt := range tests {
+		evaluated := testEval(tt.input)
+		switch expected := tt.expected.(type) {
+		case int:
+			testIntegerObject(t, evaluated, int64(expected))
+		case bool:
+			testBooleanObject(t, evaluated, expected)
+		case string:
+			errObj, ok := evaluated.(*object.Error)
+			if !ok {
+				t.Errorf("no error object returned. got=%T(%+v)", evaluated, evaluated)
+				continue
+			}
+			if errObj.Message != expected {
+				t.Errorf("wrong error message. expected=%q, got=%q", expected, errObj.Message)
+			}
+		}
+	}
+}
+
+// 尾调用分析保存在函数对象上, 不包括嵌套函数中的调用
+func TestFunctionTailCalls(t *testing.T) {
+	evaluated := testEval(`fn(n) { let g = fn() { h(1) }; if (n) { f(n) } else { g() + 1 } }`)
+	fn, ok := evaluated.(*object.Function)
+	if !ok {
+		t.Fatalf("object is not Function. got=%T (%+v)", evaluated, evaluated)
+	}
+
+	got := []string{}
+	for call := range fn.TailCalls {
+		got = append(got, call.String())
+	}
+	if len(got) != 1 || got[0] != "f(n)" {
+		t.Errorf("wrong tail calls. want=[f(n)], got=%v", got)
+	}
+}
+
 func testEval(input string) object.Object {
 	l := lexer.New(input)
 	p := parser.New(l)
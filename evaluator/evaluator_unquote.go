@@ -10,14 +10,34 @@ import (
 /*
 *  -Modify只修改了子节点，不更新父节点的Token字段,
 * -使用String()输出的信息与节点不一致，或其他错误
+* -先拷贝再替换 unquote, 避免修改宏体或函数体里的原始 AST
  */
 func quote(node ast.Node, env *object.Environment) object.Object {
-	node = evalUnquoteCall(node, env)
+	node, err := evalUnquoteCall(ast.Clone(node), env)
+	if err != nil {
+		return newError("%s", err)
+	}
 	return &object.Quote{Node: node}
 }
 
-func evalUnquoteCall(quoted ast.Node, env *object.Environment) ast.Node {
-	return ast.Modify(quoted, func(node ast.Node) ast.Node {
+func evalUnquoteCall(quoted ast.Node, env *object.Environment) (ast.Node, error) {
+	var spliceErr error
+	modified, err := ast.Rewrite(quoted, func(node ast.Node) ast.Node {
+		if spliceErr != nil {
+			return node
+		}
+		// 子节点先于父节点处理, unquote_splice 在所在的列表中展开
+		switch node := node.(type) {
+		case *ast.Program:
+			node.Statements, spliceErr = spliceStatements(node.Statements, env)
+		case *ast.BlockStatement:
+			node.Statements, spliceErr = spliceStatements(node.Statements, env)
+		case *ast.CallExpression:
+			node.Arguments, spliceErr = spliceExpressions(node.Arguments, env)
+		case *ast.ArrayLiteral:
+			node.Elements, spliceErr = spliceExpressions(node.Elements, env)
+		}
+
 		if !isUnquoteCall(node) {
 			return node
 		}
@@ -31,6 +51,21 @@ func evalUnquoteCall(quoted ast.Node, env *object.Environment) ast.Node {
 		unquoted := Eval(call.Arguments[0], env)
 		return convertObjectToASTNode(unquoted)
 	})
+	if spliceErr != nil {
+		return nil, spliceErr
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// 留下的 unquote_splice 不在列表中, 无法展开
+	ast.Inspect(modified, func(node ast.Node) bool {
+		if spliceErr == nil && isUnquoteSpliceCall(node) {
+			spliceErr = fmt.Errorf("unquote_splice is only allowed in a list of statements, arguments or elements")
+		}
+		return spliceErr == nil
+	})
+	return modified, spliceErr
 }
 
 func isUnquoteCall(node ast.Node) bool {
@@ -41,6 +76,103 @@ func isUnquoteCall(node ast.Node) bool {
 	return callExp.Function.TokenLiteral() == "unquote"
 }
 
+func isUnquoteSpliceCall(node ast.Node) bool {
+	callExp, ok := node.(*ast.CallExpression)
+	if !ok {
+		return false
+	}
+	return callExp.Function.TokenLiteral() == "unquote_splice" && len(callExp.Arguments) == 1
+}
+
+// unquote_splice(list) 的值展开成多个节点:
+// 数组的每个元素, 或者数组字面量的元素, 或者 fn() { ... } 函数体中的语句
+func spliceNodes(call *ast.CallExpression, env *object.Environment) ([]ast.Node, error) {
+	value := Eval(call.Arguments[0], env)
+	nodes := []ast.Node{}
+	switch value := value.(type) {
+	case *object.Error:
+		return nil, fmt.Errorf("%s", value.Message)
+	case *object.Array:
+		for _, el := range value.ELements {
+			node := convertObjectToASTNode(el)
+			if node == nil {
+				return nil, fmt.Errorf("cannot splice %s", el.Type())
+			}
+			nodes = append(nodes, node)
+		}
+	case *object.Quote:
+		if value.Node == nil {
+			return nil, fmt.Errorf("cannot splice an empty quote")
+		}
+		switch quoted := ast.Clone(value.Node).(type) {
+		case *ast.ArrayLiteral:
+			for _, el := range quoted.Elements {
+				nodes = append(nodes, el)
+			}
+		case *ast.FunctionLiteral:
+			for _, stmt := range quoted.Body.Statements {
+				nodes = append(nodes, stmt)
+			}
+		default:
+			return nil, fmt.Errorf("cannot splice %s, want an array or fn() { ... }", value.Node.String())
+		}
+	case nil:
+		return nil, fmt.Errorf("argument to `unquote_splice` has no value")
+	default:
+		return nil, fmt.Errorf("argument to `unquote_splice` must be ARRAY or QUOTE, got %s", value.Type())
+	}
+	return nodes, nil
+}
+
+func spliceStatements(stmts []ast.Statement, env *object.Environment) ([]ast.Statement, error) {
+	result := []ast.Statement{}
+	for _, stmt := range stmts {
+		exprStmt, ok := stmt.(*ast.ExpressionStatement)
+		if !ok || !isUnquoteSpliceCall(exprStmt.Expression) {
+			result = append(result, stmt)
+			continue
+		}
+		nodes, err := spliceNodes(exprStmt.Expression.(*ast.CallExpression), env)
+		if err != nil {
+			return nil, err
+		}
+		for _, node := range nodes {
+			switch node := node.(type) {
+			case ast.Statement:
+				result = append(result, node)
+			case ast.Expression:
+				result = append(result, &ast.ExpressionStatement{Token: exprStmt.Token, Expression: node})
+			}
+		}
+	}
+	return result, nil
+}
+
+func spliceExpressions(exps []ast.Expression, env *object.Environment) ([]ast.Expression, error) {
+	result := []ast.Expression{}
+	for _, exp := range exps {
+		if !isUnquoteSpliceCall(exp) {
+			result = append(result, exp)
+			continue
+		}
+		nodes, err := spliceNodes(exp.(*ast.CallExpression), env)
+		if err != nil {
+			return nil, err
+		}
+		for _, node := range nodes {
+			switch node := node.(type) {
+			case ast.Expression:
+				result = append(result, node)
+			case *ast.ExpressionStatement:
+				result = append(result, node.Expression)
+			default:
+				return nil, fmt.Errorf("cannot splice statement %s into an expression list", node.String())
+			}
+		}
+	}
+	return result, nil
+}
+
 func convertObjectToASTNode(obj object.Object) ast.Node {
 	switch obj := obj.(type) {
 	case *object.Integer:
@@ -64,7 +196,8 @@ func convertObjectToASTNode(obj object.Object) ast.Node {
 		}
 		return &ast.Boolean{Token: t, Value: obj.Value}
 	case *object.Quote:
-		return obj.Node
+		// 同一个 Quote 可能被 unquote 到多个位置, 每处使用独立的拷贝
+		return ast.Clone(obj.Node)
 	default:
 		return nil
 	}
@@ -1,26 +1,42 @@
 package evaluator
 
 import (
+	"fmt"
 	"monkey/ast"
 	"monkey/object"
+	"monkey/token"
 )
 
+// 宏展开结果中的宏调用会继续展开, 嵌套超过这个深度时认为宏无限递归
+const MaxMacroDepth = 100
+
+var errMacroDepth = fmt.Errorf("expansion did not terminate after %d nested expansions", MaxMacroDepth)
+
 // 将宏保存到env中
 func DefineMacro(program *ast.Program, env *object.Environment) {
-	definitions := []int{}
+	program.Statements = defineMacros(program.Statements, env)
+}
 
-	for i, statement := range program.Statements {
+// 把语句中的宏定义保存到 env 中, 返回去掉宏定义之后的语句
+func defineMacros(stmts []ast.Statement, env *object.Environment) []ast.Statement {
+	rest := []ast.Statement{}
+	for _, statement := range stmts {
 		if isMacroDefinition(statement) {
 			addMacro(statement, env)
-			definitions = append(definitions, i)
+			continue
 		}
+		rest = append(rest, statement)
 	}
+	return rest
+}
 
-	for i := len(definitions) - 1; i >= 0; i -= 1 {
-		idx := definitions[i]
-		// 从AST切片中删除宏 macro
-		program.Statements = append(program.Statements[:idx], program.Statements[idx+1:]...)
+func hasMacroDefinition(stmts []ast.Statement) bool {
+	for _, stmt := range stmts {
+		if isMacroDefinition(stmt) {
+			return true
+		}
 	}
+	return false
 }
 
 func isMacroDefinition(node ast.Statement) bool {
@@ -50,8 +66,35 @@ func addMacro(node ast.Statement, env *object.Environment) {
 	env.Set(letStmt.Name.Value, macro)
 }
 
-func ExpandMacros(program ast.Node, env *object.Environment) ast.Node {
-	return ast.Modify(program, func(node ast.Node) ast.Node {
+// 宏展开时的错误, Pos 为宏调用的位置
+type MacroError struct {
+	Pos     token.Position
+	Macro   string
+	Message string
+}
+
+func (e *MacroError) Error() string {
+	if !e.Pos.IsValid() {
+		return fmt.Sprintf("macro `%s`: %s", e.Macro, e.Message)
+	}
+	return fmt.Sprintf("%s: macro `%s`: %s", e.Pos, e.Macro, e.Message)
+}
+
+// 展开所有宏调用, 遇到第一个错误时停止展开并返回该错误
+func ExpandMacros(program ast.Node, env *object.Environment) (ast.Node, error) {
+	return expandMacros(program, env, 0)
+}
+
+func expandMacros(node ast.Node, env *object.Environment, depth int) (ast.Node, error) {
+	if err := expandBlockMacros(node, env, depth); err != nil {
+		return node, err
+	}
+
+	var expandErr error
+	expanded, err := ast.Rewrite(node, func(node ast.Node) ast.Node {
+		if expandErr != nil {
+			return node
+		}
 		callExp, ok := node.(*ast.CallExpression)
 		if !ok {
 			return node
@@ -60,17 +103,83 @@ func ExpandMacros(program ast.Node, env *object.Environment) ast.Node {
 		if !ok {
 			return node
 		}
+		if depth >= MaxMacroDepth {
+			expandErr = errMacroDepth
+			return node
+		}
 
-		args := quoteArgs(callExp)
-		evalEnv := extendMacroEnv(macro, args)
-		evaluated := Eval(macro.Body, evalEnv)
+		expanded, err := expandMacroCall(callExp, macro)
+		if err == nil {
+			// 展开结果中还有宏调用时继续展开, 直到不再变化
+			expanded, err = expandMacros(expanded, env, depth+1)
+		}
+		if err == errMacroDepth && depth == 0 {
+			// 无限递归报告在最外层的调用处
+			pos, _ := ast.Span(callExp)
+			err = &MacroError{Pos: pos, Macro: callExp.Function.String(), Message: err.Error()}
+		}
+		if err != nil {
+			expandErr = err
+			return node
+		}
+		return expanded
+	})
+	if expandErr != nil {
+		return node, expandErr
+	}
+	if err != nil {
+		return node, err
+	}
+	return expanded, nil
+}
 
-		quote, ok := evaluated.(*object.Quote)
-		if !ok {
-			panic("we only support returning AST-nodes from macro")
+// 块中定义的宏只在块内可见: 取出块中的宏定义, 在新的环境中展开这个块
+func expandBlockMacros(node ast.Node, env *object.Environment, depth int) error {
+	var err error
+	ast.Inspect(node, func(node ast.Node) bool {
+		if err != nil {
+			return false
+		}
+		block, ok := node.(*ast.BlockStatement)
+		if !ok || !hasMacroDefinition(block.Statements) {
+			return true
 		}
-		return quote.Node
+		blockEnv := object.NewEnclosedEnvironment(env)
+		block.Statements = defineMacros(block.Statements, blockEnv)
+		_, err = expandMacros(block, blockEnv, depth)
+		return false
 	})
+	return err
+}
+
+func expandMacroCall(callExp *ast.CallExpression, macro *object.Macro) (ast.Node, error) {
+	name := callExp.Function.String()
+	pos, _ := ast.Span(callExp)
+	fail := func(format string, a ...interface{}) error {
+		return &MacroError{Pos: pos, Macro: name, Message: fmt.Sprintf(format, a...)}
+	}
+
+	if len(callExp.Arguments) != len(macro.Parameters) {
+		return nil, fail("wrong number of arguments.want=%d, got=%d", len(macro.Parameters), len(callExp.Arguments))
+	}
+
+	args := quoteArgs(callExp)
+	evalEnv := extendMacroEnv(macro, args)
+	evaluated := Eval(renameIntroducedBindings(macro.Body), evalEnv)
+
+	switch evaluated := evaluated.(type) {
+	case *object.Error:
+		return nil, fail("%s", evaluated.Message)
+	case *object.Quote:
+		if evaluated.Node == nil {
+			return nil, fail("quote is empty")
+		}
+		return evaluated.Node, nil
+	case nil:
+		return nil, fail("must return a quote, got nothing")
+	default:
+		return nil, fail("must return a quote, got %s", evaluated.Type())
+	}
 }
 
 func isMacroCall(callExp *ast.CallExpression, env *object.Environment) (*object.Macro, bool) {
@@ -96,16 +205,28 @@ func quoteArgs(callExp *ast.CallExpression) []*object.Quote {
 	args := []*object.Quote{}
 	// callExp arg to Quote
 	for _, arg := range callExp.Arguments {
-		args = append(args, &object.Quote{Node: arg})
+		args = append(args, &object.Quote{Node: ast.Clone(arg)})
 	}
 	return args
 }
 
+// 宏体中可以使用 gensym() 生成新的标识符
 func extendMacroEnv(macro *object.Macro, args []*object.Quote) *object.Environment {
 	extended := object.NewEnclosedEnvironment(macro.Env)
+	extended.Set("gensym", &object.Builtin{Fn: gensymBuiltin, Arity: object.Variadic})
 	for paramIdx, param := range macro.Parameters {
 		extended.Set(param.Value, args[paramIdx])
 	}
 
 	return extended
 }
+
+// 编译前的宏处理: 取出程序中的宏定义并展开宏调用, env 中的宏在多次调用间保留
+func ExpandProgram(program *ast.Program, env *object.Environment) (*ast.Program, error) {
+	DefineMacro(program, env)
+	expanded, err := ExpandMacros(program, env)
+	if err != nil {
+		return program, err
+	}
+	return expanded.(*ast.Program), nil
+}
@@ -1,10 +1,12 @@
 package evaluator
 
 import (
+	"fmt"
 	"monkey/ast"
 	"monkey/lexer"
 	"monkey/object"
 	"monkey/parser"
+	"sync"
 	"testing"
 )
 
@@ -90,6 +92,12 @@ func TestExpandMacro(t *testing.T) {
 			unless(10>5,puts("not greater."),puts("greater!"));`,
 			`if(!(10 > 5)){puts("not greater.")}else{puts("greater!")}`,
 		},
+		{
+			`let double = macro(x){quote(unquote(x) * 2)};
+			double(1);
+			double(a + b);`,
+			"(1 * 2); ((a + b) * 2)",
+		},
 	}
 
 	for _, tt := range tests {
@@ -97,10 +105,292 @@ func TestExpandMacro(t *testing.T) {
 		program := testParserProgram(tt.input)
 		env := object.NewEnvironment()
 		DefineMacro(program, env)
-		expanded := ExpandMacros(program, env)
+		expanded, err := ExpandMacros(program, env)
+		if err != nil {
+			t.Fatalf("ExpandMacros failed: %s", err)
+		}
 
 		if expanded.String() != expected.String() {
 			t.Errorf("not equal. got=%q, want=%q", expanded.String(), expected.String())
 		}
 	}
 }
+
+func TestExpandMacrosKeepsSharedArgumentsIndependent(t *testing.T) {
+	program := testParserProgram(`
+	let twice = macro(x){quote([unquote(x), unquote(x)])};
+	twice(y);
+	`)
+	env := object.NewEnvironment()
+	DefineMacro(program, env)
+	node, err := ExpandMacros(program, env)
+	if err != nil {
+		t.Fatalf("ExpandMacros failed: %s", err)
+	}
+	expanded := node.(*ast.Program)
+
+	stmt := expanded.Statements[0].(*ast.ExpressionStatement)
+	array, ok := stmt.Expression.(*ast.ArrayLiteral)
+	if !ok {
+		t.Fatalf("expected *ast.ArrayLiteral. got=%T", stmt.Expression)
+	}
+	if array.Elements[0] == array.Elements[1] {
+		t.Errorf("unquoted argument is shared between both elements")
+	}
+	array.Elements[0].(*ast.Identifier).Value = "z"
+	if array.String() != "[z, y]" {
+		t.Errorf("changing one element affected the other. got=%q", array.String())
+	}
+}
+
+// 宏环境在多次展开之间保留, 后面的程序可以使用前面定义的宏
+func TestExpandProgramKeepsMacros(t *testing.T) {
+	env := object.NewEnvironment()
+
+	first, err := ExpandProgram(testParserProgram(`let double = macro(a) { quote(unquote(a) * 2) };`), env)
+	if err != nil {
+		t.Fatalf("ExpandProgram failed: %s", err)
+	}
+	if len(first.Statements) != 0 {
+		t.Fatalf("macro definition not removed. got=%q", first.String())
+	}
+
+	second, err := ExpandProgram(testParserProgram(`double(1 + 2);`), env)
+	if err != nil {
+		t.Fatalf("ExpandProgram failed: %s", err)
+	}
+	expected := testParserProgram(`(1 + 2) * 2;`)
+	if second.String() != expected.String() {
+		t.Errorf("wrong expansion. want=%q, got=%q", expected.String(), second.String())
+	}
+}
+
+// 宏引入的 tmp 不会覆盖调用处的 tmp
+func TestMacroHygiene(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected interface{}
+	}{
+		{`
+		let swap = macro(a, b) { quote(if (true) { let tmp = unquote(a); unquote(a) = unquote(b); unquote(b) = tmp; }) };
+		let tmp = 1;
+		let other = 2;
+		swap(tmp, other);
+		[tmp, other]
+		`, []int64{2, 1}},
+		{`
+		let square = macro(e) { quote(fn(x) { x * x }(unquote(e))) };
+		let x = 3;
+		square(x + 1)
+		`, 16},
+		{`
+		let withCounter = macro(body) { quote(if (true) { let n = 10; unquote(body) }) };
+		let n = 1;
+		withCounter(n + 1)
+		`, 2},
+		{`
+		let sum = macro(arr) {
+			quote(fn() {
+				let total = 0;
+				for (let i = 0; i < len(unquote(arr)); i += 1) { total += unquote(arr)[i]; }
+				total
+			}())
+		};
+		let i = 100;
+		sum([i, i])
+		`, 200},
+		{`
+		let point = macro(v) { quote(if (true) { let h = {"x": unquote(v)}; h.x }) };
+		point(5)
+		`, 5},
+	}
+
+	for _, tt := range tests {
+		evaluated := testEvalWithMacros(t, tt.input)
+		switch expected := tt.expected.(type) {
+		case int:
+			testIntegerObject(t, evaluated, int64(expected))
+		case []int64:
+			array, ok := evaluated.(*object.Array)
+			if !ok {
+				t.Fatalf("object is not Array. got=%T (%+v)", evaluated, evaluated)
+			}
+			for i, want := range expected {
+				testIntegerObject(t, array.ELements[i], want)
+			}
+		}
+	}
+}
+
+func TestGensym(t *testing.T) {
+	program := testParserProgram(`
+	let fresh = macro() { let name = gensym("tmp"); quote([unquote(name), unquote(gensym())]) };
+	fresh();
+	fresh();
+	`)
+	env := object.NewEnvironment()
+	DefineMacro(program, env)
+	node, err := ExpandMacros(program, env)
+	if err != nil {
+		t.Fatalf("ExpandMacros failed: %s", err)
+	}
+
+	names := map[string]bool{}
+	for _, stmt := range node.(*ast.Program).Statements {
+		array := stmt.(*ast.ExpressionStatement).Expression.(*ast.ArrayLiteral)
+		for _, el := range array.Elements {
+			ident, ok := el.(*ast.Identifier)
+			if !ok {
+				t.Fatalf("expected *ast.Identifier. got=%T", el)
+			}
+			if names[ident.Value] {
+				t.Errorf("gensym returned %q twice", ident.Value)
+			}
+			names[ident.Value] = true
+		}
+	}
+
+	// 生成的名字可以作为源码重新解析
+	reparsed := testParserProgram(node.String())
+	if reparsed.String() != node.String() {
+		t.Errorf("generated names do not round-trip. want=%q, got=%q", node.String(), reparsed.String())
+	}
+
+	// 定义了宏的程序中不能写出生成的名字, 不会与展开生成的名字冲突
+	for name := range names {
+		p := parser.New(lexer.New("let m = macro() { quote(1) }; let " + name + " = 1;"))
+		p.ParserProgram()
+		if len(p.Errors()) == 0 {
+			t.Errorf("generated name %q can be written in a program with macros", name)
+		}
+	}
+}
+
+func TestGensymConcurrent(t *testing.T) {
+	var wg sync.WaitGroup
+	results := make(chan string, 400)
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				results <- gensym("x")
+			}
+		}()
+	}
+	wg.Wait()
+	close(results)
+
+	seen := map[string]bool{}
+	for name := range results {
+		if seen[name] {
+			t.Fatalf("gensym returned %q twice", name)
+		}
+		seen[name] = true
+	}
+}
+
+func TestMacroExpansionErrors(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"let m = macro(a, b) { quote(unquote(a) + unquote(b)) };\nlet x = 1;\n  m(1);",
+			"3:3: macro `m`: wrong number of arguments.want=2, got=1"},
+		{"let m = macro(a) { 1 };\nputs(m(2));",
+			"2:6: macro `m`: must return a quote, got INTEGER"},
+		{"let m = macro() { undefined };\nm()",
+			"2:1: macro `m`: identifier not found: undefined"},
+		{"let m = macro() { gensym(1) };\nm()",
+			"2:1: macro `m`: argument to `gensym` must be STRING, got INTEGER"},
+		{"let m = macro() { let x = 1; };\nm()",
+			"2:1: macro `m`: must return a quote, got nothing"},
+	}
+
+	for _, tt := range tests {
+		program := testParserProgram(tt.input)
+		env := object.NewEnvironment()
+		DefineMacro(program, env)
+		_, err := ExpandMacros(program, env)
+		if err == nil {
+			t.Errorf("expected an error for %q", tt.input)
+			continue
+		}
+		if err.Error() != tt.expected {
+			t.Errorf("wrong error. want=%q, got=%q", tt.expected, err)
+		}
+	}
+}
+
+func testEvalWithMacros(t *testing.T, input string) object.Object {
+	t.Helper()
+	program, err := ExpandProgram(testParserProgram(input), object.NewEnvironment())
+	if err != nil {
+		t.Fatalf("ExpandProgram failed: %s", err)
+	}
+	return Eval(program, object.NewEnvironment())
+}
+
+func TestBlockMacros(t *testing.T) {
+	input := `
+	let f = fn(x) {
+		let double = macro(e) { quote(unquote(e) * 2) };
+		if (x > 0) {
+			let inc = macro(e) { quote(unquote(e) + 1) };
+			return inc(double(x));
+		}
+		double(x)
+	};
+	inc(1);
+	`
+	program := testParserProgram(input)
+	expanded, err := ExpandProgram(program, object.NewEnvironment())
+	if err != nil {
+		t.Fatalf("ExpandProgram failed: %s", err)
+	}
+
+	// 块中定义的宏在块外不可见, 块外的 inc(1) 保持原样
+	expected := testParserProgram(`
+	let f = fn(x) {
+		if (x > 0) {
+			return ((x * 2) + 1);
+		};
+		(x * 2)
+	};
+	inc(1);
+	`)
+	if expanded.String() != expected.String() {
+		t.Errorf("wrong expansion.\nwant=%q\ngot= %q", expected.String(), expanded.String())
+	}
+}
+
+// 展开结果中的宏调用继续展开, 直到没有宏调用
+func TestExpandMacrosUntilFixpoint(t *testing.T) {
+	input := `
+	let inc = macro(e) { quote(unquote(e) + 1) };
+	let incTwice = macro(e) { quote(inc(inc(unquote(e)))) };
+	let call = macro(f, args) { quote(unquote(f)(unquote_splice(args))) };
+	incTwice(1);
+	call(incTwice, [x]);
+	`
+	expanded, err := ExpandProgram(testParserProgram(input), object.NewEnvironment())
+	if err != nil {
+		t.Fatalf("ExpandProgram failed: %s", err)
+	}
+	expected := testParserProgram(`((1 + 1) + 1); ((x + 1) + 1);`)
+	if expanded.String() != expected.String() {
+		t.Errorf("wrong expansion. want=%q, got=%q", expected.String(), expanded.String())
+	}
+}
+
+func TestRunawayMacroExpansion(t *testing.T) {
+	input := "let forever = macro(e) { quote(forever(unquote(e) + 1)) };\nlet x = 1;\nputs(forever(x));"
+	_, err := ExpandProgram(testParserProgram(input), object.NewEnvironment())
+	if err == nil {
+		t.Fatalf("expected an error")
+	}
+	expected := fmt.Sprintf("3:6: macro `forever`: expansion did not terminate after %d nested expansions", MaxMacroDepth)
+	if err.Error() != expected {
+		t.Errorf("wrong error. want=%q, got=%q", expected, err)
+	}
+}
@@ -0,0 +1,121 @@
+package evaluator
+
+import (
+	"monkey/ast"
+	"monkey/object"
+	"monkey/token"
+	"sync/atomic"
+)
+
+var gensymCounter int64
+
+// 生成不会与源码中的名字冲突的标识符: prefix__a, prefix__b, ...
+// 标识符中不能有数字, 计数用字母表示; 包含 __ 的名字保留给宏使用, 定义了宏的程序中解析器会拒绝;
+// 计数器在所有展开间共享 (REPL 中之前展开生成的名字仍然有效), 并发展开时也不会重复
+func gensym(prefix string) string {
+	suffix := ""
+	for n := atomic.AddInt64(&gensymCounter, 1); n > 0; n = (n - 1) / 26 {
+		suffix = string(rune('a'+(n-1)%26)) + suffix
+	}
+	return prefix + "__" + suffix
+}
+
+// gensym() 或 gensym("prefix"): 返回新标识符的 quote
+func gensymBuiltin(args ...object.Object) object.Object {
+	prefix := "g"
+	switch len(args) {
+	case 0:
+	case 1:
+		str, ok := args[0].(*object.String)
+		if !ok {
+			return newError("argument to `gensym` must be STRING, got %s", args[0].Type())
+		}
+		prefix = str.Value
+	default:
+		return newError("wrong number of arguments. got=%d, want=0 or 1", len(args))
+	}
+
+	name := gensym(prefix)
+	ident := &ast.Identifier{Token: token.Token{Type: token.IDENT, Literal: name}, Value: name}
+	return &object.Quote{Node: ident}
+}
+
+// 宏体中 quote 模板 (unquote 之外) 由 let、函数参数和 for 引入的名字,
+// 每次展开都换成新的名字, 避免捕获或覆盖调用处的同名变量
+func renameIntroducedBindings(body *ast.BlockStatement) *ast.BlockStatement {
+	body = ast.Clone(body).(*ast.BlockStatement)
+	ast.Inspect(body, func(node ast.Node) bool {
+		call, ok := node.(*ast.CallExpression)
+		if !ok || call.Function.TokenLiteral() != "quote" || len(call.Arguments) != 1 {
+			return true
+		}
+		renameTemplate(call.Arguments[0])
+		return false
+	})
+	return body
+}
+
+func renameTemplate(template ast.Node) {
+	renames := map[string]string{}
+	bind := func(ident *ast.Identifier) {
+		if _, ok := renames[ident.Value]; !ok {
+			renames[ident.Value] = gensym(ident.Value)
+		}
+	}
+	inspectTemplate(template, func(node ast.Node) {
+		switch node := node.(type) {
+		case *ast.LetStatement:
+			bind(node.Name)
+		case *ast.FunctionLiteral:
+			for _, param := range node.Parameters {
+				bind(param)
+			}
+		}
+	})
+	if len(renames) == 0 {
+		return
+	}
+
+	inspectTemplate(template, func(node ast.Node) {
+		switch node := node.(type) {
+		case *ast.Identifier:
+			if name, ok := renames[node.Value]; ok {
+				node.Value = name
+				node.Token.Literal = name
+			}
+		case *ast.FunctionLiteral:
+			if name, ok := renames[node.Name]; ok {
+				node.Name = name
+			}
+		}
+	})
+}
+
+// 访问模板中的节点, 跳过 unquote 和 unquote_splice 的参数 (宏展开时求值的代码)、
+// 属性名 (a.b 中的 b) 以及类成员的名字
+func inspectTemplate(template ast.Node, f func(ast.Node)) {
+	ast.Inspect(template, func(node ast.Node) bool {
+		switch node := node.(type) {
+		case *ast.CallExpression:
+			if isUnquoteCall(node) || isUnquoteSpliceCall(node) {
+				return false
+			}
+		case *ast.InfixExpression:
+			if node.Operator == "." {
+				inspectTemplate(node.Left, f)
+				return false
+			}
+		case *ast.ClassStmt:
+			for _, stmt := range node.Body.Statements {
+				if member, ok := stmt.(*ast.LetStatement); ok {
+					inspectTemplate(member.Value, f)
+				} else {
+					inspectTemplate(stmt, f)
+				}
+			}
+			return false
+		}
+		f(node)
+		return true
+	})
+}
@@ -0,0 +1,22 @@
+package evaluator
+
+import (
+	"monkey/ast"
+	"monkey/object"
+)
+
+// 尾部位置的调用不立即执行, 而是返回 tailCall, 由 applyFunction 循环执行,
+// 尾递归不会增加 Go 的调用栈
+type tailCall struct {
+	fn   *object.Function
+	args []object.Object
+}
+
+func (tc *tailCall) Type() object.ObjectType { return "TAIL_CALL" }
+func (tc *tailCall) Inspect() string         { return "tail call" }
+
+// 调用是否处于所在函数的尾部位置; 函数的尾调用在创建函数对象时分析
+func isTailCall(call *ast.CallExpression, env *object.Environment) bool {
+	fn := env.Function()
+	return fn != nil && fn.TailCalls[call]
+}
@@ -0,0 +1,134 @@
+package formatter
+
+import (
+	"fmt"
+	"strings"
+)
+
+const diffContext = 3
+
+type diffLine struct {
+	kind    byte // ' ' '-' '+'
+	text    string
+	oldLine int // 该行之前 old 中已有的行数
+	newLine int
+}
+
+// 按行比较 old 和 new, 返回 unified diff; 内容相同时返回空字符串
+func Diff(oldName, newName, old, new string) string {
+	if old == new {
+		return ""
+	}
+	lines := diffLines(splitLines(old), splitLines(new))
+
+	var out strings.Builder
+	fmt.Fprintf(&out, "--- %s\n+++ %s\n", oldName, newName)
+	for i := 0; i < len(lines); {
+		for i < len(lines) && lines[i].kind == ' ' {
+			i++
+		}
+		if i == len(lines) {
+			break
+		}
+
+		start := i - diffContext
+		if start < 0 {
+			start = 0
+		}
+		// 两处改动之间相同的行不超过 2*diffContext 时合并成一段
+		last := i
+		for j := i; j < len(lines) && j-last <= 2*diffContext; j++ {
+			if lines[j].kind != ' ' {
+				last = j
+			}
+		}
+		end := last + diffContext + 1
+		if end > len(lines) {
+			end = len(lines)
+		}
+
+		writeHunk(&out, lines[start:end])
+		i = end
+	}
+	return out.String()
+}
+
+func writeHunk(out *strings.Builder, hunk []diffLine) {
+	oldCount, newCount := 0, 0
+	for _, line := range hunk {
+		if line.kind != '+' {
+			oldCount++
+		}
+		if line.kind != '-' {
+			newCount++
+		}
+	}
+	fmt.Fprintf(out, "@@ -%s +%s @@\n",
+		hunkRange(hunk[0].oldLine, oldCount), hunkRange(hunk[0].newLine, newCount))
+	for _, line := range hunk {
+		out.WriteByte(line.kind)
+		out.WriteString(line.text)
+		if !strings.HasSuffix(line.text, "\n") {
+			out.WriteString("\n\\ No newline at end of file\n")
+		}
+	}
+}
+
+func hunkRange(before, count int) string {
+	if count == 0 {
+		return fmt.Sprintf("%d,0", before)
+	}
+	if count == 1 {
+		return fmt.Sprintf("%d", before+1)
+	}
+	return fmt.Sprintf("%d,%d", before+1, count)
+}
+
+// 每行保留行尾的换行符, 这样最后一行缺少换行符也算作差异
+func splitLines(s string) []string {
+	if s == "" {
+		return nil
+	}
+	lines := strings.SplitAfter(s, "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+// 最长公共子序列
+func diffLines(old, new []string) []diffLine {
+	lcs := make([][]int, len(old)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(new)+1)
+	}
+	for i := len(old) - 1; i >= 0; i-- {
+		for j := len(new) - 1; j >= 0; j-- {
+			if old[i] == new[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	lines := []diffLine{}
+	i, j := 0, 0
+	for i < len(old) || j < len(new) {
+		switch {
+		case i < len(old) && j < len(new) && old[i] == new[j]:
+			lines = append(lines, diffLine{kind: ' ', text: old[i], oldLine: i, newLine: j})
+			i++
+			j++
+		case j == len(new) || i < len(old) && lcs[i+1][j] >= lcs[i][j+1]:
+			lines = append(lines, diffLine{kind: '-', text: old[i], oldLine: i, newLine: j})
+			i++
+		default:
+			lines = append(lines, diffLine{kind: '+', text: new[j], oldLine: i, newLine: j})
+			j++
+		}
+	}
+	return lines
+}
@@ -0,0 +1,40 @@
+package formatter
+
+import "testing"
+
+func TestDiff(t *testing.T) {
+	tests := []struct {
+		old      string
+		new      string
+		expected string
+	}{
+		{"a\nb\n", "a\nb\n", ""},
+		{
+			"a\nb\nc\n",
+			"a\nB\nc\n",
+			"--- old\n+++ new\n@@ -1,3 +1,3 @@\n a\n-b\n+B\n c\n",
+		},
+		{
+			"1\n2\n3\n4\n5\n6\n7\n8\n9\n10\n11\n12\n",
+			"one\n2\n3\n4\n5\n6\n7\n8\n9\n10\n11\ntwelve\n",
+			"--- old\n+++ new\n@@ -1,4 +1,4 @@\n-1\n+one\n 2\n 3\n 4\n@@ -9,4 +9,4 @@\n 9\n 10\n 11\n-12\n+twelve\n",
+		},
+		{
+			"x",
+			"x\n",
+			"--- old\n+++ new\n@@ -1 +1 @@\n-x\n\\ No newline at end of file\n+x\n",
+		},
+		{
+			"",
+			"a\n",
+			"--- old\n+++ new\n@@ -0,0 +1 @@\n+a\n",
+		},
+	}
+
+	for _, tt := range tests {
+		got := Diff("old", "new", tt.old, tt.new)
+		if got != tt.expected {
+			t.Errorf("Diff(%q, %q) wrong.\nwant=%q\ngot= %q", tt.old, tt.new, tt.expected, got)
+		}
+	}
+}
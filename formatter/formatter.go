@@ -1,37 +1,572 @@
-package formatter
-
-import (
-	"monkey/ast"
-)
-
-type FormatConfig struct {
-	maxLineLength uint32
-	maxHashOnline uint32
-}
-
-type Formatter struct {
-	indent uint32
-	column uint32
-	config *FormatConfig
-}
-
-func new() *Formatter {
-	return &Formatter{
-		indent: 0,
-		column: 1,
-		config: &FormatConfig{
-			maxLineLength: 80,
-			maxHashOnline: 3,
-		},
-	}
-}
-
-func ignoreSemicolonExpr(node ast.Node) bool {
-	switch node.(type) {
-	case *ast.IfExpression:
-		return true
-	case *ast.FunctionLiteral:
-		return false
-	}
-	return false
-}
+package formatter
+
+import (
+	"fmt"
+	"monkey/ast"
+	"monkey/lexer"
+	"monkey/parser"
+	"monkey/token"
+	"strings"
+	"unicode/utf8"
+)
+
+type FormatConfig struct {
+	maxLineLength uint32
+	maxHashOnline uint32
+}
+
+// maxLineLength: 每行最多的列数 (tab 按 4 列计算)
+// maxHashOnline: 键值对超过这个数量的哈希字面量逐行书写
+func NewConfig(maxLineLength, maxHashOnline uint32) *FormatConfig {
+	return &FormatConfig{
+		maxLineLength: maxLineLength,
+		maxHashOnline: maxHashOnline,
+	}
+}
+
+func DefaultConfig() *FormatConfig {
+	return NewConfig(80, 3)
+}
+
+func (c *FormatConfig) SetMaxLineLength(n uint32) {
+	c.maxLineLength = n
+}
+
+const tabWidth = 4
+
+type Formatter struct {
+	indent uint32
+	column uint32
+	config *FormatConfig
+
+	out          strings.Builder
+	comments     []token.Comment // 还没有输出的注释, 按源码顺序
+	lastLine     int             // 最近输出的代码或注释在源码中的行号
+	atBlockStart bool            // 刚输出了 { ( [ 或在文件开头, 不保留空行
+	flat         bool            // 单行模式: 遇到必须换行的内容时 failed 置为 true
+	failed       bool
+}
+
+func new(config *FormatConfig, comments []token.Comment) *Formatter {
+	if config == nil {
+		config = DefaultConfig()
+	}
+	return &Formatter{
+		indent:       0,
+		column:       1,
+		config:       config,
+		comments:     comments,
+		atBlockStart: true,
+	}
+}
+
+// 格式化源码, 注释原样保留; 源码使用 \r\n 换行时输出也使用 \r\n
+func Format(input string, config *FormatConfig) (string, error) {
+	l := lexer.New(input)
+	p := parser.New(l)
+	program := p.ParserProgram()
+	if len(p.Errors()) != 0 {
+		return "", fmt.Errorf("parser errors:\n\t%s", strings.Join(p.Errors(), "\n\t"))
+	}
+
+	out := FormatProgram(program, l.Comments(), config)
+	if i := strings.IndexByte(input, '\n'); i > 0 && input[i-1] == '\r' {
+		out = strings.ReplaceAll(out, "\n", "\r\n")
+	}
+	return out, nil
+}
+
+// comments 来自解析 program 的 lexer, 没有位置信息的节点前后不会插入注释
+func FormatProgram(program *ast.Program, comments []token.Comment, config *FormatConfig) string {
+	f := new(config, comments)
+	f.statements(program.Statements, token.Position{})
+	out := strings.TrimRight(f.out.String(), "\n")
+	if out == "" {
+		return ""
+	}
+	return out + "\n"
+}
+
+func ignoreSemicolonExpr(node ast.Node) bool {
+	switch node.(type) {
+	case *ast.IfExpression:
+		return true
+	case *ast.FunctionLiteral:
+		return false
+	}
+	return false
+}
+
+// closing 为 } 的位置, 之前剩下的注释写在块的末尾; 无效时写出所有剩下的注释
+func (f *Formatter) statements(stmts []ast.Statement, closing token.Position) {
+	for i, stmt := range stmts {
+		start, end := ast.Span(stmt)
+		f.leadingComments(start)
+		if start.IsValid() {
+			f.separate(start.Line)
+		}
+
+		f.statement(stmt, true)
+		f.atBlockStart = false
+		if end.IsValid() {
+			f.lastLine = end.Line
+		}
+
+		next := closing
+		if i+1 < len(stmts) {
+			next, _ = ast.Span(stmts[i+1])
+		}
+		f.trailingComment(next)
+		f.newline()
+	}
+	f.leadingComments(closing)
+}
+
+func (f *Formatter) statement(stmt ast.Statement, semicolon bool) {
+	end := ""
+	if semicolon {
+		end = ";"
+	}
+
+	switch stmt := stmt.(type) {
+	case *ast.LetStatement:
+		if stmt.IsConst() {
+			f.write("const ")
+		} else {
+			f.write("let ")
+		}
+		f.write(stmt.Name.Value + " = ")
+		f.expression(stmt.Value, parser.LOWEST, len(end))
+		f.write(end)
+	case *ast.ReturnStatement:
+		f.write("return")
+		if stmt.ReturnValue != nil {
+			f.write(" ")
+			f.expression(stmt.ReturnValue, parser.LOWEST, len(end))
+		}
+		f.write(end)
+	case *ast.ExpressionStatement:
+		f.expression(stmt.Expression, parser.LOWEST, len(end))
+		if !ignoreSemicolonExpr(stmt.Expression) {
+			f.write(end)
+		}
+	case *ast.WhileStatement:
+		f.write("while (")
+		f.expression(stmt.Condition, parser.LOWEST, 3)
+		f.write(") ")
+		f.block(stmt.Body)
+	case *ast.ForStatement:
+		f.write("for (")
+		if stmt.LetStmt != nil {
+			f.statement(stmt.LetStmt, false)
+		}
+		f.write("; ")
+		f.expression(stmt.Condition, parser.LOWEST, 2)
+		f.write("; ")
+		if stmt.Inc != nil {
+			f.statement(stmt.Inc, false)
+		}
+		f.write(") ")
+		f.block(stmt.Body)
+	case *ast.ClassStmt:
+		f.write("class " + stmt.Name.Value + " ")
+		f.block(stmt.Body)
+	case *ast.BlockStatement:
+		f.block(stmt)
+	}
+}
+
+// 单行模式下只接受源码中写在一行、最多一条语句的块, 其他情况每条语句一行
+func (f *Formatter) block(block *ast.BlockStatement) {
+	if block == nil || len(block.Statements) == 0 && !f.commentsBefore(block.Rbrace) {
+		f.write("{}")
+		return
+	}
+
+	if f.flat {
+		if !isSingleLine(block) {
+			f.failed = true
+			return
+		}
+		f.write("{ ")
+		f.statement(block.Statements[0], false)
+		f.write(" }")
+		return
+	}
+
+	f.write("{")
+	f.newline()
+	f.indent++
+	f.atBlockStart = true
+	f.statements(block.Statements, block.Rbrace)
+	f.indent--
+	f.write("}")
+}
+
+func isSingleLine(block *ast.BlockStatement) bool {
+	if len(block.Statements) > 1 {
+		return false
+	}
+	return !block.Token.Pos.IsValid() || !block.Rbrace.IsValid() || block.Token.Pos.Line == block.Rbrace.Line
+}
+
+// reserve 为表达式之后同一行还要写的字符数, 例如 ; 或 ,
+func (f *Formatter) expression(exp ast.Expression, prec int, reserve int) {
+	if f.flat {
+		if f.commentsWithin(exp) {
+			f.failed = true
+			return
+		}
+		f.expressionBody(exp, prec, reserve)
+		return
+	}
+
+	// 能写在一行时写在一行
+	if !f.commentsWithin(exp) {
+		flat, ok := f.tryFlat(func(sub *Formatter) {
+			sub.expressionBody(exp, prec, 0)
+		})
+		if ok && f.fits(flat, reserve) {
+			f.write(flat)
+			return
+		}
+	}
+	f.expressionBody(exp, prec, reserve)
+}
+
+func (f *Formatter) expressionBody(exp ast.Expression, prec int, reserve int) {
+	if expressionPrecedence(exp) < prec {
+		f.write("(")
+		defer f.write(")")
+		reserve++
+	}
+
+	switch exp := exp.(type) {
+	case *ast.Identifier:
+		f.write(exp.Value)
+	case *ast.IntegerLiteral:
+		f.write(fmt.Sprintf("%d", exp.Value))
+	case *ast.StringLiteral:
+		// 保留源码中的转义写法
+		if exp.Token.Type == token.STRING {
+			f.write(`"` + exp.Token.Literal + `"`)
+		} else {
+			f.write(`"` + exp.Value + `"`)
+		}
+	case *ast.Boolean:
+		f.write(fmt.Sprintf("%t", exp.Value))
+	case *ast.ThisLiteral:
+		f.write("this")
+	case *ast.PrefixExpression:
+		f.write(exp.Operator)
+		f.expression(exp.Right, parser.PREFIX, reserve)
+	case *ast.InfixExpression:
+		if exp.Operator == "." {
+			f.expression(exp.Left, parser.CALL, 0)
+			f.write(".")
+			f.expression(exp.Right, parser.INDEX, reserve)
+			return
+		}
+		p := infixPrecedence(exp.Operator)
+		f.expression(exp.Left, p, 0)
+		f.write(" " + exp.Operator + " ")
+		// 左结合: 右边优先级相同时需要括号
+		f.expression(exp.Right, p+1, reserve)
+	case *ast.AssignExpression:
+		f.expression(exp.Left, parser.CALL, 0)
+		f.write(" " + exp.Operator + " ")
+		f.expression(exp.Value, parser.LOWEST, reserve)
+	case *ast.IfExpression:
+		f.write("if (")
+		f.expression(exp.Condition, parser.LOWEST, 3)
+		f.write(") ")
+		f.block(exp.Consequence)
+		if exp.Alternative != nil {
+			f.write(" else ")
+			f.block(exp.Alternative)
+		}
+	case *ast.FunctionLiteral:
+		f.write("fn(" + joinIdentifiers(exp.Parameters) + ") ")
+		f.block(exp.Body)
+	case *ast.MacroLiteral:
+		f.write("macro(" + joinIdentifiers(exp.Parameters) + ") ")
+		f.block(exp.Body)
+	case *ast.CallExpression:
+		f.call(exp, reserve)
+	case *ast.ArrayLiteral:
+		f.list("[", "]", len(exp.Elements), func(i int) ast.Node {
+			return exp.Elements[i]
+		}, func(i, reserve int) {
+			f.expression(exp.Elements[i], parser.LOWEST, reserve)
+		}, exp.Rbracket)
+	case *ast.IndexExpression:
+		f.expression(exp.Left, parser.CALL, 0)
+		f.write("[")
+		f.expression(exp.Index, parser.LOWEST, reserve+1)
+		f.write("]")
+	case *ast.SliceExpression:
+		f.expression(exp.Left, parser.CALL, 0)
+		f.write("[")
+		if exp.Start != nil {
+			f.expression(exp.Start, parser.LOWEST, 0)
+		}
+		f.write(":")
+		if exp.End != nil {
+			f.expression(exp.End, parser.LOWEST, 0)
+		}
+		if exp.Step != nil {
+			f.write(":")
+			f.expression(exp.Step, parser.LOWEST, 0)
+		}
+		f.write("]")
+	case *ast.HashLiteral:
+		f.hash(exp)
+	}
+}
+
+func (f *Formatter) call(call *ast.CallExpression, reserve int) {
+	f.expression(call.Function, parser.CALL, 0)
+	args := call.Arguments
+
+	// 最后一个参数是函数字面量时, 其余参数写在同一行, 只展开函数体
+	if n := len(args); n > 0 && !f.flat && isFunctionLiteral(args[n-1]) {
+		last, _ := ast.Span(args[n-1])
+		prefix, ok := f.tryFlat(func(sub *Formatter) {
+			sub.write("(")
+			for _, arg := range args[:n-1] {
+				sub.expression(arg, parser.LOWEST, 0)
+				sub.write(", ")
+			}
+		})
+		if ok && !f.commentsBefore(last) && f.fits(prefix+"fn() {", 0) {
+			f.write(prefix)
+			f.expression(args[n-1], parser.LOWEST, reserve+1)
+			f.write(")")
+			return
+		}
+	}
+
+	f.list("(", ")", len(args), func(i int) ast.Node {
+		return args[i]
+	}, func(i, reserve int) {
+		f.expression(args[i], parser.LOWEST, reserve)
+	}, call.Rparen)
+}
+
+func (f *Formatter) hash(hash *ast.HashLiteral) {
+	keys := ast.SortedHashKeys(hash)
+	if f.flat && uint32(len(keys)) > f.config.maxHashOnline {
+		f.failed = true
+		return
+	}
+	f.list("{", "}", len(keys), func(i int) ast.Node {
+		return keys[i]
+	}, func(i, reserve int) {
+		f.expression(keys[i], parser.LOWEST, 0)
+		f.write(": ")
+		// 值的结束位置作为整个键值对的结束位置
+		f.expression(hash.Pairs[keys[i]], parser.LOWEST, reserve)
+		if end := nodeEnd(hash.Pairs[keys[i]]); end.IsValid() {
+			f.lastLine = end.Line
+		}
+	}, hash.Rbrace)
+}
+
+// 单行模式写成 (a, b), 否则每个元素一行
+func (f *Formatter) list(open, close string, n int, node func(i int) ast.Node, item func(i, reserve int), closing token.Position) {
+	if f.flat || n == 0 && !f.commentsBefore(closing) {
+		f.write(open)
+		for i := 0; i < n; i++ {
+			if i > 0 {
+				f.write(", ")
+			}
+			item(i, 0)
+		}
+		f.write(close)
+		return
+	}
+
+	f.write(open)
+	f.newline()
+	f.indent++
+	f.atBlockStart = true
+	for i := 0; i < n; i++ {
+		start, end := ast.Span(node(i))
+		f.leadingComments(start)
+
+		reserve := 1
+		if i == n-1 {
+			reserve = 0
+		}
+		item(i, reserve)
+		if i < n-1 {
+			f.write(",")
+		}
+		f.atBlockStart = false
+		if end.IsValid() && end.Line > f.lastLine {
+			f.lastLine = end.Line
+		}
+
+		next := closing
+		if i+1 < n {
+			next, _ = ast.Span(node(i + 1))
+		}
+		f.trailingComment(next)
+		f.newline()
+	}
+	f.leadingComments(closing)
+	f.indent--
+	f.write(close)
+}
+
+// 在单行模式下试写, 不会修改 f
+func (f *Formatter) tryFlat(print func(sub *Formatter)) (string, bool) {
+	sub := &Formatter{
+		column:   1,
+		config:   f.config,
+		comments: f.comments,
+		flat:     true,
+	}
+	print(sub)
+	return sub.out.String(), !sub.failed
+}
+
+func (f *Formatter) fits(s string, reserve int) bool {
+	column := int(f.column)
+	if column == 1 {
+		column += int(f.indent) * tabWidth
+	}
+	return column-1+utf8.RuneCountInString(s)+reserve <= int(f.config.maxLineLength)
+}
+
+func (f *Formatter) write(s string) {
+	if s == "" {
+		return
+	}
+	// 行首先写缩进
+	if f.column == 1 && f.indent > 0 && !f.flat {
+		f.out.WriteString(strings.Repeat("\t", int(f.indent)))
+		f.column += f.indent * tabWidth
+	}
+	f.out.WriteString(s)
+	f.column += uint32(utf8.RuneCountInString(s))
+}
+
+func (f *Formatter) newline() {
+	if f.flat {
+		f.failed = true
+		return
+	}
+	f.out.WriteString("\n")
+	f.column = 1
+}
+
+// 源码中与上一段代码之间有空行时保留一个空行
+func (f *Formatter) separate(line int) {
+	if !f.atBlockStart && f.lastLine > 0 && line > f.lastLine+1 {
+		f.out.WriteString("\n")
+	}
+}
+
+// 输出 pos 之前的注释, 每条独占一行; pos 无效时输出剩下的全部注释
+func (f *Formatter) leadingComments(pos token.Position) {
+	for len(f.comments) > 0 && (!pos.IsValid() || f.comments[0].Pos.Offset < pos.Offset) {
+		comment := f.comments[0]
+		f.comments = f.comments[1:]
+		f.separate(comment.Pos.Line)
+		f.write(comment.Text)
+		f.newline()
+		f.lastLine = comment.Pos.Line
+		f.atBlockStart = false
+	}
+}
+
+// 与上一段代码在同一行、并且在下一段代码 next 之前的注释写在行尾
+func (f *Formatter) trailingComment(next token.Position) {
+	if len(f.comments) == 0 {
+		return
+	}
+	comment := f.comments[0]
+	if comment.Pos.Line != f.lastLine || next.IsValid() && comment.Pos.Offset >= next.Offset {
+		return
+	}
+	f.comments = f.comments[1:]
+	f.write(" " + comment.Text)
+}
+
+func (f *Formatter) commentsBefore(pos token.Position) bool {
+	return len(f.comments) > 0 && (!pos.IsValid() || f.comments[0].Pos.Offset < pos.Offset)
+}
+
+func (f *Formatter) commentsWithin(node ast.Node) bool {
+	start, end := ast.Span(node)
+	if !start.IsValid() {
+		return false
+	}
+	for _, comment := range f.comments {
+		if comment.Pos.Offset >= end.Offset {
+			break
+		}
+		if comment.Pos.Offset >= start.Offset {
+			return true
+		}
+	}
+	return false
+}
+
+func nodeEnd(node ast.Node) token.Position {
+	_, end := ast.Span(node)
+	return end
+}
+
+func isFunctionLiteral(exp ast.Expression) bool {
+	switch exp.(type) {
+	case *ast.FunctionLiteral, *ast.MacroLiteral:
+		return true
+	}
+	return false
+}
+
+func joinIdentifiers(idents []*ast.Identifier) string {
+	names := make([]string, len(idents))
+	for i, ident := range idents {
+		names[i] = ident.Value
+	}
+	return strings.Join(names, ", ")
+}
+
+// 与 parser 的优先级表一致, 用来决定是否需要括号
+func infixPrecedence(operator string) int {
+	switch operator {
+	case "&&", "||":
+		return parser.ANDOR
+	case "==", "!=":
+		return parser.EQUALS
+	case "<", ">", "<=", ">=":
+		return parser.LESSGREATER
+	case "+", "-":
+		return parser.SUM
+	case "*", "/":
+		return parser.PRODUCT
+	case ".":
+		return parser.INDEX
+	}
+	return parser.LOWEST
+}
+
+func expressionPrecedence(exp ast.Expression) int {
+	switch exp := exp.(type) {
+	case *ast.InfixExpression:
+		return infixPrecedence(exp.Operator)
+	case *ast.PrefixExpression:
+		return parser.PREFIX
+	case *ast.CallExpression:
+		return parser.CALL
+	case *ast.IndexExpression, *ast.SliceExpression:
+		return parser.INDEX
+	case *ast.IfExpression, *ast.AssignExpression:
+		return parser.LOWEST
+	}
+	// 标识符、字面量等不需要括号
+	return parser.INDEX + 1
+}
@@ -0,0 +1,218 @@
+package formatter
+
+import (
+	"io/ioutil"
+	"monkey/lexer"
+	"monkey/parser"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestFormat(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"let   x=1", "let x = 1;\n"},
+		{"const x = 1", "const x = 1;\n"},
+		{"return 1+2*3", "return 1 + 2 * 3;\n"},
+		{"(1 + 2) * 3; 1 - (2 - 3); (1 - 2) - 3", "(1 + 2) * 3;\n1 - (2 - 3);\n1 - 2 - 3;\n"},
+		{"-(1 + 2); !(a == b) && (c || d)", "-(1 + 2);\n!(a == b) && (c || d);\n"},
+		{"a.b.c(1)[0]; (-f)(1)", "a.b.c(1)[0];\n(-f)(1);\n"},
+		{"a[1:]; a[:2]; a[::-1]; a[1:2:3]", "a[1:];\na[:2];\na[::-1];\na[1:2:3];\n"},
+		{`let s = "a\"b";`, "let s = \"a\\\"b\";\n"},
+		{"x += 1; h[\"a\"] = [1,2]; this.x = x", "x += 1;\nh[\"a\"] = [1, 2];\nthis.x = x;\n"},
+		{"let f = fn(a,b){a+b};", "let f = fn(a, b) { a + b };\n"},
+		{"let f = fn(a,b){\na+b};", "let f = fn(a, b) {\n\ta + b;\n};\n"},
+		{"let f = fn(){};", "let f = fn() {};\n"},
+		{"if(x){1}else{2}", "if (x) { 1 } else { 2 }\n"},
+		{"if(x){\n1}", "if (x) {\n\t1;\n}\n"},
+		{"while(x<1){x=x+1}", "while (x < 1) {\n\tx = x + 1;\n}\n"},
+		{"for(let i=0;i<3;i=i+1){puts(i)}", "for (let i = 0; i < 3; i = i + 1) {\n\tputs(i);\n}\n"},
+		{"class A{let x=1;}", "class A {\n\tlet x = 1;\n}\n"},
+		{"let m = macro(a){quote(unquote(a))};", "let m = macro(a) { quote(unquote(a)) };\n"},
+		{`{"a":1,"b":2}`, "{\"a\": 1, \"b\": 2};\n"},
+		{`{"a":1,"b":2,"c":3,"d":4}`, "{\n\t\"a\": 1,\n\t\"b\": 2,\n\t\"c\": 3,\n\t\"d\": 4\n};\n"},
+		{"a;\n\n\n\nb;\nc", "a;\n\nb;\nc;\n"},
+		{"", ""},
+	}
+
+	for _, tt := range tests {
+		got, err := Format(tt.input, nil)
+		if err != nil {
+			t.Fatalf("Format(%q) failed: %s", tt.input, err)
+		}
+		if got != tt.expected {
+			t.Errorf("Format(%q) wrong.\nwant=%q\ngot= %q", tt.input, tt.expected, got)
+		}
+	}
+}
+
+func TestFormatLineWidth(t *testing.T) {
+	input := `let res = reduce(items, 0, fn(acc, x) { acc + x });
+let long = call(argumentNumberOne, argumentNumberTwo, [1, 2, 3], {"key": value});`
+
+	expected := `let res = reduce(items, 0, fn(acc, x) {
+	acc + x;
+});
+let long = call(
+	argumentNumberOne,
+	argumentNumberTwo,
+	[1, 2, 3],
+	{"key": value}
+);
+`
+	config := DefaultConfig()
+	config.SetMaxLineLength(40)
+	got, err := Format(input, config)
+	if err != nil {
+		t.Fatalf("Format failed: %s", err)
+	}
+	if got != expected {
+		t.Errorf("wrong output.\nwant=%q\ngot= %q", expected, got)
+	}
+
+	for _, line := range strings.Split(got, "\n") {
+		if width := len(strings.Replace(line, "\t", "    ", -1)); width > 40 {
+			t.Errorf("line longer than 40 columns: %q", line)
+		}
+	}
+}
+
+func TestFormatComments(t *testing.T) {
+	input := `// header
+
+let x = 1;   // trailing
+let arr = [
+  1, // one
+  // before two
+  2
+];
+let f = fn() {
+  // inside
+
+  x // last
+  // end of block
+};
+// footer`
+
+	expected := `// header
+
+let x = 1; // trailing
+let arr = [
+	1, // one
+	// before two
+	2
+];
+let f = fn() {
+	// inside
+
+	x; // last
+	// end of block
+};
+// footer
+`
+	got, err := Format(input, nil)
+	if err != nil {
+		t.Fatalf("Format failed: %s", err)
+	}
+	if got != expected {
+		t.Errorf("wrong output.\nwant=%q\ngot= %q", expected, got)
+	}
+}
+
+func TestFormatCRLF(t *testing.T) {
+	got, err := Format("let x=1;\r\n// c\r\nx", nil)
+	if err != nil {
+		t.Fatalf("Format failed: %s", err)
+	}
+	expected := "let x = 1;\r\n// c\r\nx;\r\n"
+	if got != expected {
+		t.Errorf("wrong output. want=%q, got=%q", expected, got)
+	}
+}
+
+func TestFormatParseError(t *testing.T) {
+	_, err := Format("let = 1;", nil)
+	if err == nil || !strings.HasPrefix(err.Error(), "parser errors:") {
+		t.Errorf("expected parser errors, got=%v", err)
+	}
+}
+
+// 格式化结果语义不变, 注释一条不少, 再次格式化没有变化
+func TestFormatIsStable(t *testing.T) {
+	inputs := []string{
+		`let fib = fn(x) { if (x < 2) { x } else { fib(x - 1) + fib(x - 2) } }; puts(fib(10));`,
+		`let h = {"one": [1, 2, [3, 4]], "two": fn(a) { a * 2 }, "three": {"x": -1}, "four": 4};`,
+		`class P { let init = fn(x) { this.x = x; }; let get = fn() { return this.x; }; } // P
+let p = P(1); p.x += [1, 2][0]; // bump`,
+		`let m = macro(a, b) { quote(unquote(b) - unquote(a)) }; m(1 + 2, 3 * (4 - 5));`,
+		`for (let i = 0; i < 10; i += 1) { if (i > 5 && i != 7 || i == 0) { puts(i, "big", [i][0:1:1]); } }`,
+	}
+	widths := []uint32{10, 30, 80}
+
+	for _, input := range inputs {
+		want := parseString(t, input)
+		for _, width := range widths {
+			config := DefaultConfig()
+			config.SetMaxLineLength(width)
+
+			first, err := Format(input, config)
+			if err != nil {
+				t.Fatalf("Format failed: %s", err)
+			}
+			if got := parseString(t, first); got != want {
+				t.Errorf("width %d changed the program.\nwant=%q\ngot= %q", width, want, got)
+			}
+			if strings.Count(first, "//") != strings.Count(input, "//") {
+				t.Errorf("width %d lost comments:\n%s", width, first)
+			}
+			second, err := Format(first, config)
+			if err != nil {
+				t.Fatalf("Format failed: %s", err)
+			}
+			if second != first {
+				t.Errorf("width %d not idempotent.\nfirst=%q\nsecond=%q", width, first, second)
+			}
+		}
+	}
+}
+
+// 仓库里的 .mon 文件保持原样, 但格式化后程序不变且结果稳定
+func TestRepositoryFiles(t *testing.T) {
+	files, err := filepath.Glob("../*.mon")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := Format(string(data), nil)
+		if err != nil {
+			t.Fatalf("%s: %s", file, err)
+		}
+		if parseString(t, got) != parseString(t, string(data)) {
+			t.Errorf("%s: formatting changed the program", file)
+		}
+		again, err := Format(got, nil)
+		if err != nil {
+			t.Fatalf("%s: %s", file, err)
+		}
+		if again != got {
+			t.Errorf("%s: formatting is not idempotent\n%s", file, Diff(file, file, got, again))
+		}
+	}
+}
+
+func parseString(t *testing.T, input string) string {
+	t.Helper()
+	p := parser.New(lexer.New(input))
+	program := p.ParserProgram()
+	if len(p.Errors()) != 0 {
+		t.Fatalf("parser errors for %q: %v", input, p.Errors())
+	}
+	return program.String()
+}
@@ -2,6 +2,7 @@ package lexer
 
 import (
 	"monkey/token"
+	"strings"
 )
 
 type Lexer struct {
@@ -9,15 +10,27 @@ type Lexer struct {
 	position     int
 	readPosition int
 	ch           byte
+	line         int // position 所在的行
+	lineStart    int // 当前行第一个字符的 offset
+	comments     []token.Comment
 }
 
 func New(input string) *Lexer {
-	l := &Lexer{input: input}
+	return NewAtLine(input, 1)
+}
+
+// input 从第 line 行开始, 用于 REPL 等逐行输入的源码, 各行的位置不会重复
+func NewAtLine(input string, line int) *Lexer {
+	l := &Lexer{input: input, line: line}
 	l.readChar()
 	return l
 }
 
 func (l *Lexer) readChar() {
+	if l.ch == '\n' {
+		l.line++
+		l.lineStart = l.readPosition
+	}
 	if l.readPosition >= len(l.input) {
 		l.ch = 0
 	} else {
@@ -28,8 +41,24 @@ func (l *Lexer) readChar() {
 }
 
 func (l *Lexer) NextToken() token.Token {
+	l.skipWhitespace() // skip whitespace ' ' and comments
+	pos := l.currentPosition()
+	tok := l.readToken()
+	tok.Pos = pos
+	tok.End = l.currentPosition()
+	return tok
+}
+
+func (l *Lexer) currentPosition() token.Position {
+	return token.Position{
+		Offset: l.position,
+		Line:   l.line,
+		Column: l.position - l.lineStart + 1,
+	}
+}
+
+func (l *Lexer) readToken() token.Token {
 	var tok token.Token
-	l.skipWhitespace() // skip whitespace ' '
 	switch l.ch {
 	case '=':
 		if l.peekChar() == '=' {
@@ -41,13 +70,13 @@ func (l *Lexer) NextToken() token.Token {
 			tok = token.NewToken(token.ASSIGN, l.ch)
 		}
 	case '-':
-		tok = token.NewToken(token.MINUS, l.ch)
+		tok = l.readCompoundAssign(token.MINUS, token.MINUS_ASSIGN)
 	case '/':
-		tok = token.NewToken(token.SLASH, l.ch)
+		tok = l.readCompoundAssign(token.SLASH, token.SLASH_ASSIGN)
 	case '*':
-		tok = token.NewToken(token.ASTERISK, l.ch)
+		tok = l.readCompoundAssign(token.ASTERISK, token.ASTERISK_ASSIGN)
 	case '+':
-		tok = token.NewToken(token.PLUS, l.ch)
+		tok = l.readCompoundAssign(token.PLUS, token.PLUS_ASSIGN)
 	case ';':
 		tok = token.NewToken(token.SEMICOLON, l.ch)
 	case '(':
@@ -136,6 +165,16 @@ func (l *Lexer) NextToken() token.Token {
 	return tok
 }
 
+// `+` or `+=`
+func (l *Lexer) readCompoundAssign(single, compound token.TokenType) token.Token {
+	if l.peekChar() == '=' {
+		ch := l.ch
+		l.readChar()
+		return token.Token{Type: compound, Literal: string(ch) + string(l.ch)}
+	}
+	return token.NewToken(single, l.ch)
+}
+
 func isLetter(ch byte) bool {
 	return 'a' <= ch && ch <= 'z' || 'A' <= ch && ch <= 'Z' || ch == '_'
 }
@@ -186,9 +225,34 @@ func (l *Lexer) readString() string {
 }
 
 func (l *Lexer) skipWhitespace() {
-	for l.ch == ' ' || l.ch == '\t' || l.ch == '\n' || l.ch == '\r' {
+	for {
+		switch {
+		case l.ch == ' ' || l.ch == '\t' || l.ch == '\n' || l.ch == '\r':
+			l.readChar()
+		case l.ch == '/' && l.peekChar() == '/':
+			l.readComment()
+		default:
+			return
+		}
+	}
+}
+
+// `// ...` 到行尾为止, 不产生 token, 记录下来供格式化工具使用
+func (l *Lexer) readComment() {
+	pos := l.currentPosition()
+	for l.ch != '\n' && l.ch != 0 {
 		l.readChar()
 	}
+	text := strings.TrimRight(l.input[pos.Offset:l.position], "\r")
+	end := pos
+	end.Offset += len(text)
+	end.Column += len(text)
+	l.comments = append(l.comments, token.Comment{Text: text, Pos: pos, End: end})
+}
+
+// 已经读过的注释, 按源码顺序排列
+func (l *Lexer) Comments() []token.Comment {
+	return l.comments
 }
 
 // func peekNext(l *Lexer) byte {
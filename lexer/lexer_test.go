@@ -44,6 +44,8 @@ func TestNextToken(t *testing.T) {
 	class
 	this
 	.
+	const
+	+= -= *= /=
 	`
 	// "1.123";
 	tests := []struct {
@@ -190,6 +192,11 @@ func TestNextToken(t *testing.T) {
 		{token.CLASS, "class"},
 		{token.THIS, "this"},
 		{token.DOT, "."},
+		{token.CONST, "const"},
+		{token.PLUS_ASSIGN, "+="},
+		{token.MINUS_ASSIGN, "-="},
+		{token.ASTERISK_ASSIGN, "*="},
+		{token.SLASH_ASSIGN, "/="},
 		{token.EOF, ""},
 	}
 	l := New(input)
@@ -203,3 +210,43 @@ func TestNextToken(t *testing.T) {
 		}
 	}
 }
+
+func TestNewAtLine(t *testing.T) {
+	l := NewAtLine("let x\n  = 1;", 7)
+	expected := []token.Position{{Offset: 0, Line: 7, Column: 1}, {Offset: 4, Line: 7, Column: 5}, {Offset: 8, Line: 8, Column: 3}}
+	for i, want := range expected {
+		if got := l.NextToken().Pos; got != want {
+			t.Errorf("tests[%d] - wrong position. want=%+v, got=%+v", i, want, got)
+		}
+	}
+}
+
+func TestComments(t *testing.T) {
+	input := "// header\r\nlet a = 10 / 2; // half\n//\nfoo"
+	expectedTokens := []token.TokenType{
+		token.LET, token.IDENT, token.ASSIGN, token.INT, token.SLASH, token.INT,
+		token.SEMICOLON, token.IDENT, token.EOF,
+	}
+	l := New(input)
+	for i, expected := range expectedTokens {
+		tok := l.NextToken()
+		if tok.Type != expected {
+			t.Fatalf("tests[%d] - token type wrong. expected=%q, got=%q", i, expected, tok.Type)
+		}
+	}
+
+	expected := []token.Comment{
+		{Text: "// header", Pos: token.Position{Offset: 0, Line: 1, Column: 1}, End: token.Position{Offset: 9, Line: 1, Column: 10}},
+		{Text: "// half", Pos: token.Position{Offset: 27, Line: 2, Column: 17}, End: token.Position{Offset: 34, Line: 2, Column: 24}},
+		{Text: "//", Pos: token.Position{Offset: 35, Line: 3, Column: 1}, End: token.Position{Offset: 37, Line: 3, Column: 3}},
+	}
+	comments := l.Comments()
+	if len(comments) != len(expected) {
+		t.Fatalf("wrong number of comments. want=%d, got=%d (%+v)", len(expected), len(comments), comments)
+	}
+	for i, comment := range comments {
+		if comment != expected[i] {
+			t.Errorf("comments[%d] wrong. want=%+v, got=%+v", i, expected[i], comment)
+		}
+	}
+}
@@ -0,0 +1,341 @@
+package lint
+
+import (
+	"fmt"
+	"monkey/ast"
+	"monkey/compiler"
+	"monkey/object"
+	"monkey/token"
+)
+
+// 声明按名字和位置区分; 闭包中解析到的自由变量保留原来的声明位置
+type declaration struct {
+	name string
+	pos  token.Position
+}
+
+// 按编译器的方式建立作用域: 函数是新的符号表, 块是块级符号表;
+// 解析名字时记录读取过的声明, 检查结束后报告没有读取过的声明
+type checker struct {
+	symbolTable  *compiler.SymbolTable
+	declarations []declaration
+	kinds        map[declaration]string // UnusedVariable 或 UnusedParameter
+	used         map[declaration]bool
+	diagnostics  compiler.Diagnostics
+}
+
+func newChecker() *checker {
+	symbolTable := compiler.NewSymbolTable()
+	for i, v := range object.Builtins {
+		symbolTable.DefineBuiltin(i, v.Name)
+	}
+	return &checker{
+		symbolTable: symbolTable,
+		kinds:       map[declaration]string{},
+		used:        map[declaration]bool{},
+	}
+}
+
+func (c *checker) check(program *ast.Program) {
+	c.statements(program.Statements)
+	for _, decl := range c.declarations {
+		if c.used[decl] || decl.name[0] == '_' {
+			continue
+		}
+		what := "variable"
+		if c.kinds[decl] == UnusedParameter {
+			what = "parameter"
+		}
+		c.report(c.kinds[decl], identSpan(decl.name, decl.pos), "%s `%s` is declared but never used", what, decl.name)
+	}
+}
+
+func (c *checker) report(rule string, span compiler.Span, format string, a ...interface{}) *compiler.Diagnostic {
+	d := &compiler.Diagnostic{Code: rule, Span: span, Message: fmt.Sprintf(format, a...)}
+	c.diagnostics = append(c.diagnostics, d)
+	return d
+}
+
+func nodeSpan(node ast.Node) compiler.Span {
+	start, end := ast.Span(node)
+	return compiler.Span{Start: start, End: end}
+}
+
+func identSpan(name string, pos token.Position) compiler.Span {
+	end := pos
+	end.Offset += len(name)
+	end.Column += len(name)
+	return compiler.Span{Start: pos, End: end}
+}
+
+// return 之后的语句只报告第一句, 范围到块中最后一句
+func (c *checker) statements(stmts []ast.Statement) {
+	for i, stmt := range stmts {
+		c.statement(stmt)
+		if _, ok := stmt.(*ast.ReturnStatement); ok && i+1 < len(stmts) {
+			span := nodeSpan(stmts[i+1])
+			span.End = nodeSpan(stmts[len(stmts)-1]).End
+			c.report(Unreachable, span, "unreachable code after return")
+			for _, rest := range stmts[i+1:] {
+				c.statement(rest)
+			}
+			return
+		}
+	}
+}
+
+func (c *checker) statement(stmt ast.Statement) {
+	switch stmt := stmt.(type) {
+	case *ast.LetStatement:
+		c.let(stmt, UnusedVariable)
+	case *ast.ReturnStatement:
+		c.expression(stmt.ReturnValue)
+	case *ast.ExpressionStatement:
+		c.expression(stmt.Expression)
+	case *ast.BlockStatement:
+		c.block(stmt)
+	case *ast.WhileStatement:
+		if b, ok := stmt.Condition.(*ast.Boolean); !ok || !b.Value {
+			c.condition(stmt.Condition, "while")
+		}
+		c.expression(stmt.Condition)
+		c.block(stmt.Body)
+	case *ast.ForStatement:
+		c.enterBlock()
+		if stmt.LetStmt != nil {
+			c.let(stmt.LetStmt, UnusedVariable)
+		}
+		c.condition(stmt.Condition, "for")
+		c.expression(stmt.Condition)
+		if stmt.Inc != nil {
+			c.statement(stmt.Inc)
+		}
+		c.block(stmt.Body)
+		c.leave()
+	case *ast.ClassStmt:
+		c.declare(stmt.Name, UnusedVariable)
+		c.class(stmt)
+	}
+}
+
+// 与编译器不同, 先检查值再定义变量: 重复定义复用槽位, 值中的同名变量读取的是之前的声明
+func (c *checker) let(stmt *ast.LetStatement, kind string) {
+	if _, ok := stmt.Value.(*ast.MacroLiteral); ok {
+		// 宏在编译前展开, 宏体不是普通代码
+		c.declare(stmt.Name, "")
+		return
+	}
+	c.expression(stmt.Value)
+	c.declare(stmt.Name, kind)
+}
+
+// 定义变量; kind 为空时不检查是否使用
+func (c *checker) declare(name *ast.Identifier, kind string) {
+	c.checkShadow(name)
+	symbol := c.symbolTable.DefineAt(name.Value, name.Token.Pos)
+	if kind == "" || !symbol.Pos.IsValid() {
+		return
+	}
+	decl := declaration{name: symbol.Name, pos: symbol.Pos}
+	c.declarations = append(c.declarations, decl)
+	c.kinds[decl] = kind
+}
+
+// 同一作用域中重新定义不算遮蔽; 内置函数、函数自己的名字和外层作用域的变量算
+func (c *checker) checkShadow(name *ast.Identifier) {
+	var shadowed compiler.Symbol
+	var ok bool
+	if symbol, found := c.symbolTable.Lookup(name.Value); found {
+		if symbol.Scope != compiler.FunctionScope && symbol.Scope != compiler.BuiltinScope {
+			return
+		}
+		shadowed, ok = symbol, true
+	} else if c.symbolTable.Outer != nil {
+		shadowed, ok = c.symbolTable.Outer.Resolve(name.Value)
+	}
+	if !ok {
+		return
+	}
+
+	span := identSpan(name.Value, name.Token.Pos)
+	switch {
+	case shadowed.Scope == compiler.BuiltinScope:
+		c.report(Shadow, span, "`%s` shadows a builtin function", name.Value)
+	case shadowed.Scope == compiler.FunctionScope:
+		c.report(Shadow, span, "`%s` shadows the name of the enclosing function", name.Value)
+	default:
+		d := c.report(Shadow, span, "`%s` shadows a declaration in an enclosing scope", name.Value)
+		if shadowed.Pos.IsValid() {
+			d.Notes = []compiler.Note{{
+				Span:    identSpan(name.Value, shadowed.Pos),
+				Message: fmt.Sprintf("`%s` was declared here", name.Value),
+			}}
+		}
+	}
+}
+
+func (c *checker) enterBlock() {
+	c.symbolTable = compiler.NewBlockSymbolTable(c.symbolTable)
+}
+
+func (c *checker) enterFunction() {
+	c.symbolTable = compiler.NewEnclosedSymbolTable(c.symbolTable)
+}
+
+func (c *checker) leave() {
+	c.symbolTable = c.symbolTable.Outer
+}
+
+func (c *checker) block(block *ast.BlockStatement) {
+	if block == nil {
+		return
+	}
+	c.enterBlock()
+	c.statements(block.Statements)
+	c.leave()
+}
+
+// 类体中直接用 let 定义的是成员, 通过属性访问, 不检查是否使用
+func (c *checker) class(stmt *ast.ClassStmt) {
+	c.enterFunction()
+	c.symbolTable.Define("this")
+	for _, member := range stmt.Body.Statements {
+		if let, ok := member.(*ast.LetStatement); ok {
+			c.let(let, "")
+			continue
+		}
+		c.statement(member)
+	}
+	c.leave()
+}
+
+func (c *checker) expression(exp ast.Expression) {
+	switch exp := exp.(type) {
+	case *ast.Identifier:
+		c.use(exp.Value)
+	case *ast.PrefixExpression:
+		c.expression(exp.Right)
+	case *ast.InfixExpression:
+		c.expression(exp.Left)
+		if exp.Operator != token.DOT {
+			c.expression(exp.Right)
+		}
+	case *ast.IfExpression:
+		c.condition(exp.Condition, "if")
+		c.expression(exp.Condition)
+		c.block(exp.Consequence)
+		c.block(exp.Alternative)
+	case *ast.FunctionLiteral:
+		c.enterFunction()
+		if exp.Name != "" {
+			c.symbolTable.DefineFunctionName(exp.Name)
+		}
+		for _, param := range exp.Parameters {
+			c.declare(param, UnusedParameter)
+		}
+		c.block(exp.Body)
+		c.leave()
+	case *ast.CallExpression:
+		c.checkBuiltinArity(exp)
+		c.expression(exp.Function)
+		for _, arg := range exp.Arguments {
+			c.expression(arg)
+		}
+	case *ast.ArrayLiteral:
+		for _, element := range exp.Elements {
+			c.expression(element)
+		}
+	case *ast.HashLiteral:
+		for key, value := range exp.Pairs {
+			c.expression(key)
+			c.expression(value)
+		}
+	case *ast.IndexExpression:
+		c.expression(exp.Left)
+		c.expression(exp.Index)
+	case *ast.SliceExpression:
+		c.expression(exp.Left)
+		for _, bound := range []ast.Expression{exp.Start, exp.End, exp.Step} {
+			if bound != nil {
+				c.expression(bound)
+			}
+		}
+	case *ast.AssignExpression:
+		c.assign(exp)
+	}
+}
+
+func (c *checker) use(name string) {
+	symbol, ok := c.symbolTable.Resolve(name)
+	if ok && symbol.Pos.IsValid() {
+		c.used[declaration{name: symbol.Name, pos: symbol.Pos}] = true
+	}
+}
+
+// 给变量赋值不算读取; += 等复合赋值读取了变量
+func (c *checker) assign(exp *ast.AssignExpression) {
+	switch left := exp.Left.(type) {
+	case *ast.Identifier:
+		c.expression(exp.ExpandedValue())
+		if _, ok := c.symbolTable.Resolve(left.Value); !ok {
+			c.report(UndeclaredAssignment, identSpan(left.Value, left.Token.Pos),
+				"assignment to undeclared variable `%s`, declare it with let", left.Value)
+			// 与编译器一样, 赋值在当前作用域中定义变量
+			c.symbolTable.Define(left.Value)
+		}
+	case *ast.IndexExpression:
+		c.expression(left.Left)
+		c.expression(left.Index)
+		c.expression(exp.ExpandedValue())
+	default:
+		c.expression(left)
+		c.expression(exp.ExpandedValue())
+	}
+}
+
+func (c *checker) checkBuiltinArity(call *ast.CallExpression) {
+	ident, ok := call.Function.(*ast.Identifier)
+	if !ok {
+		return
+	}
+	symbol, ok := c.symbolTable.Resolve(ident.Value)
+	if !ok || symbol.Scope != compiler.BuiltinScope {
+		return
+	}
+	arity := object.Builtins[symbol.Index].Builtin.Arity
+	if arity == object.Variadic || arity == len(call.Arguments) {
+		return
+	}
+	plural := "s"
+	if arity == 1 {
+		plural = ""
+	}
+	c.report(BuiltinArity, nodeSpan(call), "`%s` takes %d argument%s, got %d", ident.Value, arity, plural, len(call.Arguments))
+}
+
+func (c *checker) condition(condition ast.Expression, statement string) {
+	if condition == nil {
+		return
+	}
+	truthy, ok := constantValue(condition)
+	if !ok {
+		return
+	}
+	c.report(ConstantCondition, nodeSpan(condition), "%s condition is always %t", statement, truthy)
+}
+
+// 只由字面量组成的条件; 只有 false 和 null 为假, 比较和逻辑运算的结果要求值才知道, 只判断字面量本身
+func constantValue(exp ast.Expression) (truthy bool, ok bool) {
+	switch exp := exp.(type) {
+	case *ast.Boolean:
+		return exp.Value, true
+	case *ast.IntegerLiteral, *ast.StringLiteral, *ast.ArrayLiteral, *ast.HashLiteral, *ast.FunctionLiteral:
+		return true, true
+	case *ast.PrefixExpression:
+		if exp.Operator == "!" {
+			truthy, ok := constantValue(exp.Right)
+			return !truthy, ok
+		}
+	}
+	return false, false
+}
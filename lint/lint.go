@@ -0,0 +1,185 @@
+// 静态检查: 基于编译器的符号表分析作用域, 报告可疑但能够编译的代码.
+// 每条规则可以单独设置级别, 也可以用注释忽略:
+//
+//	let unused = 1; // lint:ignore unused-variable
+//
+//	// lint:ignore shadow, unused-parameter
+//	let f = fn(len) { 1 };
+//
+//	// lint:ignore-file constant-condition
+//
+// lint:ignore 对注释所在的行和下一行生效, lint:ignore-file 对整个文件生效
+package lint
+
+import (
+	"fmt"
+	"monkey/compiler"
+	"monkey/lexer"
+	"monkey/parser"
+	"monkey/token"
+	"sort"
+	"strings"
+)
+
+// 关闭规则
+const Off compiler.Severity = "off"
+
+// 规则名同时是诊断代码
+const (
+	UnusedVariable       = "unused-variable"
+	UnusedParameter      = "unused-parameter"
+	Shadow               = "shadow"
+	Unreachable          = "unreachable"
+	UndeclaredAssignment = "undeclared-assignment"
+	ConstantCondition    = "constant-condition"
+	BuiltinArity         = "builtin-arity"
+)
+
+type Rule struct {
+	Name     string
+	Severity compiler.Severity // 默认级别
+	Doc      string
+}
+
+// 所有规则, 按名字排序
+var Rules = []Rule{
+	{BuiltinArity, compiler.SeverityError, "call to a builtin function with the wrong number of arguments"},
+	{ConstantCondition, compiler.SeverityWarning, "if, while or for condition that is always true or always false; while (true) is allowed"},
+	{Shadow, compiler.SeverityWarning, "declaration that hides a variable or builtin of an enclosing scope"},
+	{UndeclaredAssignment, compiler.SeverityWarning, "assignment to a name that was never declared with let, which silently declares it"},
+	{Unreachable, compiler.SeverityWarning, "statement after return in the same block"},
+	{UnusedParameter, compiler.SeverityWarning, "function parameter that is never read; names starting with _ are ignored"},
+	{UnusedVariable, compiler.SeverityWarning, "let, const or class binding that is never read; names starting with _ are ignored"},
+}
+
+// 规则的级别, 没有列出的规则使用默认级别
+type Config struct {
+	Severities map[string]compiler.Severity
+}
+
+func DefaultConfig() *Config {
+	return &Config{Severities: map[string]compiler.Severity{}}
+}
+
+func findRule(name string) (Rule, bool) {
+	for _, rule := range Rules {
+		if rule.Name == name {
+			return rule, true
+		}
+	}
+	return Rule{}, false
+}
+
+// 解析 "shadow=off,builtin-arity=warning"
+func (c *Config) Set(settings string) error {
+	for _, setting := range strings.Split(settings, ",") {
+		setting = strings.TrimSpace(setting)
+		if setting == "" {
+			continue
+		}
+		parts := strings.SplitN(setting, "=", 2)
+		if len(parts) != 2 {
+			return fmt.Errorf("invalid rule setting %q, want rule=off|warning|error", setting)
+		}
+		name, severity := strings.TrimSpace(parts[0]), compiler.Severity(strings.TrimSpace(parts[1]))
+		if _, ok := findRule(name); !ok {
+			return fmt.Errorf("unknown rule %q", name)
+		}
+		switch severity {
+		case Off, compiler.SeverityWarning, compiler.SeverityError:
+		default:
+			return fmt.Errorf("invalid severity %q for rule %s, want off, warning or error", severity, name)
+		}
+		c.Severities[name] = severity
+	}
+	return nil
+}
+
+func (c *Config) severity(name string) compiler.Severity {
+	if severity, ok := c.Severities[name]; ok {
+		return severity
+	}
+	rule, _ := findRule(name)
+	return rule.Severity
+}
+
+// 检查源码, 返回按位置排序的诊断; 有语法错误时只返回语法错误 (compiler.CodeSyntax)
+func Lint(source string, config *Config) compiler.Diagnostics {
+	l := lexer.New(source)
+	p := parser.New(l)
+	program := p.ParserProgram()
+	if len(p.Errors()) != 0 {
+		diagnostics := compiler.Diagnostics{}
+		for _, err := range p.SyntaxErrors() {
+			diagnostics = append(diagnostics, &compiler.Diagnostic{
+				Severity: compiler.SeverityError,
+				Code:     compiler.CodeSyntax,
+				Span:     compiler.Span{Start: err.Token.Pos, End: err.Token.End},
+				Message:  err.Message,
+			})
+		}
+		return diagnostics
+	}
+
+	c := newChecker()
+	c.check(program)
+
+	ignored := ignoredRules(l.Comments())
+	diagnostics := compiler.Diagnostics{}
+	for _, d := range c.diagnostics {
+		severity := config.severity(d.Code)
+		if severity == Off || ignored.ignores(d) {
+			continue
+		}
+		d.Severity = severity
+		diagnostics = append(diagnostics, d)
+	}
+	sort.SliceStable(diagnostics, func(i, j int) bool {
+		return diagnostics[i].Span.Start.Offset < diagnostics[j].Span.Start.Offset
+	})
+	return diagnostics
+}
+
+// 注释中忽略的规则
+type ignoreSet struct {
+	lines map[int]map[string]bool // 行号 -> 规则
+	file  map[string]bool
+}
+
+func ignoredRules(comments []token.Comment) *ignoreSet {
+	ignored := &ignoreSet{lines: map[int]map[string]bool{}, file: map[string]bool{}}
+	for _, comment := range comments {
+		text := strings.TrimSpace(strings.TrimPrefix(comment.Text, "//"))
+		switch {
+		case strings.HasPrefix(text, "lint:ignore-file "):
+			for _, rule := range ruleList(strings.TrimPrefix(text, "lint:ignore-file ")) {
+				ignored.file[rule] = true
+			}
+		case strings.HasPrefix(text, "lint:ignore "):
+			for _, line := range []int{comment.Pos.Line, comment.Pos.Line + 1} {
+				if ignored.lines[line] == nil {
+					ignored.lines[line] = map[string]bool{}
+				}
+				for _, rule := range ruleList(strings.TrimPrefix(text, "lint:ignore ")) {
+					ignored.lines[line][rule] = true
+				}
+			}
+		}
+	}
+	return ignored
+}
+
+// "shadow, unused-parameter"
+func ruleList(text string) []string {
+	rules := []string{}
+	for _, rule := range strings.Split(text, ",") {
+		if rule = strings.TrimSpace(rule); rule != "" {
+			rules = append(rules, rule)
+		}
+	}
+	return rules
+}
+
+func (s *ignoreSet) ignores(d *compiler.Diagnostic) bool {
+	return s.file[d.Code] || s.lines[d.Span.Start.Line][d.Code]
+}
@@ -0,0 +1,145 @@
+package lint
+
+import (
+	"monkey/compiler"
+	"reflect"
+	"testing"
+)
+
+// 每条诊断描述为 "规则 行:列"
+func describe(diagnostics compiler.Diagnostics) []string {
+	out := []string{}
+	for _, d := range diagnostics {
+		out = append(out, d.Code+" "+d.Span.Start.String())
+	}
+	return out
+}
+
+func TestRules(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected []string
+	}{
+		{`let a = 1; let b = a;`, []string{"unused-variable 1:16"}},
+		{`let f = fn(x, y) { x }; f(1, 2)`, []string{"unused-parameter 1:15"}},
+		{`let f = fn(_x) { 1 }; let _y = f(1);`, []string{}},
+		// 只赋值不读取也算没有使用; 复合赋值读取了变量
+		{`let a = 1; a = 2;`, []string{"unused-variable 1:5"}},
+		{`let a = 1; a += 2;`, []string{}},
+		{`let a = 1; let f = fn() { a }; f()`, []string{}},
+		{`let len = 1; len`, []string{"shadow 1:5"}},
+		{`let a = 1; let f = fn() { let a = 2; a }; f() + a`, []string{"shadow 1:31"}},
+		{`let f = fn() { let f = 1; f }; f()`, []string{"shadow 1:20"}},
+		{`let f = fn(a) { if (a) { let a = 2; a } }; f(1)`, []string{"shadow 1:30"}},
+		// 同一作用域中重新定义不是遮蔽
+		{`let a = 1; let a = a + 1; a`, []string{}},
+		{`let f = fn() { return 1; puts(2); puts(3); }; f()`, []string{"unreachable 1:26"}},
+		{`let f = fn(a) { if (a) { return 1; } return 2; }; f(1)`, []string{}},
+		{`count = 1; count`, []string{"undeclared-assignment 1:1"}},
+		{`let count = 0; let f = fn() { count = 1; }; f(); count`, []string{}},
+		{`if (true) { 1 }`, []string{"constant-condition 1:5"}},
+		{`if (!0) { 1 }`, []string{"constant-condition 1:5"}},
+		{`let a = 1; if (a) { 1 }`, []string{}},
+		{`while (false) { 1 }`, []string{"constant-condition 1:8"}},
+		{`while (true) { 1 }`, []string{}},
+		{`len([1], 2); puts(1, 2, 3); push([], 1)`, []string{"builtin-arity 1:1"}},
+		// 遮蔽了内置函数之后不再检查参数个数
+		{`let f = fn(len) { len(1, 2) }; f(1)`, []string{"shadow 1:12"}},
+		// 类成员通过属性访问, 不检查是否使用
+		{`class A { let x = 1; let m = fn() { this.x }; } A()`, []string{}},
+		{`class A { let x = 1; }`, []string{"unused-variable 1:7"}},
+		{`let m = macro(a) { quote(unquote(a)) }; m(1)`, []string{}},
+	}
+
+	for _, tt := range tests {
+		got := describe(Lint(tt.input, DefaultConfig()))
+		if !reflect.DeepEqual(got, tt.expected) {
+			t.Errorf("wrong diagnostics for %q. want=%q, got=%q", tt.input, tt.expected, got)
+		}
+	}
+}
+
+func TestDiagnosticDetails(t *testing.T) {
+	input := "let total = 0;\nlet f = fn() { let total = 1; total };\nf() + total + first([1], 2)"
+	diagnostics := Lint(input, DefaultConfig())
+	if len(diagnostics) != 2 {
+		t.Fatalf("expected 2 diagnostics, got %q", describe(diagnostics))
+	}
+
+	shadow := diagnostics[0]
+	if shadow.Severity != compiler.SeverityWarning || shadow.Message != "`total` shadows a declaration in an enclosing scope" {
+		t.Errorf("wrong shadow diagnostic: %s %q", shadow.Severity, shadow.Message)
+	}
+	if len(shadow.Notes) != 1 || shadow.Notes[0].Span.Start.String() != "1:5" {
+		t.Errorf("expected a note at the outer declaration, got %v", shadow.Notes)
+	}
+
+	arity := diagnostics[1]
+	if arity.Severity != compiler.SeverityError || arity.Message != "`first` takes 1 argument, got 2" {
+		t.Errorf("wrong arity diagnostic: %s %q", arity.Severity, arity.Message)
+	}
+	if arity.Span.Start.String() != "3:15" || arity.Span.End.String() != "3:28" {
+		t.Errorf("wrong arity span: %s-%s", arity.Span.Start, arity.Span.End)
+	}
+}
+
+func TestConfig(t *testing.T) {
+	config := DefaultConfig()
+	if err := config.Set("shadow=off, builtin-arity=warning,unused-variable=error"); err != nil {
+		t.Fatal(err)
+	}
+	diagnostics := Lint(`let len = 1; let a = len; first(1, 2)`, config)
+	got := []string{}
+	for _, d := range diagnostics {
+		got = append(got, d.Code+" "+string(d.Severity))
+	}
+	expected := []string{"unused-variable error", "builtin-arity warning"}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("wrong diagnostics. want=%q, got=%q", expected, got)
+	}
+
+	errors := map[string]string{
+		"shadow":       `invalid rule setting "shadow", want rule=off|warning|error`,
+		"nope=off":     `unknown rule "nope"`,
+		"shadow=fatal": `invalid severity "fatal" for rule shadow, want off, warning or error`,
+	}
+	for setting, expected := range errors {
+		err := DefaultConfig().Set(setting)
+		if err == nil || err.Error() != expected {
+			t.Errorf("wrong error for %q. want=%q, got=%v", setting, expected, err)
+		}
+	}
+}
+
+func TestIgnoreComments(t *testing.T) {
+	input := `
+let a = 1; // lint:ignore unused-variable
+// lint:ignore shadow, unused-parameter
+let f = fn(len) { 1 };
+let b = 2;
+// lint:ignore-file constant-condition
+if (true) { f(1) }
+// lint:ignore shadow
+let c = 3;
+`
+	got := describe(Lint(input, DefaultConfig()))
+	expected := []string{"unused-variable 5:5", "unused-variable 9:5"}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("wrong diagnostics. want=%q, got=%q", expected, got)
+	}
+}
+
+func TestSyntaxErrors(t *testing.T) {
+	diagnostics := Lint(`let = 1; let a = 1;`, DefaultConfig())
+	if len(diagnostics) == 0 {
+		t.Fatal("expected syntax errors")
+	}
+	for _, d := range diagnostics {
+		if d.Code != compiler.CodeSyntax || d.Severity != compiler.SeverityError {
+			t.Errorf("expected only syntax errors, got %s %s: %s", d.Severity, d.Code, d.Message)
+		}
+		if d.Span.Start.Line != 1 || d.Span.Start.Column != 5 {
+			t.Errorf("syntax error at wrong position: %s (%s)", d.Span.Start, d.Message)
+		}
+	}
+}
@@ -1,30 +1,88 @@
 package main
 
 import (
+	"flag"
 	"fmt"
+	"io/ioutil"
+	"monkey/ast"
+	"monkey/lexer"
+	"monkey/parser"
 	"monkey/repl"
 	"os"
 	"os/user"
+	"strings"
 )
 
-func main() {
-	user, err := user.Current()
-	if err != nil {
-		panic(err)
-	}
-
-	filePath := os.Args
+// 子命令: monkey <command> [flags] file
+var commands = map[string]func(args []string) int{
+	"ast":         astCommand,
+	"build":       buildCommand,
+	"conformance": conformanceCommand,
+	"disasm":      disasmCommand,
+	"expand":      expandCommand,
+	"fmt":         fmtCommand,
+	"lint":        lintCommand,
+	"run":         runCommand,
+}
 
-	if len(filePath) != 2 {
+func main() {
+	if len(os.Args) < 2 {
+		user, err := user.Current()
+		if err != nil {
+			panic(err)
+		}
 		fmt.Printf("Hello %s! This is the Monkey programming language!\n", user.Username)
 		fmt.Printf("Feel free to type in commands\n")
 		repl.StartVM(os.Stdin, os.Stdout)
-		// codegen
-		// fmt.Println("input filename!")
+		return
+	}
+
+	if command, ok := commands[os.Args[1]]; ok {
+		os.Exit(command(os.Args[2:]))
 	}
-	repl.StartFile(filePath[1])
+	repl.StartFile(os.Args[1])
 	//codegen
 	// repl.StartWriteFile(filePath[1])
 	// eval
 	// repl.StartEval(os.Stdin, os.Stdout)
 }
+
+// 读取源文件, "-" 表示标准输入
+func readSource(path string) (string, error) {
+	var data []byte
+	var err error
+	if path == "-" {
+		data, err = ioutil.ReadAll(os.Stdin)
+	} else {
+		data, err = ioutil.ReadFile(path)
+	}
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// 允许 flag 写在文件名之后: monkey build foo.mon -o foo.monc
+func parseInterspersed(flags *flag.FlagSet, args []string) ([]string, error) {
+	positional := []string{}
+	for {
+		if err := flags.Parse(args); err != nil {
+			return nil, err
+		}
+		args = flags.Args()
+		if len(args) == 0 {
+			return positional, nil
+		}
+		positional = append(positional, args[0])
+		args = args[1:]
+	}
+}
+
+func parseSource(input string) (*ast.Program, error) {
+	p := parser.New(lexer.New(input))
+	program := p.ParserProgram()
+	if len(p.Errors()) != 0 {
+		return nil, fmt.Errorf("parser errors:\n\t%s", strings.Join(p.Errors(), "\n\t"))
+	}
+	return program, nil
+}
@@ -2,8 +2,13 @@ package object
 
 import (
 	"fmt"
+	"io"
+	"os"
 )
 
+// puts 的输出位置, 测试时可以替换
+var Output io.Writer = os.Stdout
+
 var Builtins = []struct {
 	Name    string
 	Builtin *Builtin
@@ -11,6 +16,7 @@ var Builtins = []struct {
 	{
 		"len",
 		&Builtin{
+			Arity: 1,
 			Fn: func(args ...Object) Object {
 				if len(args) != 1 {
 					return newError("wrong number of arguments. got %d, want 1", len(args))
@@ -30,9 +36,10 @@ var Builtins = []struct {
 	{
 		"puts",
 		&Builtin{
+			Arity: Variadic,
 			Fn: func(args ...Object) Object {
 				for _, arg := range args {
-					fmt.Println(arg.Inspect())
+					fmt.Fprintln(Output, arg.Inspect())
 				}
 				return nil
 			},
@@ -41,6 +48,7 @@ var Builtins = []struct {
 	{
 		"first",
 		&Builtin{
+			Arity: 1,
 			Fn: func(args ...Object) Object {
 				if len(args) != 1 {
 					return newError("wrong number of arguments. got %d, want 1", len(args))
@@ -60,6 +68,7 @@ var Builtins = []struct {
 	{
 		"last",
 		&Builtin{
+			Arity: 1,
 			Fn: func(args ...Object) Object {
 				if len(args) != 1 {
 					return newError("wrong number of arguments. got %d, want 1", len(args))
@@ -80,6 +89,7 @@ var Builtins = []struct {
 	{
 		"rest",
 		&Builtin{
+			Arity: 1,
 			Fn: func(args ...Object) Object {
 				if len(args) != 1 {
 					return newError("wrong number of arguments. got %d, want 1", len(args))
@@ -102,6 +112,7 @@ var Builtins = []struct {
 	{
 		"push",
 		&Builtin{
+			Arity: 2,
 			Fn: func(args ...Object) Object {
 				if len(args) != 2 {
 					return newError("wrong number of arguments. got %d, want 2", len(args))
@@ -122,6 +133,51 @@ var Builtins = []struct {
 			},
 		},
 	},
+	{
+		// 在数组开头插入元素, 返回新数组
+		"shift",
+		&Builtin{
+			Arity: 2,
+			Fn: func(args ...Object) Object {
+				if len(args) != 2 {
+					return newError("wrong number of arguments. got %d, want 2", len(args))
+				}
+				if args[0].Type() != ARRAY_OBJ {
+					return newError("argument to `shift` must be an array, got %s", args[0].Type())
+				}
+
+				arr := args[0].(*Array)
+				newElements := make([]Object, 0, len(arr.ELements)+1)
+				newElements = append(newElements, args[1])
+				newElements = append(newElements, arr.ELements...)
+				return &Array{ELements: newElements}
+			},
+		},
+	},
+	{
+		// 去掉数组最后一个元素, 返回新数组
+		"remove",
+		&Builtin{
+			Arity: 1,
+			Fn: func(args ...Object) Object {
+				if len(args) != 1 {
+					return newError("wrong number of arguments. got %d, want 1", len(args))
+				}
+				if args[0].Type() != ARRAY_OBJ {
+					return newError("argument to `remove` must be an array, got %s", args[0].Type())
+				}
+
+				arr := args[0].(*Array)
+				length := len(arr.ELements)
+				if length > 0 {
+					newElements := make([]Object, length-1)
+					copy(newElements, arr.ELements[0:length-1])
+					return &Array{ELements: newElements}
+				}
+				return nil
+			},
+		},
+	},
 }
 
 func newError(format string, a ...interface{}) *Error {
@@ -0,0 +1,109 @@
+package object
+
+import "strings"
+
+// 结构相等: 字符串、数组、哈希按值比较, 函数、实例等其他引用类型比较是否同一个对象
+func Equal(left, right Object) bool {
+	return equal(left, right, map[comparing]bool{})
+}
+
+// 正在比较的一对容器. 原地修改可以让容器包含自己, 再次遇到同一对时视为相等, 不再递归
+type comparing struct {
+	left, right Object
+}
+
+func equal(left, right Object, visiting map[comparing]bool) bool {
+	if left == right {
+		return true
+	}
+	if left.Type() != right.Type() {
+		return false
+	}
+
+	switch left := left.(type) {
+	case *Integer:
+		return left.Value == right.(*Integer).Value
+	case *Boolean:
+		return left.Value == right.(*Boolean).Value
+	case *String:
+		return left.Value == right.(*String).Value
+	case *Null:
+		return true
+	case *Array:
+		right := right.(*Array)
+		if len(left.ELements) != len(right.ELements) {
+			return false
+		}
+		pair := comparing{left, right}
+		if visiting[pair] {
+			return true
+		}
+		visiting[pair] = true
+		defer delete(visiting, pair)
+		for i, el := range left.ELements {
+			if !equal(el, right.ELements[i], visiting) {
+				return false
+			}
+		}
+		return true
+	case *Hash:
+		right := right.(*Hash)
+		if len(left.Pairs) != len(right.Pairs) {
+			return false
+		}
+		pair := comparing{left, right}
+		if visiting[pair] {
+			return true
+		}
+		visiting[pair] = true
+		defer delete(visiting, pair)
+		for key, pair := range left.Pairs {
+			other, ok := right.Pairs[key]
+			if !ok || !equal(pair.Value, other.Value, visiting) {
+				return false
+			}
+		}
+		return true
+	default:
+		return false
+	}
+}
+
+// 比较大小: 整数按数值, 字符串按字典序, 数组逐个元素比较, 前缀较短的更小
+// 返回 -1, 0, 1
+func Compare(left, right Object) (int, *Error) {
+	return compare(left, right, map[comparing]bool{})
+}
+
+func compare(left, right Object, visiting map[comparing]bool) (int, *Error) {
+	switch {
+	case left.Type() == INTEGER_OBJ && right.Type() == INTEGER_OBJ:
+		l, r := left.(*Integer).Value, right.(*Integer).Value
+		switch {
+		case l < r:
+			return -1, nil
+		case l > r:
+			return 1, nil
+		}
+		return 0, nil
+	case left.Type() == STRING && right.Type() == STRING:
+		return strings.Compare(left.(*String).Value, right.(*String).Value), nil
+	case left.Type() == ARRAY_OBJ && right.Type() == ARRAY_OBJ:
+		pair := comparing{left, right}
+		if visiting[pair] {
+			return 0, nil
+		}
+		visiting[pair] = true
+		defer delete(visiting, pair)
+		l, r := left.(*Array).ELements, right.(*Array).ELements
+		for i := 0; i < len(l) && i < len(r); i++ {
+			result, err := compare(l[i], r[i], visiting)
+			if err != nil || result != 0 {
+				return result, err
+			}
+		}
+		return Compare(&Integer{Value: int64(len(l))}, &Integer{Value: int64(len(r))})
+	default:
+		return 0, newError("cannot compare %s and %s", left.Type(), right.Type())
+	}
+}
@@ -0,0 +1,99 @@
+package object
+
+import (
+	"fmt"
+	"monkey/suggest"
+	"sort"
+)
+
+// 赋值统一采用原地修改: 数组、哈希和实例是引用, 所有持有同一个值的变量都能看到修改
+//
+//	let a = [1, 2]; let b = a; b[0] = 3; a[0]; // 3
+
+// left[index] = value
+func SetIndex(left, index, value Object) *Error {
+	switch left := left.(type) {
+	case *Array:
+		idx, ok := index.(*Integer)
+		if !ok {
+			return newError("array index must be INTEGER, got %s", index.Type())
+		}
+		i, ok := NormalizeIndex(idx.Value, len(left.ELements))
+		if !ok {
+			return newError("index out of range [%d] with length %d", idx.Value, len(left.ELements))
+		}
+		left.ELements[i] = value
+		return nil
+	case *Hash:
+		key, ok := index.(HashAble)
+		if !ok {
+			return newError("unusable as hash key: %s", index.Type())
+		}
+		left.Pairs[key.HashKey()] = HashPair{Key: index, Value: value}
+		return nil
+	case *Instance:
+		name, ok := index.(*String)
+		if !ok {
+			return newError("property name must be STRING, got %s", index.Type())
+		}
+		left.Fields[name.Value] = value
+		return nil
+	default:
+		return newError("index assignment not supported: %s", left.Type())
+	}
+}
+
+// obj.name; 属性不存在时在已有的属性名中找拼写相近的作为建议
+func GetProperty(obj Object, name string) (Object, *Error) {
+	switch obj := obj.(type) {
+	case *Hash:
+		key := &String{Value: name}
+		pair, ok := obj.Pairs[key.HashKey()]
+		if !ok {
+			names := []string{}
+			for _, pair := range obj.Pairs {
+				if key, ok := pair.Key.(*String); ok {
+					names = append(names, key.Value)
+				}
+			}
+			return nil, newError("undefined property `%s`%s", name, didYouMean(name, names))
+		}
+		return pair.Value, nil
+	case *Instance:
+		value, ok := obj.Fields[name]
+		if !ok {
+			names := []string{}
+			for field := range obj.Fields {
+				names = append(names, field)
+			}
+			return nil, newError("undefined property `%s` on %s%s", name, obj.Class.Name, didYouMean(name, names))
+		}
+		return value, nil
+	default:
+		return nil, newError("property access not supported: %s.%s", obj.Type(), name)
+	}
+}
+
+// obj.name = value
+func SetProperty(obj Object, name string, value Object) *Error {
+	switch obj.(type) {
+	case *Hash, *Instance:
+		return SetIndex(obj, &String{Value: name}, value)
+	default:
+		return newError("property assignment not supported: %s.%s", obj.Type(), name)
+	}
+}
+
+// *Error 同时实现 error, 虚拟机可以直接返回
+func (e *Error) Error() string {
+	return e.Message
+}
+
+// ", did you mean 'name'?", 没有相近的名字时为空
+func didYouMean(name string, candidates []string) string {
+	sort.Strings(candidates)
+	if closest, ok := suggest.Closest(name, candidates); ok {
+		return fmt.Sprintf(", did you mean '%s'?", closest)
+	}
+	return ""
+}
@@ -6,6 +6,7 @@ import (
 	"hash/fnv"
 	"monkey/ast"
 	"monkey/code"
+	"sort"
 	"strings"
 )
 
@@ -32,6 +33,8 @@ const (
 	COMPILER_FUNCTION_OBJ = "COMPILER_FUNCTION_OBJ"
 	CLOSURE_OBJ           = "CLOSURE_OBJ"
 	CLASS_OBJ             = "CLASS_OBJ"
+	INSTANCE_OBJ          = "INSTANCE_OBJ"
+	CELL_OBJ              = "CELL_OBJ"
 )
 
 // 值系统
@@ -91,8 +94,10 @@ func (e *Error) Inspect() string {
 }
 
 type Environment struct {
-	store map[string]Object
-	outer *Environment
+	store    map[string]Object
+	consts   map[string]bool // const 声明的名字
+	outer    *Environment
+	function *Function // 调用函数时创建的环境对应的函数
 }
 
 func (e *Environment) Get(name string) (Object, bool) {
@@ -105,12 +110,43 @@ func (e *Environment) Get(name string) (Object, bool) {
 }
 func (e *Environment) Set(name string, val Object) Object {
 	e.store[name] = val
+	delete(e.consts, name)
 	return val
 }
 
+// 定义常量, 之后不能再赋值
+func (e *Environment) SetConst(name string, val Object) Object {
+	e.store[name] = val
+	e.consts[name] = true
+	return val
+}
+
+// 名字最近一层的定义是否是常量
+func (e *Environment) IsConst(name string) bool {
+	for env := e; env != nil; env = env.outer {
+		if _, ok := env.store[name]; ok {
+			return env.consts[name]
+		}
+	}
+	return false
+}
+
+// 赋值: 修改最近一层已定义的变量, 都没有定义时在当前环境定义; 常量返回错误
+func (e *Environment) Assign(name string, val Object) Object {
+	for env := e; env != nil; env = env.outer {
+		if _, ok := env.store[name]; ok {
+			if env.consts[name] {
+				return &Error{Message: fmt.Sprintf("cannot assign to constant `%s`", name)}
+			}
+			return env.Set(name, val)
+		}
+	}
+	return e.Set(name, val)
+}
+
 func NewEnvironment() *Environment {
 	s := make(map[string]Object)
-	return &Environment{store: s, outer: nil}
+	return &Environment{store: s, consts: map[string]bool{}, outer: nil}
 }
 func NewEnclosedEnvironment(outer *Environment) *Environment {
 	env := NewEnvironment()
@@ -118,10 +154,28 @@ func NewEnclosedEnvironment(outer *Environment) *Environment {
 	return env
 }
 
+// 调用 fn 时执行函数体的环境
+func NewFunctionEnvironment(fn *Function) *Environment {
+	env := NewEnclosedEnvironment(fn.Env)
+	env.function = fn
+	return env
+}
+
+// 包含当前环境的最内层函数, 不在函数中时返回 nil
+func (e *Environment) Function() *Function {
+	for env := e; env != nil; env = env.outer {
+		if env.function != nil {
+			return env.function
+		}
+	}
+	return nil
+}
+
 type Function struct {
 	Parameters []*ast.Identifier
 	Body       *ast.BlockStatement
 	Env        *Environment
+	TailCalls  map[*ast.CallExpression]bool // 函数体中处于尾部位置的调用
 }
 
 func (f *Function) Type() ObjectType {
@@ -158,8 +212,12 @@ func (s *String) Type() ObjectType {
 
 type BuiltinFunction func(args ...Object) Object
 
+// 参数个数为 Variadic 的内置函数接受任意个参数
+const Variadic = -1
+
 type Builtin struct {
-	Fn BuiltinFunction
+	Fn    BuiltinFunction
+	Arity int // 参数个数, 供静态检查使用; 调用时由 Fn 自己检查
 }
 
 func (b *Builtin) Type() ObjectType {
@@ -177,11 +235,22 @@ func (a *Array) Type() ObjectType {
 	return ARRAY_OBJ
 }
 func (a *Array) Inspect() string {
+	return a.inspect(map[Object]bool{})
+}
+
+// 原地修改可以让容器包含自己, printing 是正在输出的外层容器, 再次遇到时输出 [...]
+func (a *Array) inspect(printing map[Object]bool) string {
+	if printing[a] {
+		return "[...]"
+	}
+	printing[a] = true
+	defer delete(printing, a)
+
 	var out bytes.Buffer
 
 	elements := []string{}
 	for _, e := range a.ELements {
-		elements = append(elements, e.Inspect())
+		elements = append(elements, inspectNested(e, printing))
 	}
 
 	out.WriteString("[")
@@ -191,6 +260,18 @@ func (a *Array) Inspect() string {
 	return out.String()
 }
 
+// 可以包含其他值的对象, 输出时传递正在输出的外层容器
+type container interface {
+	inspect(printing map[Object]bool) string
+}
+
+func inspectNested(obj Object, printing map[Object]bool) string {
+	if c, ok := obj.(container); ok {
+		return c.inspect(printing)
+	}
+	return obj.Inspect()
+}
+
 type HashAble interface {
 	HashKey() HashKey
 }
@@ -203,11 +284,21 @@ func (h *Hash) Type() ObjectType {
 	return HASH_OBJ
 }
 func (h *Hash) Inspect() string {
+	return h.inspect(map[Object]bool{})
+}
+
+func (h *Hash) inspect(printing map[Object]bool) string {
+	if printing[h] {
+		return "{...}"
+	}
+	printing[h] = true
+	defer delete(printing, h)
+
 	var out bytes.Buffer
 
 	pairs := []string{}
-	for _, pair := range h.Pairs {
-		pairs = append(pairs, pair.Key.Inspect()+":"+pair.Value.Inspect())
+	for _, pair := range h.SortedPairs() {
+		pairs = append(pairs, pair.Key.Inspect()+":"+inspectNested(pair.Value, printing))
 	}
 
 	out.WriteString("{")
@@ -217,6 +308,35 @@ func (h *Hash) Inspect() string {
 	return out.String()
 }
 
+// 按键排序的键值对, 输出与插入顺序和 map 遍历顺序无关:
+// 整数按大小在前, 然后是 false、true, 最后是按字典序排列的字符串
+func (h *Hash) SortedPairs() []HashPair {
+	pairs := make([]HashPair, 0, len(h.Pairs))
+	for _, pair := range h.Pairs {
+		pairs = append(pairs, pair)
+	}
+	sort.Slice(pairs, func(i, j int) bool {
+		return hashKeyLess(pairs[i].Key, pairs[j].Key)
+	})
+	return pairs
+}
+
+func hashKeyLess(left, right Object) bool {
+	rank := map[ObjectType]int{INTEGER_OBJ: 0, BOOLEAN_OBJ: 1, STRING: 2}
+	if left.Type() != right.Type() {
+		return rank[left.Type()] < rank[right.Type()]
+	}
+	switch left := left.(type) {
+	case *Integer:
+		return left.Value < right.(*Integer).Value
+	case *Boolean:
+		return !left.Value && right.(*Boolean).Value
+	case *String:
+		return left.Value < right.(*String).Value
+	}
+	return left.Inspect() < right.Inspect()
+}
+
 type HashPair struct {
 	Key   Object
 	Value Object
@@ -293,6 +413,7 @@ type CompiledFunction struct {
 	NumLocals     int
 	NumParameters int
 	Name          string
+	Lines         code.LineTable // 指令对应的源码位置, 没有调试信息时为空
 }
 
 func (cf *CompiledFunction) Type() ObjectType {
@@ -314,15 +435,72 @@ func (cl *Closure) Inspect() string {
 	return fmt.Sprintf("Closure[%p]", cl)
 }
 
+// 被闭包捕获后又被赋值的变量, 闭包和定义它的函数共享同一个 Cell; 只在虚拟机的槽位中出现
+type Cell struct {
+	Value Object
+}
+
+func (c *Cell) Type() ObjectType {
+	return CELL_OBJ
+}
+func (c *Cell) Inspect() string {
+	return c.Value.Inspect()
+}
+
+// 类体以 this 为唯一参数执行, let 定义的成员和 this.x = v 都会写入实例;
+// 虚拟机中 Body 是 *Closure
 type Class struct {
-	Name    string
-	Methods map[string]Object
-	Fields  map[string]Object
+	Name string
+	Body Object
 }
 
 func (class *Class) Type() ObjectType {
 	return CLASS_OBJ
 }
 func (class *Class) Inspect() string {
-	return fmt.Sprintf("Class[%p]", class)
+	return fmt.Sprintf("Class[%s]", class.Name)
+}
+
+type Instance struct {
+	Class  *Class
+	Fields map[string]Object
+}
+
+func NewInstance(class *Class) *Instance {
+	return &Instance{Class: class, Fields: make(map[string]Object)}
+}
+
+func (ins *Instance) Type() ObjectType {
+	return INSTANCE_OBJ
+}
+func (ins *Instance) Inspect() string {
+	return ins.inspect(map[Object]bool{})
+}
+
+func (ins *Instance) inspect(printing map[Object]bool) string {
+	if printing[ins] {
+		return ins.Class.Name + "{...}"
+	}
+	printing[ins] = true
+	defer delete(printing, ins)
+
+	var out bytes.Buffer
+
+	names := []string{}
+	for name := range ins.Fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	fields := []string{}
+	for _, name := range names {
+		fields = append(fields, name+":"+inspectNested(ins.Fields[name], printing))
+	}
+
+	out.WriteString(ins.Class.Name)
+	out.WriteString("{")
+	out.WriteString(strings.Join(fields, ", "))
+	out.WriteString("}")
+
+	return out.String()
 }
@@ -20,3 +20,105 @@ func TestStringHashKey(t *testing.T) {
 		t.Errorf("strings with different content have same hash keys")
 	}
 }
+
+func TestHashInspect(t *testing.T) {
+	hash := &Hash{Pairs: map[HashKey]HashPair{}}
+	keys := []HashAble{&String{Value: "b"}, &Integer{Value: 10}, &Boolean{Value: true},
+		&String{Value: "a"}, &Integer{Value: 2}, &Boolean{Value: false}}
+	for i, key := range keys {
+		hash.Pairs[key.HashKey()] = HashPair{Key: key.(Object), Value: &Integer{Value: int64(i)}}
+	}
+
+	expected := `{2:4, 10:1, false:5, true:2, a:3, b:0}`
+	for i := 0; i < 10; i++ {
+		if got := hash.Inspect(); got != expected {
+			t.Fatalf("wrong inspect. want=%q, got=%q", expected, got)
+		}
+	}
+}
+
+func TestEqual(t *testing.T) {
+	one := &Integer{Value: 1}
+	a := &Array{ELements: []Object{one, &String{Value: "x"}}}
+	b := &Array{ELements: []Object{&Integer{Value: 1}, &String{Value: "x"}}}
+
+	if !Equal(a, b) {
+		t.Errorf("arrays with same elements are not equal")
+	}
+	b.ELements[1] = &String{Value: "y"}
+	if Equal(a, b) {
+		t.Errorf("arrays with different elements are equal")
+	}
+
+	key := &String{Value: "k"}
+	h1 := &Hash{Pairs: map[HashKey]HashPair{key.HashKey(): {Key: key, Value: a}}}
+	h2 := &Hash{Pairs: map[HashKey]HashPair{key.HashKey(): {Key: key, Value: a}}}
+	if !Equal(h1, h2) {
+		t.Errorf("hashes with same pairs are not equal")
+	}
+	if Equal(one, &String{Value: "1"}) {
+		t.Errorf("values of different types are equal")
+	}
+}
+
+// 容器包含自己时比较不会无限递归
+func TestEqualSelfReferencing(t *testing.T) {
+	key := &String{Value: "s"}
+	selfHash := func() *Hash {
+		h := &Hash{Pairs: map[HashKey]HashPair{}}
+		h.Pairs[key.HashKey()] = HashPair{Key: key, Value: h}
+		return h
+	}
+	if !Equal(selfHash(), selfHash()) {
+		t.Errorf("self-referencing hashes are not equal")
+	}
+
+	a := &Array{ELements: []Object{nil}}
+	a.ELements[0] = a
+	b := &Array{ELements: []Object{nil}}
+	b.ELements[0] = b
+	if !Equal(a, b) {
+		t.Errorf("self-referencing arrays are not equal")
+	}
+	if result, err := Compare(a, b); err != nil || result != 0 {
+		t.Errorf("wrong compare for self-referencing arrays. got=%d, %v", result, err)
+	}
+
+	c := &Array{ELements: []Object{nil, &Integer{Value: 1}}}
+	c.ELements[0] = c
+	d := &Array{ELements: []Object{nil, &Integer{Value: 2}}}
+	d.ELements[0] = d
+	if Equal(c, d) {
+		t.Errorf("self-referencing arrays with different elements are equal")
+	}
+	if result, err := Compare(c, d); err != nil || result != -1 {
+		t.Errorf("wrong compare for self-referencing arrays. want=-1, got=%d, %v", result, err)
+	}
+}
+
+func TestCompare(t *testing.T) {
+	tests := []struct {
+		left     Object
+		right    Object
+		expected int
+	}{
+		{&String{Value: "a"}, &String{Value: "b"}, -1},
+		{&String{Value: "b"}, &String{Value: "b"}, 0},
+		{&Array{ELements: []Object{&Integer{Value: 2}}}, &Array{ELements: []Object{&Integer{Value: 1}, &Integer{Value: 5}}}, 1},
+		{&Array{}, &Array{ELements: []Object{&Integer{Value: 1}}}, -1},
+	}
+
+	for _, tt := range tests {
+		result, err := Compare(tt.left, tt.right)
+		if err != nil {
+			t.Fatalf("compare failed: %s", err)
+		}
+		if result != tt.expected {
+			t.Errorf("wrong result for %s, %s. want=%d, got=%d", tt.left.Inspect(), tt.right.Inspect(), tt.expected, result)
+		}
+	}
+
+	if _, err := Compare(&Integer{Value: 1}, &String{Value: "1"}); err == nil {
+		t.Errorf("expected error comparing INTEGER and STRING")
+	}
+}
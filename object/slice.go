@@ -0,0 +1,115 @@
+package object
+
+// 负数下标从末尾开始计数: -1 为最后一个元素; 越界时 ok 为 false
+func NormalizeIndex(idx int64, length int) (int64, bool) {
+	if idx < 0 {
+		idx += int64(length)
+	}
+	if idx < 0 || idx >= int64(length) {
+		return idx, false
+	}
+	return idx, true
+}
+
+// left[start:end:step], 语义与 Python 相同; 省略的部分传 nil 或 Null
+func Slice(left, start, end, step Object) (Object, *Error) {
+	var length int
+	switch left := left.(type) {
+	case *Array:
+		length = len(left.ELements)
+	case *String:
+		length = len(left.Value)
+	default:
+		return nil, newError("slice operator not supported: %s", left.Type())
+	}
+
+	stepValue, ok, err := sliceBound(step)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		stepValue = 1
+	}
+	if stepValue == 0 {
+		return nil, newError("slice step cannot be zero")
+	}
+
+	startValue, ok, err := sliceBound(start)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case ok:
+		startValue = clampSliceIndex(startValue, length, stepValue)
+	case stepValue < 0:
+		// 步长为负时默认从末尾向前取
+		startValue = int64(length) - 1
+	default:
+		startValue = 0
+	}
+
+	endValue, ok, err := sliceBound(end)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case ok:
+		endValue = clampSliceIndex(endValue, length, stepValue)
+	case stepValue < 0:
+		endValue = -1
+	default:
+		endValue = int64(length)
+	}
+
+	indexes := []int64{}
+	for i := startValue; (stepValue > 0 && i < endValue) || (stepValue < 0 && i > endValue); i += stepValue {
+		indexes = append(indexes, i)
+	}
+
+	switch left := left.(type) {
+	case *Array:
+		elements := make([]Object, len(indexes))
+		for i, idx := range indexes {
+			elements[i] = left.ELements[idx]
+		}
+		return &Array{ELements: elements}, nil
+	default:
+		str := left.(*String).Value
+		out := make([]byte, len(indexes))
+		for i, idx := range indexes {
+			out[i] = str[idx]
+		}
+		return &String{Value: string(out)}, nil
+	}
+}
+
+// 省略的边界 (nil 或 Null) 返回 ok == false
+func sliceBound(obj Object) (int64, bool, *Error) {
+	switch obj := obj.(type) {
+	case nil, *Null:
+		return 0, false, nil
+	case *Integer:
+		return obj.Value, true, nil
+	default:
+		return 0, false, newError("slice indices must be INTEGER, got %s", obj.Type())
+	}
+}
+
+// 把下标限制在可迭代的范围内, 负步长时允许 -1 表示开头之前
+func clampSliceIndex(idx int64, length int, step int64) int64 {
+	if idx < 0 {
+		idx += int64(length)
+		if idx < 0 {
+			if step < 0 {
+				return -1
+			}
+			return 0
+		}
+	} else if idx >= int64(length) {
+		if step < 0 {
+			return int64(length) - 1
+		}
+		return int64(length)
+	}
+	return idx
+}
@@ -6,15 +6,21 @@ import (
 	"monkey/lexer"
 	"monkey/token"
 	"strconv"
+	"strings"
 )
 
 type Parser struct {
 	l              *lexer.Lexer
 	curToken       token.Token
 	peekToken      token.Token
-	errors         []string
+	errors         []Error
 	prefixParseFns map[token.TokenType]prefixParseFn
 	infixParseFns  map[token.TokenType]infixParseFn
+
+	// 包含 __ 的名字保留给宏生成的标识符 (gensym);
+	// 程序中有宏时, 用户写的这类名字可能与展开生成的名字冲突, 解析结束时报错
+	generatedNames []token.Token
+	hasMacro       bool
 }
 
 type (
@@ -41,28 +47,39 @@ const (
 
 // 优先级表
 var precedence = map[token.TokenType]int{
-	token.IDENT:    NONE,
-	token.ASSIGN:   LOWEST,
-	token.EQ:       EQUALS,
-	token.NOT_EQ:   EQUALS,
-	token.LT:       LESSGREATER,
-	token.GT:       LESSGREATER,
-	token.LTQ:      LESSGREATER,
-	token.GTQ:      LESSGREATER,
-	token.PLUS:     SUM,
-	token.MINUS:    SUM,
-	token.SLASH:    PRODUCT,
-	token.ASTERISK: PRODUCT,
-	token.BANG:     PREFIX,
-	token.LPAREN:   CALL,
-	token.LBRACKET: INDEX,
-	token.AND:      ANDOR,
-	token.OR:       ANDOR,
-	token.DOT:      INDEX,
+	token.IDENT:  NONE,
+	token.ASSIGN: LOWEST,
+	// 复合赋值
+	token.PLUS_ASSIGN:     LOWEST,
+	token.MINUS_ASSIGN:    LOWEST,
+	token.ASTERISK_ASSIGN: LOWEST,
+	token.SLASH_ASSIGN:    LOWEST,
+	token.EQ:              EQUALS,
+	token.NOT_EQ:          EQUALS,
+	token.LT:              LESSGREATER,
+	token.GT:              LESSGREATER,
+	token.LTQ:             LESSGREATER,
+	token.GTQ:             LESSGREATER,
+	token.PLUS:            SUM,
+	token.MINUS:           SUM,
+	token.SLASH:           PRODUCT,
+	token.ASTERISK:        PRODUCT,
+	token.BANG:            PREFIX,
+	token.LPAREN:          CALL,
+	token.LBRACKET:        INDEX,
+	token.AND:             ANDOR,
+	token.OR:              ANDOR,
+	token.DOT:             INDEX,
+}
+
+// 语法错误和出错的 token
+type Error struct {
+	Token   token.Token
+	Message string
 }
 
 func New(l *lexer.Lexer) *Parser {
-	p := &Parser{l: l, errors: []string{}}
+	p := &Parser{l: l, errors: []Error{}}
 	// 普拉特
 	//initial prefixParseFns
 	p.prefixParseFns = make(map[token.TokenType]prefixParseFn)
@@ -103,6 +120,10 @@ func New(l *lexer.Lexer) *Parser {
 	// group expression; let a = (1+2)*3;
 	p.registerPrefix(token.LPAREN, p.parserGroupExpression)
 	p.registerInfix(token.ASSIGN, p.parserAssignExpression)
+	p.registerInfix(token.PLUS_ASSIGN, p.parserAssignExpression)
+	p.registerInfix(token.MINUS_ASSIGN, p.parserAssignExpression)
+	p.registerInfix(token.ASTERISK_ASSIGN, p.parserAssignExpression)
+	p.registerInfix(token.SLASH_ASSIGN, p.parserAssignExpression)
 	p.registerInfix(token.DOT, p.parserInfixExpression)
 	p.nextToken()
 	p.nextToken()
@@ -119,8 +140,19 @@ func (p *Parser) registerInfix(tokenType token.TokenType, fn infixParseFn) {
 
 // 关联解析函数
 func (p *Parser) parserIdentifier() ast.Expression {
-	ident := &ast.Identifier{Token: p.curToken, Value: p.curToken.Literal}
-	return ident
+	return p.newIdentifier()
+}
+
+func (p *Parser) newIdentifier() *ast.Identifier {
+	if strings.Contains(p.curToken.Literal, "__") {
+		p.generatedNames = append(p.generatedNames, p.curToken)
+	}
+	return &ast.Identifier{Token: p.curToken, Value: p.curToken.Literal}
+}
+
+// 即使这段源码没有定义宏也拒绝包含 __ 的名字, 用于 REPL 等之前定义的宏仍然有效的场合
+func (p *Parser) ReserveGeneratedNames() {
+	p.hasMacro = true
 }
 
 func (p *Parser) parseThisLiteral() ast.Expression {
@@ -132,8 +164,7 @@ func (p *Parser) parserIntegerLiteral() ast.Expression {
 	lit := &ast.IntegerLiteral{Token: p.curToken}
 	value, err := strconv.ParseInt(p.curToken.Literal, 0, 64)
 	if err != nil { //不等于nil，有错
-		msg := fmt.Sprintf("could not parse %s as integer", p.curToken.Literal)
-		p.errors = append(p.errors, msg)
+		p.errorf(p.curToken, "could not parse %s as integer", p.curToken.Literal)
 		return nil
 	}
 	lit.Value = value
@@ -187,7 +218,7 @@ func (p *Parser) parserGroupExpression() ast.Expression {
 
 // if else expression
 func (p *Parser) parserIfExpression() ast.Expression {
-	expression := &ast.IfExpression{}
+	expression := &ast.IfExpression{Token: p.curToken}
 	if !p.expectPeek(token.LPAREN) {
 		return nil
 	}
@@ -237,14 +268,12 @@ func (p *Parser) parserFunctionParameters() []*ast.Identifier {
 	}
 	//else
 	p.nextToken() //skip ( curToken = ident->"x"
-	ident := &ast.Identifier{Token: p.curToken, Value: p.curToken.Literal}
-	identifiers = append(identifiers, ident)
+	identifiers = append(identifiers, p.newIdentifier())
 
 	for p.peekTokenIs(token.COMMA) {
 		p.nextToken()
 		p.nextToken() //skip "," ident -> "y"
-		ident := &ast.Identifier{Token: p.curToken, Value: p.curToken.Literal}
-		identifiers = append(identifiers, ident)
+		identifiers = append(identifiers, p.newIdentifier())
 	}
 	if !p.expectPeek(token.RPAREN) {
 		return nil
@@ -255,6 +284,7 @@ func (p *Parser) parserFunctionParameters() []*ast.Identifier {
 func (p *Parser) parserCallExpression(function ast.Expression) ast.Expression {
 	exp := &ast.CallExpression{Token: p.curToken, Function: function}
 	exp.Arguments = p.parserCallArguments()
+	exp.Rparen = p.curToken.Pos
 	return exp
 }
 
@@ -288,7 +318,7 @@ func (p *Parser) parserClassStatement() ast.Statement {
 	if !p.expectPeek(token.IDENT) {
 		return nil
 	}
-	class.Name = &ast.Identifier{Token: p.curToken, Value: p.curToken.Literal}
+	class.Name = p.newIdentifier()
 
 	if !p.expectPeek(token.LBRACE) {
 		return nil
@@ -306,6 +336,7 @@ func (p *Parser) parserArrayLiteral() ast.Expression {
 	array := &ast.ArrayLiteral{Token: p.curToken}
 
 	array.Elements = p.parserExpressionList(token.RBRACKET)
+	array.Rbracket = p.curToken.Pos
 	return array
 }
 
@@ -333,18 +364,46 @@ func (p *Parser) parserExpressionList(end token.TokenType) []ast.Expression {
 }
 
 func (p *Parser) parserIndexExpression(left ast.Expression) ast.Expression {
-	exp := &ast.IndexExpression{Token: p.curToken, Left: left}
+	tok := p.curToken
 
 	p.nextToken()
-	exp.Index = p.parserExpression(LOWEST)
+	var start ast.Expression
+	if !p.curTokenIs(token.COLON) {
+		start = p.parserExpression(LOWEST)
+		if p.peekTokenIs(token.RBRACKET) {
+			p.nextToken()
+			return &ast.IndexExpression{Token: tok, Left: left, Index: start, Rbracket: p.curToken.Pos}
+		}
+		if !p.expectPeek(token.COLON) {
+			return nil
+		}
+	}
+
+	// x[start:end:step]
+	exp := &ast.SliceExpression{Token: tok, Left: left, Start: start}
+	exp.End = p.parserSliceBound()
+	if p.peekTokenIs(token.COLON) {
+		p.nextToken()
+		exp.Step = p.parserSliceBound()
+	}
 
 	if !p.expectPeek(token.RBRACKET) {
 		return nil
 	}
+	exp.Rbracket = p.curToken.Pos
 
 	return exp
 }
 
+// 当前 token 为 ':', 后面紧跟 ':' 或 ']' 时该部分被省略
+func (p *Parser) parserSliceBound() ast.Expression {
+	if p.peekTokenIs(token.COLON) || p.peekTokenIs(token.RBRACKET) {
+		return nil
+	}
+	p.nextToken()
+	return p.parserExpression(LOWEST)
+}
+
 func (p *Parser) parserHashLiteral() ast.Expression {
 	hash := &ast.HashLiteral{Token: p.curToken}
 	hash.Pairs = make(map[ast.Expression]ast.Expression)
@@ -368,11 +427,13 @@ func (p *Parser) parserHashLiteral() ast.Expression {
 	if !p.expectPeek(token.RBRACE) {
 		return nil
 	}
+	hash.Rbrace = p.curToken.Pos
 	return hash
 }
 
 func (p *Parser) parserMacroLiteral() ast.Expression {
 	macroLit := &ast.MacroLiteral{Token: p.curToken}
+	p.hasMacro = true
 
 	if !p.expectPeek(token.LPAREN) {
 		return nil
@@ -388,7 +449,7 @@ func (p *Parser) parserMacroLiteral() ast.Expression {
 }
 
 func (p *Parser) parserAssignExpression(left ast.Expression) ast.Expression {
-	exp := &ast.AssignExpression{Token: p.curToken, Left: left}
+	exp := &ast.AssignExpression{Token: p.curToken, Left: left, Operator: p.curToken.Literal}
 	p.nextToken()
 	exp.Value = p.parserExpression(LOWEST)
 	return exp
@@ -401,12 +462,24 @@ func (p *Parser) nextToken() {
 
 // 语法分析，提示错误
 func (p *Parser) Errors() []string {
+	messages := make([]string, len(p.errors))
+	for i, err := range p.errors {
+		messages[i] = err.Message
+	}
+	return messages
+}
+
+// 带位置的语法错误, 与 Errors() 一一对应
+func (p *Parser) SyntaxErrors() []Error {
 	return p.errors
 }
 
+func (p *Parser) errorf(tok token.Token, format string, a ...interface{}) {
+	p.errors = append(p.errors, Error{Token: tok, Message: fmt.Sprintf(format, a...)})
+}
+
 func (p *Parser) peekError(t token.TokenType) {
-	msg := fmt.Sprintf("expected next token to be '%s' got='%s'", t, p.peekToken.Type)
-	p.errors = append(p.errors, msg)
+	p.errorf(p.peekToken, "expected next token to be '%s' got='%s'", t, p.peekToken.Type)
 }
 
 func (p *Parser) ParserProgram() *ast.Program {
@@ -420,13 +493,18 @@ func (p *Parser) ParserProgram() *ast.Program {
 		// }
 		p.nextToken()
 	}
+	if p.hasMacro {
+		for _, tok := range p.generatedNames {
+			p.errorf(tok, "identifier `%s` is reserved: names containing `__` are generated by macros", tok.Literal)
+		}
+	}
 	return program
 }
 
 // statement
 func (p *Parser) parserStatement() ast.Statement {
 	switch p.curToken.Type {
-	case token.LET:
+	case token.LET, token.CONST:
 		return p.parserLetStatement()
 	case token.RETURN:
 		return p.parserReturnStatement()
@@ -452,7 +530,7 @@ func (p *Parser) parserLetStatement() *ast.LetStatement {
 		return nil
 	}
 	// if strings.Contains(p.curToken.Literal,"1") {return nil}
-	stmt.Name = &ast.Identifier{Token: p.curToken, Value: p.curToken.Literal}
+	stmt.Name = p.newIdentifier()
 	if !p.expectPeek(token.ASSIGN) {
 		return nil
 	}
@@ -563,6 +641,7 @@ func (p *Parser) parserBlockStatement() *ast.BlockStatement {
 		// }
 		p.nextToken()
 	}
+	block.Rbrace = p.curToken.Pos
 	return block
 }
 
@@ -606,8 +685,7 @@ func (p *Parser) curTokenIs(t token.TokenType) bool {
 
 // 没找到解析函数时错误
 func (p *Parser) noPrefixFnError(t token.TokenType) {
-	msg := fmt.Sprintf("prefix parse function for %s not found", t)
-	p.errors = append(p.errors, msg)
+	p.errorf(p.curToken, "prefix parse function for %s not found", t)
 }
 
 func (p *Parser) peekPrecedence() int {
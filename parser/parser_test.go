@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"monkey/ast"
 	"monkey/lexer"
+	"strings"
 	"testing"
 )
 
@@ -16,6 +17,7 @@ func TestLetStatements(t *testing.T) {
 		{"let x = 5;", "x", 5},
 		{"let y = true;", "y", true},
 		{"let foobar = y;", "foobar", "y"},
+		{"const max = 10;", "max", 10},
 		// {"let z = 'bar'","z","bar"},
 	}
 	for _, tt := range tests {
@@ -42,7 +44,7 @@ func TestLetStatements(t *testing.T) {
 }
 
 func testLetStatement(t *testing.T, s ast.Statement, name string) bool {
-	if s.TokenLiteral() != "let" {
+	if s.TokenLiteral() != "let" && s.TokenLiteral() != "const" {
 		t.Errorf("s.TokenLiteral() not 'let' got=%q", s.TokenLiteral())
 		return false
 	}
@@ -624,6 +626,44 @@ func TestParsingIndexExpression(t *testing.T) {
 	}
 }
 
+func TestParsingSliceExpression(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"a[1:2]", "(a[1:2])"},
+		{"a[:2]", "(a[:2])"},
+		{"a[1:]", "(a[1:])"},
+		{"a[:]", "(a[:])"},
+		{"a[::-1]", "(a[::(-1)])"},
+		{"a[1:n - 1:2]", "(a[1:(n - 1):2])"},
+		{"a[::]", "(a[:])"},
+		{"a[-1]", "(a[(-1)])"},
+	}
+
+	for _, tt := range tests {
+		l := lexer.New(tt.input)
+		p := New(l)
+		program := p.ParserProgram()
+		checkParserErrors(t, p)
+
+		actual := program.String()
+		if actual != tt.expected {
+			t.Errorf("expected=%q, got=%q", tt.expected, actual)
+		}
+	}
+
+	program := New(lexer.New("a[::-1]")).ParserProgram()
+	stmt := program.Statements[0].(*ast.ExpressionStatement)
+	slice, ok := stmt.Expression.(*ast.SliceExpression)
+	if !ok {
+		t.Fatalf("exp not *ast.SliceExpression. got=%T", stmt.Expression)
+	}
+	if slice.Start != nil || slice.End != nil || slice.Step == nil {
+		t.Errorf("wrong slice bounds. got=%+v", slice)
+	}
+}
+
 func TestHashLiteral(t *testing.T) {
 	input := `{"one": 1,"two": 2,"three": 3}`
 
@@ -653,7 +693,7 @@ func TestHashLiteral(t *testing.T) {
 		if !ok {
 			t.Errorf("key is not ast.StringLiteral. got=%T", key.String())
 		}
-		expectedValue := expected[literal.String()]
+		expectedValue := expected[literal.Value]
 		testIntegerLiteral(t, value, expectedValue)
 	}
 }
@@ -710,9 +750,9 @@ func TestParsingHashLiteralWithExpression(t *testing.T) {
 			continue
 		}
 
-		testFun, ok := tests[key.String()]
+		testFun, ok := tests[literal.Value]
 		if !ok {
-			t.Errorf("No test function for key %q found.", literal.String())
+			t.Errorf("No test function for key %q found.", literal.Value)
 			continue
 		}
 		testFun(value)
@@ -759,6 +799,64 @@ func TestMacroLiteralParsing(t *testing.T) {
 	testInfixExpression(t, bodyStmt.Expression, "x", "+", "y")
 }
 
+// 定义了宏的程序中, 包含 __ 的名字保留给宏展开生成的标识符
+func TestReservedGeneratedNames(t *testing.T) {
+	tests := []struct {
+		input   string
+		reserve bool
+		errors  int
+	}{
+		{"let tmp__a = 1; tmp__a", false, 0},
+		{"let m = macro() { quote(1) }; let tmp__a = 1;", false, 1},
+		{"let f = fn(x__a) { x__a }; let m = macro() { quote(1) };", false, 2},
+		{"let m = macro(a__b) { quote(1) };", false, 1},
+		{"class A__b {} let m = macro() { quote(1) };", false, 1},
+		{"let h = {}; h.x__y", true, 1},
+		{"let tmp_a = 1; let m = macro() { quote(1) };", false, 0},
+	}
+
+	for _, tt := range tests {
+		p := New(lexer.New(tt.input))
+		if tt.reserve {
+			p.ReserveGeneratedNames()
+		}
+		p.ParserProgram()
+		if len(p.Errors()) != tt.errors {
+			t.Errorf("wrong errors for %q. want %d, got=%v", tt.input, tt.errors, p.Errors())
+		}
+		for _, msg := range p.Errors() {
+			if !strings.Contains(msg, "is reserved") {
+				t.Errorf("unexpected error for %q: %s", tt.input, msg)
+			}
+		}
+	}
+}
+
+// 语法错误记录出错的 token
+func TestSyntaxErrorPositions(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected []string
+	}{
+		{"let = 1;", []string{"1:5 expected next token to be 'IDENT' got='='", "1:5 prefix parse function for = not found"}},
+		{"let x = 1;\nlet y = (2;", []string{"2:11 expected next token to be ')' got=';'"}},
+		{"1 +\n  ;", []string{"2:3 prefix parse function for ; not found"}},
+		{"let m = macro() { 1 };\nlet a__b = 1;", []string{"2:5 identifier `a__b` is reserved: names containing `__` are generated by macros"}},
+	}
+
+	for _, tt := range tests {
+		p := New(lexer.New(tt.input))
+		p.ParserProgram()
+		got := []string{}
+		for _, err := range p.SyntaxErrors() {
+			got = append(got, fmt.Sprintf("%s %s", err.Token.Pos, err.Message))
+		}
+		if strings.Join(got, "\n") != strings.Join(tt.expected, "\n") {
+			t.Errorf("wrong errors for %q.\nwant=%q\ngot= %q", tt.input, tt.expected, got)
+		}
+	}
+}
+
 func TestFunctionLiteralWithName(t *testing.T) {
 	input := `let mfn = fn(){};`
 
@@ -870,6 +968,38 @@ func TestForStatement(t *testing.T) {
 	}
 }
 
+func TestCompoundAssignExpression(t *testing.T) {
+	tests := []struct {
+		input    string
+		operator string
+		expected string
+	}{
+		{"a += 1", "+=", "a += 1"},
+		{"a -= b * 2;", "-=", "a -= (b * 2)"},
+		{"a[0] *= 3;", "*=", "(a[0]) *= 3"},
+		{"a /= 2", "/=", "a /= 2"},
+	}
+
+	for _, tt := range tests {
+		l := lexer.New(tt.input)
+		p := New(l)
+		program := p.ParserProgram()
+		checkParserErrors(t, p)
+
+		stmt := program.Statements[0].(*ast.ExpressionStatement)
+		exp, ok := stmt.Expression.(*ast.AssignExpression)
+		if !ok {
+			t.Fatalf("expression is not ast.AssignExpression got='%T'", stmt.Expression)
+		}
+		if exp.Operator != tt.operator {
+			t.Errorf("exp.Operator is not %s, got=%q", tt.operator, exp.Operator)
+		}
+		if program.String() != tt.expected {
+			t.Errorf("program.String() wrong. want=%q, got=%q", tt.expected, program.String())
+		}
+	}
+}
+
 // 辅助函数
 func testLiteralExpression(t *testing.T, exp ast.Expression, expected interface{}) bool {
 	switch v := expected.(type) {
@@ -0,0 +1,124 @@
+package parser
+
+import (
+	"fmt"
+	"io/ioutil"
+	"monkey/ast"
+	"monkey/lexer"
+	"path/filepath"
+	"testing"
+)
+
+// 语法树的结构: 节点类型以及字面量、运算符, 不包括位置信息
+func treeShape(node ast.Node) []string {
+	shape := []string{}
+	ast.Inspect(node, func(n ast.Node) bool {
+		desc := fmt.Sprintf("%T", n)
+		switch n := n.(type) {
+		case *ast.Identifier:
+			desc += " " + n.Value
+		case *ast.IntegerLiteral:
+			desc += fmt.Sprintf(" %d", n.Value)
+		case *ast.StringLiteral:
+			desc += fmt.Sprintf(" %q", n.Value)
+		case *ast.Boolean:
+			desc += fmt.Sprintf(" %t", n.Value)
+		case *ast.PrefixExpression:
+			desc += " " + n.Operator
+		case *ast.InfixExpression:
+			desc += " " + n.Operator
+		case *ast.AssignExpression:
+			desc += " " + n.Operator
+		case *ast.LetStatement:
+			desc += fmt.Sprintf(" const=%t", n.IsConst())
+		case *ast.IfExpression:
+			desc += fmt.Sprintf(" else=%t", n.Alternative != nil)
+		case *ast.SliceExpression:
+			desc += fmt.Sprintf(" %t %t %t", n.Start != nil, n.End != nil, n.Step != nil)
+		}
+		shape = append(shape, desc)
+		return true
+	})
+	return shape
+}
+
+var roundTripCorpus = []string{
+	`let a = 1; const b = "two"; a + b * 3 - -4 / 5;`,
+	`!true == false != (1 < 2) && 3 >= 4 || 5 <= 6`,
+	`if (a) { 1 } else { 2 }; if (a > b) { let c = a; c }`,
+	`let f = fn(x, y) { return x + y; }; f(1, f(2, 3))(4);`,
+	`fn() { }(); fn(x) { x }`,
+	`[1, "a", [true]][0][1:2][::-1]; "str"[-1]; a[:][1:][:2:3]`,
+	`{"b": 1, "a": {1: 2}, true: fn() { 3 }}["a"]`,
+	`a = 1; a += 2; a[0] -= 3; h.x *= 4; h.y.z /= 5; b = fn() { c = 3 }`,
+	`while (i < 10) { i = i + 1; puts(i) } let i = 0;`,
+	`for (let i = 0; i < 3; i = i + 1) { if (i == 1) { puts(i) } }`,
+	`class Point { this.x = 0; let move = fn(dx) { this.x = this.x + dx; this.x }; }`,
+	`let p = Point(); p.move(1).toString(); -p.x; (-p).x; (a + b).c`,
+	`let unless = macro(cond, cons, alt) { quote(if (!(unquote(cond))) { unquote(cons) } else { unquote(alt) }) };`,
+	`"escaped \" quote"; puts("a"); 1`,
+	`if (true) { }; while (false) { }`,
+}
+
+func roundTrip(t *testing.T, name, input string) {
+	t.Helper()
+
+	p := New(lexer.New(input))
+	program := p.ParserProgram()
+	if len(p.Errors()) != 0 {
+		t.Fatalf("%s: parser errors: %v", name, p.Errors())
+	}
+
+	printed := program.String()
+	reparser := New(lexer.New(printed))
+	reparsed := reparser.ParserProgram()
+	if len(reparser.Errors()) != 0 {
+		t.Fatalf("%s: printed source does not parse: %v\n%s", name, reparser.Errors(), printed)
+	}
+
+	want, got := treeShape(program), treeShape(reparsed)
+	if fmt.Sprint(want) != fmt.Sprint(got) {
+		t.Errorf("%s: tree changed after printing.\nsource:  %s\nprinted: %s\nwant=%v\ngot=%v", name, input, printed, want, got)
+	}
+	if reprinted := reparsed.String(); reprinted != printed {
+		t.Errorf("%s: String() is not stable.\nfirst=%q\nsecond=%q", name, printed, reprinted)
+	}
+}
+
+func TestStringRoundTrip(t *testing.T) {
+	for i, input := range roundTripCorpus {
+		roundTrip(t, fmt.Sprintf("corpus[%d]", i), input)
+	}
+}
+
+func TestStringRoundTripFiles(t *testing.T) {
+	files, err := filepath.Glob("../*.mon")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		p := New(lexer.New(string(data)))
+		p.ParserProgram()
+		if len(p.Errors()) != 0 {
+			t.Logf("skipping %s: %v", file, p.Errors())
+			continue
+		}
+		roundTrip(t, file, string(data))
+	}
+}
+
+// map 的遍历顺序不影响输出
+func TestHashLiteralStringIsDeterministic(t *testing.T) {
+	input := `{"c": 3, "a": 1, "b": 2}`
+	expected := `{"c": 3, "a": 1, "b": 2}`
+	for i := 0; i < 20; i++ {
+		program := New(lexer.New(input)).ParserProgram()
+		if program.String() != expected {
+			t.Fatalf("wrong output. want=%q, got=%q", expected, program.String())
+		}
+	}
+}
@@ -13,6 +13,7 @@ import (
 	"monkey/object"
 	"monkey/parser"
 	"monkey/vm"
+	"os"
 	"strings"
 )
 
@@ -35,6 +36,9 @@ func StartVM(in io.Reader, out io.Writer) {
 	constants := []object.Object{}
 	globals := make([]object.Object, vm.GlobalSize)
 	symbolTable := compiler.NewSymbolTable()
+	macroEnv := object.NewEnvironment() // 宏在各行之间保留
+	// 之前各行定义的函数出错时要显示它们所在的行, 每行按输入顺序编号
+	history := []string{}
 
 	for i, v := range object.Builtins {
 		symbolTable.DefineBuiltin(i, v.Name)
@@ -47,9 +51,13 @@ func StartVM(in io.Reader, out io.Writer) {
 			return
 		}
 		line := scanner.Text()
-		l := lexer.New(line)
+		history = append(history, line)
+		source := strings.Join(history, "\n")
+		l := lexer.NewAtLine(line, len(history))
 
 		p := parser.New(l)
+		// 之前输入的宏在后面的输入中仍然有效
+		p.ReserveGeneratedNames()
 		program := p.ParserProgram()
 
 		if len(p.Errors()) != 0 {
@@ -57,11 +65,16 @@ func StartVM(in io.Reader, out io.Writer) {
 			continue
 		}
 
+		program, err := evaluator.ExpandProgram(program, macroEnv)
+		if err != nil {
+			fmt.Fprintf(out, "Woops! Macro expansion failed:\n%s\n", err)
+			continue
+		}
 		comp := compiler.NewWithState(symbolTable, constants)
-		err := comp.Compile(program)
+		err = comp.Compile(program)
 
 		if err != nil {
-			fmt.Fprintf(out, "Woops! Compilation failed:\n%s\n", err)
+			fmt.Fprintf(out, "Woops! Compilation failed:\n%s\n", compileErrorReport(err, "<stdin>", source))
 			continue
 		}
 
@@ -70,12 +83,14 @@ func StartVM(in io.Reader, out io.Writer) {
 		machine := vm.NewWithGlobalStore(code, globals)
 		err = machine.Run()
 		if err != nil {
-			fmt.Fprintf(out, "Woops! Executing bytecode failed:\n%s\n", err)
+			fmt.Fprintf(out, "Woops! Executing bytecode failed:\n%s\n", runtimeErrorReport(err, "<stdin>", source))
 			continue
 		}
 		stackTop := machine.LastPoppedStackElem()
-		io.WriteString(out, stackTop.Inspect())
-		io.WriteString(out, "\n")
+		if stackTop != nil {
+			io.WriteString(out, stackTop.Inspect())
+			io.WriteString(out, "\n")
+		}
 
 	}
 }
@@ -95,6 +110,7 @@ func StartEval(in io.Reader, out io.Writer) {
 		l := lexer.New(line)
 
 		p := parser.New(l)
+		p.ReserveGeneratedNames()
 		program := p.ParserProgram()
 
 		if len(p.Errors()) != 0 {
@@ -102,8 +118,11 @@ func StartEval(in io.Reader, out io.Writer) {
 			continue
 		}
 
-		evaluator.DefineMacro(program, macroEnv)
-		expanded := evaluator.ExpandMacros(program, macroEnv)
+		expanded, err := evaluator.ExpandProgram(program, macroEnv)
+		if err != nil {
+			fmt.Fprintf(out, "Woops! Macro expansion failed:\n%s\n", err)
+			continue
+		}
 
 		evaluated := evaluator.Eval(expanded, env)
 
@@ -128,20 +147,33 @@ func StartFile(filePath string) {
 		symbolTable.DefineBuiltin(i, builtin.Name)
 	}
 
-	program := parse(string(data))
-	compiler := compiler.NewWithState(symbolTable, constants)
+	p := parser.New(lexer.New(string(data)))
+	program := p.ParserProgram()
+	if len(p.Errors()) != 0 {
+		printParserErrors(os.Stdout, p.Errors())
+		return
+	}
+	program, err = evaluator.ExpandProgram(program, object.NewEnvironment())
+	if err != nil {
+		fmt.Printf("macro error: %s", err)
+		return
+	}
+	comp := compiler.NewWithState(symbolTable, constants)
 
-	err = compiler.Compile(program)
+	err = comp.Compile(program)
 
 	if err != nil {
-		fmt.Printf("compiler error: %s", err)
+		fmt.Printf("compiler error: %s\n", compileErrorReport(err, filePath, string(data)))
+		return
 	}
 
-	vm := vm.NewWithGlobalStore(compiler.ByteCode(), globals)
-	err = vm.Run()
+	byteCode := comp.ByteCode()
+	byteCode.Debug = &compiler.DebugInfo{Source: filePath}
+	machine := vm.NewWithGlobalStore(byteCode, globals)
+	err = machine.Run()
 
 	if err != nil {
-		fmt.Printf("vm run failed: %s", err)
+		fmt.Printf("vm run failed: %s\n", runtimeErrorReport(err, filePath, string(data)))
 	}
 
 	// stackElem := vm.LastPoppedStackElem()
@@ -179,6 +211,27 @@ func parse(input string) *ast.Program {
 	return p.ParserProgram()
 }
 
+// 编译错误逐个带上源码位置和源码行
+func compileErrorReport(err error, file, source string) string {
+	diagnostics, ok := compiler.AsDiagnostics(err)
+	if !ok {
+		return err.Error()
+	}
+	reports := make([]string, len(diagnostics))
+	for i, d := range diagnostics {
+		reports[i] = d.Report(file, source)
+	}
+	return strings.Join(reports, "\n")
+}
+
+// 虚拟机的运行时错误带上源码位置和出错的源码行
+func runtimeErrorReport(err error, file, source string) string {
+	if runtimeErr, ok := err.(*vm.RuntimeError); ok {
+		return runtimeErr.Report(file, source)
+	}
+	return err.Error()
+}
+
 func printParserErrors(out io.Writer, errors []string) {
 	io.WriteString(out, MONKEY_FACE)
 	io.WriteString(out, "Woops! We ran into some monkey business here!\n")
@@ -0,0 +1,73 @@
+package repl
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+// 宏在编译之前展开, 前面行定义的宏在后面的行中可用
+func TestStartVMExpandsMacros(t *testing.T) {
+	input := strings.Join([]string{
+		`let unless = macro(cond, cons, alt) { quote(if (!(unquote(cond))) { unquote(cons) } else { unquote(alt) }) };`,
+		`unless(10 > 5, "not greater", "greater")`,
+		`let double = macro(a) { quote(unquote(a) * 2) }; double(21)`,
+	}, "\n")
+
+	var out bytes.Buffer
+	StartVM(strings.NewReader(input), &out)
+
+	expected := PROMPT + PROMPT + "greater\n" + PROMPT + "42\n" + PROMPT
+	if out.String() != expected {
+		t.Errorf("wrong output.\nwant=%q\ngot= %q", expected, out.String())
+	}
+}
+
+// 运行时错误显示出错的位置和源码行
+func TestStartVMRuntimeErrorLocation(t *testing.T) {
+	var out bytes.Buffer
+	StartVM(strings.NewReader(`let y = 5 - true`), &out)
+
+	expected := PROMPT + "Woops! Executing bytecode failed:\n" +
+		"<stdin>:1:11: type mismatch: INTEGER - BOOLEAN\n\tlet y = 5 - true\n\t          ^\n" + PROMPT
+	if out.String() != expected {
+		t.Errorf("wrong output.\nwant=%q\ngot= %q", expected, out.String())
+	}
+}
+
+// 一行中的所有编译错误都带上位置
+func TestStartVMCompileErrors(t *testing.T) {
+	var out bytes.Buffer
+	StartVM(strings.NewReader(`let a = b; len = c;`), &out)
+
+	expected := PROMPT + "Woops! Compilation failed:\n" +
+		"<stdin>:1:9: error[E0001]: undefined variable `b`\n\tlet a = b; len = c;\n\t        ^\n" +
+		"<stdin>:1:12: error[E0005]: cannot assign to `len`\n\tlet a = b; len = c;\n\t           ^^^\n" + PROMPT
+	if out.String() != expected {
+		t.Errorf("wrong output.\nwant=%q\ngot= %q", expected, out.String())
+	}
+}
+
+// 每行按输入顺序编号, 之前的行定义的函数和常量出错时显示它们所在的行
+func TestStartVMErrorsInEarlierLines(t *testing.T) {
+	input := strings.Join([]string{
+		`let f = fn(x) { x + "a" };`,
+		`f(1)`,
+		`const c = 1;`,
+		`c = 2`,
+	}, "\n")
+
+	var out bytes.Buffer
+	StartVM(strings.NewReader(input), &out)
+
+	for _, expected := range []string{
+		"<stdin>:1:19: type mismatch: INTEGER + STRING\n\tlet f = fn(x) { x + \"a\" };\n\t                  ^\n" +
+			"traceback (most recent call last):\n  <main> (<stdin>:2:2)\n  f (<stdin>:1:19)\n",
+		"<stdin>:4:1: error[E0004]: cannot assign to constant `c`\n\tc = 2\n\t^\n" +
+			"<stdin>:3:7: note: `c` was declared as a constant here\n",
+	} {
+		if !strings.Contains(out.String(), expected) {
+			t.Errorf("output does not contain %q.\ngot= %q", expected, out.String())
+		}
+	}
+}
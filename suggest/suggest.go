@@ -0,0 +1,64 @@
+// 拼写建议: 在候选名字中找出与输入最接近的一个, 用于 "did you mean" 提示
+package suggest
+
+// 编辑距离不超过名字长度的三分之一 (至少为 1), 并且小于名字长度时才建议, 单个字母的名字没有建议;
+// 距离相同时取靠前的候选, 调用者把更可能的候选 (例如内层作用域的变量) 放在前面
+func Closest(name string, candidates []string) (string, bool) {
+	length := len([]rune(name))
+	limit := length / 3
+	if limit < 1 {
+		limit = 1
+	}
+	if limit >= length {
+		limit = length - 1
+	}
+
+	best, bestDistance := "", limit+1
+	for _, candidate := range candidates {
+		if candidate == name {
+			continue
+		}
+		if d := Distance(name, candidate); d < bestDistance {
+			best, bestDistance = candidate, d
+		}
+	}
+	return best, best != ""
+}
+
+// 编辑距离 (Damerau-Levenshtein 的简化版本): 插入、删除、替换和相邻字符交换各算一次
+func Distance(a, b string) int {
+	s, t := []rune(a), []rune(b)
+	// 只保留三行: 上上行、上一行和当前行
+	before := make([]int, len(t)+1)
+	previous := make([]int, len(t)+1)
+	current := make([]int, len(t)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+
+	for i := 1; i <= len(s); i++ {
+		current[0] = i
+		for j := 1; j <= len(t); j++ {
+			cost := 1
+			if s[i-1] == t[j-1] {
+				cost = 0
+			}
+			current[j] = min(previous[j]+1, current[j-1]+1, previous[j-1]+cost)
+			if i > 1 && j > 1 && s[i-1] == t[j-2] && s[i-2] == t[j-1] {
+				current[j] = min(current[j], before[j-2]+1)
+			}
+		}
+		before, previous, current = previous, current, before
+	}
+	return previous[len(t)]
+}
+
+func min(values ...int) int {
+	m := values[0]
+	for _, v := range values[1:] {
+		if v < m {
+			m = v
+		}
+	}
+	return m
+}
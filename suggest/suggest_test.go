@@ -0,0 +1,50 @@
+package suggest
+
+import "testing"
+
+func TestDistance(t *testing.T) {
+	tests := []struct {
+		a, b     string
+		expected int
+	}{
+		{"", "", 0},
+		{"push", "push", 0},
+		{"psuh", "push", 1},
+		{"pus", "push", 1},
+		{"pushh", "push", 1},
+		{"posh", "push", 1},
+		{"", "len", 3},
+		{"kitten", "sitting", 3},
+		{"名字", "名子", 1},
+	}
+
+	for _, tt := range tests {
+		if got := Distance(tt.a, tt.b); got != tt.expected {
+			t.Errorf("Distance(%q, %q) = %d, want %d", tt.a, tt.b, got, tt.expected)
+		}
+	}
+}
+
+func TestClosest(t *testing.T) {
+	tests := []struct {
+		name       string
+		candidates []string
+		expected   string
+	}{
+		{"psuh", []string{"len", "push", "puts"}, "push"},
+		{"lenght", []string{"len", "length"}, "length"},
+		{"x", []string{"y", "z"}, ""},
+		{"ab", []string{"a", "abc"}, "a"},
+		{"counter", []string{"counts", "count"}, "counts"},
+		{"foo", []string{"bar", "baz"}, ""},
+		{"len", []string{"len"}, ""},
+		{"valeu", []string{"value", "valve"}, "value"},
+	}
+
+	for _, tt := range tests {
+		got, ok := Closest(tt.name, tt.candidates)
+		if got != tt.expected || ok != (tt.expected != "") {
+			t.Errorf("Closest(%q) = %q, %v, want %q", tt.name, got, ok, tt.expected)
+		}
+	}
+}
@@ -1,10 +1,37 @@
 package token
 
+import "fmt"
+
 type TokenType string
 
 type Token struct {
 	Type    TokenType
 	Literal string
+	Pos     Position // token 第一个字符的位置
+	End     Position // token 之后第一个字符的位置
+}
+
+// 源码位置, 行和列从 1 开始, 列按字节计算
+type Position struct {
+	Offset int `json:"offset"`
+	Line   int `json:"line"`
+	Column int `json:"column"`
+}
+
+// 手动构造的节点没有位置信息
+func (p Position) IsValid() bool {
+	return p.Line > 0
+}
+
+func (p Position) String() string {
+	return fmt.Sprintf("%d:%d", p.Line, p.Column)
+}
+
+// `//` 注释, Text 包含开头的 //, 不含换行符
+type Comment struct {
+	Text string
+	Pos  Position
+	End  Position
 }
 
 // enum
@@ -32,6 +59,11 @@ const (
 	NOT_EQ   = "!="
 	AND      = "&&"
 	OR       = "||"
+	// 复合赋值
+	PLUS_ASSIGN     = "+="
+	MINUS_ASSIGN    = "-="
+	ASTERISK_ASSIGN = "*="
+	SLASH_ASSIGN    = "/="
 	// 分隔符
 	COMMA     = ","
 	SEMICOLON = ";"
@@ -56,6 +88,7 @@ const (
 	FOR      = "FOR"
 	CLASS    = "CLASS"
 	THIS     = "THIS"
+	CONST    = "CONST"
 )
 
 var keywords = map[string]TokenType{
@@ -71,6 +104,7 @@ var keywords = map[string]TokenType{
 	"for":    FOR,
 	"class":  CLASS,
 	"this":   THIS,
+	"const":  CONST,
 }
 
 func NewToken(tokenType TokenType, ch byte) Token {
@@ -0,0 +1,136 @@
+package vm
+
+import (
+	"fmt"
+	"monkey/token"
+	"strings"
+)
+
+// 运行时错误, Pos 是出错指令对应的源码位置; 字节码没有位置表时 Pos 无效.
+// Frames 是出错时的调用栈, 最外层的主程序在前; 尾调用复用了调用者的 Frame, 调用者不会出现在调用栈中
+type RuntimeError struct {
+	Pos     token.Position
+	Message string
+	Frames  []TraceFrame
+}
+
+// 调用栈中的一层
+type TraceFrame struct {
+	Function string         // 函数名, 主程序为 <main>, 匿名函数为 <anonymous>
+	File     string         // 源文件名, 字节码没有调试信息时为空
+	Pos      token.Position // 正在执行的指令的位置, 调用者停在调用处
+}
+
+func (f TraceFrame) String() string {
+	location := f.File
+	if f.Pos.IsValid() {
+		if location != "" {
+			location += ":"
+		}
+		location += f.Pos.String()
+	}
+	if location == "" {
+		return f.Function
+	}
+	return fmt.Sprintf("%s (%s)", f.Function, location)
+}
+
+// 只包含错误信息, 与求值器的错误相同; 带位置的输出见 Report
+func (e *RuntimeError) Error() string {
+	return e.Message
+}
+
+// file:line:column: message, 之后是出错的源码行和指向出错位置的 ^, source 为空时没有源码行;
+// 在函数中出错时最后是调用栈
+func (e *RuntimeError) Report(file, source string) string {
+	if !e.Pos.IsValid() {
+		return fmt.Sprintf("%s: %s", file, e.Message) + e.traceback(file)
+	}
+	report := fmt.Sprintf("%s:%s: %s", file, e.Pos, e.Message)
+
+	lines := strings.Split(strings.ReplaceAll(source, "\r\n", "\n"), "\n")
+	if source != "" && e.Pos.Line <= len(lines) {
+		line := lines[e.Pos.Line-1]
+		report += "\n\t" + line + "\n\t" + caretIndent(line, e.Pos.Column) + "^"
+	}
+	return report + e.traceback(file)
+}
+
+// 只有主程序一层时不输出; 没有文件名的层使用 file, 连续相同的层 (递归) 只输出一次
+func (e *RuntimeError) traceback(file string) string {
+	if len(e.Frames) < 2 {
+		return ""
+	}
+	var out strings.Builder
+	out.WriteString("\ntraceback (most recent call last):")
+	previous, repeated := "", 0
+	flush := func() {
+		if repeated > 0 {
+			fmt.Fprintf(&out, "\n  ... repeated %d more times", repeated)
+		}
+	}
+	for _, frame := range e.Frames {
+		if frame.File == "" {
+			frame.File = file
+		}
+		line := frame.String()
+		if line == previous {
+			repeated++
+			continue
+		}
+		flush()
+		out.WriteString("\n  " + line)
+		previous, repeated = line, 0
+	}
+	flush()
+	return out.String()
+}
+
+// ^ 之前的空白: 制表符保留, 其他字符按字符换成空格, 这样 ^ 和源码行对齐
+func caretIndent(line string, column int) string {
+	if column-1 < len(line) {
+		line = line[:column-1]
+	}
+	var indent strings.Builder
+	for _, ch := range line {
+		if ch == '\t' {
+			indent.WriteRune('\t')
+		} else {
+			indent.WriteRune(' ')
+		}
+	}
+	return indent.String()
+}
+
+// 记录调用栈, 错误的位置是当前 Frame 正在执行的指令的位置
+func (vm *VM) runtimeError(err error) *RuntimeError {
+	runtimeErr := &RuntimeError{Message: err.Error()}
+	for _, frame := range vm.frames[:vm.frameIndex] {
+		runtimeErr.Frames = append(runtimeErr.Frames, TraceFrame{
+			Function: frameName(frame, frame == vm.frames[0]),
+			File:     vm.file,
+			Pos:      frame.position(),
+		})
+	}
+	runtimeErr.Pos = runtimeErr.Frames[len(runtimeErr.Frames)-1].Pos
+	return runtimeErr
+}
+
+func frameName(frame *Frame, main bool) string {
+	switch {
+	case main:
+		return "<main>"
+	case frame.closureFn.Fn.Name == "":
+		return "<anonymous>"
+	default:
+		return frame.closureFn.Fn.Name
+	}
+}
+
+func (f *Frame) position() token.Position {
+	entry, ok := f.closureFn.Fn.Lines.Lookup(f.ip)
+	if !ok {
+		return token.Position{}
+	}
+	return token.Position{Line: entry.Line, Column: entry.Column}
+}
@@ -0,0 +1,122 @@
+package vm
+
+import (
+	"monkey/compiler"
+	"monkey/token"
+	"reflect"
+	"testing"
+)
+
+func TestRuntimeErrorPosition(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected token.Position
+	}{
+		{"let x = 1;\nx + true;", token.Position{Line: 2, Column: 3}},
+		{"let add = fn(a, b) {\n  a + b\n};\nadd(1, \"two\")", token.Position{Line: 2, Column: 5}},
+		{"let f = fn(a) { a };\nf(1, 2)", token.Position{Line: 2, Column: 2}},
+		{"let a = [1];\nlet f = fn() { -a };\nf()", token.Position{Line: 2, Column: 16}},
+		{"class Foo { let init = fn() { this.x = 1 + \"a\"; } }\nFoo()", token.Position{Line: 1, Column: 42}},
+	}
+
+	for _, level := range optimizationLevels {
+		for _, tt := range tests {
+			comp := compiler.New()
+			comp.SetOptimizationLevel(level)
+			if err := comp.Compile(parse(tt.input)); err != nil {
+				t.Fatalf("compiler error: %s", err)
+			}
+			err := New(comp.ByteCode()).Run()
+			runtimeErr, ok := err.(*RuntimeError)
+			if !ok {
+				t.Fatalf("expected *RuntimeError for %q, got %T (%v)", tt.input, err, err)
+			}
+			if runtimeErr.Pos != tt.expected {
+				t.Errorf("wrong position for %q at level %d. want=%s, got=%s",
+					tt.input, level, tt.expected, runtimeErr.Pos)
+			}
+		}
+	}
+}
+
+func TestRuntimeErrorFrames(t *testing.T) {
+	input := `let add = fn(a, b) { a + b };
+let twice = fn(x) { let r = add(x, "two"); r };
+let apply = fn(f) { f(1) };
+apply(fn(x) { let r = twice(x); r })`
+
+	// apply 中的 f(1) 是尾调用, apply 的 Frame 被复用, 不在调用栈中
+	expected := []TraceFrame{
+		{Function: "<main>", File: "twice.mon", Pos: token.Position{Line: 4, Column: 6}},
+		{Function: "<anonymous>", File: "twice.mon", Pos: token.Position{Line: 4, Column: 28}},
+		{Function: "twice", File: "twice.mon", Pos: token.Position{Line: 2, Column: 32}},
+		{Function: "add", File: "twice.mon", Pos: token.Position{Line: 1, Column: 24}},
+	}
+
+	for _, level := range optimizationLevels {
+		comp := compiler.New()
+		comp.SetOptimizationLevel(level)
+		if err := comp.Compile(parse(input)); err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+		byteCode := comp.ByteCode()
+		byteCode.Debug = &compiler.DebugInfo{Source: "twice.mon"}
+
+		err := New(byteCode).Run()
+		runtimeErr, ok := err.(*RuntimeError)
+		if !ok {
+			t.Fatalf("expected *RuntimeError, got %T (%v)", err, err)
+		}
+		if !reflect.DeepEqual(runtimeErr.Frames, expected) {
+			t.Errorf("wrong frames at level %d.\nwant=%v\ngot= %v", level, expected, runtimeErr.Frames)
+		}
+		if runtimeErr.Pos != expected[len(expected)-1].Pos {
+			t.Errorf("error position is not the innermost frame: %s", runtimeErr.Pos)
+		}
+	}
+}
+
+func TestRuntimeErrorTraceback(t *testing.T) {
+	err := &RuntimeError{
+		Pos:     token.Position{Line: 1, Column: 33},
+		Message: "type mismatch: INTEGER + BOOLEAN",
+		Frames: []TraceFrame{
+			{Function: "<main>", Pos: token.Position{Line: 2, Column: 2}},
+			{Function: "f", Pos: token.Position{Line: 1, Column: 58}},
+			{Function: "f", Pos: token.Position{Line: 1, Column: 58}},
+			{Function: "f", Pos: token.Position{Line: 1, Column: 58}},
+			{Function: "f", Pos: token.Position{Line: 1, Column: 33}},
+		},
+	}
+
+	expected := "f.mon:1:33: type mismatch: INTEGER + BOOLEAN\n" +
+		"traceback (most recent call last):\n" +
+		"  <main> (f.mon:2:2)\n" +
+		"  f (f.mon:1:58)\n" +
+		"  ... repeated 2 more times\n" +
+		"  f (f.mon:1:33)"
+	if got := err.Report("f.mon", ""); got != expected {
+		t.Errorf("wrong report.\nwant=%q\ngot= %q", expected, got)
+	}
+}
+
+func TestRuntimeErrorReport(t *testing.T) {
+	err := &RuntimeError{Pos: token.Position{Line: 2, Column: 11}, Message: "type mismatch: INTEGER + STRING"}
+	source := "let add = fn(a, b) {\r\n\treturn a + b;\r\n};"
+
+	expected := "add.mon:2:11: type mismatch: INTEGER + STRING\n\t\treturn a + b;\n\t\t         ^"
+	if got := err.Report("add.mon", source); got != expected {
+		t.Errorf("wrong report.\nwant=%q\ngot= %q", expected, got)
+	}
+
+	expected = "add.mon:2:11: type mismatch: INTEGER + STRING"
+	if got := err.Report("add.mon", ""); got != expected {
+		t.Errorf("wrong report without source.\nwant=%q\ngot= %q", expected, got)
+	}
+
+	err.Pos = token.Position{}
+	expected = "add.mon: type mismatch: INTEGER + STRING"
+	if got := err.Report("add.mon", source); got != expected {
+		t.Errorf("wrong report without position.\nwant=%q\ngot= %q", expected, got)
+	}
+}
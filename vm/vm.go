@@ -27,6 +27,7 @@ type VM struct {
 	globals    []object.Object
 	frames     []*Frame
 	frameIndex int
+	file       string // 源文件名, 用于运行时错误
 }
 
 // stack frame 函数调用栈
@@ -58,13 +59,18 @@ func (vm *VM) popFrame() *Frame {
 
 // create VM
 func New(byteCode *compiler.ByteCode) *VM {
-	mainFn := &object.CompiledFunction{Instructions: byteCode.Instruction}
+	mainFn := &object.CompiledFunction{Instructions: byteCode.Instruction, Lines: byteCode.Lines}
 	mainClosure := &object.Closure{Fn: mainFn}
 	mainFrame := NewFrame(mainClosure, 0)
 
 	frames := make([]*Frame, MaxFrames)
 	frames[0] = mainFrame
 
+	file := ""
+	if byteCode.Debug != nil {
+		file = byteCode.Debug.Source
+	}
+
 	return &VM{
 		// instructions: byteCode.Instruction,
 		constants:  byteCode.Constants,
@@ -73,6 +79,7 @@ func New(byteCode *compiler.ByteCode) *VM {
 		globals:    make([]object.Object, GlobalSize),
 		frames:     frames,
 		frameIndex: 1,
+		file:       file,
 	}
 }
 
@@ -94,16 +101,21 @@ func (vm *VM) LastPoppedStackElem() object.Object {
 	return vm.stack[vm.sp]
 }
 
-// 取指->解码->循环执行
+// 取指->解码->循环执行; 出错时返回 *RuntimeError
 func (vm *VM) Run() error {
+	if err := vm.run(0); err != nil {
+		return vm.runtimeError(err)
+	}
+	return nil
+}
+
+// 执行到调用栈深度回到 depth 为止; 主程序 depth 为 0, 执行到指令末尾结束
+func (vm *VM) run(depth int) error {
 	var ip int
 	var ins code.Instruction
 	var op code.Opcode
-	// length := len(ins)
 
-	// for ip := 0; ip < length; ip++ {
-	currentFrameLen := len(vm.currentFrame().Instructions()) - 1
-	for vm.currentFrame().ip < currentFrameLen {
+	for vm.frameIndex > depth && vm.currentFrame().ip < len(vm.currentFrame().Instructions())-1 {
 		vm.currentFrame().ip += 1
 
 		ip = vm.currentFrame().ip
@@ -142,7 +154,8 @@ func (vm *VM) Run() error {
 			if err != nil {
 				return err
 			}
-		case code.OpEqual, code.OpNotEqual, code.OpGreaterThan, code.OpLessThan:
+		case code.OpEqual, code.OpNotEqual, code.OpGreaterThan, code.OpLessThan,
+			code.OpGreaterEqual, code.OpLessEqual:
 			err := vm.executeComparison(op)
 			if err != nil {
 				return err
@@ -202,28 +215,14 @@ func (vm *VM) Run() error {
 			if set_type == code.SetTypeVar {
 				vm.globals[globalIndex] = vm.pop()
 			}
-
-			if set_type == code.SetTypeArray {
-				set_value := vm.pop()
-				index_obj := vm.pop()
-
-				switch index_obj.Type() {
-				case object.ARRAY_OBJ:
-					index := index_obj.(*object.Integer).Value
-					err := vm.setArrayIndex(globalIndex, index, set_value)
-					if err != nil {
-						return err
-					}
-				}
-			}
-		// case code.OpDefineClass:
-		// 	globalIndex := code.ReadUnit16(ins[ip+1:])
-		// 	vm.currentFrame().ip += 2
-		// 	vm.globals[globalIndex] = vm.peek(-1)
 		case code.OpGetGlobal:
 			globalIndex := code.ReadUnit16(ins[ip+1:])
 			vm.currentFrame().ip += 2
-			err := vm.push(vm.globals[globalIndex])
+			value := vm.globals[globalIndex]
+			if value == nil {
+				return fmt.Errorf("global %d read before assignment", globalIndex)
+			}
+			err := vm.push(value)
 			if err != nil {
 				return err
 			}
@@ -261,6 +260,61 @@ func (vm *VM) Run() error {
 			if err != nil {
 				return err
 			}
+		case code.OpSetIndex:
+			value := vm.pop()
+			index := vm.pop()
+			left := vm.pop()
+
+			if err := object.SetIndex(left, index, value); err != nil {
+				return err
+			}
+		case code.OpSlice:
+			step := vm.pop()
+			end := vm.pop()
+			start := vm.pop()
+			left := vm.pop()
+
+			result, sliceErr := object.Slice(left, start, end, step)
+			if sliceErr != nil {
+				return sliceErr
+			}
+			err := vm.push(result)
+			if err != nil {
+				return err
+			}
+		case code.OpGetProperty:
+			nameIndex := code.ReadUnit16(ins[ip+1:])
+			vm.currentFrame().ip += 2
+
+			name := vm.constants[nameIndex].(*object.String).Value
+			value, getErr := object.GetProperty(vm.pop(), name)
+			if getErr != nil {
+				return getErr
+			}
+			err := vm.push(value)
+			if err != nil {
+				return err
+			}
+		case code.OpSetProperty:
+			nameIndex := code.ReadUnit16(ins[ip+1:])
+			vm.currentFrame().ip += 2
+
+			name := vm.constants[nameIndex].(*object.String).Value
+			value := vm.pop()
+			obj := vm.pop()
+			if err := object.SetProperty(obj, name, value); err != nil {
+				return err
+			}
+		case code.OpClass:
+			nameIndex := code.ReadUnit16(ins[ip+1:])
+			vm.currentFrame().ip += 2
+
+			name := vm.constants[nameIndex].(*object.String).Value
+			class := &object.Class{Name: name, Body: vm.pop()}
+			err := vm.push(class)
+			if err != nil {
+				return err
+			}
 		case code.OpCall:
 			numArgs := code.ReadUnit8(ins[ip+1:])
 			vm.currentFrame().ip += 1
@@ -271,8 +325,21 @@ func (vm *VM) Run() error {
 			}
 			// fn, ok := vm.stack[vm.sp-1].(*object.CompiledFunction)
 
+		case code.OpTailCall:
+			numArgs := code.ReadUnit8(ins[ip+1:])
+			vm.currentFrame().ip += 1
+
+			err := vm.executeTailCall(numArgs)
+			if err != nil {
+				return err
+			}
+
 		case code.OpReturnValue:
 			returnValue := vm.pop()
+			if vm.frameIndex == 1 {
+				// 主程序中的 return 结束执行, 返回值留在最后弹出的位置
+				return nil
+			}
 			frame := vm.popFrame() //* 回到mainFn
 			vm.sp = frame.basePointer - 1
 
@@ -281,6 +348,10 @@ func (vm *VM) Run() error {
 				return err
 			}
 		case code.OpReturn:
+			if vm.frameIndex == 1 {
+				vm.stack[vm.sp] = Null
+				return nil
+			}
 			frame := vm.popFrame()
 			vm.sp = frame.basePointer - 1
 			// _ = vm.pop() //pop object.CompiledFn
@@ -300,7 +371,20 @@ func (vm *VM) Run() error {
 			vm.currentFrame().ip += 1
 
 			frame := vm.currentFrame()
-			err := vm.push(vm.stack[frame.basePointer+uint(localIndex)])
+			value := vm.stack[frame.basePointer+uint(localIndex)]
+			if value == nil {
+				return fmt.Errorf("local %d read before assignment", localIndex)
+			}
+			err := vm.push(value)
+			if err != nil {
+				return err
+			}
+		case code.OpAddLocalConstant:
+			localIndex := code.ReadUnit8(ins[ip+1:])
+			constIndex := code.ReadUnit16(ins[ip+2:])
+			vm.currentFrame().ip += 3
+
+			err := vm.executeAddLocalConstant(localIndex, constIndex)
 			if err != nil {
 				return err
 			}
@@ -327,10 +411,20 @@ func (vm *VM) Run() error {
 			vm.currentFrame().ip += 1
 
 			currentClosure := vm.currentFrame().closureFn
-			err := vm.push(currentClosure.FreeVar[freeIndex])
+			value := currentClosure.FreeVar[freeIndex]
+			if value == nil {
+				return fmt.Errorf("free variable %d read before assignment", freeIndex)
+			}
+			err := vm.push(value)
 			if err != nil {
 				return err
 			}
+		case code.OpSetFreeVar:
+			freeIndex := code.ReadUnit8(ins[ip+1:])
+			vm.currentFrame().ip += 1
+
+			currentClosure := vm.currentFrame().closureFn
+			currentClosure.FreeVar[freeIndex] = vm.pop()
 		case code.OpCurrnetClosure:
 			currentClosure := vm.currentFrame().closureFn
 			err := vm.push(currentClosure)
@@ -341,25 +435,37 @@ func (vm *VM) Run() error {
 		case code.OpLoop:
 			pos := int(code.ReadUnit16(ins[ip+1:]))
 			vm.currentFrame().ip = pos - 1
+		case code.OpDup:
+			n := uint(code.ReadUnit8(ins[ip+1:]))
+			vm.currentFrame().ip += 1
 
-			// case code.OpClass:
-			// 	class := &object.Class{}
-			// 	vm.push(class)
-			// 	vm.currentFrame().ip += 1
-			// case code.OpMethod:
-			// 	pos := code.ReadUnit16(ins[ip+1:])
-			// 	freeVars := code.ReadUnit16(ins[ip+3:])
-			// 	vm.currentFrame().ip += 3
-			// 	value := vm.peek(-1)
-			// 	class, ok := value.(*object.Class)
-			// 	if !ok {
-			// 		return fmt.Errorf("not a class!->%s", class.Name)
-			// 	}
-			// 	vm.pushClosure(pos, uint16(freeVars))
-			// 	class.Methods[class.Name] = vm.peek(-1)
-			// 	vm.pop()
+			for _, value := range vm.stack[vm.sp-n : vm.sp] {
+				err := vm.push(value)
+				if err != nil {
+					return err
+				}
+			}
+		case code.OpCell:
+			err := vm.push(&object.Cell{Value: vm.pop()})
+			if err != nil {
+				return err
+			}
+		case code.OpGetCell:
+			cell, ok := vm.pop().(*object.Cell)
+			if !ok {
+				return fmt.Errorf("not a cell")
+			}
+			err := vm.push(cell.Value)
+			if err != nil {
+				return err
+			}
+		case code.OpSetCell:
+			cell, ok := vm.pop().(*object.Cell)
+			if !ok {
+				return fmt.Errorf("not a cell")
+			}
+			cell.Value = vm.pop()
 		} //switch end
-		currentFrameLen = len(vm.currentFrame().Instructions()) - 1
 	}
 	return nil
 }
@@ -375,7 +481,6 @@ func (vm *VM) push(obj object.Object) error {
 
 func (vm *VM) pop() object.Object {
 	obj := vm.stack[vm.sp-1]
-	fmt.Println("vm.pop() -> vm.sp: ", obj)
 	vm.sp -= 1
 	return obj
 }
@@ -398,7 +503,26 @@ func (vm *VM) executeBinaryOperation(op code.Opcode) error {
 		return vm.executeBinaryStringOperation(op, left, right)
 	}
 
-	return fmt.Errorf("unsupported types for binary operation: %q %q", leftType, rightType)
+	return binaryOperationError(op, left, right)
+}
+
+var operatorSymbols = map[code.Opcode]string{
+	code.OpAdd:          "+",
+	code.OpSub:          "-",
+	code.OpMul:          "*",
+	code.OpDiv:          "/",
+	code.OpLessThan:     "<",
+	code.OpGreaterThan:  ">",
+	code.OpLessEqual:    "<=",
+	code.OpGreaterEqual: ">=",
+}
+
+// 与解释器的错误信息一致
+func binaryOperationError(op code.Opcode, left, right object.Object) error {
+	if left.Type() != right.Type() {
+		return fmt.Errorf("type mismatch: %s %s %s", left.Type(), operatorSymbols[op], right.Type())
+	}
+	return fmt.Errorf("unknown operator: %s %s %s", left.Type(), operatorSymbols[op], right.Type())
 }
 
 func (vm *VM) executeBinaryIntegerOperation(op code.Opcode, left, right object.Object) error {
@@ -424,7 +548,7 @@ func (vm *VM) executeBinaryIntegerOperation(op code.Opcode, left, right object.O
 
 func (vm *VM) executeBinaryStringOperation(op code.Opcode, left, right object.Object) error {
 	if op != code.OpAdd {
-		return fmt.Errorf("unknown string operation: %d", op)
+		return binaryOperationError(op, left, right)
 	}
 
 	leftValue := left.(*object.String).Value
@@ -442,9 +566,18 @@ func (vm *VM) executeComparison(op code.Opcode) error {
 
 	switch op {
 	case code.OpEqual:
-		return vm.push(nativeBoolToBoolObject(right == left))
+		return vm.push(nativeBoolToBoolObject(object.Equal(left, right)))
 	case code.OpNotEqual:
-		return vm.push(nativeBoolToBoolObject(right != left))
+		return vm.push(nativeBoolToBoolObject(!object.Equal(left, right)))
+	case code.OpGreaterThan, code.OpLessThan, code.OpGreaterEqual, code.OpLessEqual:
+		if left.Type() != right.Type() || left.Type() != object.STRING && left.Type() != object.ARRAY_OBJ {
+			return binaryOperationError(op, left, right)
+		}
+		result, err := object.Compare(left, right)
+		if err != nil {
+			return err
+		}
+		return vm.push(nativeBoolToBoolObject(compareResult(op, result)))
 	default:
 		return fmt.Errorf("unknown operator: %d (%s %s)",
 			op, left.Type(), right.Type())
@@ -466,11 +599,53 @@ func (vm *VM) executeIntegerComparison(
 		return vm.push(nativeBoolToBoolObject(leftValue > rightValue))
 	case code.OpLessThan:
 		return vm.push(nativeBoolToBoolObject(leftValue < rightValue))
+	case code.OpGreaterEqual:
+		return vm.push(nativeBoolToBoolObject(leftValue >= rightValue))
+	case code.OpLessEqual:
+		return vm.push(nativeBoolToBoolObject(leftValue <= rightValue))
 	default:
 		return fmt.Errorf("unknown operator: %d", op)
 	}
 }
 
+// object.Compare 的结果 (-1, 0, 1) 转换为比较运算的结果
+func compareResult(op code.Opcode, result int) bool {
+	switch op {
+	case code.OpGreaterThan:
+		return result > 0
+	case code.OpLessThan:
+		return result < 0
+	case code.OpGreaterEqual:
+		return result >= 0
+	default:
+		return result <= 0
+	}
+}
+
+// local + constant, 整数相加时不经过栈
+func (vm *VM) executeAddLocalConstant(localIndex uint8, constIndex uint16) error {
+	left := vm.stack[vm.currentFrame().basePointer+uint(localIndex)]
+	right := vm.constants[constIndex]
+	if left == nil {
+		return fmt.Errorf("local %d read before assignment", localIndex)
+	}
+
+	leftInt, ok := left.(*object.Integer)
+	if rightInt, isInt := right.(*object.Integer); ok && isInt {
+		return vm.push(&object.Integer{Value: leftInt.Value + rightInt.Value})
+	}
+
+	err := vm.push(left)
+	if err != nil {
+		return err
+	}
+	err = vm.push(right)
+	if err != nil {
+		return err
+	}
+	return vm.executeBinaryOperation(code.OpAdd)
+}
+
 func nativeBoolToBoolObject(input bool) *object.Boolean {
 	if input {
 		return True
@@ -497,7 +672,7 @@ func (vm *VM) executeMinusOperator() error {
 	operand := vm.pop()
 
 	if operand.Type() != object.INTEGER_OBJ {
-		return fmt.Errorf("unsupported type of negation: %s", operand.Type())
+		return fmt.Errorf("unknown operator: -%s", operand.Type())
 	}
 	value := operand.(*object.Integer).Value
 	return vm.push(&object.Integer{Value: -value})
@@ -547,6 +722,8 @@ func (vm *VM) buildHash(startIndex, endIndex uint) (object.Object, error) {
 func (vm *VM) executeIndexExpression(left, index object.Object) error {
 	if left.Type() == object.ARRAY_OBJ && index.Type() == object.INTEGER_OBJ {
 		return vm.executeArrayIndex(left, index)
+	} else if left.Type() == object.STRING && index.Type() == object.INTEGER_OBJ {
+		return vm.executeStringIndex(left, index)
 	} else if left.Type() == object.HASH_OBJ {
 		return vm.executeHashIndex(left, index)
 	} else {
@@ -556,16 +733,27 @@ func (vm *VM) executeIndexExpression(left, index object.Object) error {
 
 func (vm *VM) executeArrayIndex(left, index object.Object) error {
 	array := left.(*object.Array)
-	idx := index.(*object.Integer).Value
 
-	maxLen := int64(len(array.ELements) - 1)
-	if idx < 0 || idx > maxLen {
+	idx, ok := object.NormalizeIndex(index.(*object.Integer).Value, len(array.ELements))
+	if !ok {
 		return vm.push(Null)
 	}
 
 	return vm.push(array.ELements[idx])
 }
 
+// 字符串下标返回单个字符组成的字符串
+func (vm *VM) executeStringIndex(left, index object.Object) error {
+	str := left.(*object.String).Value
+
+	idx, ok := object.NormalizeIndex(index.(*object.Integer).Value, len(str))
+	if !ok {
+		return vm.push(Null)
+	}
+
+	return vm.push(&object.String{Value: str[idx : idx+1]})
+}
+
 func (vm *VM) executeHashIndex(left, index object.Object) error {
 	hash := left.(*object.Hash)
 	key, ok := index.(object.HashAble)
@@ -582,37 +770,6 @@ func (vm *VM) executeHashIndex(left, index object.Object) error {
 	return vm.push(pair.Value)
 }
 
-func (vm *VM) setArrayIndex(global_index uint16, index int64, set_value object.Object) error {
-	array := vm.globals[global_index].(*object.Array)
-	length := len(array.ELements)
-	maxLen := int64(length - 1)
-	if index < 0 || index > maxLen {
-		return fmt.Errorf("index out of range[%d] with %d", 0xffffffff, index)
-	}
-
-	newElements := make([]object.Object, length)
-	copy(newElements, array.ELements)
-
-	newElements[uint16(index)] = set_value
-	vm.globals[global_index] = &object.Array{ELements: newElements}
-
-	return nil
-}
-
-func (vm *VM) setHashIndex(left, key, new_value object.Object, index uint16) error {
-	hash := left.(*object.Hash)
-	key_, ok := key.(object.HashAble)
-
-	if !ok {
-		return fmt.Errorf("unusable as hash key: %s", key.Type())
-	}
-
-	hash.Pairs[key_.HashKey()] = object.HashPair{Key: key, Value: new_value}
-	vm.globals[index] = hash
-
-	return nil
-}
-
 func (vm *VM) executeCall(numArgs uint8) error {
 	callFn := vm.stack[vm.sp-uint(numArgs)-1]
 	switch callType := callFn.(type) {
@@ -620,9 +777,31 @@ func (vm *VM) executeCall(numArgs uint8) error {
 		return vm.callFunction(callType, numArgs)
 	case *object.Builtin:
 		return vm.Builtin(callType, numArgs)
+	case *object.Class:
+		return vm.instantiate(callType, numArgs)
 	default:
-		return fmt.Errorf("calling non-closure-function and non-built-in")
+		return fmt.Errorf("not a function: %s", callFn.Type())
+	}
+}
+
+// 尾调用: 调用闭包时复用当前的 Frame, 被调用的闭包和参数覆盖当前函数的位置, 调用栈不会增长;
+// 调用内置函数和类时与普通调用相同, 由之后的 OpReturnValue 返回
+func (vm *VM) executeTailCall(numArgs uint8) error {
+	callee, ok := vm.stack[vm.sp-uint(numArgs)-1].(*object.Closure)
+	if !ok {
+		return vm.executeCall(numArgs)
+	}
+	if callee.Fn.NumParameters != int(numArgs) {
+		return fmt.Errorf("wrong number of arguments.want=%d, got=%d",
+			callee.Fn.NumParameters, numArgs)
 	}
+
+	frame := vm.currentFrame()
+	copy(vm.stack[frame.basePointer-1:], vm.stack[vm.sp-uint(numArgs)-1:vm.sp])
+	frame.closureFn = callee
+	frame.ip = -1
+	vm.sp = frame.basePointer + uint(callee.Fn.NumLocals)
+	return nil
 }
 
 func (vm *VM) callFunction(clFn *object.Closure, numArgs uint8) error {
@@ -643,7 +822,7 @@ func (vm *VM) Builtin(builtin *object.Builtin, numArgs uint8) error {
 	arguments := vm.stack[vm.sp-uint(numArgs) : vm.sp]
 	result := builtin.Fn(arguments...)
 
-	vm.sp = vm.sp - uint(numArgs)
+	vm.sp = vm.sp - uint(numArgs) - 1 // 参数和内置函数本身
 
 	if result != nil {
 		vm.push(result)
@@ -667,7 +846,61 @@ func (vm *VM) pushClosure(constantIdx uint16, numFree uint16) error {
 	for i = 0; i < uint(numFree); i++ {
 		free[i] = vm.stack[vm.sp-uint(numFree)+i]
 	}
+	vm.sp = vm.sp - uint(numFree)
 
 	closure := &object.Closure{Fn: fn, FreeVar: free}
 	return vm.push(closure)
 }
+
+// 同步调用函数并返回结果, 用于在虚拟机内部调用 Monkey 函数
+func (vm *VM) callSync(fn object.Object, args []object.Object) (object.Object, error) {
+	depth := vm.frameIndex
+
+	err := vm.push(fn)
+	if err != nil {
+		return nil, err
+	}
+	for _, arg := range args {
+		err = vm.push(arg)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = vm.executeCall(uint8(len(args)))
+	if err != nil {
+		return nil, err
+	}
+	if vm.frameIndex > depth {
+		err = vm.run(depth)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return vm.pop(), nil
+}
+
+// Foo(args): 创建实例, 以实例为 this 执行类体, 再调用 init
+func (vm *VM) instantiate(class *object.Class, numArgs uint8) error {
+	args := make([]object.Object, numArgs)
+	copy(args, vm.stack[vm.sp-uint(numArgs):vm.sp])
+	vm.sp = vm.sp - uint(numArgs) - 1
+
+	instance := object.NewInstance(class)
+	_, err := vm.callSync(class.Body, []object.Object{instance})
+	if err != nil {
+		return err
+	}
+
+	if init, ok := instance.Fields["init"]; ok {
+		_, err := vm.callSync(init, args)
+		if err != nil {
+			return err
+		}
+	} else if numArgs > 0 {
+		return fmt.Errorf("wrong number of arguments.want=0, got=%d", numArgs)
+	}
+
+	return vm.push(instance)
+}
@@ -0,0 +1,59 @@
+package vm
+
+import (
+	"fmt"
+	"monkey/compiler"
+	"strings"
+	"testing"
+)
+
+// 循环体主要是 <=、>= 比较和局部变量加常量, 即融合比较指令和 OpAddLocalConstant 覆盖的指令
+const benchmarkInput = `
+let count = fn(n) {
+	let i = 0;
+	let hits = 0;
+	while (i <= n) {
+		if (i >= 0) { hits = hits + 1; }
+		i = i + 1;
+	}
+	hits
+};
+count(200000);
+`
+
+// go test ./vm -bench Optimization -benchmem
+func BenchmarkOptimization(b *testing.B) {
+	for _, level := range optimizationLevels {
+		b.Run(fmt.Sprintf("level-%d", level), func(b *testing.B) {
+			benchmarkProgram(b, benchmarkInput, level)
+		})
+	}
+}
+
+// 融合的 <=、>= 与之前编译出的 OpGreaterThan; OpBang 形式对比, 两者在所有优化级别下都一样
+func BenchmarkFusedComparison(b *testing.B) {
+	unfused := strings.NewReplacer("i <= n", "!(i > n)", "i >= 0", "!(i < 0)").Replace(benchmarkInput)
+	b.Run("fused", func(b *testing.B) {
+		benchmarkProgram(b, benchmarkInput, compiler.OptimizeNone)
+	})
+	b.Run("unfused", func(b *testing.B) {
+		benchmarkProgram(b, unfused, compiler.OptimizeNone)
+	})
+}
+
+func benchmarkProgram(b *testing.B, input string, level compiler.OptimizationLevel) {
+	comp := compiler.New()
+	comp.SetOptimizationLevel(level)
+	if err := comp.Compile(parse(input)); err != nil {
+		b.Fatalf("compiler error: %s", err)
+	}
+	byteCode := comp.ByteCode()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		machine := New(byteCode)
+		if err := machine.Run(); err != nil {
+			b.Fatalf("vm run failed: %s", err)
+		}
+	}
+}
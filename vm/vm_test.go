@@ -3,6 +3,7 @@ package vm
 import (
 	"fmt"
 	"monkey/ast"
+	"monkey/code"
 	"monkey/compiler"
 	"monkey/lexer"
 	"monkey/object"
@@ -101,6 +102,63 @@ func TestBooleanExpressions(t *testing.T) {
 	runVmTest(t, tests)
 }
 
+func TestStructuralComparison(t *testing.T) {
+	tests := []vmTestCase{
+		{`"a" + "b" == "ab"`, true},
+		{`let s = "a"; s += "b"; s != "ab"`, false},
+		{"[1, [2, 3]] == [1, [2, 3]]", true},
+		{"[1, 2] == [1, 2, 3]", false},
+		{"[1, 2] != [2, 1]", true},
+		{`{"a": [1], "b": 2} == {"b": 2, "a": [1]}`, true},
+		{`{"a": 1} == {"a": 2}`, false},
+		{`{"a": 1} == {"b": 1}`, false},
+		{`[1] == "1"`, false},
+		{"let f = fn() {}; f == f", true},
+		{`"abc" < "abd"`, true},
+		{`"b" > "abc"`, true},
+		{`"ab" <= "ab"`, true},
+		{`"" >= "a"`, false},
+		{"[1, 2] < [1, 3]", true},
+		{"[1, 2] < [1, 2, 0]", true},
+		{"[2] > [1, 9]", true},
+		{`[["a"], 1] >= [["a"], 1]`, true},
+		{"[1, 2] <= [1]", false},
+	}
+	runVmTest(t, tests)
+}
+
+// 窥孔优化生成的超指令和删除的指令不改变结果
+func TestPeepholeOptimizedCode(t *testing.T) {
+	tests := []vmTestCase{
+		{"let f = fn(x) { x + 1 }; f(41)", 42},
+		{`let f = fn(s) { s + "b" }; f("a")`, "ab"},
+		{"let f = fn(x) { let y = x + 1; y + x }; f(1)", 3},
+		{"let f = fn(x) { if (x) { let y = 1; } x }; f(2)", 2},
+		{"let f = fn(a, b) { if (a) { if (b) { 1 } else { 2 } } else { 3 } }; [f(true, true), f(true, false), f(false, true)]", []int{1, 2, 3}},
+		{"let f = fn(n) { let i = 0; while (i <= n) { i = i + 1; } i }; f(10)", 11},
+		{"let x = 1; if (x) { let y = 2; }", Null},
+	}
+	runVmTestWithLevel(t, tests, compiler.OptimizePeephole)
+}
+
+func TestComparisonErrors(t *testing.T) {
+	tests := []vmErrorTestCase{
+		{`"a" < 1`, "type mismatch: STRING < INTEGER"},
+		{`[1] > ["a"]`, "cannot compare INTEGER and STRING"},
+		{`{} < {}`, "unknown operator: HASH < HASH"},
+		{`true <= false`, "unknown operator: BOOLEAN <= BOOLEAN"},
+		{`"a" >= 1`, "type mismatch: STRING >= INTEGER"},
+		{"fn(x) { x + 1 }(true)", "type mismatch: BOOLEAN + INTEGER"},
+		// 与解释器的错误信息一致
+		{`1 + "a"`, "type mismatch: INTEGER + STRING"},
+		{`true + false`, "unknown operator: BOOLEAN + BOOLEAN"},
+		{`"a" - "b"`, "unknown operator: STRING - STRING"},
+		{`-true`, "unknown operator: -BOOLEAN"},
+		{`1(2)`, "not a function: INTEGER"},
+	}
+	runVmErrorTest(t, tests)
+}
+
 func TestConditionals(t *testing.T) {
 	tests := []vmTestCase{
 		{"if(true){10};", 10},
@@ -192,7 +250,12 @@ func TestIndexExpressions(t *testing.T) {
 		{"[[1],[2,3]][1][0]", 2},
 		{"[][0]", Null},
 		{"[1,2][3]", Null},
-		{"[1][-1]", Null},
+		{"[1][-1]", 1},
+		{"[1,2,3][-3]", 1},
+		{"[1,2,3][-4]", Null},
+		{`"abc"[0]`, "a"},
+		{`"abc"[-1]`, "c"},
+		{`"abc"[3]`, Null},
 		{"{1:1,2:2}[1]", 1},
 		{"{1:1,2:2}[2]", 2},
 		{"{1:1}[0]", Null},
@@ -201,6 +264,26 @@ func TestIndexExpressions(t *testing.T) {
 	runVmTest(t, tests)
 }
 
+func TestSliceExpressions(t *testing.T) {
+	tests := []vmTestCase{
+		{"[1,2,3,4][1:3]", []int{2, 3}},
+		{"[1,2,3,4][:2]", []int{1, 2}},
+		{"[1,2,3,4][2:]", []int{3, 4}},
+		{"[1,2,3,4][-2:]", []int{3, 4}},
+		{"[1,2,3,4][::2]", []int{1, 3}},
+		{"[1,2,3,4][::-1]", []int{4, 3, 2, 1}},
+		{"[1,2,3,4][-1:0:-2]", []int{4, 2}},
+		{"[1,2,3,4][3:1]", []int{}},
+		{"[1,2,3,4][-10:10]", []int{1, 2, 3, 4}},
+		{`"monkey"[1:3]`, "on"},
+		{`"monkey"[::-1]`, "yeknom"},
+		{`"monkey"[-3:]`, "key"},
+		{"let a = [1,2]; let b = a[:]; b[0] = 9; a[0]", 1},
+		{"let a = [1,2,3]; a[-1] = 0; a", []int{1, 2, 0}},
+	}
+	runVmTest(t, tests)
+}
+
 func TestCallFunctionWithoutArgs(t *testing.T) {
 	tests := []vmTestCase{
 		{
@@ -392,6 +475,8 @@ func TestBuiltinFunctions(t *testing.T) {
 				Message: "argument to `len` not supported, got INTEGER",
 			},
 		},
+		{`[len([1]), len([1, 2])]`, []int{1, 2}},
+		{`len([1]) + len([1, 2])`, 3},
 		{`last([1,2,3])`, 3},
 		{"first([1,2,3])", 1},
 		{"push([], 4);", []int{4}},
@@ -401,6 +486,14 @@ func TestBuiltinFunctions(t *testing.T) {
 			},
 		},
 		{`rest([1,2])`, []int{2}},
+		{`shift([1, 2], 0)`, []int{0, 1, 2}},
+		{`remove([1, 2])`, []int{1}},
+		{`remove([])`, Null},
+		{`shift(1, 1)`,
+			&object.Error{
+				Message: "argument to `shift` must be an array, got INTEGER",
+			},
+		},
 	}
 
 	runVmTest(t, tests)
@@ -470,7 +563,78 @@ func TestClosures(t *testing.T) {
 	runVmTest(t, tests)
 }
 
+// 捕获后又被赋值的变量在闭包和外层之间共享, 与求值器一致
+func TestSharedCapturedVariables(t *testing.T) {
+	tests := []vmTestCase{
+		{`if (true) { let x = 1; let f = fn() { x }; x = 2; f() }`, 2},
+		{`let f = fn() { let c = 0; let inc = fn() { c = c + 1; }; inc(); inc(); c }; f()`, 2},
+		{`let f = fn(a) { let get = fn() { a }; a += 5; get() }; f(1)`, 6},
+		{`let f = fn() { let n = 0; fn() { n += 1; n } }; let next = f(); next(); next(); next()`, 3},
+		// 多层嵌套的闭包共享同一个 cell
+		{`let f = fn() { let n = 1; let g = fn() { fn() { n = n * 10; } }; g()(); n }; f()`, 10},
+		{`if (true) { let y = 1; let g = fn() { y }; let y = 5; g() }`, 5},
+		// 循环中每次迭代的绑定各自独立
+		{`let fns = []; for (let i = 0; i < 4; i += 1) { let get = fn() { i }; i += 1; fns = push(fns, get); } [fns[0](), fns[1]()]`, []int{1, 3}},
+		{`let fns = []; let i = 0; while (i < 2) { let v = i; fns = push(fns, fn() { v }); v = v + 10; i += 1; } [fns[0](), fns[1]()]`, []int{10, 11}},
+	}
+
+	runVmTest(t, tests)
+}
+
 // recursive
+// 尾调用复用 Frame, 远超 MaxFrames 的尾递归也能完成
+func TestTailCalls(t *testing.T) {
+	tests := []vmTestCase{
+		{
+			input: `
+			let loop = fn(n, acc) {
+				if (n == 0) { acc } else { loop(n - 1, acc + 1) }
+			};
+			loop(100000, 0);
+			`,
+			expected: 100000,
+		},
+		{
+			input: `
+			let parity = {};
+			parity["even"] = fn(n) { if (n == 0) { return true; } return parity["odd"](n - 1); };
+			parity["odd"] = fn(n) { if (n == 0) { return false; } return parity["even"](n - 1); };
+			[parity["even"](100000), parity["odd"](100001), parity["even"](7)]
+			`,
+			expected: []interface{}{true, true, false},
+		},
+		{
+			// 闭包的自由变量随 Frame 中的闭包一起切换
+			input: `
+			let counter = fn(step) {
+				fn(n, acc) {
+					if (n == 0) { return acc; }
+					let next = counter(step + 1);
+					next(n - 1, acc + step)
+				}
+			};
+			counter(1)(3000, 0)
+			`,
+			expected: 4501500,
+		},
+		{
+			// 尾部位置调用内置函数和类与普通调用相同
+			input: `
+			class Box { let init = fn(v) { this.v = v; }; }
+			let size = fn(a) { len(a) };
+			let box = fn(v) { Box(v) };
+			[size([1, 2, 3]), box(size([1])).v]
+			`,
+			expected: []int{3, 1},
+		},
+	}
+	runVmTest(t, tests)
+
+	runVmErrorTest(t, []vmErrorTestCase{
+		{`let f = fn(a) { a }; let g = fn() { f() }; g()`, "wrong number of arguments.want=1, got=0"},
+	})
+}
+
 func TestRecursiveFibonacci(t *testing.T) {
 	tests := []vmTestCase{
 		{
@@ -542,9 +706,13 @@ func TestRecursiveFibonacci(t *testing.T) {
 func TestWhileStatement(t *testing.T) {
 	tests := []vmTestCase{
 		{
-			input:    `let foo = 0; while(foo < 2) { let a = 0; let foo = a + 1;} foo;`,
+			input:    `let foo = 0; while(foo < 2) { let a = 1; foo = foo + a; } foo;`,
 			expected: 2,
 		},
+		{
+			input:    `let foo = 0; let i = 0; while(i < 2) { let foo = 5; i = i + 1; } foo;`,
+			expected: 0,
+		},
 	}
 	runVmTest(t, tests)
 }
@@ -571,7 +739,7 @@ func TestAssignExpression(t *testing.T) {
 				fun(3)(4);
 				a;
 			`,
-			expected: 3,
+			expected: 4,
 		},
 	}
 	runVmTest(t, tests)
@@ -587,20 +755,132 @@ func TestForStatement(t *testing.T) {
 	runVmTest(t, tests)
 }
 
-func TestAssignExpressionStatement(t *testing.T) {
+func TestBlockScopes(t *testing.T) {
 	tests := []vmTestCase{
-		// {
-		// 	input:    `let b = 1; b = b + 2; b;`,
-		// 	expected: 3,
-		// },
 		{
-			input:    `let a = [0,1,2]; a[1]`,
-			expected: 5,
+			input:    `let a = 1; if (true) { let a = 2; } a;`,
+			expected: 1,
+		},
+		{
+			input:    `let a = 1; let f = fn() { let a = 2; a }; f() + a;`,
+			expected: 3,
+		},
+		{
+			input:    `let a = 1; for(let a = 0; a < 3; a = a + 1) { } a;`,
+			expected: 1,
+		},
+		{
+			input: `
+				let fns = [];
+				for(let i = 0; i < 3; i = i + 1) { fns = push(fns, fn() { i }); }
+				fns[0]() + fns[1]() * 10 + fns[2]() * 100;
+			`,
+			expected: 210,
+		},
+		{
+			input: `
+				let f = fn() {
+					let fns = [];
+					for(let i = 0; i < 3; i = i + 1) { let j = i * 2; fns = push(fns, fn() { j }); }
+					fns
+				};
+				let fns = f();
+				fns[0]() + fns[1]() * 10 + fns[2]() * 100;
+			`,
+			expected: 420,
+		},
+		{
+			input: `
+				let counter = fn() { let n = 0; fn() { n = n + 1; n } };
+				let c = counter();
+				c(); c();
+			`,
+			expected: 2,
 		},
 	}
 	runVmTest(t, tests)
 }
 
+func TestAssignExpressionStatement(t *testing.T) {
+	tests := []vmTestCase{
+		{`let b = 1; b = b + 2; b;`, 3},
+		{`let a = [0,1,2]; a[1] = 5; a[1]`, 5},
+		{`let h = {"k": 1}; h["k"] = 2; h["n"] = 3; h["k"] + h["n"]`, 5},
+		{`let a = [[0, 1], [2, 3]]; a[1][0] = 9; a[1]`, []int{9, 3}},
+		{`let f = fn() { let a = [1, 2]; a[0] = 7; a }; f();`, []int{7, 2}},
+		{`let f = fn(a, i) { a[i] = 0; }; let a = [1, 2]; f(a, 1); a`, []int{1, 0}},
+		{`let h = {}; h.name = "monkey"; h.name`, "monkey"},
+		{`let h = {"inner": {}}; h.inner.x = 4; h["inner"]["x"]`, 4},
+	}
+	runVmTest(t, tests)
+}
+
+// 复合赋值的目标和下标只求值一次
+func TestCompoundAssignmentEvaluatesTargetOnce(t *testing.T) {
+	tests := []vmTestCase{
+		{`let n = 0; let next = fn() { n = n + 1; n }; let a = [0, 0, 0, 0]; a[next()] += 10; [a[1], a[2], n]`, []int{10, 0, 1}},
+		{`let calls = 0; let h = {"x": 1}; let get = fn() { calls += 1; h }; get().x += 5; [h.x, calls]`, []int{6, 1}},
+		{`let a = [[1, 2]]; let i = 0; let row = fn() { i += 1; a[0] }; row()[1] *= 3; [a[0][1], i]`, []int{6, 1}},
+	}
+	runVmTest(t, tests)
+}
+
+// 数组、哈希和实例都按引用共享, 赋值会原地修改
+func TestMutationAliasing(t *testing.T) {
+	tests := []vmTestCase{
+		{`let a = [1, 2]; let b = a; b[0] = 9; a[0]`, 9},
+		{`let h = {}; let g = h; g["x"] = 1; h["x"]`, 1},
+		{`let a = [1]; let f = fn() { a[0] = 5; }; f(); a[0]`, 5},
+		{`let a = [[1]]; let row = a[0]; row[0] = 3; a[0][0]`, 3},
+		{`let a = [1]; let b = a; b = [2]; a[0]`, 1},
+	}
+	runVmTest(t, tests)
+}
+
+// 容器包含自己时输出占位符, 不会无限递归
+func TestSelfReferencingInspect(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"let a = [0]; a[0] = a; a", "[[...]]"},
+		{"let a = [1, 2]; a[1] = [a]; a", "[1, [[...]]]"},
+		{`let h = {}; h.s = h; h`, "{s:{...}}"},
+		{`let h = {}; let a = [h]; h.a = a; a`, "[{a:[...]}]"},
+		{"let a = [0]; let b = [a, a]; a[0] = 1; b", "[[1], [1]]"},
+	}
+
+	for _, tt := range tests {
+		comp := compiler.New()
+		if err := comp.Compile(parse(tt.input)); err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+		vm := New(comp.ByteCode())
+		if err := vm.Run(); err != nil {
+			t.Fatalf("vm error: %s", err)
+		}
+		got := vm.LastPoppedStackElem().Inspect()
+		if got != tt.expected {
+			t.Errorf("wrong inspect for %q. want=%q, got=%q", tt.input, tt.expected, got)
+		}
+	}
+}
+
+func TestAssignmentErrors(t *testing.T) {
+	tests := []vmErrorTestCase{
+		{`let a = [1]; a[1] = 2;`, "index out of range [1] with length 1"},
+		{`let a = [1]; a["x"] = 2;`, "array index must be INTEGER, got STRING"},
+		{`let n = 1; n[0] = 2;`, "index assignment not supported: INTEGER"},
+		{`let h = {}; h.x`, "undefined property `x`"},
+		{`let h = {"name": 1, "age": 2}; h.nmae`, "undefined property `nmae`, did you mean 'name'?"},
+		{`class Foo { let bar = fn() { 1 }; } Foo().baz()`, "undefined property `baz` on Foo, did you mean 'bar'?"},
+		{`[1][::0]`, "slice step cannot be zero"},
+		{`[1]["a":]`, "slice indices must be INTEGER, got STRING"},
+		{`{}[1:]`, "slice operator not supported: HASH"},
+	}
+	runVmErrorTest(t, tests)
+}
+
 func TestClassStatement(t *testing.T) {
 	tests := []vmTestCase{
 		{
@@ -610,18 +890,94 @@ func TestClassStatement(t *testing.T) {
 				};
 			}
 			let cat = Cat();
+			cat.bar();
 			`,
-			expected: nil,
+			expected: Null,
+		},
+		{
+			input: `class Counter {
+				this.n = 0;
+				let inc = fn() { this.n = this.n + 1; this.n };
+			}
+			let c = Counter();
+			c.inc();
+			c.inc();
+			`,
+			expected: 2,
+		},
+		{
+			input: `class Point {
+				let init = fn(x, y) { this.x = x; this.y = y; };
+				let sum = fn() { this.x + this.y };
+			}
+			let p = Point(3, 4);
+			p.x = 10;
+			p.sum();
+			`,
+			expected: 14,
+		},
+		{
+			input: `class Box {
+				this.v = 1;
+			}
+			let a = Box();
+			let b = a;
+			b.v = 5;
+			[a.v, Box().v]
+			`,
+			expected: []int{5, 1},
 		},
 	}
 	runVmTest(t, tests)
 }
 
+type vmErrorTestCase struct {
+	input    string
+	expected string
+}
+
+// 每个用例在所有优化级别下都要得到相同的结果
+var optimizationLevels = []compiler.OptimizationLevel{
+	compiler.OptimizeNone,
+	compiler.OptimizeBasic,
+	compiler.OptimizePeephole,
+}
+
+func runVmErrorTest(t *testing.T, tests []vmErrorTestCase) {
+	t.Helper()
+	for _, level := range optimizationLevels {
+		for _, tt := range tests {
+			compiler := compiler.New()
+			compiler.SetOptimizationLevel(level)
+			if err := compiler.Compile(parse(tt.input)); err != nil {
+				t.Fatalf("compiler error: %s", err)
+			}
+			vm := New(compiler.ByteCode())
+			err := vm.Run()
+			if err == nil {
+				t.Errorf("expected vm error for %q (level %d)", tt.input, level)
+				continue
+			}
+			if err.Error() != tt.expected {
+				t.Errorf("wrong vm error at level %d. want=%q, got=%q", level, tt.expected, err)
+			}
+		}
+	}
+}
+
 func runVmTest(t *testing.T, tests []vmTestCase) {
+	t.Helper()
+	for _, level := range optimizationLevels {
+		runVmTestWithLevel(t, tests, level)
+	}
+}
+
+func runVmTestWithLevel(t *testing.T, tests []vmTestCase, level compiler.OptimizationLevel) {
 	t.Helper()
 	for _, tt := range tests {
 		program := parse(tt.input)
 		compiler := compiler.New()
+		compiler.SetOptimizationLevel(level)
 		err := compiler.Compile(program)
 
 		if err != nil {
@@ -643,7 +999,7 @@ func runVmTest(t *testing.T, tests []vmTestCase) {
 		err = vm.Run()
 
 		if err != nil {
-			t.Fatalf("vm run failed: %s", err)
+			t.Fatalf("vm run failed at level %d: %s", level, err)
 		}
 
 		stackElem := vm.LastPoppedStackElem()
@@ -737,3 +1093,102 @@ func testBooleanObject(expected bool, actual object.Object) error {
 
 	return nil
 }
+
+// 从 .monc 文件读回的字节码与编译结果执行得到相同的值
+func TestRunUnmarshaledByteCode(t *testing.T) {
+	tests := []vmTestCase{
+		{"let fib = fn(n) { if (n <= 1) { n } else { fib(n - 1) + fib(n - 2) } }; fib(10)", 55},
+		{`class P { let init = fn(x) { this.x = x; }; let get = fn() { this.x }; } P("p").get()`, "p"},
+		{"let add = fn(a) { fn(b) { a + b } }; [add(1)(2), len([1, 2])]", []int{3, 2}},
+	}
+
+	for _, level := range optimizationLevels {
+		for _, tt := range tests {
+			comp := compiler.New()
+			comp.SetOptimizationLevel(level)
+			if err := comp.Compile(parse(tt.input)); err != nil {
+				t.Fatalf("compiler error: %s", err)
+			}
+			data, err := compiler.MarshalByteCode(comp.ByteCode())
+			if err != nil {
+				t.Fatalf("marshal failed: %s", err)
+			}
+			byteCode, err := compiler.UnmarshalByteCode(data)
+			if err != nil {
+				t.Fatalf("unmarshal failed: %s", err)
+			}
+
+			vm := New(byteCode)
+			if err := vm.Run(); err != nil {
+				t.Fatalf("vm run failed at level %d: %s", level, err)
+			}
+			testExpectedObject(t, tt.expected, vm.LastPoppedStackElem())
+		}
+	}
+}
+
+// 通过校验的字节码也可能读取从未赋值的全局或局部变量, 要报运行时错误而不是压入 nil
+func TestReadBeforeAssignment(t *testing.T) {
+	readLocal := &object.CompiledFunction{
+		Instructions: append(code.Make(code.OpGetLocal, 0), code.Make(code.OpReturnValue)...),
+		NumLocals:    1,
+	}
+	tests := []struct {
+		byteCode *compiler.ByteCode
+		expected string
+	}{
+		{
+			&compiler.ByteCode{Instruction: append(code.Make(code.OpGetGlobal, 3), code.Make(code.OpCall, 0)...)},
+			"global 3 read before assignment",
+		},
+		{
+			&compiler.ByteCode{
+				Instruction: append(append(code.Make(code.OpClosure, 0, 0), code.Make(code.OpCall, 0)...), code.Make(code.OpPop)...),
+				Constants:   []object.Object{readLocal},
+			},
+			"local 0 read before assignment",
+		},
+		{
+			&compiler.ByteCode{
+				Instruction: append(append(code.Make(code.OpClosure, 0, 0), code.Make(code.OpCall, 0)...), code.Make(code.OpPop)...),
+				Constants: []object.Object{&object.CompiledFunction{
+					Instructions: append(code.Make(code.OpAddLocalConstant, 0, 1), code.Make(code.OpReturnValue)...),
+					NumLocals:    1,
+				}, &object.Integer{Value: 1}},
+			},
+			"local 0 read before assignment",
+		},
+	}
+
+	for _, tt := range tests {
+		if err := compiler.VerifyByteCode(tt.byteCode); err != nil {
+			t.Fatalf("verify failed: %s", err)
+		}
+		err := New(tt.byteCode).Run()
+		if err == nil {
+			t.Fatalf("expected error %q", tt.expected)
+		}
+		if runtimeErr, ok := err.(*RuntimeError); !ok || runtimeErr.Message != tt.expected {
+			t.Errorf("wrong error. want=%q, got=%q", tt.expected, err)
+		}
+	}
+
+	// REPL 中赋值出错的全局变量在之后的输入里仍然有定义
+	symbolTable := compiler.NewSymbolTable()
+	for i, builtin := range object.Builtins {
+		symbolTable.DefineBuiltin(i, builtin.Name)
+	}
+	globals := make([]object.Object, GlobalSize)
+	constants := []object.Object{}
+	for i, input := range []string{`let x = 1 + "a";`, "x + 1"} {
+		comp := compiler.NewWithState(symbolTable, constants)
+		if err := comp.Compile(parse(input)); err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+		constants = comp.ByteCode().Constants
+		err := NewWithGlobalStore(comp.ByteCode(), globals).Run()
+		if i == 1 && (err == nil || err.(*RuntimeError).Message != "global 0 read before assignment") {
+			t.Errorf("wrong error for unassigned global. got=%v", err)
+		}
+	}
+}